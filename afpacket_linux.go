@@ -0,0 +1,313 @@
+package balancer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// TPACKET_V3 ring layout (see linux/if_packet.h). A ring consists of blocks,
+// each block starts with a tpacket_block_desc followed by the packets, each
+// starting with a tpacket3_hdr followed by a sockaddr_ll.
+const (
+	tpBlockStatusOffset  = 8  // tpacket_block_desc.hdr.block_status
+	tpBlockNumPkts       = 12 // tpacket_block_desc.hdr.num_pkts
+	tpBlockFirstPkt      = 16 // tpacket_block_desc.hdr.offset_to_first_pkt
+	tpBlockLen           = 20 // tpacket_block_desc.hdr.blk_len
+	tpHdrNextOffset      = 0  // tpacket3_hdr.tp_next_offset
+	tpHdrSec             = 4  // tpacket3_hdr.tp_sec
+	tpHdrNsec            = 8  // tpacket3_hdr.tp_nsec
+	tpHdrSnaplen         = 12 // tpacket3_hdr.tp_snaplen
+	tpHdrLen             = 16 // tpacket3_hdr.tp_len
+	tpHdrStatus          = 20 // tpacket3_hdr.tp_status
+	tpHdrMac             = 24 // tpacket3_hdr.tp_mac
+	tpHdrSockaddrPkttype = 48 + 10
+	tpFrameSize          = 2048
+)
+
+// AFPacketConfig configures an AFPacketHandle.
+type AFPacketConfig struct {
+	// Sockets is the number of sockets (each with its own ring) in the
+	// fanout group. The kernel distributes the packets over the sockets by
+	// flow hash.
+	Sockets int
+	// BlockSize and Blocks set the size of the ring of each socket.
+	BlockSize int
+	Blocks    int
+	// BlockTimeout is the time after which a block that is not full is
+	// handed over to the reader.
+	BlockTimeout time.Duration
+	// IgnoreOutgoing drops the packets sent by this host (like the pcap
+	// DirectionIn).
+	IgnoreOutgoing bool
+}
+
+// DefaultAFPacketConfig returns the default AFPacketConfig, one socket with a
+// 16 MiB ring.
+func DefaultAFPacketConfig() AFPacketConfig {
+	return AFPacketConfig{
+		Sockets:      1,
+		BlockSize:    1 << 20,
+		Blocks:       16,
+		BlockTimeout: time.Millisecond,
+	}
+}
+
+// AFPacketHandle captures packets using memory-mapped AF_PACKET (TPACKET_V3)
+// receive rings and sends packets on the AF_PACKET socket. Unlike a pcap
+// handle it does not use libpcap (except for compiling the BPF filter), and
+// it can spread the packets over multiple sockets using PACKET_FANOUT.
+type AFPacketHandle struct {
+	rings   []*afpacketRing
+	done    chan struct{}
+	close   sync.Once
+	readers sync.WaitGroup
+}
+
+type afpacketRing struct {
+	fd             int
+	ring           []byte
+	blockSize      int
+	blocks         int
+	block          int
+	ignoreOutgoing bool
+}
+
+// NewAFPacketHandle creates a new AFPacketHandle for the given interface.
+func NewAFPacketHandle(ifaceName string, conf AFPacketConfig) (*AFPacketHandle, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Sockets < 1 {
+		conf.Sockets = 1
+	}
+	if conf.BlockSize%os.Getpagesize() != 0 || conf.BlockSize%tpFrameSize != 0 {
+		return nil, fmt.Errorf("block size must be a multiple of the page size (%d)", os.Getpagesize())
+	}
+
+	h := &AFPacketHandle{done: make(chan struct{})}
+	fanoutID := os.Getpid() & 0xffff
+	for i := 0; i < conf.Sockets; i++ {
+		r, err := newAFPacketRing(iface, conf)
+		if err != nil {
+			h.Close()
+			return nil, err
+		}
+		h.rings = append(h.rings, r)
+
+		if conf.Sockets > 1 {
+			if err := unix.SetsockoptInt(r.fd, unix.SOL_PACKET, unix.PACKET_FANOUT, fanoutID|(unix.PACKET_FANOUT_HASH|unix.PACKET_FANOUT_FLAG_DEFRAG)<<16); err != nil {
+				h.Close()
+				return nil, fmt.Errorf("could not join fanout group: %s", err)
+			}
+		}
+	}
+	return h, nil
+}
+
+func newAFPacketRing(iface *net.Interface, conf AFPacketConfig) (*afpacketRing, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return nil, fmt.Errorf("could not open AF_PACKET socket: %s", err)
+	}
+	r := &afpacketRing{
+		fd:             fd,
+		blockSize:      conf.BlockSize,
+		blocks:         conf.Blocks,
+		ignoreOutgoing: conf.IgnoreOutgoing,
+	}
+
+	if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		r.close()
+		return nil, fmt.Errorf("could not set TPACKET_V3: %s", err)
+	}
+	req := &unix.TpacketReq3{
+		Block_size:     uint32(conf.BlockSize),
+		Block_nr:       uint32(conf.Blocks),
+		Frame_size:     tpFrameSize,
+		Frame_nr:       uint32(conf.BlockSize / tpFrameSize * conf.Blocks),
+		Retire_blk_tov: uint32(conf.BlockTimeout / time.Millisecond),
+	}
+	if err := unix.SetsockoptTpacketReq3(fd, unix.SOL_PACKET, unix.PACKET_RX_RING, req); err != nil {
+		r.close()
+		return nil, fmt.Errorf("could not setup receive ring: %s", err)
+	}
+	if r.ring, err = unix.Mmap(fd, 0, conf.BlockSize*conf.Blocks, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED); err != nil {
+		r.close()
+		return nil, fmt.Errorf("could not mmap receive ring: %s", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: iface.Index}); err != nil {
+		r.close()
+		return nil, fmt.Errorf("could not bind to interface %s: %s", iface.Name, err)
+	}
+	return r, nil
+}
+
+// SetBPFFilter compiles the given filter (using libpcap) and attaches it to
+// the sockets.
+func (h *AFPacketHandle) SetBPFFilter(expr string) error {
+	instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, 65535, expr)
+	if err != nil {
+		return err
+	}
+	filter := make([]unix.SockFilter, len(instructions))
+	for i, ins := range instructions {
+		filter[i] = unix.SockFilter{Code: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	prog := &unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	for _, r := range h.rings {
+		if err := unix.SetsockoptSockFprog(r.fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, prog); err != nil {
+			return fmt.Errorf("could not attach BPF filter: %s", err)
+		}
+	}
+	return nil
+}
+
+// Packets returns a channel with the received (decoded) packets. Each socket
+// is read by its own goroutine. The channel is closed when the handle is
+// closed.
+func (h *AFPacketHandle) Packets() chan gopacket.Packet {
+	out := make(chan gopacket.Packet, 1000)
+	for _, r := range h.rings {
+		h.readers.Add(1)
+		go func(r *afpacketRing) {
+			defer h.readers.Done()
+			r.run(out, h.done)
+		}(r)
+	}
+	go func() {
+		h.readers.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// WritePacketData sends the given Ethernet frame. It is safe for concurrent
+// use.
+func (h *AFPacketHandle) WritePacketData(data []byte) error {
+	_, err := unix.Write(h.rings[0].fd, data)
+	return err
+}
+
+// Close stops the readers (after their next poll timeout, or right away when
+// they are waiting for the consumer of Packets) and closes the sockets.
+func (h *AFPacketHandle) Close() {
+	h.close.Do(func() {
+		close(h.done)
+		h.readers.Wait()
+		for _, r := range h.rings {
+			r.close()
+		}
+	})
+}
+
+func (r *afpacketRing) close() {
+	if r.ring != nil {
+		unix.Munmap(r.ring)
+	}
+	unix.Close(r.fd)
+}
+
+// run reads the packets of the ring and sends them to out, until done is
+// closed.
+func (r *afpacketRing) run(out chan gopacket.Packet, done <-chan struct{}) {
+	pfd := []unix.PollFd{{Fd: int32(r.fd), Events: unix.POLLIN | unix.POLLERR}}
+	lastStats := time.Now()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if time.Since(lastStats) > time.Second {
+			r.updateStats()
+			lastStats = time.Now()
+		}
+
+		block := r.ring[r.block*r.blockSize : (r.block+1)*r.blockSize]
+		status := (*uint32)(unsafe.Pointer(&block[tpBlockStatusOffset]))
+		if atomic.LoadUint32(status)&unix.TP_STATUS_USER == 0 {
+			if _, err := unix.Poll(pfd, 100); err != nil && err != unix.EINTR {
+				log.Errorf("could not poll AF_PACKET socket: %s", err)
+				return
+			}
+			continue
+		}
+
+		// copy the block, so that it can be handed back to the kernel
+		// right away and the packets can be used after the next read
+		// (one copy per block instead of one per packet)
+		buf := make([]byte, binary.NativeEndian.Uint32(block[tpBlockLen:]))
+		copy(buf, block)
+		atomic.StoreUint32(status, unix.TP_STATUS_KERNEL)
+		r.block = (r.block + 1) % r.blocks
+
+		parseTPacketBlock(buf, func(data []byte, ci gopacket.CaptureInfo, pktType uint8) {
+			if r.ignoreOutgoing && pktType == unix.PACKET_OUTGOING {
+				return
+			}
+			// the packets are decoded by the handlers (see BalancePacket)
+			p := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+			p.Metadata().CaptureInfo = ci
+			select {
+			case out <- p:
+			case <-done:
+			}
+		})
+	}
+}
+
+func (r *afpacketRing) updateStats() {
+	// the kernel resets the statistics on read
+	stats, err := unix.GetsockoptTpacketStatsV3(r.fd, unix.SOL_PACKET, unix.PACKET_STATISTICS)
+	if err != nil {
+		return
+	}
+	captureDrops.Add(float64(stats.Drops))
+}
+
+// parseTPacketBlock calls f for every packet in the given TPACKET_V3 block.
+func parseTPacketBlock(block []byte, f func(data []byte, ci gopacket.CaptureInfo, pktType uint8)) {
+	numPkts := binary.NativeEndian.Uint32(block[tpBlockNumPkts:])
+	offset := binary.NativeEndian.Uint32(block[tpBlockFirstPkt:])
+
+	for i := uint32(0); i < numPkts; i++ {
+		hdr := block[offset:]
+		mac := uint32(binary.NativeEndian.Uint16(hdr[tpHdrMac:]))
+		snaplen := binary.NativeEndian.Uint32(hdr[tpHdrSnaplen:])
+		ci := gopacket.CaptureInfo{
+			Timestamp:     time.Unix(int64(binary.NativeEndian.Uint32(hdr[tpHdrSec:])), int64(binary.NativeEndian.Uint32(hdr[tpHdrNsec:]))),
+			CaptureLength: int(snaplen),
+			Length:        int(binary.NativeEndian.Uint32(hdr[tpHdrLen:])),
+		}
+		if binary.NativeEndian.Uint32(hdr[tpHdrStatus:])&unix.TP_STATUS_CSUMNOTREADY != 0 {
+			// e.g. sent over a veth pair by a local process
+			ci.AncillaryData = []interface{}{checksumNotReady{}}
+		}
+		f(hdr[mac:mac+snaplen:mac+snaplen], ci, hdr[tpHdrSockaddrPkttype])
+
+		next := binary.NativeEndian.Uint32(hdr[tpHdrNextOffset:])
+		if next == 0 {
+			return
+		}
+		offset += next
+	}
+}
+
+func htons(v uint16) uint16 {
+	return binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, v))
+}
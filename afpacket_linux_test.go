@@ -0,0 +1,134 @@
+package balancer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseTPacketBlock(t *testing.T) {
+	frames := [][]byte{
+		bytes.Repeat([]byte{1}, 60),
+		bytes.Repeat([]byte{2}, 100),
+	}
+	pktTypes := []uint8{unix.PACKET_HOST, unix.PACKET_OUTGOING}
+
+	const firstPkt, frameLen, mac = 48, 256, 80
+	block := make([]byte, firstPkt+len(frames)*frameLen)
+	binary.NativeEndian.PutUint32(block[tpBlockNumPkts:], uint32(len(frames)))
+	binary.NativeEndian.PutUint32(block[tpBlockFirstPkt:], firstPkt)
+	for i, f := range frames {
+		hdr := block[firstPkt+i*frameLen:]
+		if i < len(frames)-1 {
+			binary.NativeEndian.PutUint32(hdr[tpHdrNextOffset:], frameLen)
+		}
+		binary.NativeEndian.PutUint32(hdr[tpHdrSec:], 1000)
+		binary.NativeEndian.PutUint32(hdr[tpHdrNsec:], uint32(i))
+		binary.NativeEndian.PutUint32(hdr[tpHdrSnaplen:], uint32(len(f)))
+		binary.NativeEndian.PutUint32(hdr[tpHdrLen:], uint32(len(f)+10))
+		binary.NativeEndian.PutUint16(hdr[tpHdrMac:], mac)
+		hdr[tpHdrSockaddrPkttype] = pktTypes[i]
+		if pktTypes[i] == unix.PACKET_OUTGOING {
+			binary.NativeEndian.PutUint32(hdr[tpHdrStatus:], unix.TP_STATUS_USER|unix.TP_STATUS_CSUMNOTREADY)
+		}
+		copy(hdr[mac:], f)
+	}
+
+	var i int
+	parseTPacketBlock(block, func(data []byte, ci gopacket.CaptureInfo, pktType uint8) {
+		if !bytes.Equal(data, frames[i]) {
+			t.Errorf("Packet %d: unexpected data: %v", i, data)
+		}
+		if ci.CaptureLength != len(frames[i]) || ci.Length != len(frames[i])+10 || !ci.Timestamp.Equal(time.Unix(1000, int64(i))) {
+			t.Errorf("Packet %d: unexpected capture info: %+v", i, ci)
+		}
+		if pktType != pktTypes[i] {
+			t.Errorf("Packet %d: was expecting packet type %d, got: %d", i, pktTypes[i], pktType)
+		}
+		if notReady := len(ci.AncillaryData) == 1 && ci.AncillaryData[0] == (checksumNotReady{}); notReady != (pktType == unix.PACKET_OUTGOING) {
+			t.Errorf("Packet %d: unexpected ancillary data: %v", i, ci.AncillaryData)
+		}
+		i++
+	})
+	if i != len(frames) {
+		t.Errorf("Was expecting %d packets, got: %d", len(frames), i)
+	}
+}
+
+func TestAFPacketHandle(t *testing.T) {
+	conf := DefaultAFPacketConfig()
+	conf.Sockets = 2
+	conf.Blocks = 2
+	handle, err := NewAFPacketHandle("lo", conf)
+	if err != nil {
+		t.Skipf("Could not open AF_PACKET socket (CAP_NET_RAW required): %s", err)
+	}
+	defer handle.Close()
+	packets := handle.Packets()
+
+	eth := &layers.Ethernet{SrcMAC: make(net.HardwareAddr, 6), DstMAC: make(net.HardwareAddr, 6), EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, SrcIP: net.IPv4(127, 0, 0, 1).To4(), DstIP: net.IPv4(127, 0, 0, 1).To4(), Protocol: layers.IPProtocolTCP}
+	tcp := &layers.TCP{SrcPort: 1234, DstPort: 4321, Seq: 8765, ACK: true, Window: 1024}
+	b, err := NewEthPacket(eth, ip, tcp).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handle.WritePacketData(b); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case p := <-packets:
+			if l, ok := p.Layer(layers.LayerTypeTCP).(*layers.TCP); ok && l.DstPort == 4321 && l.Seq == 8765 {
+				return
+			}
+		case <-timeout:
+			t.Fatal("The sent packet was not received.")
+		}
+	}
+}
+
+func TestAFPacketHandleCloseBlockedReader(t *testing.T) {
+	handle, err := NewAFPacketHandle("lo", DefaultAFPacketConfig())
+	if err != nil {
+		t.Skipf("Could not open AF_PACKET socket (CAP_NET_RAW required): %s", err)
+	}
+	// nobody consumes the packets, the reader blocks once the channel is
+	// full
+	packets := handle.Packets()
+
+	eth := &layers.Ethernet{SrcMAC: make(net.HardwareAddr, 6), DstMAC: make(net.HardwareAddr, 6), EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, SrcIP: net.IPv4(127, 0, 0, 1).To4(), DstIP: net.IPv4(127, 0, 0, 1).To4(), Protocol: layers.IPProtocolTCP}
+	tcp := &layers.TCP{SrcPort: 1234, DstPort: 4321, ACK: true, Window: 1024}
+	b, err := NewEthPacket(eth, ip, tcp).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2*cap(packets); i++ {
+		if err := handle.WritePacketData(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for len(packets) < cap(packets) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		handle.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close should not block on a reader waiting for the consumer.")
+	}
+}
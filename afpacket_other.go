@@ -0,0 +1,37 @@
+//go:build !linux
+
+package balancer
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// AFPacketConfig configures an AFPacketHandle.
+type AFPacketConfig struct {
+	Sockets        int
+	BlockSize      int
+	Blocks         int
+	BlockTimeout   time.Duration
+	IgnoreOutgoing bool
+}
+
+// DefaultAFPacketConfig returns the default AFPacketConfig.
+func DefaultAFPacketConfig() AFPacketConfig {
+	return AFPacketConfig{Sockets: 1, BlockSize: 1 << 20, Blocks: 16, BlockTimeout: time.Millisecond}
+}
+
+// AFPacketHandle is only supported on Linux.
+type AFPacketHandle struct{}
+
+// NewAFPacketHandle returns an error, AF_PACKET is only supported on Linux.
+func NewAFPacketHandle(ifaceName string, conf AFPacketConfig) (*AFPacketHandle, error) {
+	return nil, errors.New("AF_PACKET is only supported on Linux")
+}
+
+func (h *AFPacketHandle) SetBPFFilter(expr string) error    { return nil }
+func (h *AFPacketHandle) Packets() chan gopacket.Packet     { return nil }
+func (h *AFPacketHandle) WritePacketData(data []byte) error { return nil }
+func (h *AFPacketHandle) Close()                            {}
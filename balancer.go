@@ -1,115 +1,431 @@
 package balancer
 
 import (
-	"log"
+	"fmt"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
 )
 
-// BalancePacket implements the actual load-balance logic on packet level.
-func BalancePackets(packetsIn chan gopacket.Packet, packetsOut chan *EthPacket, stateTable *StateTable, pool PoolBalancer) {
+// BalancePackets implements the actual load-balance logic on packet level.
+// Packets are matched against the given services by destination IP and
+// port.
+func BalancePackets(packetsIn chan gopacket.Packet, packetsOut *EthPacketQueue, stateTable *StateTable, services *ServiceTable) {
 	for packet := range packetsIn {
-		// get layers
-		layer := packet.Layer(layers.LayerTypeEthernet)
-		if layer == nil {
-			log.Println("Could not get Ethernet layer")
-			continue
+		BalancePacket(packet, packetsOut, stateTable, services)
+	}
+}
+
+// BalancePacket load-balances a single packet, see BalancePackets. It can be
+// called by multiple workers concurrently, as long as all packets of a
+// connection are handled by the same worker (see RunWorkers).
+// The packet is decoded into reused layers, which are handed over with the
+// forwarded packet (see EthPacket.Release).
+func BalancePacket(packet gopacket.Packet, packetsOut *EthPacketQueue, stateTable *StateTable, services *ServiceTable) {
+	d := getPacketDecoderFor(packet)
+	if !balancePacket(d, packet.Data(), packetsOut, stateTable, services) {
+		d.release()
+	}
+}
+
+// balancePacket implements BalancePacket, it returns true when a packet using
+// the layers decoded by d has been sent to packetsOut.
+func balancePacket(d *packetDecoder, data []byte, packetsOut *EthPacketQueue, stateTable *StateTable, services *ServiceTable) bool {
+	const handler = "balance_packets"
+
+	packetsReceived.WithLabelValues(handler).Inc()
+
+	ethLayer, ipLayer, tcpLayer, err := d.decode(data)
+	if err != nil {
+		log.WithField("handler", handler).Warningf("could not decode packet: %s", err)
+		decodeErrors.WithLabelValues(handler, d.failedLayer()).Inc()
+		return false
+	}
+
+	service, ok := services.GetService(ipLayer.DstIP, tcpLayer.DstPort)
+	if !ok {
+		logPacket(func() log.Fields {
+			return log.Fields{
+				"dst": fmt.Sprintf("%s:%d", ipLayer.DstIP, tcpLayer.DstPort),
+			}
+		}, "packet for unknown service")
+		packetsDropped.WithLabelValues(handler, "unknown_service").Inc()
+		return false
+	}
+
+	// the flow id is only computed when it is logged
+	flowID := func() string { return FlowID(ipLayer.SrcIP, tcpLayer.SrcPort, service.IP, service.Port) }
+
+	if service.Mode == MODE_L4HASH {
+		// route every packet on the 4-tuple, without keeping state
+		key, _ := FlowKey(ipLayer, tcpLayer)
+		server, err := service.Pool.RouteToServer(key)
+		if err != nil {
+			logPacket(func() log.Fields {
+				return log.Fields{
+					"flow_id": flowID(),
+					"client":  fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
+					"service": service.String(),
+					"error":   err.Error(),
+				}
+			}, "could not route packet to server")
+			routingErrors.Inc()
+			packetsDropped.WithLabelValues(handler, "routing_error").Inc()
+			return false
 		}
-		ethLayer, ok := layer.(*layers.Ethernet)
-		if !ok {
-			log.Println("Could not cast layer to Ethernet")
-			continue
+		if tcpLayer.SYN && !tcpLayer.ACK {
+			server.countConnection()
 		}
-		layer = packet.Layer(layers.LayerTypeIPv4)
-		if layer == nil {
-			log.Println("Could not get IPv4 layer")
-			continue
+
+		logPacket(func() log.Fields {
+			return log.Fields{
+				"flow_id": flowID(),
+				"src":     fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
+				"dst":     fmt.Sprintf("%s:%d", ipLayer.DstIP, tcpLayer.DstPort),
+				"server":  server.IP,
+			}
+		}, "forwarding packet")
+
+		ethPacket, err := forwardToServer(d, service, server, ethLayer, ipLayer, tcpLayer)
+		if err != nil {
+			dropUnforwarded(handler, flowID, err)
+			return false
 		}
-		ipLayer, ok := layer.(*layers.IPv4)
-		if !ok {
-			log.Println("Could not cast layer to IPv4")
-			continue
+
+		server.countBytes(float64(len(tcpLayer.Payload)))
+		packetsSent.WithLabelValues(handler).Inc()
+		packetsOut.Put(ethPacket)
+		return true
+	}
+
+	if service.Mode == MODE_L2DSR {
+		server, state, isNew, err := routeL2DSR(stateTable, service, ipLayer, tcpLayer)
+		if err == errNoHardwareAddr {
+			dropUnforwarded(handler, flowID, err)
+			return false
+		} else if err != nil {
+			log.WithFields(log.Fields{
+				"flow_id": flowID(),
+				"client":  fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
+				"service": service,
+			}).Errorf("could not route packet to server: %s", err)
+			routingErrors.Inc()
+			packetsDropped.WithLabelValues(handler, "routing_error").Inc()
+			return false
 		}
-		layer = packet.Layer(layers.LayerTypeTCP)
-		if layer == nil {
-			log.Println("Could not get TCP layer")
-			continue
+		if isNew {
+			server.countConnection()
+			log.WithFields(log.Fields{
+				"flow_id": flowID(),
+				"client":  fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
+				"service": service,
+				"server":  server.IP,
+			}).Info("new connection, server selected")
 		}
-		tcpLayer, ok := layer.(*layers.TCP)
-		if !ok {
-			log.Println("Could not cast layer to TCP")
-			continue
+
+		logPacket(func() log.Fields {
+			return log.Fields{
+				"flow_id": flowID(),
+				"src":     fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
+				"dst":     fmt.Sprintf("%s:%d", ipLayer.DstIP, tcpLayer.DstPort),
+				"server":  server.IP,
+			}
+		}, "forwarding packet")
+
+		// only the Ethernet addresses are rewritten, the server has the
+		// VIP on its loopback interface
+		hwAddr := server.GetHardwareAddr()
+		if hwAddr == nil {
+			dropUnforwarded(handler, flowID, errNoHardwareAddr)
+			return false
+		}
+		if service.SrcHardwareAddr != nil {
+			ethLayer.SrcMAC = service.SrcHardwareAddr
 		}
+		ethLayer.DstMAC = hwAddr
 
-		if state, ok := stateTable.GetState(ipLayer.SrcIP, tcpLayer.SrcPort); ok {
-			// this is a known state
-			if state.State == TCP_STATE_SYN_RECEIVED && tcpLayer.ACK {
-				// complete the handshake
-				state.State = TCP_STATE_ESTABLISHED
-				log.Printf("Handshake completed with %s:%d", ipLayer.SrcIP, tcpLayer.SrcPort)
-			} else if state.State == TCP_STATE_ESTABLISHED && state.Server == nil && tcpLayer.ACK && tcpLayer.PSH {
-				// we received the first data, set the backend server for the
-				// connection state, so we know to which server we need to
-				// forward the data
-				// NOTE: for simplicity we assume the HTTP request is within
-				// one packet, this might not be the case!
-
-				// logic to parse the request, we don't care for now since
-				// we're using a single server balancer
-				// payloadReader := bufio.NewReader(bytes.NewReader(tcpLayer.Payload))
-				// req, err := http.ReadRequest(payloadReader)
-				// if err != nil {
-				// 	log.Printf("Could not parse request: %s", err)
-				// 	continue
-				// }
-				server, err := pool.RouteToServer(1)
-				if err != nil {
-					log.Printf("Could not route packet to server: %s", err)
-					// we should reset the connection here?
-					continue
+		server.countBytes(float64(len(tcpLayer.Payload)))
+		packetsSent.WithLabelValues(handler).Inc()
+		if state != nil {
+			trackConnection(stateTable, state, tcpLayer)
+		}
+		packetsOut.Put(d.newEthPacket(ethLayer, ipLayer, tcpLayer))
+		return true
+	}
+
+	state, ok := stateTable.GetState(ipLayer.SrcIP, tcpLayer.SrcPort, ipLayer.DstIP, tcpLayer.DstPort)
+	if !ok && service.Recovery != nil {
+		// the state might have been lost (e.g. after a restart), try to
+		// recover the server from the ACK number
+		if state, ok = recoverState(stateTable, service, ipLayer, tcpLayer); ok {
+			recoveredConnections.Inc()
+			log.WithFields(log.Fields{
+				"flow_id": flowID(),
+				"client":  fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
+				"service": service,
+				"server":  state.Server.IP,
+			}).Info("connection recovered")
+		}
+	}
+
+	if ok {
+		// this is a known state
+		if state.State == TCP_STATE_SYN_RECEIVED && tcpLayer.SYN && !tcpLayer.ACK {
+			// the client retransmitted the SYN, our SYN ACK was lost
+			logPacket(func() log.Fields {
+				return log.Fields{
+					"flow_id": flowID(),
+					"client":  fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
 				}
-				state.Server = server
-				log.Printf("Using server %s for client %s:%d", state.Server.IP, ipLayer.SrcIP, tcpLayer.SrcPort)
+			}, "received retransmitted SYN, sending SYN ACK again")
+			packetsSent.WithLabelValues(handler).Inc()
+			packetsOut.Put(synACK(d, service, state, ethLayer, ipLayer, tcpLayer))
+			return true
+		}
+
+		if state.State == TCP_STATE_SYN_RECEIVED && tcpLayer.ACK {
+			// complete the handshake
+			established := *state
+			established.State = TCP_STATE_ESTABLISHED
+			state = &established
+			stateTable.Put(state)
+			stateTable.Changed(state)
+			handshakeDuration.WithLabelValues(handler).Observe(now().Sub(state.Created).Seconds())
+			log.WithFields(log.Fields{
+				"flow_id": flowID(),
+				"client":  fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
+			}).Info("handshake completed")
+		} else if state.State == TCP_STATE_ESTABLISHED && state.Server == nil && tcpLayer.ACK && tcpLayer.PSH {
+			// we received the first data, set the backend server for the
+			// connection state, so we know to which server we need to
+			// forward the data
+			key, err := service.KeyExtractor(ipLayer, tcpLayer)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"flow_id": flowID(),
+					"client":  fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
+					"service": service,
+				}).Errorf("could not extract routing key: %s", err)
+				routingErrors.Inc()
+				packetsDropped.WithLabelValues(handler, "routing_error").Inc()
+				// we should reset the connection here?
+				return false
 			}
 
-			if state.State == TCP_STATE_ESTABLISHED && state.Server != nil {
-				log.Printf("Forwarding packet %s:%d -> %s:%d to: %s", ipLayer.SrcIP, tcpLayer.SrcPort, ipLayer.DstIP, tcpLayer.DstPort, state.Server.IP)
-				ethLayer.DstMAC = state.Server.HardwareAddr
-				ipLayer.DstIP = state.Server.IP
-				ipLayer.TTL = 64
+			server, err := service.Pool.RouteToServer(key)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"flow_id": flowID(),
+					"client":  fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
+				}).Errorf("could not route packet to server: %s", err)
+				routingErrors.Inc()
+				packetsDropped.WithLabelValues(handler, "routing_error").Inc()
+				// we should reset the connection here?
+				return false
+			}
+			selected := *state
+			selected.Server = server
+			state = &selected
+			stateTable.Put(state)
+			stateTable.Changed(state)
+			server.countConnection()
+			log.WithFields(log.Fields{
+				"flow_id": flowID(),
+				"client":  fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
+				"service": service,
+				"server":  state.Server.IP,
+			}).Info("server selected")
+		}
 
-				packetsOut <- NewEthPacket(ethLayer, ipLayer, tcpLayer)
+		if (state.State == TCP_STATE_ESTABLISHED || state.State == TCP_STATE_FIN_WAIT_1) && state.Server != nil {
+			logPacket(func() log.Fields {
+				return log.Fields{
+					"flow_id": flowID(),
+					"src":     fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
+					"dst":     fmt.Sprintf("%s:%d", ipLayer.DstIP, tcpLayer.DstPort),
+					"server":  state.Server.IP,
+				}
+			}, "forwarding packet")
+			ethPacket, err := forwardToServer(d, service, state.Server, ethLayer, ipLayer, tcpLayer)
+			if err != nil {
+				dropUnforwarded(handler, flowID, err)
+				return false
 			}
+
+			state.Server.countBytes(float64(len(tcpLayer.Payload)))
+			packetsSent.WithLabelValues(handler).Inc()
+			trackConnection(stateTable, state, tcpLayer)
+			packetsOut.Put(ethPacket)
+			return true
 		} else {
-			// this is a new connection
-			if tcpLayer.SYN {
-				log.Printf("New connection from: %s:%d", ipLayer.SrcIP, tcpLayer.SrcPort)
-
-				// this is a new TCP handshake, respond
-				state := stateTable.NewState(ipLayer.SrcIP, tcpLayer.SrcPort)
-				tcpSYNCACK := &layers.TCP{
-					SrcPort: tcpLayer.DstPort,
-					DstPort: tcpLayer.SrcPort,
-					Seq:     state.Seq,
-					Ack:     tcpLayer.Seq + 1,
-					SYN:     true,
-					ACK:     true,
-					Window:  64240,
+			packetsDropped.WithLabelValues(handler, "not_established").Inc()
+		}
+	} else {
+		// this is a new connection
+		if tcpLayer.SYN && !d.validTCPChecksum(ipLayer, tcpLayer) {
+			// the balancer terminates the handshake, a corrupted SYN
+			// would be answered with a wrong SYN ACK
+			logPacket(func() log.Fields {
+				return log.Fields{
+					"flow_id": flowID(),
+					"client":  fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
+				}
+			}, "received SYN with invalid checksum")
+			packetsDropped.WithLabelValues(handler, "invalid_checksum").Inc()
+		} else if tcpLayer.SYN {
+			log.WithFields(log.Fields{
+				"flow_id": flowID(),
+				"client":  fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
+				"service": service,
+			}).Info("new connection")
+
+			// when the server is encoded in the ISN, the server is
+			// selected now (the key only depends on the headers)
+			var server *Server
+			if service.Recovery != nil {
+				key, err := service.KeyExtractor(ipLayer, tcpLayer)
+				if err == nil {
+					server, err = service.Pool.RouteToServer(key)
+				}
+				if err != nil {
+					log.WithFields(log.Fields{
+						"flow_id": flowID(),
+						"client":  fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
+						"service": service,
+					}).Errorf("could not route packet to server: %s", err)
+					routingErrors.Inc()
+					packetsDropped.WithLabelValues(handler, "routing_error").Inc()
+					return false
 				}
-				state.State = TCP_STATE_SYN_RECEIVED
-
-				// reverse eth and ip packet destination
-				ethLayer.SrcMAC, ethLayer.DstMAC = ethLayer.DstMAC, ethLayer.SrcMAC
-				ipLayer.SrcIP, ipLayer.DstIP = ipLayer.DstIP, ipLayer.SrcIP
-				// set TTL to 64
-				ipLayer.TTL = 64
-
-				packetsOut <- NewEthPacket(ethLayer, ipLayer, tcpSYNCACK)
-			} else {
-				// this is not a new TCP handshake and the connection is unknown
-				log.Println("We should send a RST at this point!")
 			}
+
+			// this is a new TCP handshake, respond
+			state := newState(ipLayer.SrcIP, tcpLayer.SrcPort, service)
+			if server != nil {
+				slot, _ := serverSlot(service.Pool, server)
+				state.Seq = service.Recovery.Encode(ipLayer.SrcIP, tcpLayer.SrcPort, service.IP, service.Port, slot)
+				state.Server = server
+				server.countConnection()
+				log.WithFields(log.Fields{
+					"flow_id": flowID(),
+					"client":  fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
+					"service": service,
+					"server":  server.IP,
+				}).Info("server selected")
+			}
+			state.State = TCP_STATE_SYN_RECEIVED
+			stateTable.Put(state)
+			stateTable.Changed(state)
+
+			packetsSent.WithLabelValues(handler).Inc()
+			packetsOut.Put(synACK(d, service, state, ethLayer, ipLayer, tcpLayer))
+			return true
+		} else {
+			// this is not a new TCP handshake and the connection is unknown
+			logPacket(func() log.Fields {
+				return log.Fields{
+					"flow_id": flowID(),
+					"client":  fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
+				}
+			}, "packet for unknown connection, we should send a RST at this point")
+			packetsDropped.WithLabelValues(handler, "unknown_connection").Inc()
 		}
 	}
+	return false
+}
+
+// synACK returns the SYN ACK answering the given SYN of the client, with the
+// sequence number of the given state. The layers must have been decoded by d.
+func synACK(d *packetDecoder, service *Service, state *State, ethLayer *layers.Ethernet, ipLayer *layers.IPv4, tcpLayer *layers.TCP) *EthPacket {
+	tcpSYNCACK := &layers.TCP{
+		SrcPort: tcpLayer.DstPort,
+		DstPort: tcpLayer.SrcPort,
+		Seq:     state.Seq,
+		Ack:     tcpLayer.Seq + 1,
+		SYN:     true,
+		ACK:     true,
+		Window:  64240,
+	}
+
+	// reverse eth and ip packet destination
+	ethLayer.SrcMAC, ethLayer.DstMAC = ethLayer.DstMAC, ethLayer.SrcMAC
+	ipLayer.SrcIP, ipLayer.DstIP = ipLayer.DstIP, ipLayer.SrcIP
+	// set TTL to 64
+	ipLayer.TTL = 64
+	if service.Encap == ENCAP_NONE {
+		ipLayer.TOS = service.LBIndex
+	}
+	return d.newEthPacket(ethLayer, ipLayer, tcpSYNCACK)
+}
+
+// trackConnection updates the state of the given connection after a packet
+// has been forwarded (the FastPath passes FIN and RST packets to
+// BalancePackets). A RST removes the state (and thus the connection from the
+// FastPath), a FIN moves the connection to FIN_WAIT_1 and removes it from the
+// FastPath (the state is removed by Expire after the closing timeout, the
+// last ACK of the client is still forwarded by BalancePackets). Other packets (but the SYN) of established connections
+// offload the connection to the FastPath, when the service does not use
+// encapsulation.
+func trackConnection(stateTable *StateTable, state *State, tcpLayer *layers.TCP) {
+	switch {
+	case tcpLayer.RST:
+		stateTable.Remove(state)
+		// the peers remove the state on the CLOSED state
+		closed := *state
+		closed.State = TCP_STATE_CLOSED
+		stateTable.Changed(&closed)
+	case tcpLayer.FIN:
+		state = stateTable.unload(state)
+		if state.State == TCP_STATE_ESTABLISHED {
+			closing := *state
+			closing.State = TCP_STATE_FIN_WAIT_1
+			if stateTable.replace(state, &closing) {
+				stateTable.Changed(&closing)
+			}
+		}
+	case !tcpLayer.SYN && state.State == TCP_STATE_ESTABLISHED && state.Service.Encap == ENCAP_NONE:
+		stateTable.offload(state)
+	}
+}
+
+// forwardToServer returns the packet forwarding the given client packet to
+// the given server (packetbridge). Unless the service uses encapsulation, the
+// destination IP is rewritten and the DSCP field is set to the balancer index.
+// It returns errNoHardwareAddr when the MAC of the server is not resolved.
+// The layers must have been decoded by d.
+func forwardToServer(d *packetDecoder, service *Service, server *Server, ethLayer *layers.Ethernet, ipLayer *layers.IPv4, tcpLayer *layers.TCP) (*EthPacket, error) {
+	hwAddr := server.GetHardwareAddr()
+	if hwAddr == nil {
+		return nil, errNoHardwareAddr
+	}
+	ethLayer.DstMAC = hwAddr
+	ethPacket := d.newEthPacket(ethLayer, ipLayer, tcpLayer)
+
+	if service.Encap == ENCAP_NONE {
+		ipLayer.DstIP = server.IP
+		ipLayer.TTL = 64
+		ipLayer.TOS = service.LBIndex
+		return ethPacket, nil
+	}
+	if err := ethPacket.Encapsulate(service.Encap, service.EncapSrcIP, server.IP, service.FOUPort); err != nil {
+		return nil, err
+	}
+	return ethPacket, nil
+}
+
+// dropUnforwarded counts (and logs) a packet that could not be forwarded to
+// its server because of the given error, see forwardToServer.
+func dropUnforwarded(handler string, flowID func() string, err error) {
+	if err == errNoHardwareAddr {
+		logPacket(func() log.Fields {
+			return log.Fields{
+				"flow_id": flowID(),
+			}
+		}, "MAC address of server is not resolved")
+		packetsDropped.WithLabelValues(handler, "unresolved_neighbor").Inc()
+		return
+	}
+	log.WithField("flow_id", flowID()).Errorf("could not encapsulate packet: %s", err)
+	packetsDropped.WithLabelValues(handler, "encapsulation_error").Inc()
 }
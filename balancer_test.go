@@ -0,0 +1,112 @@
+package balancer
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestBalancePacketsL4Hash(t *testing.T) {
+	balancerMAC, _ := net.ParseMAC("11:11:11:11:11:11")
+	routerMAC, _ := net.ParseMAC("22:22:22:22:22:22")
+	clientIP := net.ParseIP("10.0.0.1").To4()
+	vip := net.ParseIP("192.168.33.100").To4()
+
+	pool := NewConsistentHashPool()
+	for i := 1; i <= 4; i++ {
+		pool.AddServer(&Server{
+			IP:           net.IPv4(192, 168, 33, byte(20+i)).To4(),
+			HardwareAddr: net.HardwareAddr{0x08, 0, 0, 0, 0, byte(i)},
+		})
+	}
+	services := NewServiceTable()
+	if err := services.AddService(&Service{
+		IP:       vip,
+		Port:     80,
+		Protocol: layers.IPProtocolTCP,
+		LBIndex:  3,
+		Pool:     pool,
+		Mode:     MODE_L4HASH,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	clientPacket := func(srcPort layers.TCPPort, syn bool) gopacket.Packet {
+		eth := &layers.Ethernet{SrcMAC: routerMAC, DstMAC: balancerMAC, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, TTL: 63, SrcIP: clientIP, DstIP: vip, Protocol: layers.IPProtocolTCP}
+		tcp := &layers.TCP{SrcPort: srcPort, DstPort: 80, Seq: 100, SYN: syn, ACK: !syn, Window: 1024}
+		b, err := NewEthPacket(eth, ip, tcp).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gopacket.NewPacket(b, layers.LayerTypeEthernet, gopacket.Default)
+	}
+
+	// every packet is routed by a different balancer (state table), they
+	// should all select the same server
+	routes := make(map[layers.TCPPort]string)
+	for i := 0; i < 3; i++ {
+		for port := layers.TCPPort(1000); port < 1020; port++ {
+			stateTable := NewStateTable()
+			in := make(chan gopacket.Packet, 1)
+			out := NewEthPacketQueue("test", 1, OVERFLOW_BLOCK)
+			in <- clientPacket(port, i == 0)
+			close(in)
+			BalancePackets(in, out, stateTable, services)
+
+			p, ok := out.TryGet()
+			if !ok || out.Len() != 0 {
+				t.Fatal("Was expecting the packet to be forwarded.")
+			}
+			if p.tcp.SYN != (i == 0) || p.tcp.Seq != 100 {
+				t.Errorf("The packet should have been forwarded as-is, got: %s", p)
+			}
+			if p.ip.TOS != 3 {
+				t.Errorf("Was expecting TOS 3, got: %d", p.ip.TOS)
+			}
+			if len(stateTable.CountByState()) != 0 {
+				t.Error("No state should have been created.")
+			}
+
+			if i == 0 {
+				routes[port] = p.DstIP().String()
+			} else if routes[port] != p.DstIP().String() {
+				t.Errorf("Port %d: was expecting server %s, got: %s", port, routes[port], p.DstIP())
+			}
+		}
+	}
+}
+
+func TestBalancePacketAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("Allocations are not representative with the race detector.")
+	}
+
+	vip := net.ParseIP("192.168.33.10").To4()
+	pool := NewConsistentHashPool()
+	pool.AddServer(&Server{IP: net.ParseIP("192.168.33.21").To4(), HardwareAddr: net.HardwareAddr{0x08, 0, 0, 0, 0, 1}})
+	services := NewServiceTable()
+	if err := services.AddService(&Service{IP: vip, Port: 80, Protocol: layers.IPProtocolTCP, LBIndex: 3, Pool: pool, Mode: MODE_L4HASH}); err != nil {
+		t.Fatal(err)
+	}
+
+	packet := gopacket.NewPacket(testTCPPacket(t, []byte("GET / HTTP/1.0\r\n\r\n")), layers.LayerTypeEthernet, gopacket.Default)
+	out := NewEthPacketQueue("test", 1, OVERFLOW_BLOCK)
+	stateTable := NewStateTable()
+	run := func() {
+		BalancePacket(packet, out, stateTable, services)
+		p, ok := out.TryGet()
+		if !ok {
+			t.Fatal("Was expecting the packet to be forwarded.")
+		}
+		p.Release()
+	}
+	// fill the pools and look up the counters
+	run()
+
+	if allocs := testing.AllocsPerRun(100, run); allocs > 0 {
+		t.Errorf("Was expecting no allocations per packet, got: %.1f", allocs)
+	}
+}
@@ -1,214 +1,489 @@
 package balancer
 
 import (
-	"log"
+	"bytes"
+	"fmt"
 	"net"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
+	log "github.com/sirupsen/logrus"
 )
 
 // HandleBalancerPackets handles the incoming packets from the balancer
 // app. When the connection is known, it will forward it to the backend.
-// If not, it will first start a TCP handshake with the backend.
-func HandleBalancerPackets(packetsIn chan gopacket.Packet, backendPackets chan *TCPPacket, stateTable *PacketBridgeStateTable) {
+// If not, it will first start a TCP handshake with the backend, unless the
+// packet is a SYN (forwarded by a balancer in l4hash mode), in which case the
+// SYN is passed through to the backend.
+// The destination port is translated to the backend port using the given
+// PortMap and the backend is selected from the given pool.
+// Packets encapsulated in IPIP, GRE or foo-over-udp (on the given port) are
+// decapsulated. For packets that are not encapsulated, the VIP is looked up
+// in the given balancers map using the DSCP field.
+func HandleBalancerPackets(packetsIn chan gopacket.Packet, backendPackets *TCPPacketQueue, stateTable *PacketBridgeStateTable, portMap PortMap, pool PoolBalancer, balancers map[uint8]net.IP, fouPort layers.UDPPort) {
 	for p := range packetsIn {
-		// get layers
-		layer := p.Layer(layers.LayerTypeEthernet)
-		if layer == nil {
-			log.Println("Could not get Ethernet layer")
-			continue
-		}
-		ethLayer, ok := layer.(*layers.Ethernet)
-		if !ok {
-			log.Println("Could not cast layer to Ethernet")
-			continue
-		}
+		HandleBalancerPacket(p, backendPackets, stateTable, portMap, pool, balancers, fouPort)
+	}
+}
 
-		layer = p.Layer(layers.LayerTypeIPv4)
-		if layer == nil {
-			log.Println("Could not get IPv4 layer")
-			continue
-		}
-		ipLayer, ok := layer.(*layers.IPv4)
-		if !ok {
-			log.Println("Could not cast layer to IPv4")
-			continue
-		}
+// HandleBalancerPacket handles a single packet from the balancer, see
+// HandleBalancerPackets. It can be called by multiple workers concurrently,
+// as long as all packets of a connection are handled by the same worker (see
+// RunWorkers).
+// The packet is decoded into reused layers, which are handed over with the
+// packet sent to the backend (see TCPPacket.Release).
+func HandleBalancerPacket(p gopacket.Packet, backendPackets *TCPPacketQueue, stateTable *PacketBridgeStateTable, portMap PortMap, pool PoolBalancer, balancers map[uint8]net.IP, fouPort layers.UDPPort) {
+	d := getPacketDecoderFor(p)
+	if !handleBalancerPacket(d, p.Data(), backendPackets, stateTable, portMap, pool, balancers, fouPort) {
+		d.release()
+	}
+}
 
-		layer = p.Layer(layers.LayerTypeTCP)
-		if layer == nil {
-			log.Println("Could not get TCP layer")
-			continue
-		}
-		tcpLayer, ok := layer.(*layers.TCP)
-		if !ok {
-			log.Println("Could not cast layer to TCP")
-			continue
-		}
-
-		if connState, ok := stateTable.GetByIP(ipLayer.SrcIP, tcpLayer.SrcPort); ok {
-			// this is a known connection
-			if connState.State == TCP_STATE_ESTABLISHED {
-				// migrate the TCP state to packetbridge <> backend handshake
-				tcpLayer.Ack = tcpLayer.Ack + connState.SeqOffset
-				tcpLayer.SrcPort = connState.RandPort
-
-				// the function responsible for sending the TCP packets will
-				// set the correct source and destination IPs
-				backendPackets <- NewTCPPacket(ipLayer, tcpLayer)
-			} else {
-				// TODO handle this case properly
-				log.Println("Received packet, but connection is not established...")
+// handleBalancerPacket implements HandleBalancerPacket, it returns true when
+// a packet using the layers decoded by d has been sent to backendPackets.
+func handleBalancerPacket(d *packetDecoder, data []byte, backendPackets *TCPPacketQueue, stateTable *PacketBridgeStateTable, portMap PortMap, pool PoolBalancer, balancers map[uint8]net.IP, fouPort layers.UDPPort) bool {
+	const handler = "handle_balancer_packets"
+
+	packetsReceived.WithLabelValues(handler).Inc()
+
+	ethLayer, outerLayer, ipLayer, tcpLayer, err := d.decodeEncapsulated(data, fouPort)
+	if err != nil {
+		log.WithField("handler", handler).Warningf("could not decode packet: %s", err)
+		decodeErrors.WithLabelValues(handler, d.failedLayer()).Inc()
+		return false
+	}
+
+	// the VIP is the destination of the inner header for encapsulated
+	// packets, else it is identified by the DSCP field
+	var vip net.IP
+	if outerLayer != nil {
+		vip = ipLayer.DstIP
+	} else if vip = balancers[ipLayer.TOS]; vip == nil {
+		logPacket(func() log.Fields {
+			return log.Fields{
+				"lbindex": ipLayer.TOS,
 			}
-		} else {
-			// we don't know about this connection yet, add it to the state
-			// table and get the random port number for this connection
-			// (so we can look it up later)
-			connState := stateTable.NewState(ipLayer.SrcIP, ethLayer.SrcMAC, tcpLayer.SrcPort, ipLayer.TOS, tcpLayer.Ack, tcpLayer.Payload)
+		}, "received packet for unknown balancer index")
+		packetsDropped.WithLabelValues(handler, "unknown_balancer").Inc()
+		return false
+	}
 
-			// start the TCP handshake with the backend
+	// the flow id is only computed when it is logged
+	flowID := func() string { return FlowID(ipLayer.SrcIP, tcpLayer.SrcPort, vip, tcpLayer.DstPort) }
+
+	if connState, ok := stateTable.GetByIP(ipLayer.SrcIP, tcpLayer.SrcPort, vip, tcpLayer.DstPort); ok {
+		// this is a known connection
+		if connState.State == TCP_STATE_ESTABLISHED || connState.State == TCP_STATE_FIN_WAIT_1 || (connState.Passthrough && connState.State == TCP_STATE_SYN_SENT) {
+			closeConnection(stateTable, connState, tcpLayer)
+
+			// migrate the TCP state to packetbridge <> backend handshake
+			tcpLayer.Ack = tcpLayer.Ack + connState.SeqOffset
+			tcpLayer.SrcPort = connState.RandPort
+			tcpLayer.DstPort = connState.BackendPort
+			ipLayer.DstIP = connState.Backend.IP.To4()
+
+			// the function responsible for sending the TCP packets will
+			// set the correct source IP
+			connState.Backend.countBytes(float64(len(tcpLayer.Payload)))
+			packetsSent.WithLabelValues(handler).Inc()
+			backendPackets.Put(d.newTCPPacket(ipLayer, tcpLayer))
+			return true
+		} else if connState.State == TCP_STATE_SYN_SENT && bytes.Equal(tcpLayer.Payload, connState.PayloadBuf) {
+			// the client retransmitted the first segment, the SYN to
+			// the backend (or its SYN ACK) might have been lost
 			tcpSYN := &layers.TCP{
 				SrcPort: connState.RandPort,
-				DstPort: tcpLayer.DstPort,
-				Seq:     tcpLayer.Seq - 1, // the handshake will increase it with +1
-				Ack:     0,
+				DstPort: connState.BackendPort,
+				Seq:     tcpLayer.Seq - 1,
 				SYN:     true,
 				Window:  64240,
 			}
+			ipLayer.DstIP = connState.Backend.IP.To4()
 
-			log.Printf("New TCP connection: %s:%d, sending SYN to backend", ipLayer.SrcIP, tcpLayer.SrcPort)
-
-			connState.State = TCP_STATE_SYN_SENT
-			backendPackets <- NewTCPPacket(ipLayer, tcpSYN)
+			logPacket(func() log.Fields {
+				return log.Fields{
+					"flow_id": flowID(),
+					"client":  fmt.Sprintf("%s:%d", connState.IP, connState.Port),
+				}
+			}, "received retransmitted segment, sending SYN to backend again")
+			packetsSent.WithLabelValues(handler).Inc()
+			backendPackets.Put(d.newTCPPacket(ipLayer, tcpSYN))
+			return true
+		} else {
+			// TODO handle this case properly
+			logPacket(func() log.Fields {
+				return log.Fields{
+					"flow_id": flowID(),
+					"state":   connState.State,
+				}
+			}, "received packet, but connection is not established")
+			packetsDropped.WithLabelValues(handler, "not_established").Inc()
+		}
+	} else if !d.validTCPChecksum(ipLayer, tcpLayer) {
+		// the state of the connection is created from this packet, a
+		// corrupted packet would break the connection
+		logPacket(func() log.Fields {
+			return log.Fields{
+				"flow_id": flowID(),
+			}
+		}, "received packet for new connection with invalid checksum")
+		packetsDropped.WithLabelValues(handler, "invalid_checksum").Inc()
+	} else {
+		backendPort, ok := portMap.BackendPort(tcpLayer.DstPort)
+		if !ok {
+			logPacket(func() log.Fields {
+				return log.Fields{
+					"flow_id": flowID(),
+					"port":    tcpLayer.DstPort,
+				}
+			}, "received packet for unknown listener port")
+			packetsDropped.WithLabelValues(handler, "unknown_port").Inc()
+			return false
 		}
-	}
-}
 
-// SendToBackend sends packets from the packetbridge to the backend.
-func SendToBackend(conn net.PacketConn, backendPackets chan *TCPPacket, srcIP, dstIP net.IP) {
-	for p := range backendPackets {
-		p.SetDstIP(dstIP)
-		p.SetSrcIP(srcIP)
+		backend, err := pool.RouteToServer(hashKey(
+			ipLayer.SrcIP.To16(),
+			[]byte{byte(tcpLayer.SrcPort >> 8), byte(tcpLayer.SrcPort)},
+			vip.To16(),
+		))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"flow_id": flowID(),
+				"client":  fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
+			}).Errorf("could not route packet to backend: %s", err)
+			routingErrors.Inc()
+			packetsDropped.WithLabelValues(handler, "routing_error").Inc()
+			return false
+		}
 
-		bytes, err := p.MarshalBinary()
+		// we don't know about this connection yet, add it to the state
+		// table and get the random port number for this connection
+		// (so we can look it up later), the addresses and payload are
+		// copied as the decoded layers reference the received packet.
+		// For a passed through SYN the sequence numbers are not
+		// translated.
+		passthrough := tcpLayer.SYN && !tcpLayer.ACK
+		seqOffset := tcpLayer.Ack
+		if passthrough {
+			seqOffset = 0
+		}
+		connState, err := stateTable.NewState(&PacketBridgeState{
+			State:        TCP_STATE_SYN_SENT,
+			IP:           append(net.IP(nil), ipLayer.SrcIP...),
+			HardwareAddr: append(net.HardwareAddr(nil), ethLayer.SrcMAC...),
+			Port:         tcpLayer.SrcPort,
+			VIP:          append(net.IP(nil), vip...),
+			ServicePort:  tcpLayer.DstPort,
+			BackendPort:  backendPort,
+			Backend:      backend,
+			LBIndex:      ipLayer.TOS,
+			SeqOffset:    seqOffset,
+			PayloadBuf:   append([]byte(nil), tcpLayer.Payload...),
+			Passthrough:  passthrough,
+			Encapsulated: outerLayer != nil,
+		})
 		if err != nil {
-			log.Fatalf("Could not serialize packet: %s", err)
+			log.WithFields(log.Fields{
+				"flow_id": flowID(),
+				"client":  fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
+			}).Errorf("could not add connection state: %s", err)
+			packetsDropped.WithLabelValues(handler, "no_free_port").Inc()
+			return false
 		}
+		backend.countConnection()
+		ipLayer.DstIP = backend.IP.To4()
 
-		log.Printf("Sending packet to backend: %s", p)
+		if passthrough {
+			// the client starts the handshake, forward its SYN (and
+			// options) as-is
+			stateTable.Changed(connState)
+			tcpLayer.SrcPort = connState.RandPort
+			tcpLayer.DstPort = connState.BackendPort
 
-		if _, err = conn.WriteTo(bytes, &net.IPAddr{IP: dstIP.To4()}); err != nil {
-			log.Printf("Could not write TCP packet: %s", err)
+			log.WithFields(log.Fields{
+				"flow_id": flowID(),
+				"client":  fmt.Sprintf("%s:%d", connState.IP, connState.Port),
+				"port":    fmt.Sprintf("%d -> %d", connState.ServicePort, connState.BackendPort),
+				"backend": backend.IP,
+			}).Info("new connection, passing SYN through to backend")
+			packetsSent.WithLabelValues(handler).Inc()
+			backendPackets.Put(d.newTCPPacket(ipLayer, tcpLayer))
+			return true
 		}
+
+		// start the TCP handshake with the backend
+		tcpSYN := &layers.TCP{
+			SrcPort: connState.RandPort,
+			DstPort: connState.BackendPort,
+			Seq:     tcpLayer.Seq - 1, // the handshake will increase it with +1
+			Ack:     0,
+			SYN:     true,
+			Window:  64240,
+		}
+
+		log.WithFields(log.Fields{
+			"flow_id": flowID(),
+			"client":  fmt.Sprintf("%s:%d", ipLayer.SrcIP, tcpLayer.SrcPort),
+			"port":    fmt.Sprintf("%d -> %d", connState.ServicePort, connState.BackendPort),
+			"backend": backend.IP,
+		}).Info("new connection, sending SYN to backend")
+		stateTable.Changed(connState)
+
+		packetsSent.WithLabelValues(handler).Inc()
+		backendPackets.Put(d.newTCPPacket(ipLayer, tcpSYN))
+		return true
 	}
+	return false
 }
 
-// SendToClient sends packets to the client who started the request at
-// the balancer.
-func SendToClient(handle *pcap.Handle, ethPackets chan *EthPacket) {
-	for p := range ethPackets {
-		p.SetTOS(1)
-		log.Printf("Sending eth packet: %s", p)
-		bytes, err := p.MarshalBinary()
-		if err != nil {
-			log.Fatalf("Could not serialize packet: %s", err)
+// SendToBackend sends packets from the packetbridge to the backend as IPv4
+// packets, using the given PacketSink (e.g. a RawSocket or TUN). The
+// destination IP must be set by the handler producing the packets. It
+// returns when the queue is closed.
+func SendToBackend(sink PacketSink, backendPackets *TCPPacketQueue, srcIP net.IP) {
+	for {
+		p, ok := backendPackets.Get()
+		if !ok {
+			return
 		}
-		handle.WritePacketData(bytes)
+		SendPacketToBackend(sink, p, srcIP)
+	}
+}
+
+// SendPacketToBackend sends a single packet to the backend, see
+// SendToBackend. The packet is released.
+func SendPacketToBackend(sink PacketSink, p *TCPPacket, srcIP net.IP) {
+	defer p.Release()
+	p.SetSrcIP(srcIP)
+
+	bytes, err := p.MarshalIPBinary()
+	if err != nil {
+		log.Errorf("could not serialize packet: %s", err)
+		return
+	}
+
+	logPacket(func() log.Fields {
+		return log.Fields{"packet": p.String()}
+	}, "sending packet to backend")
+
+	if err = sink.WritePacketData(bytes); err != nil {
+		log.Errorf("could not write TCP packet: %s", err)
 	}
 }
 
-// HandleBackendPackets handles incoming packets from the backend. If the
-// connection is known, it will forward these packets to the client.
-func HandleBackendPackets(conn net.PacketConn, dstIP, srcIP net.IP, srcPort layers.TCPPort, pbIface *net.Interface, backendTCPPackets chan *TCPPacket, ethPackets chan *EthPacket, stateTable *PacketBridgeStateTable, balancers map[uint8]net.IP) {
-	b := make([]byte, 1500)
+// SendToClient sends packets to the client who started the request at
+// the balancer, using the given ReturnPath. It returns when the queue is
+// closed.
+func SendToClient(returnPath ReturnPath, ethPackets *EthPacketQueue) {
 	for {
-		n, srcAddr, err := conn.ReadFrom(b)
-		if err != nil {
-			log.Printf("Could not read from TCP connection: %s", err)
-			continue
+		p, ok := ethPackets.Get()
+		if !ok {
+			return
 		}
+		SendPacketToClient(returnPath, p)
+	}
+}
+
+// SendPacketToClient sends a single packet to the client, see SendToClient.
+// The packet is released.
+func SendPacketToClient(returnPath ReturnPath, p *EthPacket) {
+	defer p.Release()
+	p.SetTOS(1)
+	logPacket(func() log.Fields {
+		return log.Fields{"packet": p.String()}
+	}, "sending packet to client")
+	if err := returnPath.Send(p); err == errNoHardwareAddr {
+		logPacket(func() log.Fields {
+			return log.Fields{"client": p.DstIP()}
+		}, "MAC address of next hop is not resolved")
+		packetsDropped.WithLabelValues("send_to_client", "unresolved_neighbor").Inc()
+	} else if err != nil {
+		log.Errorf("could not send packet to client: %s", err)
+	}
+}
+
+// HandleBackendPackets handles incoming packets from the backend, received
+// as IPv4 packets from the given PacketSource (e.g. a RawSocket or TUN). If
+// the connection is known, it will forward these packets to the client. The
+// source port is translated back to the VIP port of the connection.
+// Only packets coming from one of the backends of the given pool are handled.
+func HandleBackendPackets(source PacketSource, pool PoolBalancer, portMap PortMap, pbIface *net.Interface, backendTCPPackets *TCPPacketQueue, ethPackets *EthPacketQueue, stateTable *PacketBridgeStateTable) {
+	for p := range source.Packets() {
+		HandleBackendPacket(p, pool, portMap, pbIface, backendTCPPackets, ethPackets, stateTable)
+	}
+}
 
-		packet := gopacket.NewPacket(b[:n], layers.LayerTypeTCP, gopacket.Default)
-		layer := packet.Layer(layers.LayerTypeTCP)
-		if layer == nil {
-			log.Println("Could not get TCP layer")
-			continue
+// HandleBackendPacket handles a single packet from the backend, see
+// HandleBackendPackets.
+func HandleBackendPacket(p gopacket.Packet, pool PoolBalancer, portMap PortMap, pbIface *net.Interface, backendTCPPackets *TCPPacketQueue, ethPackets *EthPacketQueue, stateTable *PacketBridgeStateTable) {
+	d := getPacketDecoderFor(p)
+	if !handleBackendPacket(d, p.Data(), pool, portMap, pbIface, backendTCPPackets, ethPackets, stateTable) {
+		d.release()
+	}
+}
+
+// handleBackendPacket implements HandleBackendPacket, it returns true when a
+// packet using the layers decoded by d has been sent to ethPackets.
+func handleBackendPacket(d *packetDecoder, data []byte, pool PoolBalancer, portMap PortMap, pbIface *net.Interface, backendTCPPackets *TCPPacketQueue, ethPackets *EthPacketQueue, stateTable *PacketBridgeStateTable) bool {
+	const handler = "handle_backend_packets"
+
+	packetsReceived.WithLabelValues(handler).Inc()
+
+	ipLayer, tcpLayer, err := d.decodeIPv4(data)
+	if err != nil {
+		layer := "ipv4"
+		if ipLayer != nil {
+			layer = "tcp"
 		}
-		tcpLayer, ok := layer.(*layers.TCP)
-		if !ok {
-			log.Println("Could not cast to TCP layer")
-			continue
+		log.WithField("handler", handler).Warningf("could not decode packet: %s", err)
+		decodeErrors.WithLabelValues(handler, layer).Inc()
+		return false
+	}
+	src := ipLayer.SrcIP
+
+	backend, ok := GetServerByIP(pool, src)
+	if !(ok && portMap.HasBackendPort(tcpLayer.SrcPort)) {
+		// this was not the packet that we were waiting for, ignore
+		packetsDropped.WithLabelValues(handler, "filtered").Inc()
+		return false
+	}
+
+	connState, ok := stateTable.GetByPort(tcpLayer.DstPort)
+	if ok && (connState.Backend != backend || connState.BackendPort != tcpLayer.SrcPort) {
+		// the port is used by a connection with an other backend
+		packetsDropped.WithLabelValues(handler, "filtered").Inc()
+		return false
+	}
+	if !ok {
+		// set RST
+		// (we received a packet for a connection that is not known)
+		tcpRST := &layers.TCP{
+			SrcPort: tcpLayer.DstPort,
+			DstPort: tcpLayer.SrcPort,
+			Seq:     tcpLayer.Ack,
+			Ack:     tcpLayer.Seq + 1,
+			ACK:     true,
+			RST:     true,
+			Window:  64240,
 		}
+		ipLayer := &layers.IPv4{
+			DstIP:    backend.IP.To4(),
+			Protocol: layers.IPProtocolTCP,
+		}
+		log.WithField("port", tcpLayer.DstPort).Warning("packet received from backend for unknown connection, sending RST to backend")
+		packetsDropped.WithLabelValues(handler, "unknown_connection").Inc()
+		backendTCPPackets.Put(NewTCPPacket(ipLayer, tcpRST))
+	} else if connState.State == TCP_STATE_CLOSED {
+		// the connection was migrated to an other packetbridge
+		packetsDropped.WithLabelValues(handler, "migrated").Inc()
+	} else if connState.State == TCP_STATE_SYN_SENT && tcpLayer.SYN && tcpLayer.ACK && !connState.Passthrough && !d.validTCPChecksum(ipLayer, tcpLayer) {
+		// the sequence offset is set from the SYN ACK, the backend will
+		// retransmit it
+		logPacket(func() log.Fields {
+			return log.Fields{
+				"flow_id": FlowID(connState.IP, connState.Port, connState.VIP, connState.ServicePort),
+			}
+		}, "received SYN ACK with invalid checksum")
+		packetsDropped.WithLabelValues(handler, "invalid_checksum").Inc()
+	} else if connState.State == TCP_STATE_SYN_SENT && tcpLayer.SYN && tcpLayer.ACK && !connState.Passthrough {
+		// send ACK
+		// (we sent the SYN and are now receiving the SYN ACK from the backend)
+		// the state is replaced, as it is read concurrently by the
+		// handler of the balancer packets
+		established := *connState
+		established.State = TCP_STATE_ESTABLISHED
+		established.SeqOffset = tcpLayer.Seq - connState.SeqOffset + 1
+		connState = &established
+		stateTable.Put(connState)
+		stateTable.Changed(connState)
+		handshakeDuration.WithLabelValues(handler).Observe(now().Sub(connState.Created).Seconds())
 
-		if !(srcAddr.String() == srcIP.String() && tcpLayer.SrcPort == srcPort) {
-			// this was not the packet that we were waiting for, ignore
-			continue
+		tcpACK := &layers.TCP{
+			SrcPort: tcpLayer.DstPort,
+			DstPort: tcpLayer.SrcPort,
+			Seq:     tcpLayer.Ack,
+			Ack:     tcpLayer.Seq + 1,
+			ACK:     true,
+			Window:  64240,
+		}
+		ipLayer := &layers.IPv4{
+			DstIP:    backend.IP.To4(),
+			Protocol: layers.IPProtocolTCP,
 		}
 
-		connState, ok := stateTable.GetByPort(tcpLayer.DstPort)
-		if !ok {
-			// set RST
-			// (we received a packet for a connection that is not known)
-			tcpRST := &layers.TCP{
-				SrcPort: tcpLayer.DstPort,
-				DstPort: tcpLayer.SrcPort,
-				Seq:     tcpLayer.Ack,
-				Ack:     tcpLayer.Seq + 1,
-				ACK:     true,
-				RST:     true,
-				Window:  64240,
-			}
-			ipLayer := &layers.IPv4{
-				Protocol: layers.IPProtocolTCP,
-			}
-			log.Printf("Packet received for unknown connection from backend (port: %d). Sending RST to backend.", tcpLayer.DstPort)
-			backendTCPPackets <- NewTCPPacket(ipLayer, tcpRST)
-		} else if connState.State == TCP_STATE_SYN_SENT && tcpLayer.SYN && tcpLayer.ACK {
-			// send ACK
-			// (we sent the SYN and are now receiving the SYN ACK from the backend)
-			connState.State = TCP_STATE_ESTABLISHED
-			connState.SeqOffset = tcpLayer.Seq - connState.SeqOffset + 1
-
-			tcpACK := &layers.TCP{
-				SrcPort: tcpLayer.DstPort,
-				DstPort: tcpLayer.SrcPort,
-				Seq:     tcpLayer.Ack,
-				Ack:     tcpLayer.Seq + 1,
-				ACK:     true,
-				Window:  64240,
-			}
-			ipLayer := &layers.IPv4{
-				Protocol: layers.IPProtocolTCP,
-			}
+		log.WithFields(log.Fields{
+			"flow_id": FlowID(connState.IP, connState.Port, connState.VIP, connState.ServicePort),
+			"client":  fmt.Sprintf("%s:%d", connState.IP, connState.Port),
+		}).Info("backend handshake completed, sending ACK")
+		packetsSent.WithLabelValues(handler).Inc()
+		backendTCPPackets.Put(NewTCPPacket(ipLayer, tcpACK))
+	} else {
+		if connState.State == TCP_STATE_SYN_SENT && tcpLayer.SYN && tcpLayer.ACK {
+			// passthrough connection, the SYN ACK is for the client
+			established := *connState
+			established.State = TCP_STATE_ESTABLISHED
+			connState = &established
+			stateTable.Put(connState)
+			stateTable.Changed(connState)
+			handshakeDuration.WithLabelValues(handler).Observe(now().Sub(connState.Created).Seconds())
+		}
+		closeConnection(stateTable, connState, tcpLayer)
 
-			log.Println("Received SYN ACK from backend, sending ACK.")
-			backendTCPPackets <- NewTCPPacket(ipLayer, tcpACK)
-		} else {
-			// correct sequence number and set the RstPort to the original
-			// client port. we're now sending the packet back to the user
-			tcpLayer.Seq = tcpLayer.Seq - connState.SeqOffset
-			tcpLayer.DstPort = connState.Port
-
-			ethLayer := &layers.Ethernet{
-				SrcMAC:       pbIface.HardwareAddr,
-				DstMAC:       connState.HardwareAddr,
-				EthernetType: layers.EthernetTypeIPv4,
-			}
+		if tcpLayer.SYN && connState.Passthrough && connState.Encapsulated {
+			// the client segments are encapsulated by the balancer, they
+			// must fit in the MTU with the encapsulation overhead
+			clampMSS(tcpLayer, encapMSS(pbIface.MTU))
+		}
 
-			ipLayer := &layers.IPv4{
-				SrcIP:    balancers[connState.LBIndex].To4(),
-				DstIP:    connState.IP.To4(),
-				Protocol: layers.IPProtocolTCP,
-				Version:  4,
-				Id:       23423, // todo make this random?
-				Flags:    layers.IPv4DontFragment,
-				TTL:      64,
-			}
+		// correct sequence number and set the ports to the original
+		// client and VIP ports. we're now sending the packet back to
+		// the user
+		tcpLayer.Seq = tcpLayer.Seq - connState.SeqOffset
+		tcpLayer.DstPort = connState.Port
+		tcpLayer.SrcPort = connState.ServicePort
+
+		// the Ethernet layer of the decoder is not used by decodeIPv4,
+		// the checksum base of the IPv4 layer is kept by the decoder
+		ethLayer := &d.eth
+		*ethLayer = layers.Ethernet{
+			SrcMAC:       pbIface.HardwareAddr,
+			DstMAC:       connState.HardwareAddr,
+			EthernetType: layers.EthernetTypeIPv4,
+		}
 
-			log.Println("Sending packet from the backend to the user")
-			ethPackets <- NewEthPacket(ethLayer, ipLayer, tcpLayer)
+		*ipLayer = layers.IPv4{
+			SrcIP:    connState.VIP.To4(),
+			DstIP:    connState.IP.To4(),
+			Protocol: layers.IPProtocolTCP,
+			Version:  4,
+			Id:       23423, // todo make this random?
+			Flags:    layers.IPv4DontFragment,
+			TTL:      64,
 		}
+
+		logPacket(func() log.Fields {
+			return log.Fields{
+				"flow_id": FlowID(connState.IP, connState.Port, connState.VIP, connState.ServicePort),
+				"client":  fmt.Sprintf("%s:%d", connState.IP, connState.Port),
+			}
+		}, "sending packet from the backend to the client")
+		packetsSent.WithLabelValues(handler).Inc()
+		ethPackets.Put(d.newEthPacket(ethLayer, ipLayer, tcpLayer))
+		return true
+	}
+	return false
+}
+
+// closeConnection moves the given established connection to FIN_WAIT_1 on a
+// FIN or RST of the client or the backend, so that its state (and random
+// port) is removed by Expire after the closing timeout. The remaining packets
+// of the connection are still forwarded.
+func closeConnection(stateTable *PacketBridgeStateTable, state *PacketBridgeState, tcp *layers.TCP) {
+	if !(tcp.FIN || tcp.RST) || state.State != TCP_STATE_ESTABLISHED {
+		return
 	}
+	closing := *state
+	closing.State = TCP_STATE_FIN_WAIT_1
+	stateTable.Put(&closing)
+	stateTable.Changed(&closing)
 }
@@ -0,0 +1,292 @@
+package balancer
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestHandleBalancerPacketsPassthrough(t *testing.T) {
+	clientIP := net.ParseIP("10.0.0.1").To4()
+	vip := net.ParseIP("192.168.33.100").To4()
+	backendIP := net.ParseIP("192.168.33.30").To4()
+
+	pool := NewConsistentHashPool()
+	pool.AddServer(&Server{IP: backendIP})
+	stateTable := NewPacketBridgeStateTable()
+
+	srcMAC, _ := net.ParseMAC("11:11:11:11:11:11")
+	dstMAC, _ := net.ParseMAC("22:22:22:22:22:22")
+	eth := &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		TOS:      1,
+		SrcIP:    clientIP,
+		DstIP:    net.ParseIP("192.168.33.20").To4(),
+		Protocol: layers.IPProtocolTCP,
+	}
+	tcp := &layers.TCP{SrcPort: 1234, DstPort: 80, Seq: 100, SYN: true, Window: 1024}
+	b, err := NewEthPacket(eth, ip, tcp).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := make(chan gopacket.Packet, 1)
+	out := NewTCPPacketQueue("test", 1, OVERFLOW_BLOCK)
+	in <- gopacket.NewPacket(b, layers.LayerTypeEthernet, gopacket.Default)
+	close(in)
+	HandleBalancerPackets(in, out, stateTable, PortMap{80: 8080}, pool, map[uint8]net.IP{1: vip}, 5555)
+
+	p, ok := out.TryGet()
+	if !ok || out.Len() != 0 {
+		t.Fatal("Was expecting the SYN to be forwarded to the backend.")
+	}
+	if !p.tcp.SYN || p.tcp.ACK || p.tcp.Seq != 100 || p.tcp.DstPort != 8080 {
+		t.Errorf("Was expecting the client SYN for port 8080, got: %s", p)
+	}
+	if !p.DstIP().Equal(backendIP) {
+		t.Errorf("Was expecting destination %s, got: %s", backendIP, p.DstIP())
+	}
+
+	state, ok := stateTable.GetByIP(clientIP, 1234, vip, 80)
+	if !ok {
+		t.Fatal("Was expecting a connection state.")
+	}
+	if !state.Passthrough || state.SeqOffset != 0 || state.State != TCP_STATE_SYN_SENT {
+		t.Errorf("Unexpected state: %+v", state)
+	}
+	if p.tcp.SrcPort != state.RandPort {
+		t.Errorf("Was expecting source port %d, got: %d", state.RandPort, p.tcp.SrcPort)
+	}
+}
+
+func TestPacketBridgeMemoryLinks(t *testing.T) {
+	clientIP := net.ParseIP("10.0.0.1").To4()
+	vip := net.ParseIP("192.168.33.100").To4()
+	pbIP := net.ParseIP("192.168.33.20").To4()
+	backendIP := net.ParseIP("192.168.33.30").To4()
+	clientMAC, _ := net.ParseMAC("11:11:11:11:11:11")
+	pbIface := &net.Interface{HardwareAddr: net.HardwareAddr{0x22, 0x22, 0x22, 0x22, 0x22, 0x22}}
+
+	pool := NewConsistentHashPool()
+	pool.AddServer(&Server{IP: backendIP})
+	stateTable := NewPacketBridgeStateTable()
+	portMap := PortMap{80: 8080}
+
+	// balancer <-> packetbridge (Ethernet) and packetbridge <-> backend
+	// (IPv4)
+	balancerPort, pbPort := NewMemoryLink(layers.LayerTypeEthernet, 16)
+	pbBackendPort, backendPort := NewMemoryLink(layers.LayerTypeIPv4, 16)
+	defer pbBackendPort.Close()
+
+	backendTCPPackets := NewTCPPacketQueue("test", 16, OVERFLOW_BLOCK)
+	clientEthPackets := NewEthPacketQueue("test", 16, OVERFLOW_BLOCK)
+	go SendToBackend(pbBackendPort, backendTCPPackets, pbIP)
+	go HandleBackendPackets(pbBackendPort, pool, portMap, pbIface, backendTCPPackets, clientEthPackets, stateTable)
+	go func() {
+		HandleBalancerPackets(pbPort.Packets(), backendTCPPackets, stateTable, portMap, pool, map[uint8]net.IP{1: vip}, 5555)
+		backendTCPPackets.Close()
+	}()
+
+	// the client SYN, forwarded by the balancer
+	syn := NewEthPacket(
+		&layers.Ethernet{SrcMAC: clientMAC, DstMAC: pbIface.HardwareAddr, EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{Version: 4, TTL: 64, TOS: 1, SrcIP: clientIP, DstIP: pbIP, Protocol: layers.IPProtocolTCP},
+		&layers.TCP{SrcPort: 1234, DstPort: 80, Seq: 100, SYN: true, Window: 1024},
+	)
+	b, err := syn.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := balancerPort.WritePacketData(b); err != nil {
+		t.Fatal(err)
+	}
+	syn.Release()
+	balancerPort.Close()
+
+	// the backend receives the SYN as IPv4 packet from the packetbridge
+	in := <-backendPort.Packets()
+	ip, _ := in.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	tcp, _ := in.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if ip == nil || tcp == nil {
+		t.Fatal("Was expecting an IPv4 TCP packet at the backend.")
+	}
+	if !ip.SrcIP.Equal(pbIP) || !ip.DstIP.Equal(backendIP) || ip.TTL != 64 {
+		t.Errorf("Unexpected IPv4 header at the backend: %s -> %s (TTL %d)", ip.SrcIP, ip.DstIP, ip.TTL)
+	}
+	if !tcp.SYN || tcp.DstPort != 8080 {
+		t.Errorf("Was expecting the SYN for port 8080, got: %d -> %d", tcp.SrcPort, tcp.DstPort)
+	}
+	expectValidTCPChecksum(t, "backend SYN", in)
+
+	// the backend answers with a SYN ACK, which is sent to the client
+	synACK := NewTCPPacket(
+		&layers.IPv4{SrcIP: backendIP, DstIP: pbIP},
+		&layers.TCP{SrcPort: 8080, DstPort: tcp.SrcPort, Seq: 5000, Ack: tcp.Seq + 1, SYN: true, ACK: true, Window: 1024},
+	)
+	if b, err = synACK.MarshalIPBinary(); err != nil {
+		t.Fatal(err)
+	}
+	if err := backendPort.WritePacketData(b); err != nil {
+		t.Fatal(err)
+	}
+	synACK.Release()
+
+	out, _ := clientEthPackets.Get()
+	b, err = out.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(b, layers.LayerTypeEthernet, gopacket.Default)
+	ip, _ = packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	tcp, _ = packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if ip == nil || tcp == nil {
+		t.Fatal("Was expecting an IPv4 TCP packet for the client.")
+	}
+	if !ip.SrcIP.Equal(vip) || !ip.DstIP.Equal(clientIP) || tcp.SrcPort != 80 || tcp.DstPort != 1234 || !tcp.SYN || !tcp.ACK {
+		t.Errorf("Unexpected packet for the client: %s", out)
+	}
+	expectValidTCPChecksum(t, "client SYN ACK", packet)
+	out.Release()
+}
+
+func TestHandleBackendPacketsClampMSS(t *testing.T) {
+	backendIP := net.ParseIP("192.168.33.30").To4()
+	pbIface := &net.Interface{HardwareAddr: net.HardwareAddr{0x22, 0x22, 0x22, 0x22, 0x22, 0x22}}
+
+	pool := NewConsistentHashPool()
+	pool.AddServer(&Server{IP: backendIP})
+	stateTable := NewPacketBridgeStateTable()
+
+	for i, encapsulated := range []bool{false, true} {
+		state, err := stateTable.NewState(&PacketBridgeState{
+			State:        TCP_STATE_SYN_SENT,
+			IP:           net.ParseIP("10.0.0.1").To4(),
+			HardwareAddr: net.HardwareAddr{0x11, 0x11, 0x11, 0x11, 0x11, 0x11},
+			Port:         layers.TCPPort(1234 + i),
+			VIP:          net.ParseIP("192.168.33.100").To4(),
+			ServicePort:  80,
+			BackendPort:  8080,
+			Backend:      pool.Servers()[0],
+			Passthrough:  true,
+			Encapsulated: encapsulated,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		synACK := NewTCPPacket(
+			&layers.IPv4{SrcIP: backendIP, DstIP: net.ParseIP("192.168.33.20").To4()},
+			&layers.TCP{SrcPort: 8080, DstPort: state.RandPort, Seq: 5000, Ack: 101, SYN: true, ACK: true, Window: 1024, Options: []layers.TCPOption{
+				{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}},
+			}},
+		)
+		b, err := synACK.MarshalIPBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := NewEthPacketQueue("test", 1, OVERFLOW_BLOCK)
+		HandleBackendPacket(gopacket.NewPacket(b, layers.LayerTypeIPv4, gopacket.Default), pool, PortMap{80: 8080}, pbIface, nil, out, stateTable)
+		synACK.Release()
+
+		p, ok := out.TryGet()
+		if !ok {
+			t.Fatal("Was expecting the SYN ACK to be sent to the client.")
+		}
+		if b, err = p.MarshalBinary(); err != nil {
+			t.Fatal(err)
+		}
+		packet := gopacket.NewPacket(b, layers.LayerTypeEthernet, gopacket.Default)
+		tcp, _ := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if tcp == nil || len(tcp.Options) == 0 || tcp.Options[0].OptionType != layers.TCPOptionKindMSS {
+			t.Fatal("Was expecting a SYN ACK with the MSS option.")
+		}
+		expected := uint16(1460)
+		if encapsulated {
+			expected = encapMSS(0)
+		}
+		if mss := binary.BigEndian.Uint16(tcp.Options[0].OptionData); mss != expected {
+			t.Errorf("encapsulated %t: was expecting MSS %d, got: %d", encapsulated, expected, mss)
+		}
+		expectValidTCPChecksum(t, "client SYN ACK", packet)
+		p.Release()
+	}
+}
+
+func TestHandlePacketsAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("Allocations are not representative with the race detector.")
+	}
+
+	clientIP := net.ParseIP("10.0.0.1").To4()
+	vip := net.ParseIP("192.168.33.100").To4()
+	pbIP := net.ParseIP("192.168.33.20").To4()
+	backendIP := net.ParseIP("192.168.33.30").To4()
+	pbIface := &net.Interface{HardwareAddr: net.HardwareAddr{0x22, 0x22, 0x22, 0x22, 0x22, 0x22}}
+
+	pool := NewConsistentHashPool()
+	pool.AddServer(&Server{IP: backendIP})
+	portMap := PortMap{80: 8080}
+	balancers := map[uint8]net.IP{1: vip}
+	stateTable := NewPacketBridgeStateTable()
+	state, err := stateTable.NewState(&PacketBridgeState{
+		State:        TCP_STATE_ESTABLISHED,
+		IP:           clientIP,
+		HardwareAddr: net.HardwareAddr{0x11, 0x11, 0x11, 0x11, 0x11, 0x11},
+		Port:         1234,
+		VIP:          vip,
+		ServicePort:  80,
+		BackendPort:  8080,
+		Backend:      pool.Servers()[0],
+		LBIndex:      1,
+		Passthrough:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewEthPacket(
+		&layers.Ethernet{SrcMAC: state.HardwareAddr, DstMAC: pbIface.HardwareAddr, EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{Version: 4, TTL: 64, TOS: 1, SrcIP: clientIP, DstIP: pbIP, Protocol: layers.IPProtocolTCP},
+		&layers.TCP{SrcPort: 1234, DstPort: 80, Seq: 100, Ack: 5000, ACK: true, Window: 1024},
+	).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromBalancer := gopacket.NewPacket(b, layers.LayerTypeEthernet, gopacket.Default)
+	if b, err = NewTCPPacket(
+		&layers.IPv4{SrcIP: backendIP, DstIP: pbIP},
+		&layers.TCP{SrcPort: 8080, DstPort: state.RandPort, Seq: 5000, Ack: 100, ACK: true, Window: 1024},
+	).MarshalIPBinary(); err != nil {
+		t.Fatal(err)
+	}
+	fromBackend := gopacket.NewPacket(b, layers.LayerTypeIPv4, gopacket.Default)
+
+	backendPackets := NewTCPPacketQueue("test", 1, OVERFLOW_BLOCK)
+	ethPackets := NewEthPacketQueue("test", 1, OVERFLOW_BLOCK)
+	run := func() {
+		HandleBalancerPacket(fromBalancer, backendPackets, stateTable, portMap, pool, balancers, 5555)
+		p, ok := backendPackets.TryGet()
+		if !ok {
+			t.Fatal("Was expecting the packet to be forwarded to the backend.")
+		}
+		p.Release()
+
+		HandleBackendPacket(fromBackend, pool, portMap, pbIface, nil, ethPackets, stateTable)
+		e, ok := ethPackets.TryGet()
+		if !ok {
+			t.Fatal("Was expecting the packet to be sent to the client.")
+		}
+		e.Release()
+	}
+	// fill the pools and look up the counters
+	run()
+
+	if allocs := testing.AllocsPerRun(100, run); allocs > 0 {
+		t.Errorf("Was expecting no allocations per packet, got: %.1f", allocs)
+	}
+}
@@ -0,0 +1,146 @@
+package balancer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var serializeBufferPool = sync.Pool{
+	New: func() interface{} {
+		return gopacket.NewSerializeBuffer()
+	},
+}
+
+var (
+	serializeOptions = gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+	// the TCP checksum is set by serializeTCP
+	serializeOptionsNoChecksum = gopacket.SerializeOptions{
+		FixLengths: true,
+	}
+)
+
+// serializeTCP serializes the TCP layer (and its payload) into buf, followed
+// by the given headers (in packet order, e.g. Ethernet and IPv4). The TCP
+// checksum is computed for the given IPv4 layer, the checksums of the other
+// headers by gopacket.
+func serializeTCP(buf gopacket.SerializeBuffer, d *packetDecoder, ip *layers.IPv4, tcp *layers.TCP, headers ...gopacket.SerializableLayer) error {
+	buf.Clear()
+	payload, err := buf.PrependBytes(len(tcp.Payload))
+	if err != nil {
+		return err
+	}
+	copy(payload, tcp.Payload)
+	if err := tcp.SerializeTo(buf, serializeOptionsNoChecksum); err != nil {
+		return err
+	}
+	tcp.Checksum, err = tcpChecksum(buf.Bytes(), ip.SrcIP, ip.DstIP, d, tcp)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(buf.Bytes()[16:], tcp.Checksum)
+	buf.PushLayer(layers.LayerTypeTCP)
+
+	for i := len(headers) - 1; i >= 0; i-- {
+		if err := headers[i].SerializeTo(buf, serializeOptions); err != nil {
+			return err
+		}
+		buf.PushLayer(headers[i].LayerType())
+	}
+	return nil
+}
+
+// tcpChecksum returns the checksum of the given serialized TCP segment from
+// src to dst. When the segment was decoded by d and only the addresses,
+// ports, sequence or acknowledgment numbers have been changed, the received
+// checksum is updated incrementally (RFC 1624), else the checksum is
+// computed over the whole segment.
+func tcpChecksum(segment []byte, src, dst net.IP, d *packetDecoder, tcp *layers.TCP) (uint16, error) {
+	src, dst = src.To4(), dst.To4()
+	if src == nil || dst == nil {
+		return 0, errors.New("TCP checksum requires IPv4 addresses")
+	}
+
+	if d != nil && d.checksumBase && tcp == &d.tcp && unchangedTCPSegment(segment, tcp.Contents, tcp.Payload, d.payload) {
+		// HC' = ~(~HC + ~m + m')
+		sum := uint32(^binary.BigEndian.Uint16(tcp.Contents[16:18]))
+		sum = checksumAddInverted(sum, d.srcIP[:])
+		sum = checksumAddInverted(sum, d.dstIP[:])
+		sum = checksumAddInverted(sum, tcp.Contents[0:12])
+		sum = checksumAdd(sum, src)
+		sum = checksumAdd(sum, dst)
+		sum = checksumAdd(sum, segment[0:12])
+		return checksumFold(sum), nil
+	}
+
+	sum := checksumAdd(0, src)
+	sum = checksumAdd(sum, dst)
+	sum += uint32(layers.IPProtocolTCP) + uint32(len(segment))
+	sum = checksumAdd(sum, segment[0:16])
+	sum = checksumAdd(sum, segment[18:])
+	return checksumFold(sum), nil
+}
+
+// validTCPChecksum returns true when the checksum of the given decoded TCP
+// segment is valid for the given IPv4 header.
+func validTCPChecksum(ip *layers.IPv4, tcp *layers.TCP) bool {
+	src, dst := ip.SrcIP.To4(), ip.DstIP.To4()
+	if src == nil || dst == nil {
+		return false
+	}
+	sum := checksumAdd(0, src)
+	sum = checksumAdd(sum, dst)
+	sum += uint32(layers.IPProtocolTCP) + uint32(len(tcp.Contents)+len(tcp.Payload))
+	sum = checksumAdd(sum, tcp.Contents)
+	sum = checksumAdd(sum, tcp.Payload)
+	return checksumFold(sum) == 0
+}
+
+// unchangedTCPSegment returns true when the given serialized segment only
+// differs from the received header in the ports, sequence and acknowledgment
+// numbers (and the checksum), and the payload is the received payload.
+func unchangedTCPSegment(segment, header, payload, received []byte) bool {
+	if len(header) < 20 || len(segment) != len(header)+len(received) || len(payload) != len(received) {
+		return false
+	}
+	if len(payload) > 0 && &payload[0] != &received[0] {
+		return false
+	}
+	return bytes.Equal(segment[12:16], header[12:16]) && bytes.Equal(segment[18:len(header)], header[18:])
+}
+
+// checksumAdd adds the 16 bit words of b to the given one's complement sum.
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// checksumAddInverted adds the complement of the 16 bit words of b (of even
+// length) to the given one's complement sum.
+func checksumAddInverted(sum uint32, b []byte) uint32 {
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(^(uint16(b[0])<<8 | uint16(b[1])))
+	}
+	return sum
+}
+
+// checksumFold folds the given sum to 16 bits and returns its complement.
+func checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,141 @@
+package balancer
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// testTCPPacket returns a serialized Ethernet / IPv4 / TCP packet.
+func testTCPPacket(t *testing.T, payload []byte) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		SrcIP:    net.ParseIP("10.0.0.1").To4(),
+		DstIP:    net.ParseIP("192.168.33.10").To4(),
+		Protocol: layers.IPProtocolTCP,
+	}
+	tcp := &layers.TCP{
+		SrcPort: 40000,
+		DstPort: 80,
+		Seq:     1000,
+		Ack:     2000,
+		ACK:     true,
+		PSH:     true,
+		Window:  1024,
+		Options: []layers.TCPOption{{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}}},
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, serializeOptions, eth, ip, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// expectValidTCPChecksum compares the TCP checksum of the given packet with
+// the checksum computed by gopacket.
+func expectValidTCPChecksum(t *testing.T, name string, packet gopacket.Packet) {
+	ip, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	tcp, _ := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if ip == nil || tcp == nil {
+		t.Fatalf("%s: could not decode packet", name)
+	}
+	received := tcp.Checksum
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, serializeOptions, tcp, gopacket.Payload(tcp.Payload)); err != nil {
+		t.Fatal(err)
+	}
+	if tcp.Checksum != received {
+		t.Errorf("%s: was expecting TCP checksum %#04x, got: %#04x", name, tcp.Checksum, received)
+	}
+}
+
+func TestTCPChecksum(t *testing.T) {
+	tests := []struct {
+		name        string
+		payload     []byte
+		modify      func(d *packetDecoder, ip *layers.IPv4, tcp *layers.TCP)
+		incremental bool
+	}{
+		{
+			name:        "rewrite addresses and ports",
+			payload:     []byte("GET / HTTP/1.0\r\n\r\n"),
+			incremental: true,
+			modify: func(d *packetDecoder, ip *layers.IPv4, tcp *layers.TCP) {
+				ip.SrcIP = net.ParseIP("192.168.33.10").To4()
+				ip.DstIP = net.ParseIP("192.168.33.20").To4()
+				tcp.SrcPort = 1234
+				tcp.DstPort = 8080
+			},
+		},
+		{
+			name:        "rewrite sequence numbers (odd payload length)",
+			payload:     []byte("GET /"),
+			incremental: true,
+			modify: func(d *packetDecoder, ip *layers.IPv4, tcp *layers.TCP) {
+				tcp.Seq += 123456789
+				tcp.Ack -= 987654321
+			},
+		},
+		{
+			name:        "unchanged",
+			incremental: true,
+			modify:      func(d *packetDecoder, ip *layers.IPv4, tcp *layers.TCP) {},
+		},
+		{
+			name:    "changed header",
+			payload: []byte("GET / HTTP/1.0\r\n\r\n"),
+			modify: func(d *packetDecoder, ip *layers.IPv4, tcp *layers.TCP) {
+				ip.DstIP = net.ParseIP("192.168.33.20").To4()
+				tcp.Window = 512
+				tcp.RST = true
+			},
+		},
+		{
+			name:    "changed payload",
+			payload: []byte("GET / HTTP/1.0\r\n\r\n"),
+			modify: func(d *packetDecoder, ip *layers.IPv4, tcp *layers.TCP) {
+				ip.DstIP = net.ParseIP("192.168.33.20").To4()
+				tcp.Payload = []byte("HEAD / HTTP/1.0\r\n\r\n")
+			},
+		},
+		{
+			name:    "changed options",
+			payload: []byte("GET / HTTP/1.0\r\n\r\n"),
+			modify: func(d *packetDecoder, ip *layers.IPv4, tcp *layers.TCP) {
+				tcp.Options = nil
+			},
+		},
+	}
+
+	for _, test := range tests {
+		d := getPacketDecoder()
+		eth, ip, tcp, err := d.decode(testTCPPacket(t, test.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.modify(d, ip, tcp)
+
+		p := d.newEthPacket(eth, ip, tcp)
+		b, err := p.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectValidTCPChecksum(t, test.name, gopacket.NewPacket(b, layers.LayerTypeEthernet, gopacket.Default))
+
+		segment := b[14+int(ip.IHL)*4 : 14+int(ip.Length)]
+		if incremental := unchangedTCPSegment(segment, tcp.Contents, tcp.Payload, d.payload); incremental != test.incremental {
+			t.Errorf("%s: was expecting incremental update: %t, got: %t", test.name, test.incremental, incremental)
+		}
+		p.Release()
+	}
+}
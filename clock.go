@@ -0,0 +1,18 @@
+package balancer
+
+import (
+	"time"
+)
+
+// now returns the current time of the packet handlers and state tables, see
+// SetClock.
+var now = time.Now
+
+// SetClock sets the function returning the current time of the packet
+// handlers and state tables, e.g. the capture time of the packets being
+// replayed (see Replay). The clock is a package global shared by all
+// handlers and tables: it must not be called while packets are handled
+// (e.g. by the workers of a live balancer in the same process).
+func SetClock(f func() time.Time) {
+	now = f
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	balancer "github.com/brocaar/l3dsr-hash-balancer"
+	"github.com/codegangsta/cli"
+	"github.com/google/gopacket/layers"
+)
+
+// config represents the JSON services config file, e.g.:
+//
+//	{
+//	  "services": [
+//	    {
+//	      "vip": "192.168.33.10",
+//	      "port": 80,
+//	      "protocol": "tcp",
+//	      "lbindex": 1,
+//	      "mode": "splice",
+//	      "hash": "consistent",
+//	      "key": "http-path",
+//	      "encap": "ipip",
+//	      "recovery": false,
+//	      "servers": [
+//	        {"ip": "192.168.33.20", "mac": "08:00:27:33:d1:63"}
+//	      ]
+//	    }
+//	  ]
+//	}
+type config struct {
+	Services []serviceConfig `json:"services"`
+}
+
+type serviceConfig struct {
+	VIP      string         `json:"vip"`
+	Port     int            `json:"port"`
+	Protocol string         `json:"protocol"`
+	LBIndex  int            `json:"lbindex"`
+	Mode     string         `json:"mode"`
+	Hash     string         `json:"hash"`
+	Key      string         `json:"key"`
+	Encap    string         `json:"encap"`
+	FOUPort  int            `json:"fou_port"`
+	Recovery bool           `json:"recovery"`
+	Servers  []serverConfig `json:"servers"`
+}
+
+// serverConfig contains the server IP and (optionally) its MAC. When the
+// MAC is omitted, it is resolved using the kernel neighbor table.
+type serverConfig struct {
+	IP  string `json:"ip"`
+	MAC string `json:"mac"`
+}
+
+// loadConfig reads the config from the given file.
+func loadConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var conf config
+	if err := json.NewDecoder(f).Decode(&conf); err != nil {
+		return nil, err
+	}
+	return &conf, nil
+}
+
+// configFromFlags returns the config for the single service defined by the
+// cli flags.
+func configFromFlags(c *cli.Context) (*config, error) {
+	ip, err := balancer.GetAddrByName(c.String("iface"))
+	if err != nil {
+		return nil, fmt.Errorf("could not get IP for interface: %s", err)
+	}
+
+	return &config{
+		Services: []serviceConfig{
+			{
+				VIP:      ip.String(),
+				Port:     c.Int("port"),
+				Protocol: "tcp",
+				LBIndex:  c.Int("lbindex"),
+				Mode:     c.String("mode"),
+				Hash:     c.String("hash"),
+				Key:      c.String("key"),
+				Encap:    c.String("encap"),
+				FOUPort:  c.Int("fou-port"),
+				Recovery: c.Bool("recovery"),
+				Servers: []serverConfig{
+					{IP: c.String("backend-ip"), MAC: c.String("backend-mac")},
+				},
+			},
+		},
+	}, nil
+}
+
+// serviceTable returns the ServiceTable for the config. The given IP is used
+// as source IP for encapsulated packets, the given MAC as source MAC for
+// the l2dsr mode and the given key for the services with recovery enabled.
+func (c *config) serviceTable(srcIP net.IP, srcMAC net.HardwareAddr, recoveryKey []byte) (*balancer.ServiceTable, error) {
+	services := balancer.NewServiceTable()
+	lbIndexes := make(map[uint8]string)
+
+	for _, sc := range c.Services {
+		s, err := sc.service(srcIP, srcMAC, recoveryKey)
+		if err != nil {
+			return nil, fmt.Errorf("service %s:%d: %s", sc.VIP, sc.Port, err)
+		}
+		if other, ok := lbIndexes[s.LBIndex]; ok {
+			return nil, fmt.Errorf("service %s: lbindex %d is already used by service %s", s, s.LBIndex, other)
+		}
+		lbIndexes[s.LBIndex] = s.String()
+
+		if err := services.AddService(s); err != nil {
+			return nil, err
+		}
+	}
+
+	return services, nil
+}
+
+func (sc serviceConfig) service(srcIP net.IP, srcMAC net.HardwareAddr, recoveryKey []byte) (*balancer.Service, error) {
+	ip := net.ParseIP(sc.VIP)
+	if ip == nil || ip.To4() == nil {
+		return nil, fmt.Errorf("invalid IPv4 VIP: %s", sc.VIP)
+	}
+	if sc.Port <= 0 || sc.Port > 65535 {
+		return nil, fmt.Errorf("invalid port: %d", sc.Port)
+	}
+	if sc.LBIndex <= 0 || sc.LBIndex > 255 {
+		return nil, fmt.Errorf("invalid lbindex: %d", sc.LBIndex)
+	}
+
+	var protocol layers.IPProtocol
+	switch strings.ToLower(sc.Protocol) {
+	case "", "tcp":
+		protocol = layers.IPProtocolTCP
+	default:
+		return nil, fmt.Errorf("unsupported protocol: %s", sc.Protocol)
+	}
+
+	hash := sc.Hash
+	if hash == "" {
+		hash = "consistent"
+	}
+	pool, err := balancer.NewPool(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	key := sc.Key
+	if key == "" {
+		key = "client-ip"
+	}
+	keyExtractor, err := balancer.GetKeyExtractor(key)
+	if err != nil {
+		return nil, err
+	}
+
+	encap, err := balancer.ParseEncapType(sc.Encap)
+	if err != nil {
+		return nil, err
+	}
+	fouPort := sc.FOUPort
+	if fouPort == 0 {
+		fouPort = 5555
+	}
+
+	mode, err := balancer.ParseForwardMode(sc.Mode)
+	if err != nil {
+		return nil, err
+	}
+	if mode == balancer.MODE_L2DSR && encap != balancer.ENCAP_NONE {
+		return nil, fmt.Errorf("encapsulation is not supported in %s mode", mode)
+	}
+
+	if len(sc.Servers) == 0 {
+		return nil, fmt.Errorf("no servers configured")
+	}
+
+	var recovery *balancer.SequenceCodec
+	if sc.Recovery {
+		if mode != balancer.MODE_SPLICE {
+			return nil, fmt.Errorf("recovery is not supported in %s mode", mode)
+		}
+		if !balancer.IsHeaderKey(key) {
+			return nil, fmt.Errorf("recovery requires a key that only uses the headers (client-ip, flow), got: %s", key)
+		}
+		if len(sc.Servers) > balancer.MaxRecoverySlots {
+			return nil, fmt.Errorf("recovery supports at most %d servers", balancer.MaxRecoverySlots)
+		}
+		recovery, err = balancer.NewSequenceCodec(recoveryKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, srv := range sc.Servers {
+		serverIP := net.ParseIP(srv.IP)
+		if serverIP == nil || serverIP.To4() == nil {
+			return nil, fmt.Errorf("invalid server IPv4 address: %s", srv.IP)
+		}
+		// when the MAC is not set, it will be resolved by the NeighborCache
+		var mac net.HardwareAddr
+		if srv.MAC != "" {
+			mac, err = net.ParseMAC(srv.MAC)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse server MAC: %s", err)
+			}
+		}
+		pool.AddServer(&balancer.Server{
+			IP:                  serverIP.To4(),
+			HardwareAddr:        mac,
+			ResolveHardwareAddr: mac == nil,
+		})
+	}
+
+	return &balancer.Service{
+		IP:              ip.To4(),
+		Port:            layers.TCPPort(sc.Port),
+		Protocol:        protocol,
+		LBIndex:         uint8(sc.LBIndex),
+		Pool:            pool,
+		KeyExtractor:    keyExtractor,
+		Mode:            mode,
+		SrcHardwareAddr: srcMAC,
+		Encap:           encap,
+		EncapSrcIP:      srcIP,
+		FOUPort:         layers.UDPPort(fouPort),
+		Recovery:        recovery,
+	}, nil
+}
@@ -1,88 +1,351 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	balancer "github.com/brocaar/l3dsr-hash-balancer"
 	"github.com/codegangsta/cli"
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/pcap"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
 )
 
 var revision string // set by the compiler
 
+// packetQueueLen is the size of the queue between the workers and the
+// goroutine sending the packets while replaying a capture (see --queue-size
+// otherwise).
+const packetQueueLen = 1024
+
 func run(c *cli.Context) {
-	backendIP := net.ParseIP(c.String("backend-ip")).To4()
-	backendMAC, err := net.ParseMAC(c.String("backend-mac"))
-	if err != nil {
-		log.Fatalf("Could not parse backend MAC: %s", err)
+	if err := balancer.SetupLogging(c.String("log-level"), c.String("log-format"), c.Int("log-packet-rate")); err != nil {
+		log.Fatalf("Could not setup logging: %s", err)
 	}
 
-	// setup pcap handle
-	hi, err := pcap.NewInactiveHandle(c.String("iface"))
+	// setup services
+	var conf *config
+	var err error
+	if c.String("config") != "" {
+		conf, err = loadConfig(c.String("config"))
+		if err != nil {
+			log.Fatalf("Could not load config: %s", err)
+		}
+	} else {
+		conf, err = configFromFlags(c)
+		if err != nil {
+			log.Fatalf("Could not setup service: %s", err)
+		}
+	}
+	ifaceIP, ifaceMAC, err := ifaceAddrs(c.String("iface"))
 	if err != nil {
-		log.Fatalf("Could not bind to interface: %s", err)
+		if c.String("replay") == "" {
+			log.Fatalf("Could not get interface addresses: %s", err)
+		}
+		// the capture can be replayed on an other host
+		log.Warningf("could not get interface addresses, replaying without: %s", err)
+		ifaceIP, ifaceMAC = net.IPv4zero.To4(), make(net.HardwareAddr, 6)
 	}
-	defer hi.CleanUp()
-	hi.SetImmediateMode(true)
-	handle, err := hi.Activate()
+	services, err := conf.serviceTable(ifaceIP, ifaceMAC, []byte(c.String("recovery-key")))
 	if err != nil {
-		log.Fatalf("Could not activate handler: %s", err)
+		log.Fatalf("Could not setup services: %s", err)
+	}
+	var pools []balancer.PoolBalancer
+	for _, s := range services.Services() {
+		log.WithFields(log.Fields{
+			"service": s,
+			"lbindex": s.LBIndex,
+			"mode":    s.Mode,
+		}).Info("serving service")
+		pools = append(pools, s.Pool)
 	}
-	defer handle.Close()
 
-	// setup BPF filter
-	ip, err := balancer.GetAddrByName(c.String("iface"))
-	if err != nil {
-		log.Fatalf("Could not get IP for interface: %s", err)
+	if c.String("replay") != "" {
+		if err := replay(c.String("replay"), c.String("output"), services, pools); err != nil {
+			log.Fatalf("Could not replay capture: %s", err)
+		}
+		return
 	}
-	if err = handle.SetBPFFilter(fmt.Sprintf("tcp and dst port %d and dst host %s", c.Int("port"), ip.String())); err != nil {
-		log.Fatalf("Could not set BPF filter: %s", err)
+
+	// resolve the server MAC addresses and keep them up-to-date
+	neighbors := balancer.NewNeighborCache(c.Duration("neighbor-ttl"))
+	for _, pool := range pools {
+		neighbors.RefreshServers(pool)
 	}
+	go neighbors.RunRefresh(pools, c.Duration("neighbor-refresh-interval"))
 
-	// get packet channel
-	ps := gopacket.NewPacketSource(handle, handle.LinkType())
+	// setup the capture handle, l2dsr forwards the packets unmodified
+	// (except for the MAC), make sure we don't capture the packets we send
+	// ourselves
+	bpfFilter := services.BPFFilter()
+	log.WithField("filter", bpfFilter).Info("setting BPF filter")
+	handle, err := openCapture(c, c.String("iface"), bpfFilter, true)
+	if err != nil {
+		log.Fatalf("Could not setup capture: %s", err)
+	}
+	defer handle.Close()
 
 	// handle packets
-	ethPacketChan := make(chan *balancer.EthPacket)
+	queuePolicy, err := balancer.ParseOverflowPolicy(c.String("queue-policy"))
+	if err != nil {
+		log.Fatalf("Could not parse the queue policy: %s", err)
+	}
+	ethPackets := balancer.NewEthPacketQueue("to_servers", c.Int("queue-size"), queuePolicy)
 	st := balancer.NewStateTable()
-	pool := balancer.NewDummyBalancer()
-	pool.AddServer(&balancer.Server{
-		IP:           backendIP,
-		HardwareAddr: backendMAC,
-	})
 
-	go balancer.BalancePackets(ps.Packets(), ethPacketChan, st, pool)
-	sendPacket(handle, ethPacketChan, uint8(c.Int("lbindex")))
+	if path := c.String("snapshot-file"); path != "" {
+		n, err := st.LoadSnapshot(path, services, c.Duration("snapshot-max-age"))
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("could not load snapshot: %s", err)
+		} else if err == nil {
+			log.WithFields(log.Fields{
+				"file":   path,
+				"states": n,
+			}).Info("loaded state snapshot")
+		}
+		go saveSnapshots(st, path, c.Duration("snapshot-interval"))
+	}
+
+	if c.String("sync-bind") != "" {
+		var peers []string
+		if c.String("sync-peers") != "" {
+			peers = strings.Split(c.String("sync-peers"), ",")
+		}
+		stateSync, err := balancer.NewStateSync(c.String("sync-bind"), peers, st, services)
+		if err != nil {
+			log.Fatalf("Could not setup state sync: %s", err)
+		}
+		go stateSync.Run()
+	}
+
+	if c.String("api-bind") != "" {
+		go func() {
+			log.Fatal(balancer.ServeAPI(c.String("api-bind"), c.String("api-token"), balancer.NewBalancerAPI(st, services)))
+		}()
+	}
+
+	switch c.String("xdp") {
+	case "off":
+	case "native", "generic":
+		fastPath, err := balancer.NewXDPFastPath(c.Int("xdp-max-flows"))
+		if err != nil {
+			log.Fatalf("Could not setup XDP fast path: %s", err)
+		}
+		defer fastPath.Close()
+		if err := fastPath.Attach(c.String("iface"), c.String("xdp") == "generic"); err != nil {
+			log.Fatalf("Could not setup XDP fast path: %s", err)
+		}
+		st.SetFastPath(fastPath)
+		go fastPath.RunRefresh(services, c.Duration("neighbor-refresh-interval"))
+		log.WithFields(log.Fields{
+			"iface": c.String("iface"),
+			"mode":  c.String("xdp"),
+		}).Info("offloading established connections to XDP")
+	default:
+		log.Fatalf("Unknown XDP mode: %s", c.String("xdp"))
+	}
+
+	go st.RunExpiry(c.Duration("state-expiry-interval"), c.Duration("state-idle-timeout"), c.Duration("state-closing-timeout"))
+
+	prometheus.MustRegister(balancer.NewStateTableCollector(st, nil))
+	go func() {
+		log.Fatal(balancer.ServeMetrics(c.String("metrics-bind")))
+	}()
+
+	go balancer.RunWorkers(handle.Packets(), c.Int("workers"), c.Int("batch-size"), func(p gopacket.Packet) {
+		balancer.BalancePacket(p, ethPackets, st, services)
+	})
+	sendPackets(handle, ethPackets)
 }
 
-func sendPacket(handle *pcap.Handle, ethPacketChan chan *balancer.EthPacket, lbIndex uint8) {
-	for p := range ethPacketChan {
-		log.Printf("Sending packet %s", p)
+// saveSnapshots saves a snapshot of the state table at the given interval
+// (when not 0) and when the process is terminated.
+func saveSnapshots(stateTable *balancer.StateTable, path string, interval time.Duration) {
+	save := func() {
+		if err := stateTable.SaveSnapshot(path); err != nil {
+			log.Errorf("could not save snapshot: %s", err)
+		}
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
 
-		p.SetTOS(lbIndex)
-		bytes, err := p.MarshalBinary()
+	for {
+		select {
+		case <-tick:
+			save()
+		case sig := <-sigChan:
+			save()
+			log.WithFields(log.Fields{
+				"signal": sig,
+				"file":   path,
+			}).Info("saved state snapshot, exiting")
+			os.Exit(0)
+		}
+	}
+}
+
+// openCapture opens the capture handle for the given interface using the
+// backend selected by --capture. The handle is also used to send packets on
+// the same interface.
+func openCapture(c *cli.Context, iface, bpfFilter string, ignoreOutgoing bool) (balancer.PacketHandle, error) {
+	switch c.String("capture") {
+	case "pcap":
+		handle, err := balancer.NewPcapHandle(iface, ignoreOutgoing)
 		if err != nil {
-			log.Fatalf("Could not marshal packet: %s", err)
+			return nil, err
+		}
+		if err := handle.SetBPFFilter(bpfFilter); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("could not set BPF filter: %s", err)
 		}
-		handle.WritePacketData(bytes)
+		return handle, nil
+	case "afpacket":
+		conf := balancer.DefaultAFPacketConfig()
+		conf.Sockets = c.Int("afpacket-sockets")
+		conf.Blocks = c.Int("afpacket-ring-size")
+		conf.IgnoreOutgoing = ignoreOutgoing
+		handle, err := balancer.NewAFPacketHandle(iface, conf)
+		if err != nil {
+			return nil, err
+		}
+		if err := handle.SetBPFFilter(bpfFilter); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("could not set BPF filter: %s", err)
+		}
+		return handle, nil
+	default:
+		return nil, fmt.Errorf("unknown capture backend: %s", c.String("capture"))
 	}
 }
 
+func sendPackets(handle balancer.PacketSink, ethPackets *balancer.EthPacketQueue) {
+	for {
+		p, ok := ethPackets.Get()
+		if !ok {
+			return
+		}
+		sendPacket(handle, p)
+	}
+}
+
+func sendPacket(handle balancer.PacketSink, p *balancer.EthPacket) {
+	defer p.Release()
+	bytes, err := p.MarshalBinary()
+	if err != nil {
+		log.Errorf("could not marshal packet: %s", err)
+		return
+	}
+	handle.WritePacketData(bytes)
+}
+
+// replay feeds the packets of the input capture through the balancer, one at
+// a time with the time of their capture, and writes the packets it sends to
+// the output capture. The network is not used, servers without a configured
+// MAC address get the zero MAC address.
+func replay(input, output string, services *balancer.ServiceTable, pools []balancer.PoolBalancer) error {
+	if output == "" {
+		return errors.New("--output is required")
+	}
+	for _, pool := range pools {
+		for _, s := range pool.Servers() {
+			if s.GetHardwareAddr() == nil {
+				s.SetHardwareAddr(make(net.HardwareAddr, 6))
+			}
+		}
+	}
+
+	in, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+	sink, err := balancer.NewPcapFileSink(w)
+	if err != nil {
+		return err
+	}
+
+	st := balancer.NewStateTable()
+	ethPackets := balancer.NewEthPacketQueue("to_servers", packetQueueLen, balancer.OVERFLOW_DROP_NEWEST)
+	n, err := balancer.Replay(in, func(p gopacket.Packet) {
+		balancer.BalancePacket(p, ethPackets, st, services)
+		for p, ok := ethPackets.TryGet(); ok; p, ok = ethPackets.TryGet() {
+			sendPacket(sink, p)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"input":  input,
+		"output": output,
+		"in":     n,
+		"out":    sink.Written(),
+	}).Info("replayed capture")
+	return nil
+}
+
+// ifaceAddrs returns the IPv4 and hardware address of the given interface.
+func ifaceAddrs(name string) (net.IP, net.HardwareAddr, error) {
+	ip, err := balancer.GetAddrByName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ip, iface.HardwareAddr, nil
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Version = revision
 	app.Name = "balancer"
 	app.Usage = "Load-balancer application for for L3-DSR."
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "path to the JSON services config file (when set, the port, lbindex, mode, hash, key, encap, fou-port, recovery and backend-* flags are ignored)",
+		},
 		cli.StringFlag{
 			Name:  "iface",
 			Value: "eth1",
 			Usage: "interface to listen on",
 		},
+		cli.StringFlag{
+			Name:  "replay",
+			Usage: "pcap file to replay offline instead of listening on the interface (the packets sent are written to --output)",
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "pcap file to write the packets sent while replaying to (see --replay)",
+		},
 		cli.IntFlag{
 			Name:  "port",
 			Value: 80,
@@ -93,6 +356,86 @@ func main() {
 			Value: 1,
 			Usage: "load-balancer index (used for DSCP field)",
 		},
+		cli.StringFlag{
+			Name:  "mode",
+			Value: "splice",
+			Usage: "forwarding mode (splice: delayed binding through the packetbridge, l2dsr: route on the SYN and rewrite the MAC only, l4hash: stateless routing on the 4-tuple)",
+		},
+		cli.StringFlag{
+			Name:  "hash",
+			Value: "consistent",
+			Usage: "hashing algorithm (dummy, modulo, consistent)",
+		},
+		cli.StringFlag{
+			Name:  "key",
+			Value: "client-ip",
+			Usage: "routing key extractor (client-ip, flow, http-path, http-host)",
+		},
+		cli.StringFlag{
+			Name:  "encap",
+			Value: "none",
+			Usage: "encapsulation between balancer and packetbridge (none, ipip, gre, fou)",
+		},
+		cli.IntFlag{
+			Name:  "fou-port",
+			Value: 5555,
+			Usage: "UDP port of the packetbridge for foo-over-udp encapsulation",
+		},
+		cli.BoolFlag{
+			Name:  "recovery",
+			Usage: "encode the server in the ISN, so that connections can be recovered after state loss, only while the client has received less than 1 MiB (requires --recovery-key)",
+		},
+		cli.StringFlag{
+			Name:   "recovery-key",
+			Usage:  "secret key used to encode the server in the ISN, must be equal on all balancers",
+			EnvVar: "BALANCER_RECOVERY_KEY",
+		},
+		cli.DurationFlag{
+			Name:  "state-idle-timeout",
+			Value: 15 * time.Minute,
+			Usage: "time after which the state of an idle established connection is removed",
+		},
+		cli.DurationFlag{
+			Name:  "state-closing-timeout",
+			Value: time.Minute,
+			Usage: "time after which the state of an idle connection that is not established (handshake or closing) is removed",
+		},
+		cli.DurationFlag{
+			Name:  "state-expiry-interval",
+			Value: 10 * time.Second,
+			Usage: "interval to remove the expired connection states at",
+		},
+		cli.StringFlag{
+			Name:  "snapshot-file",
+			Usage: "file to save the state table to on shutdown and to restore it from on startup (disabled when empty)",
+		},
+		cli.DurationFlag{
+			Name:  "snapshot-interval",
+			Value: 0,
+			Usage: "interval to (also) save the state table snapshot at (0 = only on shutdown)",
+		},
+		cli.DurationFlag{
+			Name:  "snapshot-max-age",
+			Value: 15 * time.Minute,
+			Usage: "states of a snapshot saved longer ago (and handshakes idle for longer) are not restored (0 = no limit)",
+		},
+		cli.StringFlag{
+			Name:  "sync-bind",
+			Usage: "address to listen on for state sync messages of the peer balancers (e.g. :7946, disabled when empty)",
+		},
+		cli.StringFlag{
+			Name:  "sync-peers",
+			Usage: "comma separated list of peer balancers (host:port) or a multicast group (e.g. 239.1.1.1:7946, --sync-bind must then be the port of the group) to sync the state with",
+		},
+		cli.StringFlag{
+			Name:  "api-bind",
+			Usage: "ip:port to bind the flow migration API to (disabled when empty), an address other than a loopback address requires --api-token",
+		},
+		cli.StringFlag{
+			Name:   "api-token",
+			Usage:  "token required by the flow migration API (as bearer token) and sent to the APIs of the other balancers and packetbridges, must be equal on all of them",
+			EnvVar: "BALANCER_API_TOKEN",
+		},
 		cli.StringFlag{
 			Name:  "backend-ip",
 			Value: "192.168.33.20",
@@ -100,8 +443,82 @@ func main() {
 		},
 		cli.StringFlag{
 			Name:  "backend-mac",
-			Value: "08:00:27:33:d1:63",
-			Usage: "MAC address of backend server",
+			Usage: "MAC address of backend server (resolved using the kernel neighbor table when empty)",
+		},
+		cli.StringFlag{
+			Name:  "capture",
+			Value: "pcap",
+			Usage: "capture backend (pcap, afpacket), afpacket uses memory-mapped AF_PACKET rings without libpcap",
+		},
+		cli.IntFlag{
+			Name:  "afpacket-sockets",
+			Value: 1,
+			Usage: "number of AF_PACKET sockets in the fanout group, the kernel distributes the packets over the sockets by flow hash",
+		},
+		cli.IntFlag{
+			Name:  "afpacket-ring-size",
+			Value: 16,
+			Usage: "size of the AF_PACKET ring per socket in MiB",
+		},
+		cli.IntFlag{
+			Name:  "workers",
+			Value: runtime.NumCPU(),
+			Usage: "number of packet handling workers (connections are distributed over the workers by flow hash)",
+		},
+		cli.IntFlag{
+			Name:  "batch-size",
+			Value: 64,
+			Usage: "max number of packets dispatched to a worker at once",
+		},
+		cli.IntFlag{
+			Name:  "queue-size",
+			Value: 1024,
+			Usage: "max number of packets queued between the workers and the goroutine sending the packets",
+		},
+		cli.StringFlag{
+			Name:  "queue-policy",
+			Value: "prioritize-control",
+			Usage: "what to do with a packet when the queue is full (block, drop-newest, drop-oldest, prioritize-control), block stalls the capture, prioritize-control drops data packets to make room for SYN, FIN and RST packets",
+		},
+		cli.StringFlag{
+			Name:  "xdp",
+			Value: "off",
+			Usage: "offload established connections (without encapsulation) to an XDP program on the interface (off, native, generic), generic works with every driver (e.g. veth)",
+		},
+		cli.IntFlag{
+			Name:  "xdp-max-flows",
+			Value: 1 << 20,
+			Usage: "max number of connections offloaded to XDP (the least recently used are evicted)",
+		},
+		cli.DurationFlag{
+			Name:  "neighbor-ttl",
+			Value: time.Minute,
+			Usage: "time to cache resolved server MAC addresses",
+		},
+		cli.DurationFlag{
+			Name:  "neighbor-refresh-interval",
+			Value: 30 * time.Second,
+			Usage: "interval between refreshing the server MAC addresses",
+		},
+		cli.StringFlag{
+			Name:  "metrics-bind",
+			Value: ":9190",
+			Usage: "ip:port to bind the Prometheus /metrics endpoint to",
+		},
+		cli.StringFlag{
+			Name:  "log-level",
+			Value: "info",
+			Usage: "log level (debug, info, warning, error)",
+		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Value: "text",
+			Usage: "log format (text, json)",
+		},
+		cli.IntFlag{
+			Name:  "log-packet-rate",
+			Value: 100,
+			Usage: "max number of per-packet debug log lines per second (0 = unlimited)",
 		},
 	}
 	app.Action = run
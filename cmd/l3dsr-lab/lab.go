@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The addresses of the lab. As in the Vagrant environment, the VIP is
+// 192.168.33.10, the packetbridge 192.168.33.20 and the backend
+// 192.168.33.30. The VIP and the packetbridge IP are not configured on the
+// interfaces of the balancer and packetbridge, so that their kernels do not
+// answer the packets themselves (e.g. with a RST), the other hosts reach them
+// by a static neighbor entry.
+const (
+	vip            = "192.168.33.10"
+	packetbridgeIP = "192.168.33.20"
+	backendIP      = "192.168.33.30"
+	prefixLen      = 24
+
+	// tunName is the TUN device the packetbridge exchanges the packets of
+	// the backend connections on, the packets for the packetbridge IP
+	// are routed to it
+	tunName = "l3dsr0"
+)
+
+// node is a host of the lab, running in its own network namespace with an
+// eth1 interface connected to the switch.
+type node struct {
+	name string
+	ip   string
+	mac  string
+}
+
+var (
+	client       = node{name: "client", ip: "192.168.33.2", mac: "02:00:00:33:00:02"}
+	balancerNode = node{name: "balancer", ip: "192.168.33.11", mac: "02:00:00:33:00:0b"}
+	packetbridge = node{name: "packetbridge", ip: "192.168.33.21", mac: "02:00:00:33:00:15"}
+	backend      = node{name: "backend", ip: backendIP, mac: "02:00:00:33:00:1e"}
+
+	nodes = []node{client, balancerNode, packetbridge, backend}
+)
+
+// lab is a running lab, see newLab.
+type lab struct {
+	prefix string
+	dir    string
+	procs  []*process
+}
+
+// process is a process started in a namespace of the lab.
+type process struct {
+	name string
+	cmd  *exec.Cmd
+	log  string
+	done chan struct{}
+	err  error
+}
+
+// newLab creates the namespaces of the lab, with the given prefix. The
+// config and log files are written to a temporary directory.
+func newLab(prefix string) (*lab, error) {
+	dir, err := os.MkdirTemp("", prefix+"-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create lab directory: %s", err)
+	}
+	l := &lab{prefix: prefix, dir: dir}
+
+	// remove the namespaces of a lab that was not torn down
+	teardown(prefix)
+
+	if err := l.setup(); err != nil {
+		l.close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// netns returns the name of the namespace of the given node.
+func (l *lab) netns(name string) string {
+	return l.prefix + "-" + name
+}
+
+func (l *lab) setup() error {
+	// the switch is a bridge in its own namespace. It does not learn MAC
+	// addresses (like a hub), as the balancer forwards the client packets
+	// with the client MAC as source, so that the client MAC would be
+	// learned on the port of the balancer.
+	sw := l.netns("switch")
+	if err := ip("netns", "add", sw); err != nil {
+		return err
+	}
+	if err := ip("-n", sw, "link", "add", "br0", "type", "bridge", "ageing_time", "0"); err != nil {
+		return err
+	}
+	if err := ip("-n", sw, "link", "set", "br0", "up"); err != nil {
+		return err
+	}
+
+	for _, n := range nodes {
+		ns := l.netns(n.name)
+		for _, args := range [][]string{
+			{"netns", "add", ns},
+			{"link", "add", "name", "eth1", "netns", ns, "address", n.mac, "type", "veth", "peer", "name", n.name, "netns", sw},
+			{"-n", sw, "link", "set", n.name, "master", "br0", "up"},
+			{"-n", ns, "link", "set", "lo", "up"},
+			{"-n", ns, "addr", "add", fmt.Sprintf("%s/%d", n.ip, prefixLen), "dev", "eth1"},
+			{"-n", ns, "link", "set", "eth1", "up"},
+		} {
+			if err := ip(args...); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the VIP and packetbridge IP are not configured on an interface
+	for _, args := range [][]string{
+		{"-n", l.netns(client.name), "neigh", "add", vip, "lladdr", balancerNode.mac, "dev", "eth1"},
+		{"-n", l.netns(backend.name), "neigh", "add", packetbridgeIP, "lladdr", packetbridge.mac, "dev", "eth1"},
+	} {
+		if err := ip(args...); err != nil {
+			return err
+		}
+	}
+
+	// the packetbridge kernel forwards the packets of the backends to the
+	// TUN device and the packets written to it to the backends
+	pb := l.netns(packetbridge.name)
+	for _, setting := range []string{
+		"net.ipv4.ip_forward=1",
+		"net.ipv4.conf.all.rp_filter=0",
+		"net.ipv4.conf.default.rp_filter=0",
+		"net.ipv4.conf.eth1.rp_filter=0",
+		"net.ipv4.conf.all.send_redirects=0",
+		"net.ipv4.conf.eth1.send_redirects=0",
+	} {
+		if err := command("ip", "netns", "exec", pb, "sysctl", "-q", "-w", setting); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start starts the given command in the namespace of the given node, its
+// output is written to a log file in the lab directory.
+func (l *lab) start(n node, name string, args ...string) (*process, error) {
+	p := &process{
+		name: name,
+		log:  filepath.Join(l.dir, name+".log"),
+		done: make(chan struct{}),
+	}
+	f, err := os.Create(p.log)
+	if err != nil {
+		return nil, fmt.Errorf("could not create log file: %s", err)
+	}
+	defer f.Close()
+
+	p.cmd = exec.Command("ip", append([]string{"netns", "exec", l.netns(n.name)}, args...)...)
+	p.cmd.Stdout = f
+	p.cmd.Stderr = f
+	if err := p.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("could not start %s: %s", name, err)
+	}
+	go func() {
+		p.err = p.cmd.Wait()
+		close(p.done)
+	}()
+	l.procs = append(l.procs, p)
+
+	log.WithFields(log.Fields{
+		"netns": l.netns(n.name),
+		"pid":   p.cmd.Process.Pid,
+		"log":   p.log,
+	}).Infof("started %s", name)
+	return p, nil
+}
+
+// exited returns an error when one of the processes has exited.
+func (l *lab) exited() error {
+	for _, p := range l.procs {
+		select {
+		case <-p.done:
+			return fmt.Errorf("%s exited: %v", p.name, p.err)
+		default:
+		}
+	}
+	return nil
+}
+
+// waitForLink waits until the given link exists in the namespace of the
+// given node, e.g. the TUN device created by the packetbridge.
+func (l *lab) waitForLink(n node, name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := ip("-n", l.netns(n.name), "link", "show", name); err == nil {
+			return nil
+		} else if time.Now().After(deadline) {
+			return err
+		}
+		if err := l.exited(); err != nil {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// printLogs writes the logs of the processes to stderr.
+func (l *lab) printLogs() {
+	for _, p := range l.procs {
+		b, err := os.ReadFile(p.log)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "==> %s <==\n%s\n", p.name, b)
+	}
+}
+
+// close stops the processes, removes the namespaces and the lab directory.
+func (l *lab) close() {
+	for _, p := range l.procs {
+		p.cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-p.done:
+		case <-time.After(5 * time.Second):
+			p.cmd.Process.Kill()
+			<-p.done
+		}
+	}
+	teardown(l.prefix)
+	os.RemoveAll(l.dir)
+	log.Info("lab torn down")
+}
+
+// teardown removes the namespaces with the given prefix, with their
+// interfaces.
+func teardown(prefix string) {
+	for _, name := range append([]string{"switch"}, nodeNames()...) {
+		ns := prefix + "-" + name
+		if _, err := os.Stat(filepath.Join("/var/run/netns", ns)); err == nil {
+			if err := ip("netns", "del", ns); err != nil {
+				log.Errorf("could not remove namespace: %s", err)
+			}
+		}
+	}
+}
+
+func nodeNames() []string {
+	var names []string
+	for _, n := range nodes {
+		names = append(names, n.name)
+	}
+	return names
+}
+
+// ip runs the ip command with the given arguments.
+func ip(args ...string) error {
+	return command("ip", args...)
+}
+
+// command runs the given command, the error contains its output.
+func command(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %s (%s)", name, strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/codegangsta/cli"
+	log "github.com/sirupsen/logrus"
+)
+
+var revision string // set by the compiler
+
+// body is the response body of the backend.
+const body = "hello from the backend\n"
+
+func run(c *cli.Context) {
+	if err := setupLogging(c); err != nil {
+		log.Fatalf("Could not setup logging: %s", err)
+	}
+
+	binDir, err := filepath.Abs(c.String("bin-dir"))
+	if err != nil {
+		log.Fatalf("Could not get bin directory: %s", err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Could not get executable: %s", err)
+	}
+
+	l, err := newLab(c.String("prefix"))
+	if err != nil {
+		log.Fatalf("Could not setup lab: %s", err)
+	}
+	log.WithField("prefix", l.prefix).Info("lab created")
+
+	err = startLab(c, l, binDir, self)
+	if err == nil {
+		err = check(l, self, c.Int("requests"), c.Duration("timeout"))
+	}
+	if err != nil {
+		log.Errorf("lab failed: %s", err)
+		l.printLogs()
+	}
+
+	if c.Bool("keep") && err == nil {
+		log.WithField("prefix", l.prefix).Info("lab is running, press ctrl+c to tear it down")
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		<-sigChan
+	}
+	l.close()
+
+	if err != nil {
+		os.Exit(1)
+	}
+	log.Info("all checks passed")
+}
+
+// startLab starts the balancer, packetbridge and backend in their namespaces.
+func startLab(c *cli.Context, l *lab, binDir, self string) error {
+	confPath := filepath.Join(l.dir, "balancer.json")
+	if err := writeBalancerConfig(confPath); err != nil {
+		return err
+	}
+
+	logArgs := []string{"--log-level", c.String("log-level")}
+	if _, err := l.start(balancerNode, "balancer", append([]string{
+		filepath.Join(binDir, "balancer"),
+		"--config", confPath,
+		"--iface", "eth1",
+		"--capture", c.String("capture"),
+	}, logArgs...)...); err != nil {
+		return err
+	}
+
+	if _, err := l.start(packetbridge, "packetbridge", append([]string{
+		filepath.Join(binDir, "packetbridge"),
+		"--packetbridge-iface", "eth1",
+		"--packetbridge-ip", packetbridgeIP,
+		"--backends", backendIP,
+		"--listeners", "80",
+		"--balancers", "1:" + vip,
+		"--backend-io", "tun",
+		"--tun-name", tunName,
+		"--capture", c.String("capture"),
+	}, logArgs...)...); err != nil {
+		return err
+	}
+	if err := l.waitForLink(packetbridge, tunName, 10*time.Second); err != nil {
+		return fmt.Errorf("could not get TUN device: %s", err)
+	}
+	// the replies of the backend are routed to the TUN device
+	pb := l.netns(packetbridge.name)
+	if err := ip("-n", pb, "link", "set", tunName, "up"); err != nil {
+		return err
+	}
+	if err := ip("-n", pb, "route", "add", packetbridgeIP+"/32", "dev", tunName); err != nil {
+		return err
+	}
+
+	if _, err := l.start(backend, "backend", self, "serve", "--bind", backendIP+":80"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// writeBalancerConfig writes the services config of the balancer, with the
+// packetbridge as server.
+func writeBalancerConfig(path string) error {
+	b, err := json.MarshalIndent(map[string]interface{}{
+		"services": []map[string]interface{}{
+			{
+				"vip":     vip,
+				"port":    80,
+				"lbindex": 1,
+				"mode":    "splice",
+				"servers": []map[string]string{
+					{"ip": packetbridgeIP, "mac": packetbridge.mac},
+				},
+			},
+		},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("could not write balancer config: %s", err)
+	}
+	return nil
+}
+
+// check makes the given number of requests from the client namespace to the
+// VIP, retrying until the processes are ready or the timeout expires.
+func check(l *lab, self string, requests int, timeout time.Duration) error {
+	out, err := runIn(l, client, self, "get",
+		"--url", "http://"+vip+"/",
+		"--requests", fmt.Sprint(requests),
+		"--timeout", timeout.String(),
+	)
+	if err != nil {
+		return fmt.Errorf("requests failed: %s\n%s", err, out)
+	}
+	log.WithField("requests", requests).Info("requests through the VIP succeeded")
+	if err := l.exited(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// runIn runs the given command in the namespace of the given node and
+// returns its output.
+func runIn(l *lab, n node, args ...string) (string, error) {
+	p, err := l.start(n, args[1], args...)
+	if err != nil {
+		return "", err
+	}
+	// the process is done, it is not stopped on close
+	l.procs = l.procs[:len(l.procs)-1]
+	<-p.done
+	b, _ := os.ReadFile(p.log)
+	return string(b), p.err
+}
+
+// serve runs the HTTP server of the backend.
+func serve(c *cli.Context) {
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		log.WithFields(log.Fields{
+			"remote": r.RemoteAddr,
+			"path":   r.URL.Path,
+		}).Info("request received")
+		io.WriteString(w, body)
+	})
+	log.WithField("bind", c.String("bind")).Info("serving HTTP")
+	log.Fatal(http.ListenAndServe(c.String("bind"), nil))
+}
+
+// get makes the requests of the client. The first request is retried until
+// the timeout, as the balancer and packetbridge might still be starting.
+func get(c *cli.Context) {
+	client := &http.Client{Timeout: 2 * time.Second}
+	deadline := time.Now().Add(c.Duration("timeout"))
+
+	for i := 0; i < c.Int("requests"); i++ {
+		for {
+			err := getOnce(client, c.String("url"))
+			if err == nil {
+				break
+			}
+			if i > 0 || time.Now().After(deadline) {
+				log.Fatalf("Request %d failed: %s", i+1, err)
+			}
+			log.Warningf("request failed, retrying: %s", err)
+			time.Sleep(500 * time.Millisecond)
+		}
+		log.WithField("request", i+1).Info("request succeeded")
+	}
+}
+
+func getOnce(client *http.Client, url string) error {
+	// a new connection for every request, to exercise the handshake
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Close = true
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || string(b) != body {
+		return fmt.Errorf("unexpected response: %s %q", resp.Status, b)
+	}
+	return nil
+}
+
+// down removes the namespaces of a lab that was kept running.
+func down(c *cli.Context) {
+	teardown(c.GlobalString("prefix"))
+}
+
+func setupLogging(c *cli.Context) error {
+	level, err := log.ParseLevel(c.String("log-level"))
+	if err != nil {
+		return err
+	}
+	log.SetLevel(level)
+	return nil
+}
+
+func main() {
+	app := cli.NewApp()
+	app.Version = revision
+	app.Name = "l3dsr-lab"
+	app.Usage = "Runs the client, balancer, packetbridge and backend in network namespaces (requires root)."
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "bin-dir",
+			Value: "bin",
+			Usage: "directory with the balancer and packetbridge binaries (see make)",
+		},
+		cli.StringFlag{
+			Name:  "prefix",
+			Value: "l3dsr",
+			Usage: "prefix of the network namespaces",
+		},
+		cli.IntFlag{
+			Name:  "requests",
+			Value: 10,
+			Usage: "number of HTTP requests to make through the VIP",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Value: 15 * time.Second,
+			Usage: "time to wait for the first request to succeed",
+		},
+		cli.StringFlag{
+			Name:  "capture",
+			Value: "afpacket",
+			Usage: "capture backend of the balancer and packetbridge (pcap, afpacket)",
+		},
+		cli.BoolFlag{
+			Name:  "keep",
+			Usage: "keep the lab running after the checks until interrupted (e.g. to make requests with ip netns exec l3dsr-client curl)",
+		},
+		cli.StringFlag{
+			Name:  "log-level",
+			Value: "info",
+			Usage: "log level (debug, info, warning, error), also used for the balancer and packetbridge",
+		},
+	}
+	app.Action = run
+	app.Commands = []cli.Command{
+		{
+			Name:   "down",
+			Usage:  "remove the network namespaces of the lab (e.g. after it was killed)",
+			Action: down,
+		},
+		{
+			Name:   "serve",
+			Usage:  "run the backend HTTP server (started in the backend namespace)",
+			Hidden: true,
+			Action: serve,
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "bind", Value: ":80"},
+			},
+		},
+		{
+			Name:   "get",
+			Usage:  "make the client requests (started in the client namespace)",
+			Hidden: true,
+			Action: get,
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "url"},
+				cli.IntFlag{Name: "requests", Value: 1},
+				cli.DurationFlag{Name: "timeout", Value: 15 * time.Second},
+			},
+		},
+	}
+	app.Run(os.Args)
+}
@@ -1,84 +1,241 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"os"
+	"os/signal"
+	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	balancer "github.com/brocaar/l3dsr-hash-balancer"
 	"github.com/codegangsta/cli"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
 )
 
 var revision string // set by the compiler
 
+// packetQueueLen is the size of the queues between the handlers and the
+// goroutines sending the packets while replaying a capture (see --queue-size
+// otherwise).
+const packetQueueLen = 1024
+
 func run(c *cli.Context) {
+	if err := balancer.SetupLogging(c.String("log-level"), c.String("log-format"), c.Int("log-packet-rate")); err != nil {
+		log.Fatalf("Could not setup logging: %s", err)
+	}
+
 	balancers, err := parseBalancers(c.String("balancers"))
 	if err != nil {
 		log.Fatalf("Could not parse the balancers: %s", err)
 	}
 
-	pbIP, err := balancer.GetAddrByName(c.String("packetbridge-iface"))
+	portMap, err := parseListeners(c.String("listeners"))
 	if err != nil {
+		log.Fatalf("Could not parse the listeners: %s", err)
+	}
+
+	// a capture can be replayed on an other host, without the interface
+	// when --packetbridge-ip is set
+	replaying := c.String("replay") != ""
+	pbIP, err := balancer.GetAddrByName(c.String("packetbridge-iface"))
+	if err != nil && !(replaying && c.String("packetbridge-ip") != "") {
 		log.Fatalf("Could not get interface IP: %s", err)
 	}
+	if c.String("packetbridge-ip") != "" {
+		// e.g. a floating IP that is moved to the standby on failover
+		if pbIP = net.ParseIP(c.String("packetbridge-ip")).To4(); pbIP == nil {
+			log.Fatalf("Invalid packetbridge IP: %s", c.String("packetbridge-ip"))
+		}
+	}
+
+	// the source IP of the connections with the backends, packetbridges
+	// that migrate flows between each other must use the same IP
+	backendSourceIP := pbIP
+	if c.String("backend-source-ip") != "" {
+		if backendSourceIP = net.ParseIP(c.String("backend-source-ip")).To4(); backendSourceIP == nil {
+			log.Fatalf("Invalid backend source IP: %s", c.String("backend-source-ip"))
+		}
+	}
 
 	pbIface, err := net.InterfaceByName(c.String("packetbridge-iface"))
 	if err != nil {
-		log.Fatalf("Could not get interface: %s", err)
+		if !replaying {
+			log.Fatalf("Could not get interface: %s", err)
+		}
+		log.Warningf("could not get interface, replaying with the zero MAC address: %s", err)
+		pbIface = &net.Interface{Name: c.String("packetbridge-iface"), HardwareAddr: make(net.HardwareAddr, 6)}
 	}
 
-	backendIP, err := balancer.GetAddrByName(c.String("backend-iface"))
+	pool, err := balancer.NewPool(c.String("backend-hash"))
 	if err != nil {
-		log.Fatalf("Could not get interface IP: %s", err)
+		log.Fatalf("Could not setup backend pool: %s", err)
+	}
+	if c.String("backends") != "" {
+		backends, err := parseBackends(c.String("backends"))
+		if err != nil {
+			log.Fatalf("Could not parse the backends: %s", err)
+		}
+		for _, ip := range backends {
+			pool.AddServer(&balancer.Server{IP: ip})
+		}
+	} else {
+		backendIP, err := balancer.GetAddrByName(c.String("backend-iface"))
+		if err != nil {
+			log.Fatalf("Could not get interface IP: %s", err)
+		}
+		pool.AddServer(&balancer.Server{IP: backendIP})
+	}
+
+	if replaying {
+		if err := replay(c.String("replay"), c.String("output"), pbIP, backendSourceIP, pbIface, pool, portMap, balancers, layers.UDPPort(c.Int("fou-port"))); err != nil {
+			log.Fatalf("Could not replay capture: %s", err)
+		}
+		return
+	}
+
+	if c.Int("health-check-port") != 0 {
+		hc := &balancer.HealthChecker{
+			Pool:     pool,
+			Port:     c.Int("health-check-port"),
+			Interval: c.Duration("health-check-interval"),
+			Timeout:  c.Duration("health-check-interval") / 2,
+		}
+		go hc.Run()
 	}
 
 	stateTable := balancer.NewPacketBridgeStateTable()
+	prometheus.MustRegister(balancer.NewStateTableCollector(nil, stateTable))
+
+	if path := c.String("snapshot-file"); path != "" {
+		n, err := stateTable.LoadSnapshot(path, pool, c.Duration("snapshot-max-age"))
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("could not load snapshot: %s", err)
+		} else if err == nil {
+			log.WithFields(log.Fields{
+				"file":   path,
+				"states": n,
+			}).Info("loaded state snapshot")
+		}
+		go saveSnapshots(stateTable, path, c.Duration("snapshot-interval"))
+	}
+
+	go stateTable.RunExpiry(c.Duration("state-expiry-interval"), c.Duration("state-idle-timeout"), c.Duration("state-closing-timeout"))
+
+	if c.String("sync-bind") != "" {
+		var peers []string
+		if c.String("sync-peers") != "" {
+			peers = strings.Split(c.String("sync-peers"), ",")
+		}
+		stateSync, err := balancer.NewPacketBridgeStateSync(c.String("sync-bind"), peers, stateTable, pool)
+		if err != nil {
+			log.Fatalf("Could not setup state sync: %s", err)
+		}
+		go stateSync.Run()
+	}
+	if c.String("api-bind") != "" {
+		api := balancer.NewPacketBridgeAPI(stateTable, pool, pbIP, backendSourceIP, c.String("api-token"))
+		go func() {
+			log.Fatal(balancer.ServeAPI(c.String("api-bind"), c.String("api-token"), api))
+		}()
+	}
+	go func() {
+		log.Fatal(balancer.ServeMetrics(c.String("metrics-bind")))
+	}()
 
-	// setup PCAP handle for receiving IP packets from the client.
+	// setup the capture handle for receiving IP packets from the client.
 	// IP level is needed since we need to have access to the DSCP / ToS
 	// field.
-	ih, err := pcap.NewInactiveHandle(c.String("packetbridge-iface"))
+	bpfFilter := fmt.Sprintf("(%s) or (%s)", portMap.BPFFilter(pbIP), balancer.EncapBPFFilter(pbIP, layers.UDPPort(c.Int("fou-port"))))
+	log.WithField("filter", bpfFilter).Info("setting BPF filter")
+	handle, err := openCapture(c, c.String("packetbridge-iface"), bpfFilter, false)
 	if err != nil {
-		log.Fatalf("Could not bind to interface %s: %s", c.String("packetbridge-iface"), err)
+		log.Fatalf("Could not setup capture: %s", err)
 	}
-	defer ih.CleanUp()
-	ih.SetImmediateMode(true)
-	handle, err := ih.Activate()
+	defer handle.Close()
+
+	// setup the datapath with the backends
+	backendHandle, err := openBackendIO(c, backendSourceIP)
 	if err != nil {
-		log.Fatalf("Could not activate handle: %s", err)
+		log.Fatalf("Could not setup backend datapath: %s", err)
 	}
-	defer handle.Close()
+	defer backendHandle.Close()
 
-	bpfFilter := fmt.Sprintf("tcp and dst port %d and dst host %s", c.Int("packetbridge-port"), pbIP.String())
-	log.Println(bpfFilter)
-	if err = handle.SetBPFFilter(bpfFilter); err != nil {
-		log.Fatalf("Could not set BPF filter: %s", err)
+	queuePolicy, err := balancer.ParseOverflowPolicy(c.String("queue-policy"))
+	if err != nil {
+		log.Fatalf("Could not parse the queue policy: %s", err)
 	}
+	backendTCPPackets := balancer.NewTCPPacketQueue("to_backends", c.Int("queue-size"), queuePolicy)
+	clientEthPackets := balancer.NewEthPacketQueue("to_clients", c.Int("queue-size"), queuePolicy)
 
-	ps := gopacket.NewPacketSource(handle, handle.LinkType())
+	for _, backend := range pool.Servers() {
+		log.WithFields(log.Fields{
+			"packetbridge": backendSourceIP,
+			"backend":      backend.IP,
+		}).Info("starting proxy")
+	}
 
-	// setup TCP connection
-	tcpConn, err := net.ListenPacket("ip4:tcp", pbIP.String())
+	go balancer.SendToBackend(backendHandle, backendTCPPackets, backendSourceIP)
+	go balancer.HandleBackendPackets(backendHandle, pool, portMap, pbIface, backendTCPPackets, clientEthPackets, stateTable)
+	var routes *balancer.RouteCache
+	if c.String("return-mode") == "routed" {
+		if routes, err = balancer.NewRouteCache(); err != nil {
+			log.Fatalf("Could not setup return path: %s", err)
+		}
+		go routes.RunRefresh(c.Duration("route-refresh-interval"))
+	}
+	returnPath, err := balancer.NewReturnPath(c.String("return-mode"), handle, routes, balancer.NewNeighborCache(c.Duration("neighbor-ttl")))
 	if err != nil {
-		log.Fatalf("Could not open IPv4:TCP connection: %s", err)
+		log.Fatalf("Could not setup return path: %s", err)
+	}
+
+	go balancer.SendToClient(returnPath, clientEthPackets)
+	fouPort := layers.UDPPort(c.Int("fou-port"))
+	balancer.RunWorkers(handle.Packets(), c.Int("workers"), c.Int("batch-size"), func(p gopacket.Packet) {
+		balancer.HandleBalancerPacket(p, backendTCPPackets, stateTable, portMap, pool, balancers, fouPort)
+	})
+}
+
+// saveSnapshots saves a snapshot of the state table at the given interval
+// (when not 0) and when the process is terminated.
+func saveSnapshots(stateTable *balancer.PacketBridgeStateTable, path string, interval time.Duration) {
+	save := func() {
+		if err := stateTable.SaveSnapshot(path); err != nil {
+			log.Errorf("could not save snapshot: %s", err)
+		}
 	}
 
-	backendTCPPackets := make(chan *balancer.TCPPacket)
-	clientEthPackets := make(chan *balancer.EthPacket)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	log.Printf("Starting proxy %s -> %s", pbIP, backendIP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
 
-	go balancer.SendToBackend(tcpConn, backendTCPPackets, pbIP, backendIP)
-	go balancer.HandleBackendPackets(tcpConn, pbIP, backendIP, layers.TCPPort(c.Int("packetbridge-port")), pbIface, backendTCPPackets, clientEthPackets, stateTable, balancers)
-	go balancer.SendToClient(handle, clientEthPackets)
-	balancer.HandleBalancerPackets(ps.Packets(), backendTCPPackets, stateTable)
+	for {
+		select {
+		case <-tick:
+			save()
+		case sig := <-sigChan:
+			save()
+			log.WithFields(log.Fields{
+				"signal": sig,
+				"file":   path,
+			}).Info("saved state snapshot, exiting")
+			os.Exit(0)
+		}
+	}
 }
 
 func main() {
@@ -92,26 +249,319 @@ func main() {
 			Value: "eth1",
 			Usage: "interface to listen on",
 		},
-		cli.IntFlag{
-			Name:  "packetbridge-port",
-			Value: 80,
-			Usage: "port number to forward packages for",
+		cli.StringFlag{
+			Name:  "replay",
+			Usage: "pcap file to replay offline instead of listening on the interfaces (the packets sent are written to --output)",
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "pcap file to write the packets sent while replaying to (see --replay)",
+		},
+		cli.StringFlag{
+			Name:  "packetbridge-ip",
+			Usage: "IP to use instead of the IP of the packetbridge interface, e.g. a floating IP shared with a standby packetbridge",
+		},
+		cli.StringFlag{
+			Name:  "sync-bind",
+			Usage: "address to listen on for state sync messages of the peer packetbridge (e.g. :7947, disabled when empty)",
+		},
+		cli.StringFlag{
+			Name:  "sync-peers",
+			Usage: "comma separated list of peer packetbridges (host:port) or a multicast group (--sync-bind must then be the port of the group) to sync the state with",
+		},
+		cli.StringFlag{
+			Name:  "backend-source-ip",
+			Usage: "source IP of the connections with the backends (defaults to the packetbridge IP), must be shared by packetbridges that migrate flows",
+		},
+		cli.StringFlag{
+			Name:  "api-bind",
+			Usage: "ip:port to bind the flow migration API to (disabled when empty), an address other than a loopback address requires --api-token",
+		},
+		cli.StringFlag{
+			Name:   "api-token",
+			Usage:  "token required by the flow migration API (as bearer token) and sent to the APIs of the other balancers and packetbridges, must be equal on all of them",
+			EnvVar: "PACKETBRIDGE_API_TOKEN",
+		},
+		cli.StringFlag{
+			Name:  "snapshot-file",
+			Usage: "file to save the state table to on shutdown and to restore it from on startup (disabled when empty)",
+		},
+		cli.DurationFlag{
+			Name:  "state-idle-timeout",
+			Value: 15 * time.Minute,
+			Usage: "time after which the state of an idle established connection is removed (and its random port freed)",
+		},
+		cli.DurationFlag{
+			Name:  "state-closing-timeout",
+			Value: time.Minute,
+			Usage: "time after which the state of an idle connection that is not established (handshake, closing or migrated) is removed",
+		},
+		cli.DurationFlag{
+			Name:  "state-expiry-interval",
+			Value: 10 * time.Second,
+			Usage: "interval to remove the expired connection states at",
+		},
+		cli.DurationFlag{
+			Name:  "snapshot-interval",
+			Value: 0,
+			Usage: "interval to (also) save the state table snapshot at (0 = only on shutdown)",
+		},
+		cli.DurationFlag{
+			Name:  "snapshot-max-age",
+			Value: 15 * time.Minute,
+			Usage: "states of a snapshot saved longer ago (and handshakes idle for longer) are not restored (0 = no limit)",
+		},
+		cli.StringFlag{
+			Name:  "listeners",
+			Value: "80",
+			Usage: "comma separated list of ports to forward packets for in the format port[:backendport] (e.g. 80:8080,443:8443)",
 		},
 		cli.StringFlag{
 			Name:  "backend-iface",
 			Value: "eth2",
-			Usage: "interface to forward traffic to",
+			Usage: "interface to forward traffic to (its IP is used as backend when --backends is not set)",
+		},
+		cli.StringFlag{
+			Name:  "backends",
+			Usage: "comma separated list of backend IPs",
+		},
+		cli.StringFlag{
+			Name:  "backend-hash",
+			Value: "consistent",
+			Usage: "hashing algorithm for selecting the backend (dummy, modulo, consistent)",
+		},
+		cli.IntFlag{
+			Name:  "fou-port",
+			Value: 5555,
+			Usage: "UDP port to receive foo-over-udp encapsulated packets on",
+		},
+		cli.StringFlag{
+			Name:  "return-mode",
+			Value: "l2",
+			Usage: "how to send packets to the client (l2, routed, raw), use routed or raw when the client is not on the same L2 segment",
+		},
+		cli.StringFlag{
+			Name:  "capture",
+			Value: "pcap",
+			Usage: "capture backend (pcap, afpacket), afpacket uses memory-mapped AF_PACKET rings without libpcap",
+		},
+		cli.IntFlag{
+			Name:  "afpacket-sockets",
+			Value: 1,
+			Usage: "number of AF_PACKET sockets in the fanout group, the kernel distributes the packets over the sockets by flow hash",
+		},
+		cli.IntFlag{
+			Name:  "afpacket-ring-size",
+			Value: 16,
+			Usage: "size of the AF_PACKET ring per socket in MiB",
+		},
+		cli.StringFlag{
+			Name:  "backend-io",
+			Value: "raw",
+			Usage: "datapath to the backends (raw, tun), tun sends and receives the packets on a TUN device that must be configured and routed to",
+		},
+		cli.StringFlag{
+			Name:  "tun-name",
+			Value: "l3dsr0",
+			Usage: "name of the TUN device (tun backend datapath)",
+		},
+		cli.IntFlag{
+			Name:  "workers",
+			Value: runtime.NumCPU(),
+			Usage: "number of packet handling workers (connections are distributed over the workers by flow hash)",
+		},
+		cli.IntFlag{
+			Name:  "batch-size",
+			Value: 64,
+			Usage: "max number of packets dispatched to a worker at once",
+		},
+		cli.IntFlag{
+			Name:  "queue-size",
+			Value: 1024,
+			Usage: "max number of packets queued for the backends and for the clients",
+		},
+		cli.StringFlag{
+			Name:  "queue-policy",
+			Value: "prioritize-control",
+			Usage: "what to do with a packet when a queue is full (block, drop-newest, drop-oldest, prioritize-control), block stalls the capture, prioritize-control drops data packets to make room for SYN, FIN and RST packets",
+		},
+		cli.DurationFlag{
+			Name:  "neighbor-ttl",
+			Value: time.Minute,
+			Usage: "time to cache resolved next hop MAC addresses (routed return mode)",
+		},
+		cli.DurationFlag{
+			Name:  "route-refresh-interval",
+			Value: 10 * time.Second,
+			Usage: "interval to re-read the kernel routing table (routed return mode)",
+		},
+		cli.IntFlag{
+			Name:  "health-check-port",
+			Value: 0,
+			Usage: "port to health check the backends on (0 = disabled)",
+		},
+		cli.DurationFlag{
+			Name:  "health-check-interval",
+			Value: 5 * time.Second,
+			Usage: "interval between backend health checks",
 		},
 		cli.StringFlag{
 			Name:  "balancers",
 			Value: "1:192.168.33.10",
-			Usage: "comma separated list of balancers in the format index:ip",
+			Usage: "comma separated list of services in the format lbindex:vip (used for packets that are not encapsulated)",
+		},
+		cli.StringFlag{
+			Name:  "metrics-bind",
+			Value: ":9191",
+			Usage: "ip:port to bind the Prometheus /metrics endpoint to",
+		},
+		cli.StringFlag{
+			Name:  "log-level",
+			Value: "info",
+			Usage: "log level (debug, info, warning, error)",
+		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Value: "text",
+			Usage: "log format (text, json)",
+		},
+		cli.IntFlag{
+			Name:  "log-packet-rate",
+			Value: 100,
+			Usage: "max number of per-packet debug log lines per second (0 = unlimited)",
 		},
 	}
 	app.Action = run
 	app.Run(os.Args)
 }
 
+// openCapture opens the capture handle for the given interface using the
+// backend selected by --capture. The handle is also used to send packets on
+// the same interface.
+func openCapture(c *cli.Context, iface, bpfFilter string, ignoreOutgoing bool) (balancer.PacketHandle, error) {
+	switch c.String("capture") {
+	case "pcap":
+		handle, err := balancer.NewPcapHandle(iface, ignoreOutgoing)
+		if err != nil {
+			return nil, err
+		}
+		if err := handle.SetBPFFilter(bpfFilter); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("could not set BPF filter: %s", err)
+		}
+		return handle, nil
+	case "afpacket":
+		conf := balancer.DefaultAFPacketConfig()
+		conf.Sockets = c.Int("afpacket-sockets")
+		conf.Blocks = c.Int("afpacket-ring-size")
+		conf.IgnoreOutgoing = ignoreOutgoing
+		handle, err := balancer.NewAFPacketHandle(iface, conf)
+		if err != nil {
+			return nil, err
+		}
+		if err := handle.SetBPFFilter(bpfFilter); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("could not set BPF filter: %s", err)
+		}
+		return handle, nil
+	default:
+		return nil, fmt.Errorf("unknown capture backend: %s", c.String("capture"))
+	}
+}
+
+// replay feeds the packets of the input capture through the packetbridge,
+// one at a time with the time of their capture, and writes the packets it
+// sends to the output capture. The packets from the backends in the pool are
+// handled as received on the backend datapath, the other packets sent to
+// the packetbridge IP as received from the balancers. The packets for the
+// backends are written in Ethernet frames with zero MAC addresses.
+func replay(input, output string, pbIP, backendSourceIP net.IP, pbIface *net.Interface, pool balancer.PoolBalancer, portMap balancer.PortMap, balancers map[uint8]net.IP, fouPort layers.UDPPort) error {
+	if output == "" {
+		return errors.New("--output is required")
+	}
+
+	in, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+	sink, err := balancer.NewPcapFileSink(w)
+	if err != nil {
+		return err
+	}
+	backendSink := sink.IPv4()
+	returnPath, err := balancer.NewReturnPath("l2", sink, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	stateTable := balancer.NewPacketBridgeStateTable()
+	backendTCPPackets := balancer.NewTCPPacketQueue("to_backends", packetQueueLen, balancer.OVERFLOW_DROP_NEWEST)
+	clientEthPackets := balancer.NewEthPacketQueue("to_clients", packetQueueLen, balancer.OVERFLOW_DROP_NEWEST)
+
+	n, err := balancer.Replay(in, func(p gopacket.Packet) {
+		ip, _ := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if ip == nil {
+			return
+		}
+		if _, ok := balancer.GetServerByIP(pool, ip.SrcIP); ok && ip.DstIP.Equal(backendSourceIP) {
+			ipPacket := gopacket.NewPacket(p.LinkLayer().LayerPayload(), layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+			balancer.HandleBackendPacket(ipPacket, pool, portMap, pbIface, backendTCPPackets, clientEthPackets, stateTable)
+		} else if ip.DstIP.Equal(pbIP) {
+			balancer.HandleBalancerPacket(p, backendTCPPackets, stateTable, portMap, pool, balancers, fouPort)
+		}
+
+		for p, ok := backendTCPPackets.TryGet(); ok; p, ok = backendTCPPackets.TryGet() {
+			balancer.SendPacketToBackend(backendSink, p, backendSourceIP)
+		}
+		for p, ok := clientEthPackets.TryGet(); ok; p, ok = clientEthPackets.TryGet() {
+			balancer.SendPacketToClient(returnPath, p)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"input":  input,
+		"output": output,
+		"in":     n,
+		"out":    sink.Written(),
+	}).Info("replayed capture")
+	return nil
+}
+
+// openBackendIO opens the handle for sending and receiving the IPv4 packets
+// of the connections with the backends, selected by --backend-io.
+func openBackendIO(c *cli.Context, srcIP net.IP) (balancer.PacketHandle, error) {
+	switch c.String("backend-io") {
+	case "raw":
+		s, err := balancer.NewRawSocket(srcIP)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "tun":
+		tun, err := balancer.NewTUN(c.String("tun-name"))
+		if err != nil {
+			return nil, err
+		}
+		log.WithField("iface", tun.Name()).Info("opened TUN device")
+		return tun, nil
+	default:
+		return nil, fmt.Errorf("unknown backend datapath: %s", c.String("backend-io"))
+	}
+}
+
 // parseBalancers parses a string in the format "1:192.168.1.10,2:192.168.1.50"
 // into a map.
 func parseBalancers(s string) (map[uint8]net.IP, error) {
@@ -134,3 +584,49 @@ func parseBalancers(s string) (map[uint8]net.IP, error) {
 
 	return out, nil
 }
+
+// parseBackends parses a string in the format "192.168.1.10,192.168.1.11"
+// into a slice of IPs.
+func parseBackends(s string) ([]net.IP, error) {
+	var out []net.IP
+
+	for _, backend := range strings.Split(s, ",") {
+		ip := net.ParseIP(backend)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("Invalid backend IPv4 address: %s", backend)
+		}
+		out = append(out, ip.To4())
+	}
+
+	return out, nil
+}
+
+// parseListeners parses a string in the format "80:8080,443:8443" into a
+// PortMap. When the backend port is omitted, it is equal to the listener
+// port.
+func parseListeners(s string) (balancer.PortMap, error) {
+	out := make(balancer.PortMap)
+
+	listeners := strings.Split(s, ",")
+	for _, listener := range listeners {
+		parts := strings.Split(listener, ":")
+		if len(parts) > 2 {
+			return nil, errors.New("Could not parse the listener, it should be in the format PORT[:BACKENDPORT]")
+		}
+
+		port, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		backendPort := port
+		if len(parts) == 2 {
+			if backendPort, err = strconv.ParseUint(parts[1], 10, 16); err != nil {
+				return nil, err
+			}
+		}
+
+		out[layers.TCPPort(port)] = layers.TCPPort(backendPort)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,279 @@
+package balancer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+)
+
+// packetDecoder decodes packets into reused layers using a
+// DecodingLayerParser, so that decoding a packet does not allocate. The
+// decoded layers reference the decoded data, they are valid until the decoder
+// is released (see EthPacket.Release and TCPPacket.Release when the layers
+// are sent on).
+type packetDecoder struct {
+	eth   layers.Ethernet
+	outer layers.IPv4
+	ip    layers.IPv4
+	tcp   layers.TCP
+	udp   layers.UDP
+	gre   layers.GRE
+
+	parser  *gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+
+	// the addresses and payload of the decoded TCP segment, used for the
+	// incremental update of its checksum (see tcpChecksum)
+	srcIP, dstIP [4]byte
+	payload      []byte
+	checksumBase bool
+
+	// the checksum of the received packet has not been computed yet (see
+	// checksumNotReady), it can not be validated or updated incrementally
+	checksumNotReady bool
+
+	// the packets sent on with the decoded layers
+	ethPacket EthPacket
+	tcpPacket TCPPacket
+}
+
+var decoderPool = sync.Pool{
+	New: func() interface{} {
+		d := &packetDecoder{
+			decoded: make([]gopacket.LayerType, 0, 8),
+		}
+		d.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &d.eth, &d.ip, &d.tcp, &d.udp, &d.gre)
+		d.parser.IgnoreUnsupported = true
+		return d
+	},
+}
+
+// checksumNotReady is added to the AncillaryData of the capture info of
+// packets whose checksum has not been computed yet, e.g. packets received
+// over a veth pair with checksum offloading (see AFPacketHandle and
+// localSource).
+type checksumNotReady struct{}
+
+// localSource recognizes the packets sent by the local host (e.g. received
+// on lo or a veth pair), which might carry a checksum that is not computed
+// yet. Unlike the AFPacketHandle, the PcapHandle and the RawSocket can not
+// tell, so they mark all these packets with checksumNotReady.
+type localSource struct {
+	hwAddr net.HardwareAddr
+	ips    map[[4]byte]bool
+}
+
+// newLocalSource returns a localSource for the given MAC address (of the
+// capture interface, can be nil) and the IPv4 addresses of the host at the
+// time it is called.
+func newLocalSource(hwAddr net.HardwareAddr) *localSource {
+	l := &localSource{hwAddr: hwAddr, ips: make(map[[4]byte]bool)}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Warningf("could not get the local addresses: %s", err)
+	}
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && n.IP.To4() != nil {
+			var ip [4]byte
+			copy(ip[:], n.IP.To4())
+			l.ips[ip] = true
+		}
+	}
+	return l
+}
+
+// sent returns true when the given packet, starting with the given layer
+// (Ethernet or IPv4), was sent by the local host.
+func (l *localSource) sent(data []byte, first gopacket.LayerType) bool {
+	if first == layers.LayerTypeEthernet {
+		if len(data) < 14 {
+			return false
+		}
+		if len(l.hwAddr) != 0 && bytes.Equal(data[6:12], l.hwAddr) {
+			return true
+		}
+		if layers.EthernetType(uint16(data[12])<<8|uint16(data[13])) != layers.EthernetTypeIPv4 {
+			return false
+		}
+		data = data[14:]
+	}
+	if len(data) < 20 {
+		return false
+	}
+	var src [4]byte
+	copy(src[:], data[12:16])
+	return l.ips[src]
+}
+
+// localPacketDataSource marks the packets of src sent by the local host with
+// checksumNotReady.
+type localPacketDataSource struct {
+	src   gopacket.PacketDataSource
+	first gopacket.LayerType
+	local *localSource
+}
+
+func (s localPacketDataSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.src.ReadPacketData()
+	if err == nil && s.local.sent(data, s.first) {
+		ci.AncillaryData = append(ci.AncillaryData, checksumNotReady{})
+	}
+	return data, ci, err
+}
+
+// getPacketDecoder returns a packetDecoder from the pool.
+func getPacketDecoder() *packetDecoder {
+	return decoderPool.Get().(*packetDecoder)
+}
+
+// getPacketDecoderFor returns a packetDecoder from the pool for the given
+// received packet.
+func getPacketDecoderFor(packet gopacket.Packet) *packetDecoder {
+	d := getPacketDecoder()
+	for _, data := range packet.Metadata().AncillaryData {
+		if _, ok := data.(checksumNotReady); ok {
+			d.checksumNotReady = true
+		}
+	}
+	return d
+}
+
+// release returns the decoder to the pool, the decoded layers must not be
+// used afterwards.
+func (d *packetDecoder) release() {
+	d.checksumBase = false
+	d.checksumNotReady = false
+	d.payload = nil
+	decoderPool.Put(d)
+}
+
+// decode decodes the given Ethernet / IPv4 / TCP packet.
+func (d *packetDecoder) decode(data []byte) (*layers.Ethernet, *layers.IPv4, *layers.TCP, error) {
+	if err := d.parser.DecodeLayers(data, &d.decoded); err != nil {
+		return nil, nil, nil, err
+	}
+	if len(d.decoded) != 3 || d.decoded[2] != layers.LayerTypeTCP {
+		return nil, nil, nil, errors.New("not an IPv4 TCP packet")
+	}
+	d.setChecksumBase(&d.ip)
+	return &d.eth, &d.ip, &d.tcp, nil
+}
+
+// failedLayer returns the name of the layer (as used for the decodeErrors
+// metric) that could not be decoded by decode.
+func (d *packetDecoder) failedLayer() string {
+	switch len(d.decoded) {
+	case 0:
+		return "ethernet"
+	case 1:
+		return "ipv4"
+	default:
+		return "tcp"
+	}
+}
+
+// decodeEncapsulated decodes the given Ethernet frame, it returns the outer
+// and inner IPv4 layers and the TCP layer. For packets that are not
+// encapsulated, outer is nil. UDP packets are only decapsulated when they are
+// sent to the given foo-over-udp port.
+func (d *packetDecoder) decodeEncapsulated(data []byte, fouPort layers.UDPPort) (eth *layers.Ethernet, outer, inner *layers.IPv4, tcp *layers.TCP, err error) {
+	// the parser decodes the inner IPv4 header of IPIP and GRE packets into
+	// the same layer as the outer header, the outer header is decoded again
+	// when needed
+	if err := d.parser.DecodeLayers(data, &d.decoded); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if len(d.decoded) < 2 || d.decoded[1] != layers.LayerTypeIPv4 {
+		return nil, nil, nil, nil, errors.New("could not get IPv4 layer")
+	}
+
+	switch last := d.decoded[len(d.decoded)-1]; {
+	case len(d.decoded) == 3 && last == layers.LayerTypeTCP:
+		// not encapsulated
+	case len(d.decoded) > 3 && last == layers.LayerTypeTCP:
+		// IPIP or GRE
+		if err := d.outer.DecodeFromBytes(d.eth.Payload, gopacket.NilDecodeFeedback); err != nil {
+			return nil, nil, nil, nil, err
+		}
+		outer = &d.outer
+	case last == layers.LayerTypeUDP:
+		if d.udp.DstPort != fouPort {
+			return nil, nil, nil, nil, errors.New("UDP packet is not sent to the foo-over-udp port")
+		}
+		if err := d.outer.DecodeFromBytes(d.eth.Payload, gopacket.NilDecodeFeedback); err != nil {
+			return nil, nil, nil, nil, err
+		}
+		outer = &d.outer
+		if err := d.ip.DecodeFromBytes(d.udp.Payload, gopacket.NilDecodeFeedback); err != nil {
+			return nil, nil, nil, nil, err
+		}
+		if d.ip.Protocol != layers.IPProtocolTCP {
+			return nil, nil, nil, nil, errors.New("could not get TCP layer")
+		}
+		if err := d.tcp.DecodeFromBytes(d.ip.Payload, gopacket.NilDecodeFeedback); err != nil {
+			return nil, nil, nil, nil, err
+		}
+	default:
+		return nil, nil, nil, nil, fmt.Errorf("unexpected IP protocol: %s", d.ip.Protocol)
+	}
+
+	d.setChecksumBase(&d.ip)
+	return &d.eth, outer, &d.ip, &d.tcp, nil
+}
+
+// decodeIPv4 decodes the given IPv4 / TCP packet (e.g. received from a
+// RawSocket or TUN). When only the TCP layer could not be decoded, the IPv4
+// layer is returned with the error.
+func (d *packetDecoder) decodeIPv4(data []byte) (*layers.IPv4, *layers.TCP, error) {
+	if err := d.ip.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		return nil, nil, err
+	}
+	if d.ip.Protocol != layers.IPProtocolTCP {
+		return &d.ip, nil, fmt.Errorf("unexpected IP protocol: %s", d.ip.Protocol)
+	}
+	if err := d.tcp.DecodeFromBytes(d.ip.Payload, gopacket.NilDecodeFeedback); err != nil {
+		return &d.ip, nil, err
+	}
+	d.setChecksumBase(&d.ip)
+	return &d.ip, &d.tcp, nil
+}
+
+// setChecksumBase remembers the addresses of the given IPv4 header and the
+// payload of the decoded TCP layer, unless the received checksum is not
+// ready.
+func (d *packetDecoder) setChecksumBase(ip *layers.IPv4) {
+	if len(ip.Contents) < 20 || d.checksumNotReady {
+		return
+	}
+	copy(d.srcIP[:], ip.Contents[12:16])
+	copy(d.dstIP[:], ip.Contents[16:20])
+	d.payload = d.tcp.Payload
+	d.checksumBase = true
+}
+
+// newEthPacket returns an EthPacket for the given layers (decoded by d). The
+// decoder is released with the packet.
+func (d *packetDecoder) newEthPacket(eth *layers.Ethernet, ip *layers.IPv4, tcp *layers.TCP) *EthPacket {
+	d.ethPacket = EthPacket{eth: eth, ip: ip, tcp: tcp, decoder: d}
+	return &d.ethPacket
+}
+
+// newTCPPacket returns a TCPPacket for the given layers (decoded by d). The
+// decoder is released with the packet.
+func (d *packetDecoder) newTCPPacket(ip *layers.IPv4, tcp *layers.TCP) *TCPPacket {
+	d.tcpPacket = TCPPacket{ip: ip, tcp: tcp, decoder: d}
+	return &d.tcpPacket
+}
+
+// validTCPChecksum returns true when the checksum of the decoded TCP segment
+// is valid for the given IPv4 header. A checksum that is not ready can not be
+// validated, the packet did not cross a physical link.
+func (d *packetDecoder) validTCPChecksum(ip *layers.IPv4, tcp *layers.TCP) bool {
+	return d.checksumNotReady || validTCPChecksum(ip, tcp)
+}
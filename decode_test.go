@@ -0,0 +1,204 @@
+package balancer
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestDecodeEncapsulated(t *testing.T) {
+	balancerIP := net.ParseIP("192.168.33.10")
+	bridgeIP := net.ParseIP("192.168.33.20")
+	fouPort := layers.UDPPort(5555)
+
+	for _, encap := range []EncapType{ENCAP_NONE, ENCAP_IPIP, ENCAP_GRE, ENCAP_FOU} {
+		ethPacket := NewEthPacket(
+			&layers.Ethernet{SrcMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4},
+			&layers.IPv4{
+				Version:  4,
+				TTL:      64,
+				SrcIP:    net.ParseIP("10.0.0.1").To4(),
+				DstIP:    net.ParseIP("192.168.33.100").To4(),
+				Protocol: layers.IPProtocolTCP,
+			},
+			&layers.TCP{
+				SrcPort: layers.TCPPort(1234),
+				DstPort: layers.TCPPort(80),
+				ACK:     true,
+				BaseLayer: layers.BaseLayer{
+					Payload: []byte("GET / HTTP/1.1\r\n\r\n"),
+				},
+			},
+		)
+		if encap != ENCAP_NONE {
+			if err := ethPacket.Encapsulate(encap, balancerIP, bridgeIP, fouPort); err != nil {
+				t.Fatal(err)
+			}
+		}
+		b, err := ethPacket.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := getPacketDecoder()
+		_, outer, inner, tcp, err := d.decodeEncapsulated(b, fouPort)
+		if err != nil {
+			t.Fatalf("%s: %s", encap, err)
+		}
+		if encap == ENCAP_NONE {
+			if outer != nil {
+				t.Errorf("%s: was expecting no outer IPv4 layer, got: %v", encap, outer)
+			}
+		} else if outer == nil || !outer.SrcIP.Equal(balancerIP) || !outer.DstIP.Equal(bridgeIP) {
+			t.Errorf("%s: unexpected outer IPv4 layer: %v", encap, outer)
+		}
+		if !inner.DstIP.Equal(net.ParseIP("192.168.33.100")) {
+			t.Errorf("%s: was expecting inner destination IP 192.168.33.100, got: %s", encap, inner.DstIP)
+		}
+		if tcp.SrcPort != 1234 || string(tcp.Payload) != "GET / HTTP/1.1\r\n\r\n" {
+			t.Errorf("%s: unexpected TCP layer: %d %q", encap, tcp.SrcPort, tcp.Payload)
+		}
+		d.release()
+		ethPacket.Release()
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	fou := NewEthPacket(
+		&layers.Ethernet{SrcMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{Version: 4, TTL: 64, SrcIP: net.ParseIP("10.0.0.1").To4(), DstIP: net.ParseIP("10.0.0.2").To4(), Protocol: layers.IPProtocolTCP},
+		&layers.TCP{SrcPort: 1234, DstPort: 80},
+	)
+	if err := fou.Encapsulate(ENCAP_FOU, net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 5555); err != nil {
+		t.Fatal(err)
+	}
+	b, err := fou.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := getPacketDecoder()
+	defer d.release()
+
+	if _, _, _, err := d.decode(b); err == nil {
+		t.Error("Was expecting an error when decoding a UDP packet as TCP")
+	}
+	if _, _, _, _, err := d.decodeEncapsulated(b, 6666); err == nil {
+		t.Error("Was expecting an error for a UDP packet not sent to the foo-over-udp port")
+	}
+	if _, _, _, err := d.decode(b[:20]); err == nil {
+		t.Error("Was expecting an error for a truncated packet")
+	} else if layer := d.failedLayer(); layer != "ipv4" {
+		t.Errorf("Was expecting the IPv4 layer to fail, got: %s", layer)
+	}
+}
+
+// raceEnabled is set when the tests are run with the race detector.
+var raceEnabled bool
+
+func TestDecodeAndMarshalAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("Allocations are not representative with the race detector.")
+	}
+
+	data := testTCPPacket(t, []byte("GET / HTTP/1.0\r\n\r\n"))
+	serverMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 3}
+	balancerMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	serverIP := net.ParseIP("192.168.33.20").To4()
+
+	run := func() {
+		d := getPacketDecoder()
+		eth, ip, tcp, err := d.decode(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip.DstIP = serverIP
+		p := d.newEthPacket(eth, ip, tcp)
+		p.SetHardwareAddrs(balancerMAC, serverMAC)
+		p.SetTOS(5)
+		if _, err := p.MarshalBinary(); err != nil {
+			t.Fatal(err)
+		}
+		p.Release()
+	}
+	// fill the pools
+	run()
+
+	if allocs := testing.AllocsPerRun(100, run); allocs > 0 {
+		t.Errorf("Was expecting no allocations per packet, got: %.1f", allocs)
+	}
+}
+
+func TestDecodeChecksumNotReady(t *testing.T) {
+	ethPacket := NewEthPacket(
+		&layers.Ethernet{SrcMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{Version: 4, TTL: 64, SrcIP: net.ParseIP("10.0.0.1").To4(), DstIP: net.ParseIP("10.0.0.2").To4(), Protocol: layers.IPProtocolTCP},
+		&layers.TCP{SrcPort: 1234, DstPort: 80, SYN: true},
+	)
+	defer ethPacket.Release()
+	b, err := ethPacket.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an offloaded checksum only contains the pseudo header sum
+	b[14+20+16] ^= 0xff
+
+	for _, notReady := range []bool{false, true} {
+		p := gopacket.NewPacket(b, layers.LayerTypeEthernet, gopacket.NoCopy)
+		if notReady {
+			p.Metadata().AncillaryData = []interface{}{checksumNotReady{}}
+		}
+		d := getPacketDecoderFor(p)
+		_, ip, tcp, err := d.decode(p.Data())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if valid := d.validTCPChecksum(ip, tcp); valid != notReady {
+			t.Errorf("checksum not ready %t: was expecting valid %t, got %t", notReady, notReady, valid)
+		}
+		// the checksum of a packet sent on must be computed
+		if d.checksumBase == notReady {
+			t.Errorf("checksum not ready %t: unexpected checksum base %t", notReady, d.checksumBase)
+		}
+		d.release()
+	}
+}
+
+func TestLocalSource(t *testing.T) {
+	hwAddr := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	l := &localSource{hwAddr: hwAddr, ips: map[[4]byte]bool{{192, 168, 33, 10}: true}}
+
+	frame := func(srcMAC net.HardwareAddr, srcIP string) []byte {
+		b, err := NewEthPacket(
+			&layers.Ethernet{SrcMAC: srcMAC, DstMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4},
+			&layers.IPv4{Version: 4, TTL: 64, SrcIP: net.ParseIP(srcIP).To4(), DstIP: net.ParseIP("10.0.0.2").To4(), Protocol: layers.IPProtocolTCP},
+			&layers.TCP{SrcPort: 1234, DstPort: 80, SYN: true},
+		).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	other := net.HardwareAddr{0x02, 0, 0, 0, 0, 3}
+
+	tests := []struct {
+		name  string
+		data  []byte
+		first gopacket.LayerType
+		sent  bool
+	}{
+		{"local MAC", frame(hwAddr, "10.0.0.1"), layers.LayerTypeEthernet, true},
+		{"local IP", frame(other, "192.168.33.10"), layers.LayerTypeEthernet, true},
+		{"remote", frame(other, "10.0.0.1"), layers.LayerTypeEthernet, false},
+		{"local IP (IPv4)", frame(other, "192.168.33.10")[14:], layers.LayerTypeIPv4, true},
+		{"remote (IPv4)", frame(other, "10.0.0.1")[14:], layers.LayerTypeIPv4, false},
+		{"truncated", frame(hwAddr, "10.0.0.1")[:10], layers.LayerTypeEthernet, false},
+	}
+	for _, test := range tests {
+		if sent := l.sent(test.data, test.first); sent != test.sent {
+			t.Errorf("%s: was expecting sent %t, got: %t", test.name, test.sent, sent)
+		}
+	}
+}
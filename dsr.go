@@ -0,0 +1,44 @@
+package balancer
+
+import (
+	"github.com/google/gopacket/layers"
+)
+
+// routeL2DSR returns the server and state of the given MODE_L2DSR
+// connection. The balancer does not take part in the handshake, so the
+// server is selected by hashing the 4-tuple and a state is only added on the
+// SYN. As the hash is deterministic, a connection unknown to the balancer
+// (e.g. after a restart) is routed to the same server without state (the
+// returned state is nil), as long as the healthy servers of the pool did not
+// change. The returned bool is true when the connection is new. It returns
+// errNoHardwareAddr when the MAC of the selected server is not resolved.
+func routeL2DSR(stateTable *StateTable, service *Service, ip *layers.IPv4, tcp *layers.TCP) (*Server, *State, bool, error) {
+	state, ok := stateTable.GetState(ip.SrcIP, tcp.SrcPort, ip.DstIP, tcp.DstPort)
+	// a SYN for a closing connection starts a new connection on the same
+	// 4-tuple
+	if ok && (!tcp.SYN || state.State == TCP_STATE_ESTABLISHED) {
+		return state.Server, state, false, nil
+	}
+
+	key, err := FlowKey(ip, tcp)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	server, err := service.Pool.RouteToServer(key)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if server.GetHardwareAddr() == nil {
+		return nil, nil, false, errNoHardwareAddr
+	}
+	if !tcp.SYN || tcp.ACK {
+		return server, nil, false, nil
+	}
+
+	state = newState(ip.SrcIP, tcp.SrcPort, service)
+	state.State = TCP_STATE_ESTABLISHED
+	state.Server = server
+	stateTable.Put(state)
+	stateTable.Changed(state)
+	return server, state, true, nil
+}
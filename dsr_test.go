@@ -0,0 +1,173 @@
+package balancer
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestBalancePacketsL2DSR(t *testing.T) {
+	balancerMAC, _ := net.ParseMAC("11:11:11:11:11:11")
+	routerMAC, _ := net.ParseMAC("22:22:22:22:22:22")
+	vip := net.ParseIP("192.168.33.100").To4()
+
+	pool := NewConsistentHashPool()
+	for i := 1; i <= 4; i++ {
+		pool.AddServer(&Server{
+			IP:           net.IPv4(192, 168, 33, byte(20+i)).To4(),
+			HardwareAddr: net.HardwareAddr{0x08, 0, 0, 0, 0, byte(i)},
+		})
+	}
+	services := NewServiceTable()
+	if err := services.AddService(&Service{
+		IP:              vip,
+		Port:            80,
+		Protocol:        layers.IPProtocolTCP,
+		Pool:            pool,
+		Mode:            MODE_L2DSR,
+		SrcHardwareAddr: balancerMAC,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	clientPacketFlags := func(syn, fin, rst bool) gopacket.Packet {
+		eth := &layers.Ethernet{SrcMAC: routerMAC, DstMAC: balancerMAC, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      63,
+			SrcIP:    net.ParseIP("10.0.0.1").To4(),
+			DstIP:    vip,
+			Protocol: layers.IPProtocolTCP,
+		}
+		tcp := &layers.TCP{SrcPort: 1234, DstPort: 80, Seq: 100, SYN: syn, ACK: !syn, FIN: fin, RST: rst, Window: 1024}
+		b, err := NewEthPacket(eth, ip, tcp).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gopacket.NewPacket(b, layers.LayerTypeEthernet, gopacket.Default)
+	}
+	clientPacket := func(syn bool) gopacket.Packet {
+		return clientPacketFlags(syn, false, false)
+	}
+
+	run := func(stateTable *StateTable, packets ...gopacket.Packet) []*EthPacket {
+		in := make(chan gopacket.Packet, len(packets))
+		out := NewEthPacketQueue("test", len(packets), OVERFLOW_BLOCK)
+		for _, p := range packets {
+			in <- p
+		}
+		close(in)
+		BalancePackets(in, out, stateTable, services)
+		out.Close()
+
+		var res []*EthPacket
+		for p, ok := out.Get(); ok; p, ok = out.Get() {
+			res = append(res, p)
+		}
+		return res
+	}
+
+	stateTable := NewStateTable()
+	out := run(stateTable, clientPacket(true), clientPacket(false))
+	if len(out) != 2 {
+		t.Fatalf("Was expecting 2 forwarded packets, got: %d", len(out))
+	}
+
+	state, ok := stateTable.GetState(net.ParseIP("10.0.0.1"), 1234, vip, 80)
+	if !ok || state.Server == nil {
+		t.Fatal("Was expecting a state with the selected server.")
+	}
+
+	for _, p := range out {
+		if !p.tcp.SYN && !p.tcp.ACK {
+			t.Error("The TCP flags should not have been modified.")
+		}
+		if !p.DstIP().Equal(vip) || p.ip.TTL != 63 {
+			t.Errorf("The IP layer should not have been modified, got: %s (TTL %d)", p, p.ip.TTL)
+		}
+		if !bytes.Equal(p.eth.SrcMAC, balancerMAC) {
+			t.Errorf("Was expecting source MAC %s, got: %s", balancerMAC, p.eth.SrcMAC)
+		}
+		if !bytes.Equal(p.eth.DstMAC, state.Server.HardwareAddr) {
+			t.Errorf("Was expecting destination MAC %s, got: %s", state.Server.HardwareAddr, p.eth.DstMAC)
+		}
+	}
+
+	// a balancer without state routes the connection to the same server
+	stateTable = NewStateTable()
+	out = run(stateTable, clientPacket(false))
+	if len(out) != 1 {
+		t.Fatalf("Was expecting 1 forwarded packet, got: %d", len(out))
+	}
+	if !bytes.Equal(out[0].eth.DstMAC, state.Server.HardwareAddr) {
+		t.Errorf("Was expecting destination MAC %s, got: %s", state.Server.HardwareAddr, out[0].eth.DstMAC)
+	}
+
+	if _, ok := stateTable.GetState(net.ParseIP("10.0.0.1"), 1234, vip, 80); ok {
+		t.Error("Only the SYN should add a state.")
+	}
+
+	// a RST removes the state
+	stateTable = NewStateTable()
+	run(stateTable, clientPacket(true), clientPacket(false))
+	if out := run(stateTable, clientPacketFlags(false, false, true)); len(out) != 1 {
+		t.Fatalf("Was expecting the RST to be forwarded, got %d packets.", len(out))
+	}
+	if _, ok := stateTable.GetState(net.ParseIP("10.0.0.1"), 1234, vip, 80); ok {
+		t.Error("The state should have been removed on the RST.")
+	}
+
+	// established connections are offloaded to the fast path and removed
+	// when closed
+	fastPath := &testFastPath{}
+	stateTable = NewStateTable()
+	stateTable.SetFastPath(fastPath)
+	run(stateTable, clientPacket(true))
+	if fastPath.flows != 0 {
+		t.Error("The connection should not have been offloaded on the SYN.")
+	}
+	run(stateTable, clientPacket(false), clientPacket(false))
+	if state, _ := stateTable.GetState(net.ParseIP("10.0.0.1"), 1234, vip, 80); fastPath.flows != 1 || fastPath.offloads != 1 || !state.Offloaded {
+		t.Errorf("Was expecting the connection to be offloaded once, got %d offloads.", fastPath.offloads)
+	}
+	run(stateTable, clientPacketFlags(false, true, false))
+	if state, _ := stateTable.GetState(net.ParseIP("10.0.0.1"), 1234, vip, 80); fastPath.flows != 0 || state.Offloaded {
+		t.Error("The connection should have been removed from the fast path.")
+	} else if state.State != TCP_STATE_FIN_WAIT_1 {
+		t.Errorf("Was expecting state FIN_WAIT_1 after the FIN, got: %s", state.State)
+	}
+
+	// a RST removes an offloaded connection from the fast path too
+	fastPath = &testFastPath{}
+	stateTable = NewStateTable()
+	stateTable.SetFastPath(fastPath)
+	run(stateTable, clientPacket(true), clientPacket(false))
+	run(stateTable, clientPacketFlags(false, false, true))
+	if _, ok := stateTable.GetState(net.ParseIP("10.0.0.1"), 1234, vip, 80); ok || fastPath.flows != 0 {
+		t.Errorf("Was expecting the state and the fast path flow to be removed, got %d flows.", fastPath.flows)
+	}
+}
+
+type testFastPath struct {
+	offloads int
+	flows    int
+	active   bool
+}
+
+func (f *testFastPath) Offload(state *State) error {
+	f.offloads++
+	f.flows++
+	return nil
+}
+
+func (f *testFastPath) Remove(state *State) error {
+	f.flows--
+	return nil
+}
+
+func (f *testFastPath) Active(state *State) bool {
+	return f.active
+}
@@ -0,0 +1,111 @@
+package balancer
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket/layers"
+)
+
+// EncapType defines the encapsulation used between the balancer and the
+// packetbridge.
+type EncapType uint8
+
+const (
+	// ENCAP_NONE rewrites the destination IP and uses the DSCP field to
+	// identify the balancer
+	ENCAP_NONE EncapType = iota
+	// ENCAP_IPIP encapsulates the client packet in IPv4 (IP protocol 4)
+	ENCAP_IPIP
+	// ENCAP_GRE encapsulates the client packet in GRE (IP protocol 47)
+	ENCAP_GRE
+	// ENCAP_FOU encapsulates the client packet in UDP (foo-over-udp)
+	ENCAP_FOU
+)
+
+var encapTypeNames = map[EncapType]string{
+	ENCAP_NONE: "none",
+	ENCAP_IPIP: "ipip",
+	ENCAP_GRE:  "gre",
+	ENCAP_FOU:  "fou",
+}
+
+func (t EncapType) String() string {
+	if name, ok := encapTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseEncapType returns the EncapType for the given name.
+func ParseEncapType(name string) (EncapType, error) {
+	if name == "" {
+		return ENCAP_NONE, nil
+	}
+	for t, n := range encapTypeNames {
+		if n == name {
+			return t, nil
+		}
+	}
+	return ENCAP_NONE, fmt.Errorf("unknown encapsulation: %s", name)
+}
+
+// Encapsulate wraps the IP packet in an outer IPv4 header from src to dst,
+// using the given encapsulation. For ENCAP_FOU the packet is sent to the
+// given UDP port, the UDP source port is derived from the inner flow so
+// that ECMP routers can spread the flows.
+func (p *EthPacket) Encapsulate(t EncapType, src, dst net.IP, fouPort layers.UDPPort) error {
+	p.outer = &layers.IPv4{
+		Version: 4,
+		TTL:     64,
+		Flags:   layers.IPv4DontFragment,
+		SrcIP:   src.To4(),
+		DstIP:   dst.To4(),
+	}
+	p.gre = nil
+	p.udp = nil
+
+	switch t {
+	case ENCAP_IPIP:
+		p.outer.Protocol = layers.IPProtocolIPv4
+	case ENCAP_GRE:
+		p.outer.Protocol = layers.IPProtocolGRE
+		p.gre = &layers.GRE{
+			Protocol: layers.EthernetTypeIPv4,
+		}
+	case ENCAP_FOU:
+		p.outer.Protocol = layers.IPProtocolUDP
+		p.udp = &layers.UDP{
+			SrcPort: layers.UDPPort(49152 + hashKey(p.ip.SrcIP.To16(), []byte{byte(p.tcp.SrcPort >> 8), byte(p.tcp.SrcPort)})%16384),
+			DstPort: fouPort,
+		}
+		p.udp.SetNetworkLayerForChecksum(p.outer)
+	default:
+		p.outer = nil
+		return fmt.Errorf("can not encapsulate using %s", t)
+	}
+
+	p.eth.EthernetType = layers.EthernetTypeIPv4
+	return nil
+}
+
+// encapOverhead is the largest overhead of the encapsulations, the outer
+// IPv4 and UDP headers of foo-over-udp.
+const encapOverhead = 28
+
+// encapMSS returns the largest MSS of a TCP segment (without options) that
+// still fits in the given MTU once it is encapsulated. The outer header has
+// the DF flag set, so larger segments would be dropped on the way to the
+// packetbridge. An MTU of 0 means the Ethernet MTU of 1500.
+func encapMSS(mtu int) uint16 {
+	if mtu == 0 {
+		mtu = 1500
+	}
+	return uint16(mtu - 20 - 20 - encapOverhead)
+}
+
+// EncapBPFFilter returns the BPF filter matching the encapsulated packets
+// sent to the given host.
+func EncapBPFFilter(host net.IP, fouPort layers.UDPPort) string {
+	return fmt.Sprintf("dst host %s and (ip proto 4 or ip proto 47 or udp dst port %d)", host, fouPort)
+}
@@ -0,0 +1,82 @@
+package balancer
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestEncapsulation(t *testing.T) {
+	balancerIP := net.ParseIP("192.168.33.10")
+	bridgeIP := net.ParseIP("192.168.33.20")
+	fouPort := layers.UDPPort(5555)
+	protocols := map[EncapType]layers.IPProtocol{
+		ENCAP_IPIP: layers.IPProtocolIPv4,
+		ENCAP_GRE:  layers.IPProtocolGRE,
+		ENCAP_FOU:  layers.IPProtocolUDP,
+	}
+
+	for _, encap := range []EncapType{ENCAP_IPIP, ENCAP_GRE, ENCAP_FOU} {
+		srcMAC, _ := net.ParseMAC("11:11:11:11:11:11")
+		dstMAC, _ := net.ParseMAC("22:22:22:22:22:22")
+
+		ethPacket := NewEthPacket(
+			&layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeIPv4},
+			&layers.IPv4{
+				Version:  4,
+				TTL:      64,
+				SrcIP:    net.ParseIP("10.0.0.1").To4(),
+				DstIP:    net.ParseIP("192.168.33.100").To4(),
+				Protocol: layers.IPProtocolTCP,
+			},
+			&layers.TCP{
+				SrcPort: layers.TCPPort(1234),
+				DstPort: layers.TCPPort(80),
+				ACK:     true,
+				BaseLayer: layers.BaseLayer{
+					Payload: []byte("GET / HTTP/1.1\r\n\r\n"),
+				},
+			},
+		)
+		if err := ethPacket.Encapsulate(encap, balancerIP, bridgeIP, fouPort); err != nil {
+			t.Fatal(err)
+		}
+		if !ethPacket.DstIP().Equal(bridgeIP) {
+			t.Errorf("%s: was expecting destination IP %s, got: %s", encap, bridgeIP, ethPacket.DstIP())
+		}
+
+		b, err := ethPacket.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := getPacketDecoder()
+		_, outer, inner, tcp, err := d.decodeEncapsulated(b, fouPort)
+		if err != nil {
+			t.Fatalf("%s: %s", encap, err)
+		}
+		if outer == nil || !outer.SrcIP.Equal(balancerIP) || !outer.DstIP.Equal(bridgeIP) {
+			t.Errorf("%s: unexpected outer IPv4 layer: %v", encap, outer)
+		} else if outer.Flags&layers.IPv4DontFragment == 0 || outer.Protocol != protocols[encap] {
+			t.Errorf("%s: unexpected outer flags %s or protocol %s", encap, outer.Flags, outer.Protocol)
+		}
+		if !inner.DstIP.Equal(net.ParseIP("192.168.33.100")) {
+			t.Errorf("%s: was expecting inner destination IP 192.168.33.100, got: %s", encap, inner.DstIP)
+		}
+		if tcp.SrcPort != 1234 || string(tcp.Payload) != "GET / HTTP/1.1\r\n\r\n" {
+			t.Errorf("%s: unexpected TCP layer: %d %q", encap, tcp.SrcPort, tcp.Payload)
+		}
+		d.release()
+		ethPacket.Release()
+	}
+}
+
+func TestEncapMSS(t *testing.T) {
+	if mss := encapMSS(0); mss != 1432 {
+		t.Errorf("Was expecting MSS 1432 for the default MTU, got: %d", mss)
+	}
+	if mss := encapMSS(9000); mss != 8932 {
+		t.Errorf("Was expecting MSS 8932 for MTU 9000, got: %d", mss)
+	}
+}
@@ -2,16 +2,28 @@ package balancer
 
 import (
 	"fmt"
+	"net"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
-// EthPacket represents an ethernet packet.
+// EthPacket represents an ethernet packet. The IP packet can optionally be
+// encapsulated (see Encapsulate).
 type EthPacket struct {
 	eth *layers.Ethernet
 	ip  *layers.IPv4
 	tcp *layers.TCP
+
+	// set when the packet is encapsulated
+	outer *layers.IPv4
+	gre   *layers.GRE
+	udp   *layers.UDP
+
+	// decoder is set when the layers were decoded by a packetDecoder, buf
+	// once the packet has been serialized (see Release)
+	decoder *packetDecoder
+	buf     gopacket.SerializeBuffer
 }
 
 // NewEthPacket creates and initializes a new EthPacket.
@@ -28,16 +40,89 @@ func (p *EthPacket) SetTOS(tos uint8) {
 	p.ip.TOS = tos
 }
 
-// MarshalBinary returns the binary representation of the packet.
+// DstIP returns the destination IP (of the outer header when the packet is
+// encapsulated).
+func (p *EthPacket) DstIP() net.IP {
+	if p.outer != nil {
+		return p.outer.DstIP
+	}
+	return p.ip.DstIP
+}
+
+// SetHardwareAddrs sets the source and destination hardware addresses.
+func (p *EthPacket) SetHardwareAddrs(src, dst net.HardwareAddr) {
+	p.eth.SrcMAC = src
+	p.eth.DstMAC = dst
+}
+
+// MarshalBinary returns the binary representation of the packet. The
+// returned slice is valid until Release is called.
 func (p *EthPacket) MarshalBinary() ([]byte, error) {
-	p.tcp.SetNetworkLayerForChecksum(p.ip)
-	opts := gopacket.SerializeOptions{
-		ComputeChecksums: true,
-		FixLengths:       true,
-	}
-	buf := gopacket.NewSerializeBuffer()
-	err := gopacket.SerializeLayers(buf, opts, p.eth, p.ip, p.tcp, gopacket.Payload(p.tcp.Payload))
-	return buf.Bytes(), err
+	err := p.serialize(true)
+	if err != nil {
+		serializeErrors.WithLabelValues("eth").Inc()
+	}
+	return p.buf.Bytes(), err
+}
+
+// MarshalIPBinary returns the binary representation of the packet, without
+// the Ethernet layer. The returned slice is valid until Release is called.
+func (p *EthPacket) MarshalIPBinary() ([]byte, error) {
+	err := p.serialize(false)
+	if err != nil {
+		serializeErrors.WithLabelValues("ip").Inc()
+	}
+	return p.buf.Bytes(), err
+}
+
+// Release returns the buffers of the packet (including the decoded layers it
+// was created from) for reuse. The packet and the data returned by
+// MarshalBinary must not be used afterwards.
+func (p *EthPacket) Release() {
+	if p.buf != nil {
+		serializeBufferPool.Put(p.buf)
+		p.buf = nil
+	}
+	if d := p.decoder; d != nil {
+		p.decoder = nil
+		d.release()
+	}
+}
+
+// isControl returns true for SYN, FIN and RST packets (see
+// OVERFLOW_PRIORITIZE_CONTROL).
+func (p *EthPacket) isControl() bool {
+	return p.tcp != nil && (p.tcp.SYN || p.tcp.FIN || p.tcp.RST)
+}
+
+// serialize serializes the packet, including the encapsulation layers, into
+// the buffer of the packet.
+func (p *EthPacket) serialize(withEthernet bool) error {
+	if p.buf == nil {
+		p.buf = serializeBufferPool.Get().(gopacket.SerializeBuffer)
+	}
+
+	var headers [5]gopacket.SerializableLayer
+	n := 0
+	if withEthernet {
+		headers[n] = p.eth
+		n++
+	}
+	if p.outer != nil {
+		headers[n] = p.outer
+		n++
+	}
+	if p.gre != nil {
+		headers[n] = p.gre
+		n++
+	}
+	if p.udp != nil {
+		headers[n] = p.udp
+		n++
+	}
+	headers[n] = p.ip
+	n++
+	return serializeTCP(p.buf, p.decoder, p.ip, p.tcp, headers[:n]...)
 }
 
 func (p *EthPacket) String() string {
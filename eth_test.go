@@ -67,3 +67,35 @@ func TestEthPacket(t *testing.T) {
 		t.Fatal("Could not get the TCP layer.")
 	}
 }
+
+func TestEthPacketMarshalIPBinary(t *testing.T) {
+	ethPacket := NewEthPacket(
+		&layers.Ethernet{EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			SrcIP:    net.ParseIP("127.0.0.1").To4(),
+			DstIP:    net.ParseIP("127.0.0.2").To4(),
+			Protocol: layers.IPProtocolTCP,
+		},
+		&layers.TCP{
+			SrcPort: layers.TCPPort(80),
+			DstPort: layers.TCPPort(8080),
+		},
+	)
+	ipBytes, err := ethPacket.MarshalIPBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := gopacket.NewPacket(ipBytes, layers.LayerTypeIPv4, gopacket.Default)
+	if packet.Layer(layers.LayerTypeEthernet) != nil {
+		t.Error("Was not expecting an Ethernet layer.")
+	}
+	if ipLayer, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); !ok || !ipLayer.DstIP.Equal(ethPacket.DstIP()) {
+		t.Error("Was expecting the IPv4 layer with dst IP 127.0.0.2.")
+	}
+	if packet.Layer(layers.LayerTypeTCP) == nil {
+		t.Error("Could not get the TCP layer.")
+	}
+}
@@ -0,0 +1,67 @@
+package balancer
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var serverHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "l3dsr_server_healthy",
+	Help: "Health of the server (1 = healthy, 0 = unhealthy).",
+}, []string{"server"})
+
+func init() {
+	prometheus.MustRegister(serverHealthy)
+}
+
+// HealthChecker periodically checks the servers of a pool by opening a
+// TCP connection to the given port. Servers failing the check are marked
+// unhealthy, so that the pool does not route new connections to them.
+type HealthChecker struct {
+	Pool     PoolBalancer
+	Port     int
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// Run runs the health checks until the program exits.
+func (h *HealthChecker) Run() {
+	for {
+		h.Check()
+		time.Sleep(h.Interval)
+	}
+}
+
+// Check checks all the servers of the pool once.
+func (h *HealthChecker) Check() {
+	for _, s := range h.Pool.Servers() {
+		healthy := h.checkServer(s)
+		if healthy != s.Healthy() {
+			log.WithFields(log.Fields{
+				"server":  s.IP,
+				"healthy": healthy,
+			}).Warning("server health changed")
+		}
+		s.SetHealthy(healthy)
+
+		if healthy {
+			serverHealthy.WithLabelValues(s.IP.String()).Set(1)
+		} else {
+			serverHealthy.WithLabelValues(s.IP.String()).Set(0)
+		}
+	}
+}
+
+func (h *HealthChecker) checkServer(s *Server) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(s.IP.String(), strconv.Itoa(h.Port)), h.Timeout)
+	if err != nil {
+		log.WithField("server", s.IP).Debugf("health check failed: %s", err)
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -0,0 +1,50 @@
+package balancer
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHealthChecker(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	up := &Server{IP: net.ParseIP("127.0.0.1")}
+	down := &Server{IP: net.ParseIP("127.0.0.2")}
+	down.SetHealthy(true)
+
+	pool := NewModuloPool()
+	pool.AddServer(up)
+	pool.AddServer(down)
+
+	hc := &HealthChecker{
+		Pool:    pool,
+		Port:    port,
+		Timeout: 100 * time.Millisecond,
+	}
+
+	// the listener is bound to 127.0.0.1 only, so connecting to
+	// 127.0.0.2 fails
+	hc.Check()
+	if !up.Healthy() {
+		t.Error("Server with listener should be healthy.")
+	}
+	if down.Healthy() {
+		t.Error("Server without listener should be unhealthy.")
+	}
+
+	for key := int64(0); key < 10; key++ {
+		s, err := pool.RouteToServer(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != up {
+			t.Fatalf("Key %d was routed to the unhealthy server.", key)
+		}
+	}
+}
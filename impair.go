@@ -0,0 +1,220 @@
+package balancer
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// Impairment defines the faults injected by an ImpairedSink or
+// ImpairedSource. The probabilities are between 0 and 1.
+type Impairment struct {
+	// Loss is the probability a packet is dropped.
+	Loss float64
+
+	// Duplicate is the probability a packet is sent twice.
+	Duplicate float64
+
+	// Reorder is the probability a packet is held back and sent after the
+	// next packet.
+	Reorder float64
+
+	// Corrupt is the probability a random bit of a packet is flipped, from
+	// the CorruptOffset byte on (e.g. 14 to keep the Ethernet header
+	// intact, which is protected by the frame check sequence of a real
+	// link).
+	Corrupt       float64
+	CorruptOffset int
+
+	// Delay is the time each packet is delayed, Jitter the maximum random
+	// time added to or subtracted from it (which reorders packets too).
+	Delay  time.Duration
+	Jitter time.Duration
+
+	// Seed seeds the random decisions, the same packets get the same
+	// faults for the same seed.
+	Seed int64
+}
+
+// ImpairmentStats contains the number of injected faults.
+type ImpairmentStats struct {
+	Lost       int
+	Duplicated int
+	Reordered  int
+	Corrupted  int
+}
+
+// impairer injects the faults of an Impairment.
+type impairer struct {
+	sync.Mutex
+	conf    Impairment
+	rand    *rand.Rand
+	held    []byte
+	stats   ImpairmentStats
+	pending sync.WaitGroup
+}
+
+func newImpairer(conf Impairment) *impairer {
+	return &impairer{
+		conf: conf,
+		rand: rand.New(rand.NewSource(conf.Seed)),
+	}
+}
+
+// impair returns the packets resulting from the given packet and the time
+// they must be delayed. The same random values are drawn for every packet,
+// so that the faults of a packet do not depend on the faults enabled for the
+// previous packets.
+func (i *impairer) impair(data []byte) ([][]byte, time.Duration) {
+	i.Lock()
+	defer i.Unlock()
+	lose := i.rand.Float64() < i.conf.Loss
+	corrupt := i.rand.Float64() < i.conf.Corrupt
+	bit := i.rand.Intn(len(data)*8 + 1)
+	duplicate := i.rand.Float64() < i.conf.Duplicate
+	reorder := i.rand.Float64() < i.conf.Reorder
+	delay := i.conf.Delay + time.Duration((i.rand.Float64()*2-1)*float64(i.conf.Jitter))
+
+	if lose {
+		i.stats.Lost++
+		return nil, delay
+	}
+	data = append([]byte(nil), data...)
+	if corrupt && len(data) > i.conf.CorruptOffset {
+		i.stats.Corrupted++
+		n := len(data) - i.conf.CorruptOffset
+		data[i.conf.CorruptOffset+bit/8%n] ^= 1 << uint(bit%8)
+	}
+	packets := [][]byte{data}
+	if duplicate {
+		i.stats.Duplicated++
+		packets = append(packets, data)
+	}
+	if i.held != nil {
+		packets = append(packets, i.held)
+		i.held = nil
+	} else if reorder {
+		i.stats.Reordered++
+		i.held = data
+		packets = packets[1:]
+	}
+	return packets, delay
+}
+
+// emitLater calls emit with the given packets after the given delay.
+func (i *impairer) emitLater(packets [][]byte, delay time.Duration, emit func([]byte)) {
+	i.pending.Add(1)
+	time.AfterFunc(delay, func() {
+		defer i.pending.Done()
+		for _, p := range packets {
+			emit(p)
+		}
+	})
+}
+
+func (i *impairer) getStats() ImpairmentStats {
+	i.Lock()
+	defer i.Unlock()
+	return i.stats
+}
+
+// ImpairedSink is a PacketSink injecting faults in the packets written to
+// an other PacketSink, e.g. to test the packet handlers with an unreliable
+// network. A packet held back to reorder it is sent after the next packet.
+// It is safe for concurrent use.
+type ImpairedSink struct {
+	imp  *impairer
+	sink PacketSink
+}
+
+// NewImpairedSink returns a new ImpairedSink writing to the given sink.
+func NewImpairedSink(sink PacketSink, conf Impairment) *ImpairedSink {
+	return &ImpairedSink{imp: newImpairer(conf), sink: sink}
+}
+
+// WritePacketData writes the given data to the sink, with the faults of the
+// impairment. The errors of delayed packets are ignored.
+func (s *ImpairedSink) WritePacketData(data []byte) error {
+	packets, delay := s.imp.impair(data)
+	if delay > 0 {
+		s.imp.emitLater(packets, delay, func(b []byte) { s.sink.WritePacketData(b) })
+		return nil
+	}
+	for _, p := range packets {
+		if err := s.sink.WritePacketData(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns the number of injected faults.
+func (s *ImpairedSink) Stats() ImpairmentStats {
+	return s.imp.getStats()
+}
+
+// ImpairedSource is a PacketSource injecting faults in the packets received
+// from an other PacketSource, see ImpairedSink. A packet held back to reorder
+// it is lost when the source is closed.
+type ImpairedSource struct {
+	imp    *impairer
+	source PacketSource
+	out    chan gopacket.Packet
+}
+
+// NewImpairedSource returns a new ImpairedSource receiving from the given
+// source.
+func NewImpairedSource(source PacketSource, conf Impairment) *ImpairedSource {
+	s := &ImpairedSource{
+		imp:    newImpairer(conf),
+		source: source,
+		out:    make(chan gopacket.Packet, cap(source.Packets())),
+	}
+	go s.receive()
+	return s
+}
+
+// Packets returns the channel with the received packets, it is closed when
+// the source is closed and the delayed packets have been received.
+func (s *ImpairedSource) Packets() chan gopacket.Packet {
+	return s.out
+}
+
+// Close closes the source.
+func (s *ImpairedSource) Close() {
+	s.source.Close()
+}
+
+// Stats returns the number of injected faults.
+func (s *ImpairedSource) Stats() ImpairmentStats {
+	return s.imp.getStats()
+}
+
+func (s *ImpairedSource) receive() {
+	for p := range s.source.Packets() {
+		l := p.Layers()
+		if len(l) == 0 {
+			continue
+		}
+		first := l[0].LayerType()
+		ci := p.Metadata().CaptureInfo
+		emit := func(b []byte) {
+			packet := gopacket.NewPacket(b, first, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+			packet.Metadata().CaptureInfo = ci
+			s.out <- packet
+		}
+
+		packets, delay := s.imp.impair(p.Data())
+		if delay > 0 {
+			s.imp.emitLater(packets, delay, emit)
+			continue
+		}
+		for _, b := range packets {
+			emit(b)
+		}
+	}
+	s.imp.pending.Wait()
+	close(s.out)
+}
@@ -0,0 +1,137 @@
+package balancer
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// recordingSink records the packets written to it.
+type recordingSink struct {
+	sync.Mutex
+	packets [][]byte
+}
+
+func (s *recordingSink) WritePacketData(data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.packets = append(s.packets, append([]byte(nil), data...))
+	return nil
+}
+
+func (s *recordingSink) written() [][]byte {
+	s.Lock()
+	defer s.Unlock()
+	return s.packets
+}
+
+func TestImpairedSink(t *testing.T) {
+	packets := make([][]byte, 100)
+	for i := range packets {
+		packets[i] = []byte{byte(i), 0, 0, 0}
+	}
+	impair := func(conf Impairment) ([][]byte, ImpairmentStats) {
+		var rec recordingSink
+		s := NewImpairedSink(&rec, conf)
+		for _, p := range packets {
+			if err := s.WritePacketData(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.written(), s.Stats()
+	}
+
+	t.Run("loss", func(t *testing.T) {
+		out, stats := impair(Impairment{Loss: 0.3, Seed: 1})
+		if stats.Lost == 0 || len(out) != len(packets)-stats.Lost {
+			t.Errorf("Was expecting %d packets to be lost, got %d packets", stats.Lost, len(out))
+		}
+	})
+
+	t.Run("duplication", func(t *testing.T) {
+		out, _ := impair(Impairment{Duplicate: 1})
+		if len(out) != 2*len(packets) || !bytes.Equal(out[0], out[1]) || !bytes.Equal(out[2], packets[1]) {
+			t.Errorf("Was expecting every packet twice, got: %v", out)
+		}
+	})
+
+	t.Run("reordering", func(t *testing.T) {
+		out, stats := impair(Impairment{Reorder: 1})
+		// every other packet is held back and sent after the next one
+		if stats.Reordered != len(packets)/2 || len(out) != len(packets) {
+			t.Fatalf("Was expecting %d reordered packets, got: %+v (%d packets)", len(packets)/2, stats, len(out))
+		}
+		if !bytes.Equal(out[0], packets[1]) || !bytes.Equal(out[1], packets[0]) {
+			t.Errorf("Was expecting the first two packets to be swapped, got: %v", out[:2])
+		}
+	})
+
+	t.Run("corruption", func(t *testing.T) {
+		out, _ := impair(Impairment{Corrupt: 1, CorruptOffset: 1})
+		for i, p := range out {
+			if p[0] != packets[i][0] {
+				t.Fatalf("Was expecting the byte before the offset to be intact, got: %v", p)
+			}
+			var flipped int
+			for j := range p {
+				for b := p[j] ^ packets[i][j]; b != 0; b &= b - 1 {
+					flipped++
+				}
+			}
+			if flipped != 1 {
+				t.Fatalf("Was expecting one flipped bit, got %d: %v", flipped, p)
+			}
+		}
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		var rec recordingSink
+		s := NewImpairedSink(&rec, Impairment{Delay: 20 * time.Millisecond, Jitter: 10 * time.Millisecond})
+		start := time.Now()
+		s.WritePacketData(packets[0])
+		if len(rec.written()) != 0 {
+			t.Fatal("Was expecting the packet to be delayed.")
+		}
+		s.imp.pending.Wait()
+		if d := time.Since(start); d < 10*time.Millisecond || len(rec.written()) != 1 {
+			t.Errorf("Was expecting the packet after at least 10ms, got %d packets after %s", len(rec.written()), d)
+		}
+	})
+
+	t.Run("seed", func(t *testing.T) {
+		conf := Impairment{Loss: 0.1, Duplicate: 0.1, Reorder: 0.1, Corrupt: 0.1, Seed: 42}
+		a, _ := impair(conf)
+		b, _ := impair(conf)
+		if !reflect.DeepEqual(a, b) {
+			t.Error("Was expecting the same faults for the same seed.")
+		}
+		conf.Seed++
+		if c, _ := impair(conf); reflect.DeepEqual(a, c) {
+			t.Error("Was expecting other faults for an other seed.")
+		}
+	})
+}
+
+func TestImpairedSource(t *testing.T) {
+	a, b := NewMemoryLink(layers.LayerTypeEthernet, 4)
+	s := NewImpairedSource(b, Impairment{Duplicate: 1})
+
+	a.WritePacketData([]byte{1, 2, 3})
+	for i := 0; i < 2; i++ {
+		if p := <-s.Packets(); !bytes.Equal(p.Data(), []byte{1, 2, 3}) {
+			t.Errorf("Was expecting the duplicated packet, got: %v", p.Data())
+		}
+	}
+	if stats := s.Stats(); stats.Duplicated != 1 {
+		t.Errorf("Was expecting 1 duplicated packet, got: %+v", stats)
+	}
+
+	s.Close()
+	if _, ok := <-s.Packets(); ok {
+		t.Error("Was expecting the packets channel to be closed.")
+	}
+}
@@ -0,0 +1,112 @@
+package balancer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// isnSlotBits is the number of ISN bits used for the server slot
+	isnSlotBits = 4
+	// isnWindowBits is the number of ISN bits for the sequence space the
+	// client acknowledges (the bytes sent by the server), the remaining 8
+	// bits are the keyed check
+	isnWindowBits = 20
+)
+
+// MaxRecoverySlots is the maximum number of servers of a pool for which the
+// server can be encoded in the ISN.
+const MaxRecoverySlots = 1 << isnSlotBits
+
+// SequenceCodec encodes the server (slot) a connection is routed to in the
+// initial sequence number of the SYN-ACK, so that a balancer that lost the
+// state of the connection (e.g. after a restart, or when ECMP moves the flow
+// to a sibling balancer) can recover the server from the ACK number of the
+// client.
+//
+// The ISN is a keyed hash of the 4-tuple plus the slot shifted by
+// isnWindowBits. The ACK number of the client is the ISN plus one plus the
+// bytes sent by the server, so the slot can only be recovered while the
+// client has received less than 1 MiB. Recovering connections that received
+// more is a non-goal, it would need more than 32 bits. The remaining bits
+// serve as the keyed check: a forged (or random) ACK number is accepted with
+// a probability of 1 in 256, its packet is then forwarded to a server that
+// does not know the connection and answers with a RST.
+// The slot is the index of the server in the Servers of the pool, so all
+// balancers must use the same key and list the servers of the pool in the
+// same order.
+type SequenceCodec struct {
+	key []byte
+}
+
+// NewSequenceCodec returns a new SequenceCodec using the given secret key.
+func NewSequenceCodec(key []byte) (*SequenceCodec, error) {
+	if len(key) == 0 {
+		return nil, errors.New("the recovery key must not be empty")
+	}
+	return &SequenceCodec{key: key}, nil
+}
+
+// Encode returns the ISN for the connection between the given client and
+// VIP, encoding the given server slot.
+func (c *SequenceCodec) Encode(ip net.IP, port layers.TCPPort, vip net.IP, vipPort layers.TCPPort, slot int) uint32 {
+	return c.base(ip, port, vip, vipPort) + uint32(slot)<<isnWindowBits
+}
+
+// Decode returns the server slot for the given ACK number of the connection
+// between the given client and VIP. It returns false when the ACK number does
+// not match an encoded ISN.
+func (c *SequenceCodec) Decode(ip net.IP, port layers.TCPPort, vip net.IP, vipPort layers.TCPPort, ack uint32) (int, bool) {
+	d := ack - 1 - c.base(ip, port, vip, vipPort)
+	if d>>(isnWindowBits+isnSlotBits) != 0 {
+		return 0, false
+	}
+	return int(d >> isnWindowBits), true
+}
+
+func (c *SequenceCodec) base(ip net.IP, port layers.TCPPort, vip net.IP, vipPort layers.TCPPort) uint32 {
+	mac := hmac.New(sha256.New, c.key)
+	key := flowKey(ip, port, vip, vipPort)
+	mac.Write(key[:])
+	return binary.BigEndian.Uint32(mac.Sum(nil))
+}
+
+// serverSlot returns the index of the given server in the Servers of the
+// pool, which is encoded as the slot in the ISN.
+func serverSlot(pool PoolBalancer, server *Server) (int, bool) {
+	for i, s := range pool.Servers() {
+		if s == server {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// recoverState recreates the state of an established connection that is
+// unknown to the balancer, using the server encoded in the ACK number.
+func recoverState(stateTable *StateTable, service *Service, ip *layers.IPv4, tcp *layers.TCP) (*State, bool) {
+	if !tcp.ACK || tcp.SYN || tcp.RST {
+		return nil, false
+	}
+	slot, ok := service.Recovery.Decode(ip.SrcIP, tcp.SrcPort, service.IP, service.Port, tcp.Ack)
+	if !ok {
+		return nil, false
+	}
+	servers := service.Pool.Servers()
+	if slot >= len(servers) {
+		return nil, false
+	}
+
+	state := newState(ip.SrcIP, tcp.SrcPort, service)
+	state.State = TCP_STATE_ESTABLISHED
+	state.Server = servers[slot]
+	state.Seq = service.Recovery.Encode(ip.SrcIP, tcp.SrcPort, service.IP, service.Port, slot)
+	stateTable.Put(state)
+	stateTable.Changed(state)
+	return state, true
+}
@@ -0,0 +1,119 @@
+package balancer
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestSequenceCodec(t *testing.T) {
+	if _, err := NewSequenceCodec(nil); err == nil {
+		t.Error("Was expecting an error for an empty key.")
+	}
+
+	codec, _ := NewSequenceCodec([]byte("secret"))
+	other, _ := NewSequenceCodec([]byte("other secret"))
+	vip := net.ParseIP("192.168.33.100")
+
+	var forged int
+	for port := layers.TCPPort(1000); port < 2000; port++ {
+		slot := int(port) % MaxRecoverySlots
+		isn := codec.Encode(net.ParseIP("10.0.0.1"), port, vip, 80, slot)
+
+		for _, sent := range []uint32{0, 1, 12345, 1<<isnWindowBits - 1} {
+			s, ok := codec.Decode(net.ParseIP("10.0.0.1"), port, vip, 80, isn+1+sent)
+			if !ok || s != slot {
+				t.Fatalf("Port %d: was expecting slot %d after %d bytes, got: %d (%t)", port, slot, sent, s, ok)
+			}
+		}
+
+		if _, ok := codec.Decode(net.ParseIP("10.0.0.1"), port, vip, 80, isn+1+1<<(isnWindowBits+isnSlotBits)); ok {
+			t.Errorf("Port %d: the ACK number should not have been decoded outside the window.", port)
+		}
+		if _, ok := other.Decode(net.ParseIP("10.0.0.1"), port, vip, 80, isn+1); ok {
+			forged++
+		}
+	}
+
+	// a different key must be accepted with a probability of about 1 in 256
+	if forged > 16 {
+		t.Errorf("Too many ACK numbers accepted with a different key: %d", forged)
+	}
+}
+
+func TestBalancePacketsRecovery(t *testing.T) {
+	balancerMAC, _ := net.ParseMAC("11:11:11:11:11:11")
+	routerMAC, _ := net.ParseMAC("22:22:22:22:22:22")
+	clientIP := net.ParseIP("10.0.0.1").To4()
+	vip := net.ParseIP("192.168.33.100").To4()
+	codec, _ := NewSequenceCodec([]byte("secret"))
+
+	pool := NewConsistentHashPool()
+	for i := 1; i <= 4; i++ {
+		pool.AddServer(&Server{
+			IP:           net.IPv4(192, 168, 33, byte(20+i)).To4(),
+			HardwareAddr: net.HardwareAddr{0x08, 0, 0, 0, 0, byte(i)},
+		})
+	}
+	services := NewServiceTable()
+	if err := services.AddService(&Service{
+		IP:           vip,
+		Port:         80,
+		Protocol:     layers.IPProtocolTCP,
+		LBIndex:      1,
+		Pool:         pool,
+		KeyExtractor: FlowKey,
+		Recovery:     codec,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	clientPacket := func(tcp *layers.TCP) gopacket.Packet {
+		eth := &layers.Ethernet{SrcMAC: routerMAC, DstMAC: balancerMAC, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, TTL: 63, SrcIP: clientIP, DstIP: vip, Protocol: layers.IPProtocolTCP}
+		tcp.SrcPort = 1234
+		tcp.DstPort = 80
+		b, err := NewEthPacket(eth, ip, tcp).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gopacket.NewPacket(b, layers.LayerTypeEthernet, gopacket.Default)
+	}
+	run := func(stateTable *StateTable, p gopacket.Packet) *EthPacket {
+		in := make(chan gopacket.Packet, 1)
+		out := NewEthPacketQueue("test", 1, OVERFLOW_BLOCK)
+		in <- p
+		close(in)
+		BalancePackets(in, out, stateTable, services)
+		forwarded, _ := out.TryGet()
+		return forwarded
+	}
+
+	stateTable := NewStateTable()
+	synAck := run(stateTable, clientPacket(&layers.TCP{Seq: 100, SYN: true}))
+	if synAck == nil || !synAck.tcp.SYN || !synAck.tcp.ACK {
+		t.Fatal("Was expecting a SYN ACK.")
+	}
+	state, ok := stateTable.GetState(clientIP, 1234, vip, 80)
+	if !ok || state.Server == nil {
+		t.Fatal("Was expecting the server to be selected on the SYN.")
+	}
+
+	// a balancer without state recovers the server from the ACK number
+	stateTable = NewStateTable()
+	p := run(stateTable, clientPacket(&layers.TCP{Seq: 101, Ack: synAck.tcp.Seq + 1 + 500000, ACK: true}))
+	if p == nil {
+		t.Fatal("Was expecting the packet to be forwarded.")
+	}
+	if !p.DstIP().Equal(state.Server.IP) {
+		t.Errorf("Was expecting the packet to be forwarded to %s, got: %s", state.Server.IP, p.DstIP())
+	}
+
+	// a forged ACK number is not recovered
+	stateTable = NewStateTable()
+	if p := run(stateTable, clientPacket(&layers.TCP{Seq: 101, Ack: synAck.tcp.Seq + 1<<30, ACK: true})); p != nil {
+		t.Error("The packet with a forged ACK number should have been dropped.")
+	}
+}
@@ -0,0 +1,89 @@
+package balancer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+
+	"github.com/google/gopacket/layers"
+)
+
+// KeyExtractor returns the key used to route a connection to a server. It
+// is called with the first data packet of the connection.
+type KeyExtractor func(ip *layers.IPv4, tcp *layers.TCP) (int64, error)
+
+var keyExtractors = map[string]KeyExtractor{
+	"client-ip": ClientIPKey,
+	"flow":      FlowKey,
+	"http-path": HTTPPathKey,
+	"http-host": HTTPHostKey,
+}
+
+// headerKeyExtractors are the key extractors that only use the IP and TCP
+// headers, the key is then already known on the SYN.
+var headerKeyExtractors = map[string]bool{
+	"client-ip": true,
+	"flow":      true,
+}
+
+// IsHeaderKey returns true when the given key extractor only uses the IP and
+// TCP headers.
+func IsHeaderKey(name string) bool {
+	return headerKeyExtractors[name]
+}
+
+// GetKeyExtractor returns the KeyExtractor for the given name.
+func GetKeyExtractor(name string) (KeyExtractor, error) {
+	ke, ok := keyExtractors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown key extractor: %s", name)
+	}
+	return ke, nil
+}
+
+// ClientIPKey returns the key based on the IP address of the client.
+func ClientIPKey(ip *layers.IPv4, tcp *layers.TCP) (int64, error) {
+	return hashKey(ip.SrcIP.To16()), nil
+}
+
+// FlowKey returns the key based on the client and server IP and port.
+func FlowKey(ip *layers.IPv4, tcp *layers.TCP) (int64, error) {
+	return hashKey(
+		ip.SrcIP.To16(),
+		[]byte{byte(tcp.SrcPort >> 8), byte(tcp.SrcPort)},
+		ip.DstIP.To16(),
+		[]byte{byte(tcp.DstPort >> 8), byte(tcp.DstPort)},
+	), nil
+}
+
+// HTTPPathKey returns the key based on the path of the HTTP request.
+// NOTE: for simplicity we assume the HTTP request is within one packet,
+// this might not be the case!
+func HTTPPathKey(ip *layers.IPv4, tcp *layers.TCP) (int64, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(tcp.Payload)))
+	if err != nil {
+		return 0, fmt.Errorf("could not parse request: %s", err)
+	}
+	return hashKey([]byte(req.URL.Path)), nil
+}
+
+// HTTPHostKey returns the key based on the host of the HTTP request.
+// NOTE: for simplicity we assume the HTTP request is within one packet,
+// this might not be the case!
+func HTTPHostKey(ip *layers.IPv4, tcp *layers.TCP) (int64, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(tcp.Payload)))
+	if err != nil {
+		return 0, fmt.Errorf("could not parse request: %s", err)
+	}
+	return hashKey([]byte(req.Host)), nil
+}
+
+func hashKey(parts ...[]byte) int64 {
+	h := fnv.New64a()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return int64(h.Sum64() >> 1)
+}
@@ -0,0 +1,112 @@
+package balancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+)
+
+// FlowID returns the identifier of the connection of the given client to
+// the given VIP and port. The balancer and the packetbridge compute the same
+// id for the same client connection, so that their logs can be correlated.
+func FlowID(ip net.IP, port layers.TCPPort, vip net.IP, vipPort layers.TCPPort) string {
+	h := fnv.New64a()
+	h.Write(ip.To16())
+	h.Write([]byte{byte(port >> 8), byte(port)})
+	h.Write(vip.To16())
+	h.Write([]byte{byte(vipPort >> 8), byte(vipPort)})
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// logLimiter limits the number of log lines per second.
+type logLimiter struct {
+	sync.Mutex
+	rate       int
+	second     int64
+	count      int
+	suppressed int
+}
+
+// allow returns true when a log line may be written at the given time.
+// When lines have been suppressed since the last allowed line, it also
+// returns the number of suppressed lines.
+func (l *logLimiter) allow(now time.Time) (bool, int) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.rate <= 0 {
+		return true, 0
+	}
+
+	if sec := now.Unix(); sec != l.second {
+		l.second = sec
+		l.count = 0
+	}
+
+	if l.count >= l.rate {
+		l.suppressed++
+		return false, 0
+	}
+
+	l.count++
+	suppressed := l.suppressed
+	l.suppressed = 0
+	return true, suppressed
+}
+
+var packetLogLimiter = &logLimiter{rate: 100}
+
+// SetupLogging sets the log level and format (text or json) and the maximum
+// number of per-packet debug log lines per second (see SetPacketLogRate).
+func SetupLogging(level, format string, packetRate int) error {
+	l, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(l)
+
+	switch format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+
+	SetPacketLogRate(packetRate)
+	return nil
+}
+
+// SetPacketLogRate sets the maximum number of per-packet debug log lines
+// per second. A rate of 0 disables the limit.
+func SetPacketLogRate(rate int) {
+	packetLogLimiter.Lock()
+	defer packetLogLimiter.Unlock()
+	packetLogLimiter.rate = rate
+}
+
+// logPacket logs a per-packet message at debug level. These messages are
+// rate-limited (see SetPacketLogRate). The fields function is only called
+// when the message is actually logged.
+func logPacket(fields func() log.Fields, msg string) {
+	if !log.IsLevelEnabled(log.DebugLevel) {
+		return
+	}
+
+	ok, suppressed := packetLogLimiter.allow(time.Now())
+	if !ok {
+		return
+	}
+
+	f := fields()
+	if suppressed > 0 {
+		f["suppressed"] = suppressed
+	}
+	log.WithFields(f).Debug(msg)
+}
@@ -0,0 +1,48 @@
+package balancer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestLogLimiter(t *testing.T) {
+	l := &logLimiter{rate: 2}
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow(now); !ok {
+			t.Fatalf("Line %d should have been allowed.", i)
+		}
+	}
+	if ok, _ := l.allow(now); ok {
+		t.Fatal("Third line within the same second should have been suppressed.")
+	}
+
+	ok, suppressed := l.allow(now.Add(time.Second))
+	if !ok {
+		t.Fatal("First line of the next second should have been allowed.")
+	}
+	if suppressed != 1 {
+		t.Errorf("Was expecting 1 suppressed line, got: %d", suppressed)
+	}
+}
+
+func TestFlowID(t *testing.T) {
+	vip := net.ParseIP("10.0.0.10")
+	a := FlowID(net.ParseIP("10.0.0.1").To4(), layers.TCPPort(1234), vip, 80)
+	b := FlowID(net.ParseIP("10.0.0.1"), layers.TCPPort(1234), vip, 80)
+	if a != b {
+		t.Errorf("FlowID should not depend on the IP representation, got: %s and %s", a, b)
+	}
+
+	if c := FlowID(net.ParseIP("10.0.0.1"), layers.TCPPort(1235), vip, 80); c == a {
+		t.Error("FlowID should be different for a different port.")
+	}
+
+	if c := FlowID(net.ParseIP("10.0.0.1"), layers.TCPPort(1234), net.ParseIP("10.0.0.100"), 80); c == a {
+		t.Error("FlowID should be different for a different VIP.")
+	}
+}
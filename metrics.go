@@ -0,0 +1,181 @@
+package balancer
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	packetsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "l3dsr_packets_in_total",
+		Help: "Number of packets received per handler.",
+	}, []string{"handler"})
+
+	packetsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "l3dsr_packets_out_total",
+		Help: "Number of packets sent per handler.",
+	}, []string{"handler"})
+
+	packetsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "l3dsr_packets_dropped_total",
+		Help: "Number of packets dropped per handler and reason.",
+	}, []string{"handler", "reason"})
+
+	decodeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "l3dsr_decode_errors_total",
+		Help: "Number of packets that could not be decoded per handler and layer.",
+	}, []string{"handler", "layer"})
+
+	serializeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "l3dsr_serialize_errors_total",
+		Help: "Number of packets that could not be serialized per packet type.",
+	}, []string{"type"})
+
+	routingErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "l3dsr_routing_errors_total",
+		Help: "Number of times a packet could not be routed to a server.",
+	})
+
+	recoveredConnections = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "l3dsr_recovered_connections_total",
+		Help: "Number of established connections recovered from the ISN after state loss.",
+	})
+
+	expiredStates = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "l3dsr_expired_states_total",
+		Help: "Number of connection states removed after being idle for too long.",
+	})
+
+	stateSyncRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "l3dsr_state_sync_records_total",
+		Help: "Number of state sync records per direction (sent, received, dropped).",
+	}, []string{"direction"})
+
+	stateSyncResyncsIncomplete = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "l3dsr_state_sync_resyncs_incomplete_total",
+		Help: "Number of state resyncs received with missing chunks (and requested again).",
+	})
+
+	captureDrops = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "l3dsr_capture_drops_total",
+		Help: "Number of packets dropped by the kernel because the AF_PACKET ring was full.",
+	})
+
+	fastPathOffloads = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "l3dsr_fast_path_offloads_total",
+		Help: "Number of connections offloaded to the fast path (XDP).",
+	})
+
+	fastPathErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "l3dsr_fast_path_errors_total",
+		Help: "Number of times a connection could not be offloaded to or removed from the fast path.",
+	})
+
+	serverConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "l3dsr_server_connections_total",
+		Help: "Number of connections routed per server.",
+	}, []string{"server"})
+
+	serverBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "l3dsr_server_bytes_total",
+		Help: "Number of TCP payload bytes forwarded per server.",
+	}, []string{"server"})
+
+	queueFull = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "l3dsr_queue_full_total",
+		Help: "Number of packets that found the queue full per queue (and were dropped or waited, see the overflow policy).",
+	}, []string{"queue"})
+
+	queueDrops = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "l3dsr_queue_drops_total",
+		Help: "Number of packets dropped by the queue per queue and packet type (control, data).",
+	}, []string{"queue", "type"})
+
+	queueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "l3dsr_queue_length",
+		Help: "Number of packets in the queue per queue.",
+	}, []string{"queue"})
+
+	handshakeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "l3dsr_handshake_duration_seconds",
+		Help:    "Duration of the TCP handshake per handler.",
+		Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"handler"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		packetsReceived,
+		packetsSent,
+		packetsDropped,
+		decodeErrors,
+		serializeErrors,
+		routingErrors,
+		recoveredConnections,
+		expiredStates,
+		stateSyncRecords,
+		stateSyncResyncsIncomplete,
+		captureDrops,
+		fastPathOffloads,
+		fastPathErrors,
+		serverConnections,
+		serverBytes,
+		queueFull,
+		queueDrops,
+		queueLength,
+		handshakeDuration,
+	)
+}
+
+// ServeMetrics serves the Prometheus metrics on /metrics at the given
+// address. It only returns when the server fails.
+func ServeMetrics(bind string) error {
+	log.WithField("bind", bind).Info("serving metrics")
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(bind, mux)
+}
+
+var stateTableSizeDesc = prometheus.NewDesc(
+	"l3dsr_state_table_entries",
+	"Number of entries in the state table per TCP state.",
+	[]string{"table", "state"}, nil,
+)
+
+// StateTableCollector implements prometheus.Collector and exposes the number
+// of entries in the given state tables, broken down by TCPState.
+type StateTableCollector struct {
+	stateTable             *StateTable
+	packetBridgeStateTable *PacketBridgeStateTable
+}
+
+// NewStateTableCollector creates a new StateTableCollector. Any of the
+// given tables can be nil.
+func NewStateTableCollector(st *StateTable, pbst *PacketBridgeStateTable) *StateTableCollector {
+	return &StateTableCollector{
+		stateTable:             st,
+		packetBridgeStateTable: pbst,
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *StateTableCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- stateTableSizeDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *StateTableCollector) Collect(ch chan<- prometheus.Metric) {
+	if c.stateTable != nil {
+		for state, count := range c.stateTable.CountByState() {
+			ch <- prometheus.MustNewConstMetric(stateTableSizeDesc, prometheus.GaugeValue, float64(count), "balancer", state.String())
+		}
+	}
+	if c.packetBridgeStateTable != nil {
+		for state, count := range c.packetBridgeStateTable.CountByState() {
+			ch <- prometheus.MustNewConstMetric(stateTableSizeDesc, prometheus.GaugeValue, float64(count), "packetbridge", state.String())
+		}
+	}
+}
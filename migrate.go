@@ -0,0 +1,392 @@
+package balancer
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+)
+
+// The live migration of flows moves the established connections of a
+// packetbridge (source) to an other packetbridge (target), e.g. for host
+// maintenance. It is started with the migrate API of the source:
+//
+//  1. the source is drained at the balancers, it no longer receives new
+//     connections
+//  2. the source hands the PacketBridgeState of its established connections
+//     over to the target (import API)
+//  3. the balancers update State.Server of these connections to the target
+//
+// The APIs change the forwarding of live connections, they require a shared
+// token when they are reachable from other hosts (see ServeAPI).
+//
+// The target only accepts the connections when it can resume them: it must
+// use the same backend-facing IP as the source (e.g. a floating IP that is
+// moved to the target after the migration), know the backends and the
+// random ports must not be in use. When the target rejects the connections,
+// they stay at the (drained) source until they end.
+
+// Flow identifies a connection between a client and a VIP.
+type Flow struct {
+	ClientIP   net.IP         `json:"client_ip"`
+	ClientPort layers.TCPPort `json:"client_port"`
+	VIP        net.IP         `json:"vip"`
+	VIPPort    layers.TCPPort `json:"vip_port"`
+}
+
+// MigrateFlowsRequest is the request of the balancer API to move flows from
+// one server (packetbridge) to an other.
+type MigrateFlowsRequest struct {
+	From  net.IP `json:"from"`
+	To    net.IP `json:"to"`
+	Flows []Flow `json:"flows"`
+}
+
+// MigrateFlowsResponse is the response of the balancer API to move flows.
+type MigrateFlowsResponse struct {
+	Migrated int `json:"migrated"`
+}
+
+// DrainServerRequest is the request of the balancer API to drain a server
+// (no new connections are routed to it) or to undo this.
+type DrainServerRequest struct {
+	Server net.IP `json:"server"`
+	Drain  bool   `json:"drain"`
+}
+
+// DrainServerResponse is the response of the balancer API to drain a server.
+type DrainServerResponse struct {
+	Servers int `json:"servers"`
+}
+
+// MigrateRequest is the request of the packetbridge API to migrate its
+// established connections to the given target packetbridge. TargetIP is the
+// IP of the target in the server pools of the balancers.
+type MigrateRequest struct {
+	Target    string   `json:"target"`
+	TargetIP  net.IP   `json:"target_ip"`
+	Balancers []string `json:"balancers"`
+}
+
+// MigrateResponse is the response of the packetbridge migrate API.
+type MigrateResponse struct {
+	Drained  bool   `json:"drained"`
+	Migrated int    `json:"migrated"`
+	Error    string `json:"error,omitempty"`
+}
+
+// NewBalancerAPI returns the HTTP API of the balancer used for the live
+// migration of flows.
+func NewBalancerAPI(stateTable *StateTable, services *ServiceTable) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/flows/migrate", func(w http.ResponseWriter, r *http.Request) {
+		var req MigrateFlowsRequest
+		if !decodeAPIRequest(w, r, &req) {
+			return
+		}
+
+		var resp MigrateFlowsResponse
+		for _, f := range req.Flows {
+			state, ok := stateTable.GetState(f.ClientIP, f.ClientPort, f.VIP, f.VIPPort)
+			if !ok || state.Server == nil || !state.Server.IP.Equal(req.From) {
+				continue
+			}
+			to, ok := GetServerByIP(state.Service.Pool, req.To)
+			if !ok {
+				continue
+			}
+
+			// the fast path would keep forwarding to the old server, the
+			// next packet offloads the migrated connection again
+			if state = stateTable.unload(state); state.Offloaded {
+				continue
+			}
+
+			// replace the state instead of modifying it, as it is in use
+			// by BalancePackets
+			migrated := *state
+			migrated.Server = to
+			if !stateTable.replace(state, &migrated) {
+				// the connection changed (e.g. it was reset) meanwhile
+				continue
+			}
+			stateTable.Changed(&migrated)
+			resp.Migrated++
+		}
+
+		log.WithFields(log.Fields{
+			"from":     req.From,
+			"to":       req.To,
+			"flows":    len(req.Flows),
+			"migrated": resp.Migrated,
+		}).Info("migrated flows")
+		writeAPIResponse(w, http.StatusOK, resp)
+	})
+
+	mux.HandleFunc("/api/servers/drain", func(w http.ResponseWriter, r *http.Request) {
+		var req DrainServerRequest
+		if !decodeAPIRequest(w, r, &req) {
+			return
+		}
+
+		var resp DrainServerResponse
+		for _, s := range services.Services() {
+			if server, ok := GetServerByIP(s.Pool, req.Server); ok {
+				server.SetHealthy(!req.Drain)
+				resp.Servers++
+			}
+		}
+
+		log.WithFields(log.Fields{
+			"server": req.Server,
+			"drain":  req.Drain,
+		}).Info("changed server drain state")
+		writeAPIResponse(w, http.StatusOK, resp)
+	})
+
+	return mux
+}
+
+// PacketBridgeAPI implements the HTTP API of the packetbridge used for the
+// live migration of flows.
+type PacketBridgeAPI struct {
+	stateTable *PacketBridgeStateTable
+	pool       PoolBalancer
+	balancerIP net.IP
+	backendIP  net.IP
+	token      string
+	client     *http.Client
+}
+
+// NewPacketBridgeAPI creates a new PacketBridgeAPI. The balancerIP is the IP
+// the balancers forward the packets to, the backendIP the (source) IP of the
+// connections with the backends. The given token (can be empty) is sent to
+// the APIs of the balancers and the target packetbridge.
+func NewPacketBridgeAPI(stateTable *PacketBridgeStateTable, pool PoolBalancer, balancerIP, backendIP net.IP, token string) *PacketBridgeAPI {
+	return &PacketBridgeAPI{
+		stateTable: stateTable,
+		pool:       pool,
+		balancerIP: balancerIP,
+		backendIP:  backendIP,
+		token:      token,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (a *PacketBridgeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/flows/import":
+		a.handleImport(w, r)
+	case "/api/migrate":
+		a.handleMigrate(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleImport imports the states in the body (snapshot encoding) when all
+// of them can be resumed.
+func (a *PacketBridgeAPI) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ip := net.ParseIP(r.URL.Query().Get("backend_ip")); !ip.Equal(a.backendIP) {
+		http.Error(w, fmt.Sprintf("backend-facing IP %s does not match %s", r.URL.Query().Get("backend_ip"), a.backendIP), http.StatusConflict)
+		return
+	}
+
+	snap, err := decodeSnapshot(r.Body, snapshotTablePacketBridge, packetBridgeRecordLen)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var states []*PacketBridgeState
+	for _, rec := range snap.records {
+		state, err := parsePacketBridgeRecord(rec, a.pool)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if existing, ok := a.stateTable.GetByPort(state.RandPort); ok && !(existing.IP.Equal(state.IP) && existing.Port == state.Port) {
+			http.Error(w, fmt.Sprintf("random port %d is already in use", state.RandPort), http.StatusConflict)
+			return
+		}
+		states = append(states, state)
+	}
+
+	for _, state := range states {
+		a.stateTable.Put(state)
+		a.stateTable.Changed(state)
+	}
+	log.WithField("flows", len(states)).Info("imported flows")
+	writeAPIResponse(w, http.StatusOK, map[string]int{"imported": len(states)})
+}
+
+// handleMigrate drains the packetbridge at the balancers and migrates the
+// established connections to the target packetbridge.
+func (a *PacketBridgeAPI) handleMigrate(w http.ResponseWriter, r *http.Request) {
+	var req MigrateRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	var resp MigrateResponse
+	for _, b := range req.Balancers {
+		if err := a.postJSON(b+"/api/servers/drain", DrainServerRequest{Server: a.balancerIP, Drain: true}, nil); err != nil {
+			resp.Error = fmt.Sprintf("could not drain at balancer %s: %s", b, err)
+			writeAPIResponse(w, http.StatusBadGateway, resp)
+			return
+		}
+	}
+	resp.Drained = true
+
+	var states []PacketBridgeState
+	var records [][]byte
+	for _, state := range a.stateTable.States() {
+		if state.State == TCP_STATE_ESTABLISHED {
+			states = append(states, state)
+			records = append(records, appendPacketBridgeRecord(nil, state))
+		}
+	}
+	if len(states) == 0 {
+		writeAPIResponse(w, http.StatusOK, resp)
+		return
+	}
+
+	var body bytes.Buffer
+	encodeSnapshot(&body, snapshotTablePacketBridge, packetBridgeRecordLen, records)
+	if err := a.post(fmt.Sprintf("%s/api/flows/import?backend_ip=%s", req.Target, a.backendIP), "application/octet-stream", &body, nil); err != nil {
+		// the connections can not be resumed by the target, they are
+		// drained instead
+		log.WithField("target", req.Target).Warningf("target rejected flows, draining: %s", err)
+		resp.Error = fmt.Sprintf("target rejected the flows, draining them instead: %s", err)
+		writeAPIResponse(w, http.StatusOK, resp)
+		return
+	}
+
+	flows := make([]Flow, len(states))
+	for i, state := range states {
+		flows[i] = Flow{ClientIP: state.IP, ClientPort: state.Port, VIP: state.VIP, VIPPort: state.ServicePort}
+	}
+	for _, b := range req.Balancers {
+		if err := a.postJSON(b+"/api/flows/migrate", MigrateFlowsRequest{From: a.balancerIP, To: req.TargetIP, Flows: flows}, nil); err != nil {
+			resp.Error = fmt.Sprintf("could not migrate flows at balancer %s: %s", b, err)
+			writeAPIResponse(w, http.StatusBadGateway, resp)
+			return
+		}
+	}
+
+	// the connections are now handled by the target, packets that are
+	// still received for them are dropped (instead of starting a new
+	// connection with the backend or resetting it) until the states are
+	// removed by Expire, after the closing timeout
+	for _, state := range states {
+		closed := state
+		closed.State = TCP_STATE_CLOSED
+		a.stateTable.Put(&closed)
+		a.stateTable.Changed(&closed)
+	}
+	resp.Migrated = len(states)
+
+	log.WithFields(log.Fields{
+		"target":   req.Target,
+		"migrated": resp.Migrated,
+	}).Info("migrated flows")
+	writeAPIResponse(w, http.StatusOK, resp)
+}
+
+func (a *PacketBridgeAPI) postJSON(url string, in, out interface{}) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return a.post(url, "application/json", bytes.NewReader(b), out)
+}
+
+func (a *PacketBridgeAPI) post(url, contentType string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// ServeAPI serves the given API handler at the given address. When a token is
+// given, requests must carry it as bearer token (Authorization header). An
+// API reachable from other hosts (the address is not a loopback address)
+// requires a token. It only returns when the server fails.
+func ServeAPI(bind, token string, handler http.Handler) error {
+	host, _, err := net.SplitHostPort(bind)
+	if err != nil {
+		return fmt.Errorf("could not parse API address: %s", err)
+	}
+	if ip := net.ParseIP(host); token == "" && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("the API on %s is reachable from other hosts, it requires a token", bind)
+	}
+
+	log.WithField("bind", bind).Info("serving API")
+	return http.ListenAndServe(bind, requireAPIToken(token, handler))
+}
+
+// requireAPIToken returns a handler that rejects the requests that do not
+// carry the given token (unless it is empty) before calling the given
+// handler.
+func requireAPIToken(token string, handler http.Handler) http.Handler {
+	if token == "" {
+		return handler
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func decodeAPIRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, fmt.Sprintf("could not decode request: %s", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
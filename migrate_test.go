@@ -0,0 +1,129 @@
+package balancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMigrateFlows(t *testing.T) {
+	services := newSyncTestServices(t)
+	service, _ := services.GetService(net.ParseIP("192.168.33.10"), 80)
+	source, target := service.Pool.Servers()[0], service.Pool.Servers()[1]
+
+	lbStateTable := NewStateTable()
+	lbState := lbStateTable.NewState(net.ParseIP("10.0.0.1").To4(), 1234, service)
+	lbState.State = TCP_STATE_ESTABLISHED
+	lbState.Server = source
+	fastPath := &testFastPath{}
+	lbStateTable.SetFastPath(fastPath)
+	lbStateTable.offload(lbState)
+	lb := httptest.NewServer(requireAPIToken("secret", NewBalancerAPI(lbStateTable, services)))
+	defer lb.Close()
+
+	backends := NewConsistentHashPool()
+	backends.AddServer(&Server{IP: net.ParseIP("192.168.33.30").To4()})
+	backendIP := net.ParseIP("192.168.33.40").To4()
+
+	newPacketBridge := func(ip, backendIP net.IP) (*PacketBridgeStateTable, *httptest.Server) {
+		stateTable := NewPacketBridgeStateTable()
+		return stateTable, httptest.NewServer(requireAPIToken("secret", NewPacketBridgeAPI(stateTable, backends, ip, backendIP, "secret")))
+	}
+	sourceTable, sourcePB := newPacketBridge(source.IP, backendIP)
+	defer sourcePB.Close()
+	targetTable, targetPB := newPacketBridge(target.IP, backendIP)
+	defer targetPB.Close()
+	_, otherPB := newPacketBridge(target.IP, net.ParseIP("192.168.33.41").To4())
+	defer otherPB.Close()
+
+	state, err := sourceTable.NewState(&PacketBridgeState{
+		IP:           net.ParseIP("10.0.0.1").To4(),
+		HardwareAddr: net.HardwareAddr{0x08, 0, 0, 0, 0, 1},
+		Port:         1234,
+		VIP:          service.IP,
+		ServicePort:  80,
+		BackendPort:  8080,
+		Backend:      backends.Servers()[0],
+		LBIndex:      1,
+		State:        TCP_STATE_ESTABLISHED,
+		SeqOffset:    12345,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrate := func(url string) MigrateResponse {
+		b, _ := json.Marshal(MigrateRequest{Target: url, TargetIP: target.IP, Balancers: []string{lb.URL}})
+		req, _ := http.NewRequest(http.MethodPost, sourcePB.URL+"/api/migrate", bytes.NewReader(b))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out MigrateResponse
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	// requests without the token are rejected
+	b, _ := json.Marshal(DrainServerRequest{Server: source.IP, Drain: true})
+	if resp, err := http.Post(lb.URL+"/api/servers/drain", "application/json", bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusUnauthorized || !source.Healthy() {
+		t.Fatalf("Was expecting the request without token to be rejected, got: %s", resp.Status)
+	}
+
+	// the other packetbridge uses an other backend-facing IP, it can not
+	// resume the connection
+	if resp := migrate(otherPB.URL); !resp.Drained || resp.Migrated != 0 || resp.Error == "" {
+		t.Fatalf("Was expecting the flows to be rejected, got: %+v", resp)
+	}
+	if source.Healthy() {
+		t.Error("The source should be drained at the balancer.")
+	}
+	if s, _ := sourceTable.GetByPort(state.RandPort); s.State != TCP_STATE_ESTABLISHED {
+		t.Errorf("Rejected flows should stay established at the source, got: %s", s.State)
+	}
+
+	if resp := migrate(targetPB.URL); !resp.Drained || resp.Migrated != 1 || resp.Error != "" {
+		t.Fatalf("Was expecting 1 migrated flow, got: %+v", resp)
+	}
+	if s, ok := targetTable.GetByIP(state.IP, state.Port, state.VIP, state.ServicePort); !ok ||
+		s.RandPort != state.RandPort || s.SeqOffset != state.SeqOffset || s.State != TCP_STATE_ESTABLISHED {
+		t.Errorf("Was expecting %+v at the target, got: %+v", state, s)
+	}
+	if s, _ := lbStateTable.GetState(lbState.IP, lbState.Port, service.IP, service.Port); s.Server != target {
+		t.Errorf("Was expecting the balancer to forward the flow to %s, got: %s", target.IP, s.Server.IP)
+	} else if s.Offloaded || fastPath.flows != 0 || fastPath.offloads != 1 {
+		t.Errorf("Was expecting the flow to be removed from the fast path, got: %+v (%d flows)", s, fastPath.flows)
+	}
+	if s, _ := sourceTable.GetByPort(state.RandPort); s.State != TCP_STATE_CLOSED {
+		t.Errorf("Migrated flows should be closed at the source, got: %s", s.State)
+	}
+
+	// the migrated states are removed after the closing timeout, which
+	// frees their random ports
+	now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	defer func() { now = time.Now }()
+	if n := sourceTable.Expire(time.Hour, time.Minute); n != 1 {
+		t.Errorf("Was expecting the migrated flow to expire, got %d expired states.", n)
+	}
+	if _, ok := sourceTable.GetByPort(state.RandPort); ok {
+		t.Error("The random port of the migrated flow should have been freed.")
+	}
+}
+
+func TestServeAPIRequiresToken(t *testing.T) {
+	for _, bind := range []string{":0", "0.0.0.0:0", "192.168.33.20:0"} {
+		if err := ServeAPI(bind, "", http.NotFoundHandler()); err == nil {
+			t.Errorf("Was expecting an error for %s without token.", bind)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package balancer
+
+import "fmt"
+
+// ForwardMode defines how the balancer forwards the connections of a
+// service.
+type ForwardMode uint8
+
+const (
+	// MODE_SPLICE terminates the handshake at the balancer and routes the
+	// connection on its first data (delayed binding), the packetbridge
+	// splices the connection to the backend
+	MODE_SPLICE ForwardMode = iota
+	// MODE_L2DSR routes the connection on the SYN by hashing the 4-tuple and
+	// only rewrites the Ethernet addresses, the servers have the VIP
+	// configured on their loopback interface and reply directly to the client
+	MODE_L2DSR
+	// MODE_L4HASH routes every packet (including the SYN) by hashing the
+	// 4-tuple, no state is kept so that any balancer forwards the packets of
+	// a connection to the same packetbridge or server
+	MODE_L4HASH
+)
+
+var forwardModeNames = map[ForwardMode]string{
+	MODE_SPLICE: "splice",
+	MODE_L2DSR:  "l2dsr",
+	MODE_L4HASH: "l4hash",
+}
+
+func (m ForwardMode) String() string {
+	if name, ok := forwardModeNames[m]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseForwardMode returns the ForwardMode for the given name.
+func ParseForwardMode(name string) (ForwardMode, error) {
+	if name == "" {
+		return MODE_SPLICE, nil
+	}
+	for m, n := range forwardModeNames {
+		if n == name {
+			return m, nil
+		}
+	}
+	return MODE_SPLICE, fmt.Errorf("unknown forwarding mode: %s", name)
+}
@@ -0,0 +1,246 @@
+package balancer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errNoHardwareAddr is returned when a packet can not be sent, as the
+// hardware address of its next hop (or server) is not resolved (yet).
+var errNoHardwareAddr = errors.New("hardware address is not resolved")
+
+// NeighborCache resolves the hardware address of IPv4 next hops, using the
+// kernel neighbor table (/proc/net/arp). When an entry is missing, the kernel
+// is triggered to resolve it by sending a UDP probe to the next hop.
+// Resolved addresses are cached until the TTL expires.
+// Resolving an address can take up to a second, the packet path must use
+// LookupNextHop, which resolves the address in the background.
+// Note that the packet path is IPv4 only, so NDP (IPv6) is not supported.
+type NeighborCache struct {
+	sync.RWMutex
+	ttl     time.Duration
+	entries map[string]neighborEntry // by 4 byte IP
+	pending map[string]bool
+
+	// lookupRoute, readTable and probe are replaced in tests
+	lookupRoute func(ip net.IP) (Route, error)
+	readTable   func() (map[string]net.HardwareAddr, error)
+	probe       func(ip net.IP) error
+}
+
+type neighborEntry struct {
+	hwAddr  net.HardwareAddr
+	expires time.Time
+}
+
+// NewNeighborCache creates and initializes a new NeighborCache.
+func NewNeighborCache(ttl time.Duration) *NeighborCache {
+	return &NeighborCache{
+		ttl:         ttl,
+		entries:     make(map[string]neighborEntry),
+		pending:     make(map[string]bool),
+		lookupRoute: LookupRoute,
+		readTable:   readARPTable,
+		probe:       probeNeighbor,
+	}
+}
+
+// Resolve returns the hardware address of the next hop for the given IP.
+func (c *NeighborCache) Resolve(ip net.IP) (net.HardwareAddr, error) {
+	nextHop := ip
+	if r, err := c.lookupRoute(ip); err == nil {
+		nextHop = r.NextHop(ip)
+	}
+	return c.ResolveNextHop(nextHop)
+}
+
+// ResolveNextHop returns the hardware address of the given (directly
+// connected) next hop.
+func (c *NeighborCache) ResolveNextHop(ip net.IP) (net.HardwareAddr, error) {
+	c.RLock()
+	entry, ok := c.entries[string(ip.To4())]
+	c.RUnlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.hwAddr, nil
+	}
+
+	hwAddr, err := c.lookup(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	c.entries[string(ip.To4())] = neighborEntry{
+		hwAddr:  hwAddr,
+		expires: time.Now().Add(c.ttl),
+	}
+	c.Unlock()
+
+	return hwAddr, nil
+}
+
+// LookupNextHop returns the cached hardware address of the given (directly
+// connected) next hop, without blocking. When the address is not cached or
+// its entry has expired, it is resolved in the background. Until then, an
+// expired address is still returned and a missing address returns false.
+func (c *NeighborCache) LookupNextHop(ip net.IP) (net.HardwareAddr, bool) {
+	// the keys are converted in the index expressions, which does not
+	// allocate
+	ip4 := ip.To4()
+	c.RLock()
+	entry, ok := c.entries[string(ip4)]
+	pending := c.pending[string(ip4)]
+	c.RUnlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.hwAddr, true
+	}
+	if !pending {
+		c.resolveBackground(append(net.IP(nil), ip...))
+	}
+	return entry.hwAddr, ok
+}
+
+// resolveBackground resolves the hardware address of the given next hop in
+// a new goroutine, unless it is being resolved already.
+func (c *NeighborCache) resolveBackground(ip net.IP) {
+	key := string(ip.To4())
+	c.Lock()
+	defer c.Unlock()
+	if c.pending[key] {
+		return
+	}
+	c.pending[key] = true
+
+	go func() {
+		if _, err := c.ResolveNextHop(ip); err != nil {
+			log.WithField("next_hop", ip).Warningf("could not resolve hardware address: %s", err)
+		}
+		c.Lock()
+		delete(c.pending, key)
+		c.Unlock()
+	}()
+}
+
+// lookup reads the hardware address from the kernel neighbor table. When
+// the entry is missing, it probes the neighbor and retries a few times.
+func (c *NeighborCache) lookup(ip net.IP) (net.HardwareAddr, error) {
+	for i := 0; i < 10; i++ {
+		table, err := c.readTable()
+		if err != nil {
+			return nil, err
+		}
+		if hwAddr, ok := table[ip.String()]; ok {
+			return hwAddr, nil
+		}
+
+		if i == 0 {
+			if err := c.probe(ip); err != nil {
+				return nil, fmt.Errorf("could not probe %s: %s", ip, err)
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return nil, fmt.Errorf("could not resolve hardware address of %s", ip)
+}
+
+// RefreshServers resolves the hardware address of the servers in the given
+// pool that have ResolveHardwareAddr set and updates it when it has changed.
+func (c *NeighborCache) RefreshServers(pool PoolBalancer) {
+	for _, s := range pool.Servers() {
+		if !s.ResolveHardwareAddr {
+			continue
+		}
+
+		hwAddr, err := c.Resolve(s.IP)
+		if err != nil {
+			log.WithField("server", s.IP).Errorf("could not resolve hardware address: %s", err)
+			continue
+		}
+
+		if current := s.GetHardwareAddr(); !bytes.Equal(current, hwAddr) {
+			log.WithFields(log.Fields{
+				"server":  s.IP,
+				"old_mac": current,
+				"new_mac": hwAddr,
+			}).Info("server hardware address changed")
+			s.SetHardwareAddr(hwAddr)
+		}
+	}
+}
+
+// RunRefresh refreshes the hardware addresses of the servers in the given
+// pools at the given interval, until the program exits.
+func (c *NeighborCache) RunRefresh(pools []PoolBalancer, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		for _, pool := range pools {
+			c.RefreshServers(pool)
+		}
+	}
+}
+
+// probeNeighbor triggers the kernel to resolve the hardware address of the
+// given IP by sending an UDP packet to the discard port.
+func probeNeighbor(ip net.IP) error {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: ip, Port: 9})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte{0})
+	return err
+}
+
+func readARPTable() (map[string]net.HardwareAddr, error) {
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseARPTable(f)
+}
+
+// parseARPTable parses the complete entries in the /proc/net/arp format.
+func parseARPTable(r io.Reader) (map[string]net.HardwareAddr, error) {
+	out := make(map[string]net.HardwareAddr)
+	scanner := bufio.NewScanner(r)
+
+	// skip header
+	scanner.Scan()
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+
+		flags, err := strconv.ParseUint(strings.TrimPrefix(fields[2], "0x"), 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse ARP flags: %s", err)
+		}
+		if flags&0x2 == 0 {
+			// entry is not complete
+			continue
+		}
+
+		hwAddr, err := net.ParseMAC(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		out[fields[0]] = hwAddr
+	}
+
+	return out, scanner.Err()
+}
@@ -0,0 +1,98 @@
+package balancer
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testProcNetARP = `IP address       HW type     Flags       HW address            Mask     Device
+192.168.33.20    0x1         0x2         08:00:27:33:d1:63     *        eth1
+192.168.33.21    0x1         0x0         00:00:00:00:00:00     *        eth1
+`
+
+func TestParseARPTable(t *testing.T) {
+	table, err := parseARPTable(strings.NewReader(testProcNetARP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hwAddr := table["192.168.33.20"]; hwAddr.String() != "08:00:27:33:d1:63" {
+		t.Errorf("Was expecting 08:00:27:33:d1:63, got: %s", hwAddr)
+	}
+	if _, ok := table["192.168.33.21"]; ok {
+		t.Error("Incomplete entries should be skipped.")
+	}
+}
+
+func TestNeighborCache(t *testing.T) {
+	hwAddr, _ := net.ParseMAC("08:00:27:33:d1:63")
+	table := make(map[string]net.HardwareAddr)
+	var probed []string
+
+	c := NewNeighborCache(time.Minute)
+	c.lookupRoute = func(ip net.IP) (Route, error) {
+		// directly connected
+		return Route{}, nil
+	}
+	c.readTable = func() (map[string]net.HardwareAddr, error) {
+		return table, nil
+	}
+	c.probe = func(ip net.IP) error {
+		probed = append(probed, ip.String())
+		// the kernel resolved the address
+		table[ip.String()] = hwAddr
+		return nil
+	}
+
+	ip := net.ParseIP("192.168.33.20")
+	resolved, err := c.ResolveNextHop(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.String() != hwAddr.String() || len(probed) != 1 {
+		t.Fatalf("Was expecting %s after one probe, got: %s after %d probes", hwAddr, resolved, len(probed))
+	}
+
+	// the MAC changed, but the cached entry has not yet expired
+	newHWAddr, _ := net.ParseMAC("08:00:27:33:d1:64")
+	table[ip.String()] = newHWAddr
+	if resolved, _ = c.ResolveNextHop(ip); resolved.String() != hwAddr.String() {
+		t.Errorf("Was expecting the cached %s, got: %s", hwAddr, resolved)
+	}
+
+	// the packet path does not wait for an address to be resolved
+	other := net.ParseIP("192.168.33.21")
+	if _, ok := c.LookupNextHop(other); ok {
+		t.Error("The address should not have been resolved yet.")
+	}
+	for i := 0; i < 100; i++ {
+		if resolved, ok := c.LookupNextHop(other); ok {
+			if resolved.String() != hwAddr.String() {
+				t.Errorf("Was expecting %s, got: %s", hwAddr, resolved)
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := c.LookupNextHop(other); !ok {
+		t.Error("The address should have been resolved in the background.")
+	}
+
+	// servers are updated once the cache has expired
+	c.ttl = 0
+	c.entries = make(map[string]neighborEntry)
+	s := &Server{IP: ip, HardwareAddr: hwAddr, ResolveHardwareAddr: true}
+	static := &Server{IP: ip, HardwareAddr: hwAddr}
+	pool := NewModuloPool()
+	pool.AddServer(s)
+	pool.AddServer(static)
+
+	c.RefreshServers(pool)
+	if s.GetHardwareAddr().String() != newHWAddr.String() {
+		t.Errorf("Was expecting server MAC %s, got: %s", newHWAddr, s.GetHardwareAddr())
+	}
+	if static.GetHardwareAddr().String() != hwAddr.String() {
+		t.Errorf("Static server MAC should not have been updated, got: %s", static.GetHardwareAddr())
+	}
+}
@@ -0,0 +1,108 @@
+package balancer
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// PacketSource receives packets. The packets are sent to the channel
+// returned by Packets (which must only be called once), the channel is closed
+// when the source is closed. It is implemented by *PcapHandle,
+// *AFPacketHandle (Ethernet frames), *RawSocket, *TUN (IPv4 packets) and
+// *MemoryPort.
+type PacketSource interface {
+	Packets() chan gopacket.Packet
+	Close()
+}
+
+// PacketSink sends packets. It is implemented by the same types as
+// PacketSource.
+type PacketSink interface {
+	WritePacketData(data []byte) error
+}
+
+// PacketHandle is a PacketSource that can also send packets, e.g. the
+// capture handle of an interface.
+type PacketHandle interface {
+	PacketSource
+	PacketSink
+}
+
+// ErrClosed is returned when sending packets on a closed handle.
+var ErrClosed = errors.New("handle is closed")
+
+// MemoryPort is one end of an in-memory link (see NewMemoryLink), e.g. to
+// test the packet handlers without an interface.
+type MemoryPort struct {
+	firstLayer gopacket.LayerType
+	in         chan gopacket.Packet
+	peer       *MemoryPort
+	dropped    uint64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewMemoryLink returns the two ends of an in-memory link, the packets
+// written to one end are received from the other end. The packets are
+// decoded starting at the given layer (e.g. layers.LayerTypeEthernet or
+// layers.LayerTypeIPv4). Like a NIC, a port drops the packets written to
+// its peer once queueLen received packets are queued.
+func NewMemoryLink(firstLayer gopacket.LayerType, queueLen int) (*MemoryPort, *MemoryPort) {
+	a := &MemoryPort{firstLayer: firstLayer, in: make(chan gopacket.Packet, queueLen)}
+	b := &MemoryPort{firstLayer: firstLayer, in: make(chan gopacket.Packet, queueLen)}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+// Packets returns the channel with the packets received from the peer.
+func (p *MemoryPort) Packets() chan gopacket.Packet {
+	return p.in
+}
+
+// WritePacketData sends a copy of the given data to the peer. It is safe for
+// concurrent use.
+func (p *MemoryPort) WritePacketData(data []byte) error {
+	return p.peer.receive(data)
+}
+
+// Dropped returns the number of packets dropped because the queue of the
+// port was full.
+func (p *MemoryPort) Dropped() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
+
+// Close closes the port, its Packets channel is closed and the packets sent
+// to it are rejected.
+func (p *MemoryPort) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.in)
+	}
+}
+
+func (p *MemoryPort) receive(data []byte) error {
+	b := append([]byte(nil), data...)
+	packet := gopacket.NewPacket(b, p.firstLayer, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	packet.Metadata().Timestamp = time.Now()
+	packet.Metadata().CaptureLength = len(b)
+	packet.Metadata().Length = len(b)
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrClosed
+	}
+	select {
+	case p.in <- packet:
+	default:
+		atomic.AddUint64(&p.dropped, 1)
+	}
+	return nil
+}
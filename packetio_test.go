@@ -0,0 +1,46 @@
+package balancer
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestMemoryLink(t *testing.T) {
+	a, b := NewMemoryLink(layers.LayerTypeEthernet, 2)
+
+	data := []byte{1, 2, 3}
+	for i := 0; i < 3; i++ {
+		if err := a.WritePacketData(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the data is copied
+	data[0] = 4
+
+	if n := b.Dropped(); n != 1 {
+		t.Errorf("Was expecting 1 dropped packet, got: %d", n)
+	}
+	if n := a.Dropped(); n != 0 {
+		t.Errorf("Was expecting no dropped packets at the sender, got: %d", n)
+	}
+	if p := <-b.Packets(); p.Data()[0] != 1 {
+		t.Errorf("Was expecting a copy of the written data, got: %v", p.Data())
+	}
+
+	if err := b.WritePacketData(data); err != nil {
+		t.Fatal(err)
+	}
+	if p := <-a.Packets(); p.Data()[0] != 4 {
+		t.Errorf("Was expecting the packet written to b, got: %v", p.Data())
+	}
+
+	b.Close()
+	if err := a.WritePacketData(data); err != ErrClosed {
+		t.Errorf("Was expecting ErrClosed, got: %v", err)
+	}
+	<-b.Packets()
+	if _, ok := <-b.Packets(); ok {
+		t.Error("Was expecting the packets channel to be closed.")
+	}
+}
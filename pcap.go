@@ -0,0 +1,68 @@
+package balancer
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// PcapHandle captures and sends packets on an interface using libpcap. The
+// packets sent by the local host are marked with checksumNotReady (see
+// localSource).
+type PcapHandle struct {
+	handle *pcap.Handle
+	local  *localSource
+}
+
+// NewPcapHandle opens a new PcapHandle for the given interface. When
+// ignoreOutgoing is set, the packets sent by this host are not captured.
+func NewPcapHandle(iface string, ignoreOutgoing bool) (*PcapHandle, error) {
+	ih, err := pcap.NewInactiveHandle(iface)
+	if err != nil {
+		return nil, fmt.Errorf("could not bind to interface %s: %s", iface, err)
+	}
+	defer ih.CleanUp()
+	ih.SetImmediateMode(true)
+	handle, err := ih.Activate()
+	if err != nil {
+		return nil, fmt.Errorf("could not activate handle: %s", err)
+	}
+	if ignoreOutgoing {
+		if err := handle.SetDirection(pcap.DirectionIn); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("could not set capture direction: %s", err)
+		}
+	}
+	var hwAddr net.HardwareAddr
+	if i, err := net.InterfaceByName(iface); err == nil {
+		hwAddr = i.HardwareAddr
+	}
+	return &PcapHandle{handle: handle, local: newLocalSource(hwAddr)}, nil
+}
+
+// SetBPFFilter sets the BPF filter of the handle.
+func (h *PcapHandle) SetBPFFilter(expr string) error {
+	return h.handle.SetBPFFilter(expr)
+}
+
+// Packets returns a channel with the received packets. The packets are
+// decoded lazily, by the handlers (see BalancePacket). The channel is closed
+// when the handle is closed.
+func (h *PcapHandle) Packets() chan gopacket.Packet {
+	source := gopacket.NewPacketSource(localPacketDataSource{src: h.handle, first: h.handle.LinkType().LayerType(), local: h.local}, h.handle.LinkType())
+	source.Lazy = true
+	source.NoCopy = true
+	return source.Packets()
+}
+
+// WritePacketData sends the given Ethernet frame.
+func (h *PcapHandle) WritePacketData(data []byte) error {
+	return h.handle.WritePacketData(data)
+}
+
+// Close closes the handle.
+func (h *PcapHandle) Close() {
+	h.handle.Close()
+}
@@ -0,0 +1,42 @@
+package balancer
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// PortMap maps the (VIP) ports on which the packetbridge receives traffic
+// from the balancer to the ports the backend is listening on.
+type PortMap map[layers.TCPPort]layers.TCPPort
+
+// BackendPort returns the backend port for the given VIP port.
+func (m PortMap) BackendPort(port layers.TCPPort) (layers.TCPPort, bool) {
+	backendPort, ok := m[port]
+	return backendPort, ok
+}
+
+// HasBackendPort returns true when the given port is one of the backend
+// ports.
+func (m PortMap) HasBackendPort(port layers.TCPPort) bool {
+	for _, backendPort := range m {
+		if backendPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+// BPFFilter returns the BPF filter matching the traffic for all VIP ports
+// on the given host.
+func (m PortMap) BPFFilter(host net.IP) string {
+	var ports []string
+	for port := range m {
+		ports = append(ports, fmt.Sprintf("dst port %d", port))
+	}
+	sort.Strings(ports)
+	return fmt.Sprintf("tcp and dst host %s and (%s)", host, strings.Join(ports, " or "))
+}
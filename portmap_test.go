@@ -0,0 +1,34 @@
+package balancer
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestPortMap(t *testing.T) {
+	m := PortMap{
+		layers.TCPPort(80):  layers.TCPPort(8080),
+		layers.TCPPort(443): layers.TCPPort(8443),
+	}
+
+	if port, ok := m.BackendPort(80); !ok || port != 8080 {
+		t.Errorf("Was expecting backend port 8080, got: %d", port)
+	}
+	if _, ok := m.BackendPort(8080); ok {
+		t.Error("Port 8080 is not a listener port.")
+	}
+
+	if !m.HasBackendPort(8443) {
+		t.Error("Port 8443 should be a backend port.")
+	}
+	if m.HasBackendPort(443) {
+		t.Error("Port 443 is not a backend port.")
+	}
+
+	expected := "tcp and dst host 10.0.0.1 and (dst port 443 or dst port 80)"
+	if f := m.BPFFilter(net.ParseIP("10.0.0.1")); f != expected {
+		t.Errorf("Was expecting BPF filter: %s, got: %s", expected, f)
+	}
+}
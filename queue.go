@@ -0,0 +1,298 @@
+package balancer
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OverflowPolicy defines what a packet queue does with a packet when it is
+// full.
+type OverflowPolicy uint8
+
+const (
+	// OVERFLOW_BLOCK waits until there is room in the queue (backpressure),
+	// a slow sender stalls the handlers and with them the capture
+	OVERFLOW_BLOCK OverflowPolicy = iota
+	// OVERFLOW_DROP_NEWEST drops the packet that does not fit
+	OVERFLOW_DROP_NEWEST
+	// OVERFLOW_DROP_OLDEST drops the packet at the head of the queue to make
+	// room for the new packet
+	OVERFLOW_DROP_OLDEST
+	// OVERFLOW_PRIORITIZE_CONTROL drops the oldest queued data packet to
+	// make room for a control packet (SYN, FIN or RST), as a lost control
+	// packet costs a handshake or leaves a connection open. Data packets
+	// that do not fit are dropped, TCP retransmits them.
+	OVERFLOW_PRIORITIZE_CONTROL
+)
+
+var overflowPolicyNames = map[OverflowPolicy]string{
+	OVERFLOW_BLOCK:              "block",
+	OVERFLOW_DROP_NEWEST:        "drop-newest",
+	OVERFLOW_DROP_OLDEST:        "drop-oldest",
+	OVERFLOW_PRIORITIZE_CONTROL: "prioritize-control",
+}
+
+func (p OverflowPolicy) String() string {
+	if name, ok := overflowPolicyNames[p]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseOverflowPolicy returns the OverflowPolicy for the given name.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	if name == "" {
+		return OVERFLOW_BLOCK, nil
+	}
+	for p, n := range overflowPolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return OVERFLOW_BLOCK, fmt.Errorf("unknown overflow policy: %s", name)
+}
+
+// queuedPacket is a packet in a packetQueue, a dropped packet is released.
+type queuedPacket interface {
+	Release()
+	isControl() bool
+}
+
+// packetQueue is a bounded FIFO queue of packets between the handlers and
+// the goroutine sending them. When it is full, the packets are dropped (or
+// the handler waits) according to the OverflowPolicy. It is safe for
+// concurrent use.
+type packetQueue struct {
+	policy OverflowPolicy
+
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	packets  []queuedPacket // ring buffer
+	head     int
+	len      int
+	closed   bool
+
+	full         prometheus.Counter
+	dropsControl prometheus.Counter
+	dropsData    prometheus.Counter
+	length       prometheus.Gauge
+}
+
+func newPacketQueue(name string, size int, policy OverflowPolicy) *packetQueue {
+	if size < 1 {
+		size = 1
+	}
+	q := &packetQueue{
+		policy:       policy,
+		packets:      make([]queuedPacket, size),
+		full:         queueFull.WithLabelValues(name),
+		dropsControl: queueDrops.WithLabelValues(name, "control"),
+		dropsData:    queueDrops.WithLabelValues(name, "data"),
+		length:       queueLength.WithLabelValues(name),
+	}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	return q
+}
+
+// put adds the given packet to the queue. The queue takes over the packet,
+// when it is dropped (or an other packet is dropped for it) the dropped
+// packet is released.
+func (q *packetQueue) put(p queuedPacket) {
+	q.mu.Lock()
+	if q.len == len(q.packets) && !q.closed {
+		q.full.Inc()
+		for q.policy == OVERFLOW_BLOCK && q.len == len(q.packets) && !q.closed {
+			q.notFull.Wait()
+		}
+	}
+	if q.closed {
+		q.mu.Unlock()
+		q.drop(p)
+		return
+	}
+
+	var dropped queuedPacket
+	if q.len == len(q.packets) {
+		switch q.policy {
+		case OVERFLOW_DROP_OLDEST:
+			dropped = q.remove(0)
+		case OVERFLOW_PRIORITIZE_CONTROL:
+			if p.isControl() {
+				for i := 0; i < q.len; i++ {
+					if !q.at(i).isControl() {
+						dropped = q.remove(i)
+						break
+					}
+				}
+			}
+		}
+		if dropped == nil {
+			q.mu.Unlock()
+			q.drop(p)
+			return
+		}
+	}
+
+	q.packets[(q.head+q.len)%len(q.packets)] = p
+	q.len++
+	q.length.Set(float64(q.len))
+	q.notEmpty.Signal()
+	q.mu.Unlock()
+
+	if dropped != nil {
+		q.drop(dropped)
+	}
+}
+
+// drop releases the given packet and counts the drop.
+func (q *packetQueue) drop(p queuedPacket) {
+	if p.isControl() {
+		q.dropsControl.Inc()
+	} else {
+		q.dropsData.Inc()
+	}
+	p.Release()
+}
+
+// at returns the i-th packet from the head of the queue.
+func (q *packetQueue) at(i int) queuedPacket {
+	return q.packets[(q.head+i)%len(q.packets)]
+}
+
+// remove removes the i-th packet from the head of the queue, the packets
+// after it move up.
+func (q *packetQueue) remove(i int) queuedPacket {
+	p := q.at(i)
+	if i == 0 {
+		q.packets[q.head] = nil
+		q.head = (q.head + 1) % len(q.packets)
+		q.len--
+		return p
+	}
+	for ; i < q.len-1; i++ {
+		q.packets[(q.head+i)%len(q.packets)] = q.at(i + 1)
+	}
+	q.packets[(q.head+q.len-1)%len(q.packets)] = nil
+	q.len--
+	return p
+}
+
+// get removes the packet at the head of the queue, when wait is set it
+// waits for a packet until the queue is closed. It returns false when there
+// is no packet.
+func (q *packetQueue) get(wait bool) (queuedPacket, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for wait && q.len == 0 && !q.closed {
+		q.notEmpty.Wait()
+	}
+	if q.len == 0 {
+		return nil, false
+	}
+	p := q.packets[q.head]
+	q.packets[q.head] = nil
+	q.head = (q.head + 1) % len(q.packets)
+	q.len--
+	q.length.Set(float64(q.len))
+	q.notFull.Signal()
+	return p, true
+}
+
+// Len returns the number of queued packets.
+func (q *packetQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.len
+}
+
+// Close closes the queue, the queued packets can still be received. The
+// packets put afterwards are dropped.
+func (q *packetQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+// EthPacketQueue is a bounded queue of EthPackets, e.g. between the balancer
+// handlers and the goroutine sending the packets to the servers. The queue
+// name is used as label of the queue metrics.
+type EthPacketQueue struct {
+	*packetQueue
+}
+
+// NewEthPacketQueue returns a new EthPacketQueue holding the given number of
+// packets.
+func NewEthPacketQueue(name string, size int, policy OverflowPolicy) *EthPacketQueue {
+	return &EthPacketQueue{newPacketQueue(name, size, policy)}
+}
+
+// Put adds the given packet to the queue, see OverflowPolicy. A dropped
+// packet is released.
+func (q *EthPacketQueue) Put(p *EthPacket) {
+	q.put(p)
+}
+
+// Get waits for a packet and removes it from the queue. It returns false
+// when the queue is closed and empty.
+func (q *EthPacketQueue) Get() (*EthPacket, bool) {
+	p, ok := q.get(true)
+	if !ok {
+		return nil, false
+	}
+	return p.(*EthPacket), true
+}
+
+// TryGet removes a packet from the queue, it returns false when the queue is
+// empty.
+func (q *EthPacketQueue) TryGet() (*EthPacket, bool) {
+	p, ok := q.get(false)
+	if !ok {
+		return nil, false
+	}
+	return p.(*EthPacket), true
+}
+
+// TCPPacketQueue is a bounded queue of TCPPackets, e.g. between the
+// packetbridge handlers and the goroutine sending the packets to the
+// backends, see EthPacketQueue.
+type TCPPacketQueue struct {
+	*packetQueue
+}
+
+// NewTCPPacketQueue returns a new TCPPacketQueue holding the given number of
+// packets.
+func NewTCPPacketQueue(name string, size int, policy OverflowPolicy) *TCPPacketQueue {
+	return &TCPPacketQueue{newPacketQueue(name, size, policy)}
+}
+
+// Put adds the given packet to the queue, see OverflowPolicy. A dropped
+// packet is released.
+func (q *TCPPacketQueue) Put(p *TCPPacket) {
+	q.put(p)
+}
+
+// Get waits for a packet and removes it from the queue. It returns false
+// when the queue is closed and empty.
+func (q *TCPPacketQueue) Get() (*TCPPacket, bool) {
+	p, ok := q.get(true)
+	if !ok {
+		return nil, false
+	}
+	return p.(*TCPPacket), true
+}
+
+// TryGet removes a packet from the queue, it returns false when the queue is
+// empty.
+func (q *TCPPacketQueue) TryGet() (*TCPPacket, bool) {
+	p, ok := q.get(false)
+	if !ok {
+		return nil, false
+	}
+	return p.(*TCPPacket), true
+}
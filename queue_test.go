@@ -0,0 +1,103 @@
+package balancer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for _, p := range []OverflowPolicy{OVERFLOW_BLOCK, OVERFLOW_DROP_NEWEST, OVERFLOW_DROP_OLDEST, OVERFLOW_PRIORITIZE_CONTROL} {
+		if parsed, err := ParseOverflowPolicy(p.String()); err != nil || parsed != p {
+			t.Errorf("Was expecting %s, got: %s (%v)", p, parsed, err)
+		}
+	}
+	if _, err := ParseOverflowPolicy("drop-all"); err == nil {
+		t.Error("Was expecting an error for an unknown policy.")
+	}
+}
+
+func TestPacketQueueOverflow(t *testing.T) {
+	// the packets are identified by their sequence number, packets with
+	// an odd sequence number are SYNs
+	packet := func(seq uint32) *TCPPacket {
+		return NewTCPPacket(&layers.IPv4{}, &layers.TCP{Seq: seq, SYN: seq%2 == 1})
+	}
+	drain := func(q *TCPPacketQueue) []uint32 {
+		var seqs []uint32
+		for p, ok := q.TryGet(); ok; p, ok = q.TryGet() {
+			seqs = append(seqs, p.tcp.Seq)
+		}
+		return seqs
+	}
+
+	for _, test := range []struct {
+		policy OverflowPolicy
+		in     []uint32
+		out    []uint32
+	}{
+		{OVERFLOW_DROP_NEWEST, []uint32{2, 4, 6, 8}, []uint32{2, 4, 6}},
+		{OVERFLOW_DROP_OLDEST, []uint32{2, 4, 6, 8}, []uint32{4, 6, 8}},
+		// a SYN replaces the oldest data packet, data is dropped
+		{OVERFLOW_PRIORITIZE_CONTROL, []uint32{1, 4, 6, 9, 10}, []uint32{1, 6, 9}},
+		// when only control packets are queued, the SYN is dropped
+		{OVERFLOW_PRIORITIZE_CONTROL, []uint32{1, 3, 5, 7}, []uint32{1, 3, 5}},
+	} {
+		q := NewTCPPacketQueue("test", 3, test.policy)
+		for _, seq := range test.in {
+			q.Put(packet(seq))
+		}
+		if out := drain(q); !reflect.DeepEqual(out, test.out) {
+			t.Errorf("%s %v: was expecting %v, got: %v", test.policy, test.in, test.out, out)
+		}
+
+		// the queue wraps around
+		for _, seq := range test.in {
+			q.Put(packet(seq))
+		}
+		if out := drain(q); !reflect.DeepEqual(out, test.out) {
+			t.Errorf("%s %v (again): was expecting %v, got: %v", test.policy, test.in, test.out, out)
+		}
+	}
+}
+
+func TestPacketQueueBlock(t *testing.T) {
+	q := NewEthPacketQueue("test", 1, OVERFLOW_BLOCK)
+	q.Put(NewEthPacket(&layers.Ethernet{}, &layers.IPv4{}, &layers.TCP{Seq: 1}))
+
+	put := make(chan struct{})
+	go func() {
+		q.Put(NewEthPacket(&layers.Ethernet{}, &layers.IPv4{}, &layers.TCP{Seq: 2}))
+		close(put)
+	}()
+	select {
+	case <-put:
+		t.Fatal("Was expecting Put to wait until there is room.")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	for _, seq := range []uint32{1, 2} {
+		if p, ok := q.Get(); !ok || p.tcp.Seq != seq {
+			t.Fatalf("Was expecting packet %d, got: %v", seq, p)
+		}
+	}
+	<-put
+
+	// Get returns when the queue is closed, the packets put afterwards are
+	// dropped
+	got := make(chan bool)
+	go func() {
+		_, ok := q.Get()
+		got <- ok
+	}()
+	q.Close()
+	if <-got {
+		t.Error("Was expecting no packet from the closed queue.")
+	}
+	q.Put(NewEthPacket(&layers.Ethernet{}, &layers.IPv4{}, &layers.TCP{Seq: 3}))
+	if q.Len() != 0 {
+		t.Error("Was expecting the packet to be dropped.")
+	}
+}
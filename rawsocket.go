@@ -0,0 +1,123 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+)
+
+// RawSocket receives and sends IPv4 TCP packets (including the IPv4 header)
+// using a raw socket. The kernel still handles the packets it receives
+// itself, e.g. it answers the packets for unknown connections with a RST
+// unless these are filtered. The packets sent by the local host are marked
+// with checksumNotReady (see localSource).
+type RawSocket struct {
+	file  *os.File
+	conn  syscall.RawConn
+	local *localSource
+}
+
+// NewRawSocket opens a new RawSocket. When localIP is set, only the packets
+// sent to this IP are received.
+func NewRawSocket(localIP net.IP) (*RawSocket, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_TCP)
+	if err != nil {
+		return nil, fmt.Errorf("could not open raw socket: %s", err)
+	}
+	syscall.CloseOnExec(fd)
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_HDRINCL, 1); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("could not set IP_HDRINCL: %s", err)
+	}
+	if ip := localIP.To4(); ip != nil {
+		addr := &syscall.SockaddrInet4{}
+		copy(addr.Addr[:], ip)
+		if err := syscall.Bind(fd, addr); err != nil {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("could not bind raw socket to %s: %s", ip, err)
+		}
+	}
+	// a non-blocking file uses the runtime poller, so that Close unblocks
+	// the reader
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	file := os.NewFile(uintptr(fd), "raw")
+	conn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &RawSocket{file: file, conn: conn, local: newLocalSource(nil)}, nil
+}
+
+// Packets returns a channel with the received IPv4 packets. The channel is
+// closed when the socket is closed.
+func (s *RawSocket) Packets() chan gopacket.Packet {
+	out := make(chan gopacket.Packet, 1000)
+	go func() {
+		defer close(out)
+		b := make([]byte, 65535)
+		for {
+			n, err := s.read(b)
+			if err != nil {
+				if !errors.Is(err, os.ErrClosed) {
+					log.Errorf("could not read from raw socket: %s", err)
+				}
+				return
+			}
+			data := append([]byte(nil), b[:n]...)
+			p := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+			if s.local.sent(data, layers.LayerTypeIPv4) {
+				p.Metadata().AncillaryData = []interface{}{checksumNotReady{}}
+			}
+			out <- p
+		}
+	}()
+	return out
+}
+
+func (s *RawSocket) read(b []byte) (int, error) {
+	var n int
+	var rerr error
+	err := s.conn.Read(func(fd uintptr) bool {
+		n, _, rerr = syscall.Recvfrom(int(fd), b, 0)
+		return rerr != syscall.EAGAIN
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, rerr
+}
+
+// WritePacketData sends the given IPv4 packet to its destination IP. It is
+// safe for concurrent use.
+func (s *RawSocket) WritePacketData(data []byte) error {
+	if len(data) < 20 {
+		return fmt.Errorf("invalid IPv4 packet length: %d", len(data))
+	}
+	addr := &syscall.SockaddrInet4{}
+	copy(addr.Addr[:], data[16:20])
+
+	var werr error
+	err := s.conn.Write(func(fd uintptr) bool {
+		werr = syscall.Sendto(int(fd), data, 0, addr)
+		return werr != syscall.EAGAIN
+	})
+	if err != nil {
+		return err
+	}
+	return werr
+}
+
+// Close closes the socket.
+func (s *RawSocket) Close() {
+	s.file.Close()
+}
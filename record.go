@@ -0,0 +1,127 @@
+package balancer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// The state records are the binary encoding of the connection states, used
+// by the state sync protocol and the snapshots. All integers are big endian,
+// the services and servers are identified by their IP (and port).
+
+// stateRecordLen is the length of an encoded State:
+//
+//	client IP (4) | client port (2) | VIP (4) | VIP port (2) | state (1) |
+//	seq (4) | server IP (4, 0.0.0.0 when not selected) | created (8, unix ns)
+const stateRecordLen = 29
+
+// packetBridgeRecordLen is the length of an encoded PacketBridgeState:
+//
+//	client IP (4) | client MAC (6) | client port (2) | random port (2) |
+//	VIP (4) | service port (2) | backend port (2) | backend IP (4) |
+//	lbindex (1) | seq offset (4) | state (1) | flags (1, passthrough 0x01,
+//	encapsulated 0x02) | created (8)
+const packetBridgeRecordLen = 41
+
+func appendStateRecord(b []byte, st State) []byte {
+	server := net.IPv4zero
+	if st.Server != nil {
+		server = st.Server.IP
+	}
+	b = append(b, st.IP.To4()...)
+	b = binary.BigEndian.AppendUint16(b, uint16(st.Port))
+	b = append(b, st.Service.IP.To4()...)
+	b = binary.BigEndian.AppendUint16(b, uint16(st.Service.Port))
+	b = append(b, byte(st.State))
+	b = binary.BigEndian.AppendUint32(b, st.Seq)
+	b = append(b, server.To4()...)
+	return binary.BigEndian.AppendUint64(b, uint64(st.Created.UnixNano()))
+}
+
+// parseStateRecord decodes the State from b, which must be at least
+// stateRecordLen bytes. The service and server are looked up in the given
+// ServiceTable.
+func parseStateRecord(b []byte, services *ServiceTable) (*State, error) {
+	vip := net.IP(b[6:10])
+	vipPort := layers.TCPPort(binary.BigEndian.Uint16(b[10:12]))
+	service, ok := services.GetService(vip, vipPort)
+	if !ok {
+		return nil, fmt.Errorf("unknown service %s:%d", vip, vipPort)
+	}
+
+	state := &State{
+		IP:      copyIP(b[0:4]),
+		Port:    layers.TCPPort(binary.BigEndian.Uint16(b[4:6])),
+		Service: service,
+		State:   TCPState(b[12]),
+		Seq:     binary.BigEndian.Uint32(b[13:17]),
+		Created: time.Unix(0, int64(binary.BigEndian.Uint64(b[21:29]))),
+	}
+	if server := net.IP(b[17:21]); !server.Equal(net.IPv4zero) {
+		if state.Server, ok = GetServerByIP(service.Pool, server); !ok {
+			return nil, fmt.Errorf("unknown server %s for service %s", server, service)
+		}
+	}
+	return state, nil
+}
+
+func appendPacketBridgeRecord(b []byte, st PacketBridgeState) []byte {
+	hwAddr := make([]byte, 6)
+	copy(hwAddr, st.HardwareAddr)
+	var flags byte
+	if st.Passthrough {
+		flags |= 0x01
+	}
+	if st.Encapsulated {
+		flags |= 0x02
+	}
+
+	b = append(b, st.IP.To4()...)
+	b = append(b, hwAddr...)
+	b = binary.BigEndian.AppendUint16(b, uint16(st.Port))
+	b = binary.BigEndian.AppendUint16(b, uint16(st.RandPort))
+	b = append(b, st.VIP.To4()...)
+	b = binary.BigEndian.AppendUint16(b, uint16(st.ServicePort))
+	b = binary.BigEndian.AppendUint16(b, uint16(st.BackendPort))
+	b = append(b, st.Backend.IP.To4()...)
+	b = append(b, st.LBIndex)
+	b = binary.BigEndian.AppendUint32(b, st.SeqOffset)
+	b = append(b, byte(st.State), flags)
+	return binary.BigEndian.AppendUint64(b, uint64(st.Created.UnixNano()))
+}
+
+// parsePacketBridgeRecord decodes the PacketBridgeState from b, which must be
+// at least packetBridgeRecordLen bytes. The backend is looked up in the given
+// pool.
+func parsePacketBridgeRecord(b []byte, pool PoolBalancer) (*PacketBridgeState, error) {
+	backendIP := net.IP(b[22:26])
+	backend, ok := GetServerByIP(pool, backendIP)
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %s", backendIP)
+	}
+
+	return &PacketBridgeState{
+		IP:           copyIP(b[0:4]),
+		HardwareAddr: net.HardwareAddr(append([]byte(nil), b[4:10]...)),
+		Port:         layers.TCPPort(binary.BigEndian.Uint16(b[10:12])),
+		RandPort:     layers.TCPPort(binary.BigEndian.Uint16(b[12:14])),
+		VIP:          copyIP(b[14:18]),
+		ServicePort:  layers.TCPPort(binary.BigEndian.Uint16(b[18:20])),
+		BackendPort:  layers.TCPPort(binary.BigEndian.Uint16(b[20:22])),
+		Backend:      backend,
+		LBIndex:      b[26],
+		SeqOffset:    binary.BigEndian.Uint32(b[27:31]),
+		State:        TCPState(b[31]),
+		Passthrough:  b[32]&0x01 != 0,
+		Encapsulated: b[32]&0x02 != 0,
+		Created:      time.Unix(0, int64(binary.BigEndian.Uint64(b[33:41]))),
+	}, nil
+}
+
+func copyIP(b []byte) net.IP {
+	return net.IP(append([]byte(nil), b...))
+}
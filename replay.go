@@ -0,0 +1,118 @@
+package balancer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// replaySeed seeds the random sequence numbers and ports during a replay.
+const replaySeed = 1
+
+// Replay reads the Ethernet frames of the given pcap capture and passes them
+// to handle, one at a time and in order. While a packet is handled, the
+// clock of the packet handlers (see SetClock) returns its capture time and
+// the random sequence numbers and ports are taken from a seeded source, so
+// that replaying a capture gives the same result on every run. It returns
+// the number of packets read.
+//
+// Replay swaps the package globals of the clock (see SetClock) and the
+// random source until it returns, so it must not run while other packets
+// are handled (e.g. by live workers or an other Replay in the same process).
+func Replay(r io.Reader, handle func(gopacket.Packet)) (int, error) {
+	pr, err := pcapgo.NewReader(r)
+	if err != nil {
+		return 0, fmt.Errorf("could not read pcap header: %s", err)
+	}
+	if pr.LinkType() != layers.LinkTypeEthernet {
+		return 0, fmt.Errorf("unsupported link type: %s", pr.LinkType())
+	}
+
+	var ts time.Time
+	SetClock(func() time.Time { return ts })
+	seededRand = rand.New(rand.NewSource(replaySeed))
+	defer func() {
+		SetClock(time.Now)
+		seededRand = nil
+	}()
+
+	var n int
+	for {
+		data, ci, err := pr.ReadPacketData()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, fmt.Errorf("could not read packet %d: %s", n+1, err)
+		}
+		n++
+
+		ts = ci.Timestamp
+		p := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		p.Metadata().CaptureInfo = ci
+		handle(p)
+	}
+}
+
+// PcapFileSink writes the packets sent to it to a pcap capture, with the
+// time of the clock of the packet handlers (see SetClock). It is safe for
+// concurrent use.
+type PcapFileSink struct {
+	sync.Mutex
+	w       *pcapgo.Writer
+	written int
+}
+
+// NewPcapFileSink writes the pcap file header (Ethernet link type) to w and
+// returns a new PcapFileSink writing to w.
+func NewPcapFileSink(w io.Writer) (*PcapFileSink, error) {
+	pw := pcapgo.NewWriter(w)
+	if err := pw.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		return nil, fmt.Errorf("could not write pcap header: %s", err)
+	}
+	return &PcapFileSink{w: pw}, nil
+}
+
+// WritePacketData writes the given Ethernet frame.
+func (s *PcapFileSink) WritePacketData(data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.written++
+	return s.w.WritePacket(gopacket.CaptureInfo{
+		Timestamp:     now(),
+		CaptureLength: len(data),
+		Length:        len(data),
+	}, data)
+}
+
+// Written returns the number of packets written.
+func (s *PcapFileSink) Written() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.written
+}
+
+// IPv4 returns a PacketSink for IPv4 packets (e.g. the packets for the
+// backends), which are written to s in an Ethernet frame with zero MAC
+// addresses.
+func (s *PcapFileSink) IPv4() PacketSink {
+	return ipv4PcapFileSink{s}
+}
+
+type ipv4PcapFileSink struct {
+	s *PcapFileSink
+}
+
+func (s ipv4PcapFileSink) WritePacketData(data []byte) error {
+	frame := make([]byte, 14+len(data))
+	binary.BigEndian.PutUint16(frame[12:], uint16(layers.EthernetTypeIPv4))
+	copy(frame[14:], data)
+	return s.s.WritePacketData(frame)
+}
@@ -0,0 +1,121 @@
+package balancer
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestReplay(t *testing.T) {
+	balancerMAC, _ := net.ParseMAC("11:11:11:11:11:11")
+	routerMAC, _ := net.ParseMAC("22:22:22:22:22:22")
+	clientIP := net.ParseIP("10.0.0.1").To4()
+	vip := net.ParseIP("192.168.33.100").To4()
+	captured := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// the capture with the SYN and ACK of the client, the sequence number of
+	// the balancer is taken from the seeded source
+	isn := uint32(rand.New(rand.NewSource(replaySeed)).Int31())
+	var capture bytes.Buffer
+	w := pcapgo.NewWriter(&capture)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	for i, tcp := range []*layers.TCP{
+		{SrcPort: 1234, DstPort: 80, Seq: 100, SYN: true, Window: 1024},
+		{SrcPort: 1234, DstPort: 80, Seq: 101, Ack: isn + 1, ACK: true, Window: 1024},
+		{SrcPort: 1234, DstPort: 80, Seq: 101, Ack: isn + 1, ACK: true, PSH: true, Window: 1024, BaseLayer: layers.BaseLayer{Payload: []byte("GET / HTTP/1.0\r\n\r\n")}},
+	} {
+		eth := &layers.Ethernet{SrcMAC: routerMAC, DstMAC: balancerMAC, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, TTL: 63, SrcIP: clientIP, DstIP: vip, Protocol: layers.IPProtocolTCP}
+		p := NewEthPacket(eth, ip, tcp)
+		b, err := p.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ci := gopacket.CaptureInfo{Timestamp: captured.Add(time.Duration(i) * time.Millisecond), CaptureLength: len(b), Length: len(b)}
+		if err := w.WritePacket(ci, b); err != nil {
+			t.Fatal(err)
+		}
+		p.Release()
+	}
+
+	replay := func() ([]byte, *StateTable) {
+		pool := NewConsistentHashPool()
+		pool.AddServer(&Server{IP: net.ParseIP("192.168.33.21").To4(), HardwareAddr: net.HardwareAddr{0x08, 0, 0, 0, 0, 1}})
+		services := NewServiceTable()
+		if err := services.AddService(&Service{
+			IP:           vip,
+			Port:         80,
+			Protocol:     layers.IPProtocolTCP,
+			LBIndex:      3,
+			Pool:         pool,
+			Mode:         MODE_SPLICE,
+			KeyExtractor: FlowKey,
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		sink, err := NewPcapFileSink(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stateTable := NewStateTable()
+		packets := NewEthPacketQueue("test", 16, OVERFLOW_BLOCK)
+		n, err := Replay(bytes.NewReader(capture.Bytes()), func(p gopacket.Packet) {
+			BalancePacket(p, packets, stateTable, services)
+			for p, ok := packets.TryGet(); ok; p, ok = packets.TryGet() {
+				b, err := p.MarshalBinary()
+				if err != nil {
+					t.Fatal(err)
+				}
+				sink.WritePacketData(b)
+				p.Release()
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 3 {
+			t.Errorf("Was expecting 3 replayed packets, got: %d", n)
+		}
+		if sink.Written() != 2 {
+			t.Errorf("Was expecting the SYN ACK and the forwarded request, got %d packets", sink.Written())
+		}
+		return out.Bytes(), stateTable
+	}
+
+	out, stateTable := replay()
+	state, ok := stateTable.GetState(clientIP, 1234, vip, 80)
+	if !ok {
+		t.Fatal("Was expecting a connection state.")
+	}
+	if !state.Created.Equal(captured) {
+		t.Errorf("Was expecting the state to be created at %s, got: %s", captured, state.Created)
+	}
+
+	r, err := pcapgo.NewReader(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []time.Time{captured, captured.Add(2 * time.Millisecond)} {
+		_, ci, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ci.Timestamp.Equal(expected) {
+			t.Errorf("Packet %d: was expecting timestamp %s, got: %s", i, expected, ci.Timestamp)
+		}
+	}
+
+	if again, _ := replay(); !bytes.Equal(again, out) {
+		t.Error("Was expecting the same output when replaying the capture again.")
+	}
+}
@@ -0,0 +1,150 @@
+package balancer
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ReturnPath sends the packets from the backend to the client.
+type ReturnPath interface {
+	Send(p *EthPacket) error
+}
+
+// NewReturnPath returns the ReturnPath for the given mode:
+//
+//	l2:     the packets are sent as-is using the given handle, this
+//	        only works when the client (or its gateway) and the
+//	        packetbridge share the same L2 segment
+//	routed: the outgoing interface and next hop are looked up in the given
+//	        copy of the kernel routing table, the MAC of the next hop is
+//	        resolved using the given NeighborCache
+//	raw:    the IP packets are sent using a raw (IP_HDRINCL) socket, the
+//	        kernel takes care of the routing
+func NewReturnPath(mode string, handle PacketSink, routes *RouteCache, neighbors *NeighborCache) (ReturnPath, error) {
+	switch mode {
+	case "l2":
+		return &L2ReturnPath{handle: handle}, nil
+	case "routed":
+		return NewRoutedReturnPath(routes, neighbors), nil
+	case "raw":
+		return NewRawReturnPath()
+	default:
+		return nil, fmt.Errorf("unknown return mode: %s", mode)
+	}
+}
+
+// L2ReturnPath sends the packets as-is using the given PacketSink, e.g. a
+// pcap or AF_PACKET handle.
+type L2ReturnPath struct {
+	handle PacketSink
+}
+
+// Send sends the given packet.
+func (r *L2ReturnPath) Send(p *EthPacket) error {
+	bytes, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return r.handle.WritePacketData(bytes)
+}
+
+// RoutedReturnPath looks up the outgoing interface and next hop of each
+// packet in the kernel routing table and sets the Ethernet addresses
+// accordingly. The packet is not sent (errNoHardwareAddr) while the MAC
+// address of the next hop is being resolved.
+type RoutedReturnPath struct {
+	sync.Mutex
+	routes    *RouteCache
+	neighbors *NeighborCache
+	handles   map[string]*PcapHandle
+	ifaces    map[string]*net.Interface
+}
+
+// NewRoutedReturnPath creates and initializes a new RoutedReturnPath.
+func NewRoutedReturnPath(routes *RouteCache, neighbors *NeighborCache) *RoutedReturnPath {
+	return &RoutedReturnPath{
+		routes:    routes,
+		neighbors: neighbors,
+		handles:   make(map[string]*PcapHandle),
+		ifaces:    make(map[string]*net.Interface),
+	}
+}
+
+// Send sends the given packet to the next hop of its destination.
+func (r *RoutedReturnPath) Send(p *EthPacket) error {
+	route, err := r.routes.Lookup(p.DstIP())
+	if err != nil {
+		return err
+	}
+	hwAddr, ok := r.neighbors.LookupNextHop(route.NextHop(p.DstIP()))
+	if !ok {
+		return errNoHardwareAddr
+	}
+	handle, iface, err := r.getHandle(route.Iface)
+	if err != nil {
+		return err
+	}
+
+	p.SetHardwareAddrs(iface.HardwareAddr, hwAddr)
+	bytes, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return handle.WritePacketData(bytes)
+}
+
+// getHandle returns the (lazily opened) pcap handle for the given interface.
+func (r *RoutedReturnPath) getHandle(name string) (*PcapHandle, *net.Interface, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if handle, ok := r.handles[name]; ok {
+		return handle, r.ifaces[name], nil
+	}
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	handle, err := NewPcapHandle(name, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.WithField("iface", name).Info("opened return path interface")
+	r.handles[name] = handle
+	r.ifaces[name] = iface
+	return handle, iface, nil
+}
+
+// RawReturnPath sends the IP packets using a raw socket. As the IP header
+// is included, the kernel only takes care of the routing.
+type RawReturnPath struct {
+	fd int
+}
+
+// NewRawReturnPath opens the raw socket and returns a new RawReturnPath.
+func NewRawReturnPath() (*RawReturnPath, error) {
+	// IPPROTO_RAW implies IP_HDRINCL
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err != nil {
+		return nil, fmt.Errorf("could not open raw socket: %s", err)
+	}
+	return &RawReturnPath{fd: fd}, nil
+}
+
+// Send sends the IP layer (and up) of the given packet.
+func (r *RawReturnPath) Send(p *EthPacket) error {
+	bytes, err := p.MarshalIPBinary()
+	if err != nil {
+		return err
+	}
+
+	addr := &syscall.SockaddrInet4{}
+	copy(addr.Addr[:], p.DstIP().To4())
+	return syscall.Sendto(r.fd, bytes, 0, addr)
+}
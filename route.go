@@ -0,0 +1,182 @@
+package balancer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Route represents an IPv4 route of the kernel routing table.
+type Route struct {
+	Iface       string
+	Destination *net.IPNet
+	Gateway     net.IP
+	Metric      int
+}
+
+// NextHop returns the IP of the next hop for the given destination.
+func (r Route) NextHop(ip net.IP) net.IP {
+	if r.Gateway == nil || r.Gateway.IsUnspecified() {
+		return ip
+	}
+	return r.Gateway
+}
+
+// LookupRoute returns the route from the kernel routing table for the
+// given IPv4 destination. It reads the routing table on every call, the
+// packet path must use a RouteCache.
+func LookupRoute(ip net.IP) (Route, error) {
+	routes, err := readRoutes()
+	if err != nil {
+		return Route{}, err
+	}
+	return matchRoute(routes, ip)
+}
+
+// RouteCache is a copy of the kernel routing table, which is refreshed
+// periodically (see RunRefresh).
+type RouteCache struct {
+	routes atomic.Pointer[[]Route]
+
+	// read is replaced in tests
+	read func() ([]Route, error)
+}
+
+// NewRouteCache creates a new RouteCache and reads the routing table.
+func NewRouteCache() (*RouteCache, error) {
+	c := &RouteCache{read: readRoutes}
+	if err := c.Refresh(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Lookup returns the cached route for the given IPv4 destination.
+func (c *RouteCache) Lookup(ip net.IP) (Route, error) {
+	return matchRoute(*c.routes.Load(), ip)
+}
+
+// Refresh reads the routing table.
+func (c *RouteCache) Refresh() error {
+	routes, err := c.read()
+	if err != nil {
+		return fmt.Errorf("could not read routes: %s", err)
+	}
+	c.routes.Store(&routes)
+	return nil
+}
+
+// RunRefresh refreshes the routes at the given interval, until the program
+// exits.
+func (c *RouteCache) RunRefresh(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := c.Refresh(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+func readRoutes() ([]Route, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseRoutes(f)
+}
+
+// matchRoute returns the most specific route (and with the lowest metric)
+// matching the given IP.
+func matchRoute(routes []Route, ip net.IP) (Route, error) {
+	var out Route
+	bestOnes := -1
+
+	for _, r := range routes {
+		if !r.Destination.Contains(ip) {
+			continue
+		}
+		ones, _ := r.Destination.Mask.Size()
+		if ones > bestOnes || (ones == bestOnes && r.Metric < out.Metric) {
+			out = r
+			bestOnes = ones
+		}
+	}
+
+	if bestOnes == -1 {
+		return out, fmt.Errorf("no route to %s", ip)
+	}
+	return out, nil
+}
+
+// parseRoutes parses the routes in the /proc/net/route format.
+func parseRoutes(r io.Reader) ([]Route, error) {
+	var out []Route
+	scanner := bufio.NewScanner(r)
+
+	// skip header
+	scanner.Scan()
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+
+		flags, err := strconv.ParseUint(fields[3], 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse route flags: %s", err)
+		}
+		if flags&0x1 == 0 {
+			// route is not up
+			continue
+		}
+
+		dst, err := parseProcIP(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		gw, err := parseProcIP(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		mask, err := parseProcIP(fields[7])
+		if err != nil {
+			return nil, err
+		}
+		metric, err := strconv.Atoi(fields[6])
+		if err != nil {
+			return nil, fmt.Errorf("could not parse route metric: %s", err)
+		}
+
+		out = append(out, Route{
+			Iface:       fields[0],
+			Destination: &net.IPNet{IP: dst, Mask: net.IPMask(mask)},
+			Gateway:     gw,
+			Metric:      metric,
+		})
+	}
+
+	return out, scanner.Err()
+}
+
+// parseProcIP parses an IPv4 address in the (little-endian) hex format
+// used by /proc/net/route.
+func parseProcIP(s string) (net.IP, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return nil, fmt.Errorf("invalid IP address: %s", s)
+	}
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(b))
+	return ip, nil
+}
@@ -0,0 +1,88 @@
+package balancer
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testProcNetRoute = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	0102A8C0	0003	0	0	100	00000000	0	0	0
+eth0	0002A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+eth1	0021A8C0	00000000	0001	0	0	0	00FFFFFF	0	0	0
+eth2	0021A8C0	00000000	0000	0	0	0	00FFFFFF	0	0	0
+`
+
+func TestRoutes(t *testing.T) {
+	routes, err := parseRoutes(strings.NewReader(testProcNetRoute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 3 {
+		t.Fatalf("Was expecting 3 routes (skipping the route that is down), got: %d", len(routes))
+	}
+
+	tests := []struct {
+		ip      string
+		iface   string
+		nextHop string
+	}{
+		{"192.168.33.20", "eth1", "192.168.33.20"},
+		{"192.168.2.10", "eth0", "192.168.2.10"},
+		{"8.8.8.8", "eth0", "192.168.2.1"},
+	}
+
+	for _, test := range tests {
+		ip := net.ParseIP(test.ip)
+		r, err := matchRoute(routes, ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Iface != test.iface {
+			t.Errorf("Was expecting interface %s for %s, got: %s", test.iface, test.ip, r.Iface)
+		}
+		if nh := r.NextHop(ip); nh.String() != test.nextHop {
+			t.Errorf("Was expecting next hop %s for %s, got: %s", test.nextHop, test.ip, nh)
+		}
+	}
+}
+
+func TestRouteCache(t *testing.T) {
+	table := testProcNetRoute
+	reads := 0
+	c := &RouteCache{read: func() ([]Route, error) {
+		reads++
+		return parseRoutes(strings.NewReader(table))
+	}}
+	if err := c.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("192.168.33.20")
+	for i := 0; i < 3; i++ {
+		r, err := c.Lookup(ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Iface != "eth1" {
+			t.Errorf("Was expecting interface eth1 for %s, got: %s", ip, r.Iface)
+		}
+	}
+	if reads != 1 {
+		t.Errorf("Was expecting the routes to be read once, got: %d", reads)
+	}
+
+	// the route on eth1 is removed, eth2 comes up
+	table = strings.Replace(testProcNetRoute, "eth1	0021A8C0	00000000	0001", "eth1	0021A8C0	00000000	0000", 1)
+	table = strings.Replace(table, "eth2	0021A8C0	00000000	0000", "eth2	0021A8C0	00000000	0001", 1)
+	if err := c.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Lookup(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Iface != "eth2" {
+		t.Errorf("Was expecting interface eth2 for %s after a refresh, got: %s", ip, r.Iface)
+	}
+}
@@ -2,19 +2,108 @@ package balancer
 
 import (
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // PoolBalancer specifies the interface for a balancer backend.
 type PoolBalancer interface {
 	AddServer(*Server)
 	RouteToServer(int64) (*Server, error)
+	Servers() []*Server
+	// ServerByIP returns the server of the pool with the given IP.
+	ServerByIP(net.IP) (*Server, bool)
 }
 
 // Server contains all the information for a backend server.
+// Once the server is in use, its hardware address must be accessed through
+// GetHardwareAddr and SetHardwareAddr, as it can be updated by the
+// NeighborCache.
 type Server struct {
 	IP           net.IP
 	HardwareAddr net.HardwareAddr
+
+	// ResolveHardwareAddr must be set when the hardware address must be
+	// resolved (and kept up-to-date) by the NeighborCache
+	ResolveHardwareAddr bool
+
+	// down is set to 1 by the HealthChecker when the server is unhealthy
+	down int32
+	mu   sync.RWMutex
+
+	// the per-server counters, see initCounters
+	countersOnce sync.Once
+	connections  prometheus.Counter
+	bytes        prometheus.Counter
+}
+
+// GetHardwareAddr returns the hardware address of the server.
+func (s *Server) GetHardwareAddr() net.HardwareAddr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.HardwareAddr
+}
+
+// SetHardwareAddr sets the hardware address of the server.
+func (s *Server) SetHardwareAddr(hwAddr net.HardwareAddr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.HardwareAddr = hwAddr
+}
+
+// countConnection counts a new connection routed to the server, see
+// serverConnections.
+func (s *Server) countConnection() {
+	s.initCounters()
+	s.connections.Inc()
+}
+
+// countBytes counts the given number of TCP payload bytes forwarded to the
+// server, see serverBytes.
+func (s *Server) countBytes(n float64) {
+	s.initCounters()
+	s.bytes.Add(n)
+}
+
+// initCounters looks up the counters of the server once, as they are used
+// for every forwarded packet.
+func (s *Server) initCounters() {
+	s.countersOnce.Do(func() {
+		s.connections = serverConnections.WithLabelValues(s.IP.String())
+		s.bytes = serverBytes.WithLabelValues(s.IP.String())
+	})
+}
+
+// Healthy returns false when the server failed its health check.
+func (s *Server) Healthy() bool {
+	return atomic.LoadInt32(&s.down) == 0
+}
+
+// SetHealthy sets the health of the server.
+func (s *Server) SetHealthy(healthy bool) {
+	if healthy {
+		atomic.StoreInt32(&s.down, 0)
+	} else {
+		atomic.StoreInt32(&s.down, 1)
+	}
+}
+
+// GetServerByIP returns the server of the pool with the given IP.
+func GetServerByIP(pool PoolBalancer, ip net.IP) (*Server, bool) {
+	return pool.ServerByIP(ip)
+}
+
+// serverKey returns the key of the server with the given IP in the IP index
+// of the pools.
+func serverKey(ip net.IP) [net.IPv6len]byte {
+	var key [net.IPv6len]byte
+	copy(key[:], ip.To16())
+	return key
 }
 
 // DummyPool provides a PoolBalancer for a single server.
@@ -32,10 +121,176 @@ func (b *DummyPool) AddServer(s *Server) {
 	b.server = s
 }
 
-// RouteToServer returns the single server (or an error when no server is set).
+// RouteToServer returns the single server (or an error when no server is set
+// or when it is unhealthy).
 func (b *DummyPool) RouteToServer(i int64) (*Server, error) {
-	if b.server == nil {
+	if b.server == nil || !b.server.Healthy() {
 		return nil, errors.New("Could not route to server.")
 	}
 	return b.server, nil
 }
+
+// Servers returns the (single) server.
+func (b *DummyPool) Servers() []*Server {
+	if b.server == nil {
+		return nil
+	}
+	return []*Server{b.server}
+}
+
+// ServerByIP returns the server when it has the given IP.
+func (b *DummyPool) ServerByIP(ip net.IP) (*Server, bool) {
+	if b.server == nil || !b.server.IP.Equal(ip) {
+		return nil, false
+	}
+	return b.server, true
+}
+
+// NewPool returns a new PoolBalancer for the given hashing algorithm.
+func NewPool(algorithm string) (PoolBalancer, error) {
+	switch algorithm {
+	case "dummy":
+		return NewDummyBalancer(), nil
+	case "modulo":
+		return NewModuloPool(), nil
+	case "consistent":
+		return NewConsistentHashPool(), nil
+	default:
+		return nil, fmt.Errorf("unknown hashing algorithm: %s", algorithm)
+	}
+}
+
+// ModuloPool provides a PoolBalancer which routes to the server at index
+// key modulo the number of servers.
+type ModuloPool struct {
+	sync.RWMutex
+	servers []*Server
+	byIP    map[[net.IPv6len]byte]*Server
+}
+
+// NewModuloPool returns a new ModuloPool.
+func NewModuloPool() PoolBalancer {
+	return &ModuloPool{byIP: make(map[[net.IPv6len]byte]*Server)}
+}
+
+// AddServer adds the given server to the pool.
+func (b *ModuloPool) AddServer(s *Server) {
+	b.Lock()
+	defer b.Unlock()
+	b.servers = append(b.servers, s)
+	b.byIP[serverKey(s.IP)] = s
+}
+
+// RouteToServer returns the server for the given key. Unhealthy servers
+// are skipped.
+func (b *ModuloPool) RouteToServer(i int64) (*Server, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	var healthy []*Server
+	for _, s := range b.servers {
+		if s.Healthy() {
+			healthy = append(healthy, s)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return nil, errors.New("Could not route to server.")
+	}
+	// the key is taken as unsigned, -i would still be negative for the
+	// smallest int64
+	return healthy[uint64(i)%uint64(len(healthy))], nil
+}
+
+// Servers returns all servers of the pool.
+func (b *ModuloPool) Servers() []*Server {
+	b.RLock()
+	defer b.RUnlock()
+	return append([]*Server(nil), b.servers...)
+}
+
+// ServerByIP returns the server of the pool with the given IP.
+func (b *ModuloPool) ServerByIP(ip net.IP) (*Server, bool) {
+	b.RLock()
+	defer b.RUnlock()
+	s, ok := b.byIP[serverKey(ip)]
+	return s, ok
+}
+
+// ConsistentHashPool provides a PoolBalancer based on rendezvous (highest
+// random weight) hashing. Adding or removing a server only moves the keys
+// of that server.
+type ConsistentHashPool struct {
+	sync.RWMutex
+	servers []*Server
+	byIP    map[[net.IPv6len]byte]*Server
+}
+
+// NewConsistentHashPool returns a new ConsistentHashPool.
+func NewConsistentHashPool() PoolBalancer {
+	return &ConsistentHashPool{byIP: make(map[[net.IPv6len]byte]*Server)}
+}
+
+// AddServer adds the given server to the pool.
+func (b *ConsistentHashPool) AddServer(s *Server) {
+	b.Lock()
+	defer b.Unlock()
+	b.servers = append(b.servers, s)
+	b.byIP[serverKey(s.IP)] = s
+}
+
+// RouteToServer returns the healthy server with the highest weight for the
+// given key.
+func (b *ConsistentHashPool) RouteToServer(i int64) (*Server, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	var server *Server
+	var max uint64
+	for _, s := range b.servers {
+		if !s.Healthy() {
+			continue
+		}
+		if w := rendezvousWeight(i, s); server == nil || w > max {
+			server = s
+			max = w
+		}
+	}
+	if server == nil {
+		return nil, errors.New("Could not route to server.")
+	}
+	return server, nil
+}
+
+// Servers returns all servers of the pool.
+func (b *ConsistentHashPool) Servers() []*Server {
+	b.RLock()
+	defer b.RUnlock()
+	return append([]*Server(nil), b.servers...)
+}
+
+// ServerByIP returns the server of the pool with the given IP.
+func (b *ConsistentHashPool) ServerByIP(ip net.IP) (*Server, bool) {
+	b.RLock()
+	defer b.RUnlock()
+	s, ok := b.byIP[serverKey(ip)]
+	return s, ok
+}
+
+func rendezvousWeight(key int64, s *Server) uint64 {
+	h := fnv.New64a()
+	h.Write(s.IP.To16())
+	for i := uint(0); i < 64; i += 8 {
+		h.Write([]byte{byte(key >> i)})
+	}
+
+	// fnv does not mix the last bytes very well, finalize the hash
+	// (murmur3 fmix64)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
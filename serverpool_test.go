@@ -1,6 +1,10 @@
 package balancer
 
-import "testing"
+import (
+	"math"
+	"net"
+	"testing"
+)
 
 func TestDummyBalancer(t *testing.T) {
 	s := &Server{}
@@ -21,3 +25,70 @@ func TestDummyBalancer(t *testing.T) {
 		t.Error("The server that was added should be equal to the returned server.")
 	}
 }
+
+func TestConsistentHashPool(t *testing.T) {
+	b := NewConsistentHashPool()
+	if _, err := b.RouteToServer(123); err == nil {
+		t.Fatal("ConsistentHashPool should have returned an error when no server is set.")
+	}
+
+	for i := 1; i <= 4; i++ {
+		b.AddServer(&Server{IP: net.IPv4(10, 0, 0, byte(i))})
+	}
+
+	routes := make(map[int64]*Server)
+	for key := int64(0); key < 1000; key++ {
+		s, err := b.RouteToServer(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes[key] = s
+	}
+
+	// adding a server should only move keys to the new server
+	added := &Server{IP: net.IPv4(10, 0, 0, 5)}
+	b.AddServer(added)
+	for key, before := range routes {
+		s, err := b.RouteToServer(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != before && s != added {
+			t.Fatalf("Key %d moved from %s to %s.", key, before.IP, s.IP)
+		}
+	}
+}
+
+func TestModuloPool(t *testing.T) {
+	b := NewModuloPool()
+	s1 := &Server{IP: net.IPv4(10, 0, 0, 1)}
+	s2 := &Server{IP: net.IPv4(10, 0, 0, 2)}
+	b.AddServer(s1)
+	b.AddServer(s2)
+
+	for key, expected := range map[int64]*Server{0: s1, 1: s2, 2: s1, -3: s2, math.MinInt64: s1} {
+		s, err := b.RouteToServer(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != expected {
+			t.Errorf("Was expecting server %s for key %d, got: %s", expected.IP, key, s.IP)
+		}
+	}
+}
+
+func TestServerByIP(t *testing.T) {
+	for _, algorithm := range []string{"dummy", "modulo", "consistent"} {
+		pool, _ := NewPool(algorithm)
+		s := &Server{IP: net.ParseIP("10.0.0.1").To4()}
+		pool.AddServer(s)
+
+		// the IP may be in the 16 byte form
+		if found, ok := GetServerByIP(pool, net.ParseIP("10.0.0.1")); !ok || found != s {
+			t.Errorf("%s: was expecting the server.", algorithm)
+		}
+		if _, ok := GetServerByIP(pool, net.ParseIP("10.0.0.2")); ok {
+			t.Errorf("%s: was expecting no server.", algorithm)
+		}
+	}
+}
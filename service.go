@@ -0,0 +1,124 @@
+package balancer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Service represents a virtual service (VIP:port) served by the balancer.
+type Service struct {
+	IP           net.IP
+	Port         layers.TCPPort
+	Protocol     layers.IPProtocol
+	LBIndex      uint8
+	Pool         PoolBalancer
+	KeyExtractor KeyExtractor
+
+	// Mode defines how the connections are forwarded. For MODE_L2DSR the
+	// frames are sent from SrcHardwareAddr (the balancer interface) and the
+	// KeyExtractor and encapsulation settings are not used.
+	Mode            ForwardMode
+	SrcHardwareAddr net.HardwareAddr
+
+	// Recovery is set when the server is encoded in the ISN, so that
+	// established connections can be recovered after state loss. The
+	// server is then selected on the SYN, so the KeyExtractor must only use
+	// the IP and TCP headers.
+	Recovery *SequenceCodec
+
+	// Encap defines how packets are forwarded to the packetbridge. When set,
+	// packets are encapsulated from EncapSrcIP (the balancer IP) to the
+	// server (for ENCAP_FOU to FOUPort).
+	Encap      EncapType
+	EncapSrcIP net.IP
+	FOUPort    layers.UDPPort
+}
+
+func (s *Service) String() string {
+	return fmt.Sprintf("%s:%d/%s", s.IP, s.Port, strings.ToLower(s.Protocol.String()))
+}
+
+// ServiceTable contains the virtual services of the balancer.
+type ServiceTable struct {
+	sync.RWMutex
+	services map[serviceKey]*Service
+}
+
+// NewServiceTable creates and initializes a new ServiceTable.
+func NewServiceTable() *ServiceTable {
+	return &ServiceTable{
+		services: make(map[serviceKey]*Service),
+	}
+}
+
+// AddService adds the given service to the table. It returns an error when
+// a service with the same VIP and port already exists.
+func (t *ServiceTable) AddService(s *Service) error {
+	t.Lock()
+	defer t.Unlock()
+
+	if s.Protocol != layers.IPProtocolTCP {
+		return fmt.Errorf("service %s: only the TCP protocol is supported", s)
+	}
+	if s.IP.To4() == nil {
+		return fmt.Errorf("service %s: only IPv4 VIPs are supported", s)
+	}
+
+	key := newServiceKey(s.IP, s.Port)
+	if _, ok := t.services[key]; ok {
+		return fmt.Errorf("service %s already exists", s)
+	}
+	t.services[key] = s
+	return nil
+}
+
+// GetService returns the service for the given VIP and port.
+func (t *ServiceTable) GetService(ip net.IP, port layers.TCPPort) (*Service, bool) {
+	t.RLock()
+	defer t.RUnlock()
+
+	s, ok := t.services[newServiceKey(ip, port)]
+	return s, ok
+}
+
+// Services returns all services.
+func (t *ServiceTable) Services() []*Service {
+	t.RLock()
+	defer t.RUnlock()
+
+	var out []*Service
+	for _, s := range t.services {
+		out = append(out, s)
+	}
+	return out
+}
+
+// BPFFilter returns the BPF filter matching the traffic of all services.
+func (t *ServiceTable) BPFFilter() string {
+	var filters []string
+	for _, s := range t.Services() {
+		filters = append(filters, fmt.Sprintf("(dst host %s and dst port %d)", s.IP, s.Port))
+	}
+	if len(filters) == 0 {
+		return "tcp"
+	}
+	sort.Strings(filters)
+	return fmt.Sprintf("tcp and (%s)", strings.Join(filters, " or "))
+}
+
+// serviceKey identifies a service in the ServiceTable: the IPv4 VIP and
+// port.
+type serviceKey [6]byte
+
+func newServiceKey(ip net.IP, port layers.TCPPort) serviceKey {
+	var key serviceKey
+	copy(key[0:4], ip.To4())
+	binary.BigEndian.PutUint16(key[4:6], uint16(port))
+	return key
+}
@@ -0,0 +1,41 @@
+package balancer
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestServiceTable(t *testing.T) {
+	st := NewServiceTable()
+	s1 := &Service{IP: net.ParseIP("10.0.0.1").To4(), Port: 80, Protocol: layers.IPProtocolTCP, LBIndex: 1}
+	s2 := &Service{IP: net.ParseIP("10.0.0.2").To4(), Port: 443, Protocol: layers.IPProtocolTCP, LBIndex: 2}
+
+	for _, s := range []*Service{s1, s2} {
+		if err := st.AddService(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.AddService(&Service{IP: net.ParseIP("10.0.0.1"), Port: 80, Protocol: layers.IPProtocolTCP}); err == nil {
+		t.Error("Adding a service with an existing VIP and port should have returned an error.")
+	}
+	if err := st.AddService(&Service{IP: net.ParseIP("10.0.0.3"), Port: 53, Protocol: layers.IPProtocolUDP}); err == nil {
+		t.Error("Adding an UDP service should have returned an error.")
+	}
+	if err := st.AddService(&Service{IP: net.ParseIP("fd00::1"), Port: 80, Protocol: layers.IPProtocolTCP}); err == nil {
+		t.Error("Adding an IPv6 service should have returned an error.")
+	}
+
+	if s, ok := st.GetService(net.ParseIP("10.0.0.2"), 443); !ok || s != s2 {
+		t.Error("Was expecting to get the second service.")
+	}
+	if _, ok := st.GetService(net.ParseIP("10.0.0.2"), 80); ok {
+		t.Error("Was not expecting a service for 10.0.0.2:80.")
+	}
+
+	expected := "tcp and ((dst host 10.0.0.1 and dst port 80) or (dst host 10.0.0.2 and dst port 443))"
+	if f := st.BPFFilter(); f != expected {
+		t.Errorf("Was expecting BPF filter: %s, got: %s", expected, f)
+	}
+}
@@ -0,0 +1,209 @@
+// Package sim runs the balancer and the packetbridge in-process, with a
+// simulated client and backend connected by in-memory links:
+//
+//	client ---+
+//	          | switch (Ethernet)
+//	balancer -+
+//	          |
+//	packetbridge <-- IPv4 --> backend
+//
+// The client connects to the VIP of the balancer, which splices the
+// connection to the packetbridge, which opens a connection to the backend
+// and sends the packets of the backend directly (L2 return path) to the
+// client. This makes it possible to test the complete flow without
+// interfaces, pcap or root.
+package sim
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	balancer "github.com/brocaar/l3dsr-hash-balancer"
+	"github.com/google/gopacket/layers"
+)
+
+// The addresses of the simulated hosts.
+var (
+	ClientIP       = net.IPv4(10, 0, 0, 1).To4()
+	VIP            = net.IPv4(192, 168, 33, 10).To4()
+	PacketBridgeIP = net.IPv4(192, 168, 33, 20).To4()
+	BackendIP      = net.IPv4(192, 168, 33, 30).To4()
+
+	ClientMAC       = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	BalancerMAC     = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x10}
+	PacketBridgeMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x20}
+)
+
+// The ports of the simulated service.
+const (
+	ServicePort layers.TCPPort = 80
+	BackendPort layers.TCPPort = 8080
+)
+
+// lbIndex is the balancer index (DSCP) of the service.
+const lbIndex = 1
+
+// Config contains the simulation settings.
+type Config struct {
+	// QueueLen is the queue length of the links and pipeline queues.
+	QueueLen int
+
+	// QueuePolicy is the overflow policy of the pipeline queues.
+	QueuePolicy balancer.OverflowPolicy
+
+	// RTO is the retransmission timeout of the client and backend.
+	RTO time.Duration
+
+	// ClientLink and BackendLink are the faults injected in both
+	// directions of the link of the client (to the switch) and of the
+	// backend (to the packetbridge).
+	ClientLink  balancer.Impairment
+	BackendLink balancer.Impairment
+}
+
+// DefaultConfig is the default simulation config.
+var DefaultConfig = Config{
+	QueueLen: 64,
+	RTO:      20 * time.Millisecond,
+}
+
+// Simulation is a running simulation.
+type Simulation struct {
+	Client  *Host
+	Backend *Host
+
+	BalancerStates     *balancer.StateTable
+	PacketBridgeStates *balancer.PacketBridgeStateTable
+
+	sw    *Switch
+	ports []*balancer.MemoryPort
+
+	ethPackets        *balancer.EthPacketQueue
+	backendTCPPackets *balancer.TCPPacketQueue
+	clientEthPackets  *balancer.EthPacketQueue
+
+	// handlers are the goroutines receiving from the ports, senders the
+	// goroutines sending the packets of the handlers
+	handlers sync.WaitGroup
+	senders  sync.WaitGroup
+}
+
+// New starts a new simulation with the given config.
+func New(conf Config) (*Simulation, error) {
+	s := &Simulation{
+		BalancerStates:     balancer.NewStateTable(),
+		PacketBridgeStates: balancer.NewPacketBridgeStateTable(),
+		sw:                 NewSwitch(conf.QueueLen),
+		ethPackets:         balancer.NewEthPacketQueue("sim_to_servers", conf.QueueLen, conf.QueuePolicy),
+		backendTCPPackets:  balancer.NewTCPPacketQueue("sim_to_backends", conf.QueueLen, conf.QueuePolicy),
+		clientEthPackets:   balancer.NewEthPacketQueue("sim_to_clients", conf.QueueLen, conf.QueuePolicy),
+	}
+
+	// the balancer, splicing the connections to the packetbridge
+	pbPool := balancer.NewConsistentHashPool()
+	pbPool.AddServer(&balancer.Server{IP: PacketBridgeIP, HardwareAddr: PacketBridgeMAC})
+	services := balancer.NewServiceTable()
+	if err := services.AddService(&balancer.Service{
+		IP:           VIP,
+		Port:         ServicePort,
+		Protocol:     layers.IPProtocolTCP,
+		LBIndex:      lbIndex,
+		Pool:         pbPool,
+		Mode:         balancer.MODE_SPLICE,
+		KeyExtractor: balancer.FlowKey,
+	}); err != nil {
+		return nil, err
+	}
+
+	// the packetbridge, forwarding to the backend
+	backendPool := balancer.NewConsistentHashPool()
+	backendPool.AddServer(&balancer.Server{IP: BackendIP})
+	portMap := balancer.PortMap{ServicePort: BackendPort}
+	pbIface := &net.Interface{HardwareAddr: PacketBridgeMAC}
+	balancers := map[uint8]net.IP{lbIndex: VIP}
+
+	balancerPort := s.sw.Attach(BalancerMAC)
+	pbPort := s.sw.Attach(PacketBridgeMAC)
+	pbBackendPort, backendPort := balancer.NewMemoryLink(layers.LayerTypeIPv4, conf.QueueLen)
+	s.ports = []*balancer.MemoryPort{balancerPort, pbPort, pbBackendPort}
+	returnPath, err := balancer.NewReturnPath("l2", pbPort, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s.handlers.Add(3)
+	go func() {
+		defer s.handlers.Done()
+		balancer.BalancePackets(balancerPort.Packets(), s.ethPackets, s.BalancerStates, services)
+	}()
+	go func() {
+		defer s.handlers.Done()
+		balancer.HandleBalancerPackets(pbPort.Packets(), s.backendTCPPackets, s.PacketBridgeStates, portMap, backendPool, balancers, 0)
+	}()
+	go func() {
+		defer s.handlers.Done()
+		balancer.HandleBackendPackets(pbBackendPort, backendPool, portMap, pbIface, s.backendTCPPackets, s.clientEthPackets, s.PacketBridgeStates)
+	}()
+
+	s.senders.Add(3)
+	go func() {
+		defer s.senders.Done()
+		for p, ok := s.ethPackets.Get(); ok; p, ok = s.ethPackets.Get() {
+			if b, err := p.MarshalBinary(); err == nil {
+				balancerPort.WritePacketData(b)
+			}
+			p.Release()
+		}
+	}()
+	go func() {
+		defer s.senders.Done()
+		balancer.SendToBackend(pbBackendPort, s.backendTCPPackets, PacketBridgeIP)
+	}()
+	go func() {
+		defer s.senders.Done()
+		balancer.SendToClient(returnPath, s.clientEthPackets)
+	}()
+
+	// the client uses the balancer as gateway
+	s.Client = NewHost(ClientIP, ClientMAC, BalancerMAC, impair(s.sw.Attach(ClientMAC), conf.ClientLink), conf.RTO)
+	s.Backend = NewHost(BackendIP, nil, nil, impair(backendPort, conf.BackendLink), conf.RTO)
+	return s, nil
+}
+
+// impairedHandle is a PacketHandle with an impaired source and sink.
+type impairedHandle struct {
+	*balancer.ImpairedSource
+	*balancer.ImpairedSink
+}
+
+// impair returns the given port with the given faults injected in both
+// directions, the packets sent use the next seed.
+func impair(p *balancer.MemoryPort, conf balancer.Impairment) balancer.PacketHandle {
+	if conf == (balancer.Impairment{}) {
+		return p
+	}
+	out := conf
+	out.Seed++
+	return impairedHandle{
+		ImpairedSource: balancer.NewImpairedSource(p, conf),
+		ImpairedSink:   balancer.NewImpairedSink(p, out),
+	}
+}
+
+// Close stops the simulation.
+func (s *Simulation) Close() {
+	for _, p := range s.ports {
+		p.Close()
+	}
+	s.handlers.Wait()
+
+	s.ethPackets.Close()
+	s.backendTCPPackets.Close()
+	s.clientEthPackets.Close()
+	s.senders.Wait()
+
+	s.Client.Close()
+	s.Backend.Close()
+	s.sw.Close()
+}
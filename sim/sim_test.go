@@ -0,0 +1,153 @@
+package sim
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	balancer "github.com/brocaar/l3dsr-hash-balancer"
+)
+
+const timeout = 5 * time.Second
+
+const (
+	request  = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	response = "HTTP/1.1 200 OK\r\nContent-Length: 6\r\nConnection: close\r\n\r\nhello\n"
+)
+
+// serveHTTP accepts a connection on the backend, reads the request, writes
+// the response and closes the connection.
+func serveHTTP(s *Simulation) (string, error) {
+	c, err := s.Backend.Accept(BackendPort, timeout)
+	if err != nil {
+		return "", err
+	}
+	req, err := c.ReadUntil([]byte("\r\n\r\n"), timeout)
+	if err != nil {
+		return string(req), err
+	}
+	if err := c.Write([]byte(response)); err != nil {
+		return string(req), err
+	}
+	return string(req), c.Close(timeout)
+}
+
+func TestHTTPExchange(t *testing.T) {
+	testHTTPExchange(t, DefaultConfig)
+}
+
+// testHTTPExchange tests an HTTP request from the client to the backend
+// with the given config.
+func testHTTPExchange(t *testing.T, conf Config) {
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Backend.Listen(BackendPort)
+	type result struct {
+		req string
+		err error
+	}
+	served := make(chan result, 1)
+	go func() {
+		req, err := serveHTTP(s)
+		served <- result{req, err}
+	}()
+
+	c, err := s.Client.Dial(VIP, ServicePort, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.ReadUntil(nil, timeout)
+	if err != nil {
+		t.Fatalf("Could not read the response: %s (got: %q)", err, resp)
+	}
+	if string(resp) != response {
+		t.Errorf("Was expecting response %q, got: %q", response, resp)
+	}
+	if _, err := c.ReadUntil(nil, timeout); err != io.EOF {
+		t.Errorf("Was expecting EOF, got: %v", err)
+	}
+	if err := c.Close(timeout); err != nil {
+		t.Errorf("Could not close the connection: %s", err)
+	}
+
+	r := <-served
+	if r.err != nil {
+		t.Fatalf("Backend failed: %s", r.err)
+	}
+	if r.req != request {
+		t.Errorf("Was expecting request %q at the backend, got: %q", request, r.req)
+	}
+
+	// the handshake was completed by the balancer, which spliced the
+	// connection to the packetbridge, which opened a connection to the
+	// backend (the client closed the connection with a FIN)
+	state, ok := s.BalancerStates.GetState(ClientIP, c.LocalPort, VIP, ServicePort)
+	if !ok || state.State != balancer.TCP_STATE_FIN_WAIT_1 {
+		t.Fatalf("Was expecting a closing connection at the balancer, got: %+v", state)
+	}
+	if state.Server == nil || !state.Server.IP.Equal(PacketBridgeIP) {
+		t.Errorf("Was expecting the packetbridge as server, got: %+v", state.Server)
+	}
+	pbState, ok := s.PacketBridgeStates.GetByIP(ClientIP, c.LocalPort, VIP, ServicePort)
+	if !ok || pbState.State != balancer.TCP_STATE_FIN_WAIT_1 || !pbState.Backend.IP.Equal(BackendIP) {
+		t.Errorf("Was expecting a closing connection to the backend at the packetbridge, got: %+v", pbState)
+	}
+}
+
+func TestHTTPExchangeImpaired(t *testing.T) {
+	// the Ethernet header of the client link is not corrupted, as it is
+	// protected by the frame check sequence on a real link
+	badNetwork := balancer.Impairment{
+		Loss:          0.1,
+		Duplicate:     0.1,
+		Reorder:       0.1,
+		Corrupt:       0.1,
+		CorruptOffset: 14,
+		Delay:         2 * time.Millisecond,
+		Jitter:        2 * time.Millisecond,
+	}
+
+	for _, test := range []struct {
+		name    string
+		client  balancer.Impairment
+		backend balancer.Impairment
+	}{
+		{"client loss", balancer.Impairment{Loss: 0.2, Seed: 1}, balancer.Impairment{}},
+		{"backend loss", balancer.Impairment{}, balancer.Impairment{Loss: 0.2, Seed: 1}},
+		{"client duplication", balancer.Impairment{Duplicate: 0.5, Seed: 1}, balancer.Impairment{}},
+		{"backend duplication", balancer.Impairment{}, balancer.Impairment{Duplicate: 0.5, Seed: 1}},
+		{"client reordering", balancer.Impairment{Reorder: 0.3, Seed: 1}, balancer.Impairment{}},
+		{"backend reordering", balancer.Impairment{}, balancer.Impairment{Reorder: 0.3, Seed: 1}},
+		{"client jitter", balancer.Impairment{Delay: 5 * time.Millisecond, Jitter: 5 * time.Millisecond, Seed: 1}, balancer.Impairment{}},
+		{"backend jitter", balancer.Impairment{}, balancer.Impairment{Delay: 5 * time.Millisecond, Jitter: 5 * time.Millisecond, Seed: 1}},
+		{"client corruption", balancer.Impairment{Corrupt: 0.2, CorruptOffset: 14, Seed: 1}, balancer.Impairment{}},
+		{"backend corruption", balancer.Impairment{}, balancer.Impairment{Corrupt: 0.2, Seed: 1}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := DefaultConfig
+			conf.ClientLink = test.client
+			conf.BackendLink = test.backend
+			testHTTPExchange(t, conf)
+		})
+	}
+
+	for seed := int64(1); seed <= 10; seed++ {
+		t.Run(fmt.Sprintf("bad network seed %d", seed), func(t *testing.T) {
+			conf := DefaultConfig
+			conf.ClientLink = badNetwork
+			conf.ClientLink.Seed = seed
+			conf.BackendLink = badNetwork
+			conf.BackendLink.Seed = seed + 1000
+			testHTTPExchange(t, conf)
+		})
+	}
+}
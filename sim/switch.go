@@ -0,0 +1,65 @@
+package sim
+
+import (
+	"net"
+	"sync"
+
+	balancer "github.com/brocaar/l3dsr-hash-balancer"
+	"github.com/google/gopacket/layers"
+)
+
+// Switch forwards Ethernet frames between the hosts attached to it by
+// destination MAC address, frames for unknown MAC addresses are dropped.
+type Switch struct {
+	sync.RWMutex
+	ports   map[string]*balancer.MemoryPort
+	queue   int
+	closing sync.WaitGroup
+}
+
+// NewSwitch creates a new Switch, each link queues up to queueLen frames.
+func NewSwitch(queueLen int) *Switch {
+	return &Switch{
+		ports: make(map[string]*balancer.MemoryPort),
+		queue: queueLen,
+	}
+}
+
+// Attach attaches a host with the given MAC address to the switch and
+// returns the port of the host. The frames written to the port are
+// forwarded, the frames for the MAC address are received from it.
+func (s *Switch) Attach(mac net.HardwareAddr) *balancer.MemoryPort {
+	hostPort, switchPort := balancer.NewMemoryLink(layers.LayerTypeEthernet, s.queue)
+
+	s.Lock()
+	s.ports[mac.String()] = switchPort
+	s.Unlock()
+
+	s.closing.Add(1)
+	go func() {
+		defer s.closing.Done()
+		for p := range switchPort.Packets() {
+			data := p.Data()
+			if len(data) < 14 {
+				continue
+			}
+			s.RLock()
+			out, ok := s.ports[net.HardwareAddr(data[0:6]).String()]
+			s.RUnlock()
+			if ok && out != switchPort {
+				out.WritePacketData(data)
+			}
+		}
+	}()
+	return hostPort
+}
+
+// Close closes the ports of the switch.
+func (s *Switch) Close() {
+	s.Lock()
+	for _, p := range s.ports {
+		p.Close()
+	}
+	s.Unlock()
+	s.closing.Wait()
+}
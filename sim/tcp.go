@@ -0,0 +1,508 @@
+package sim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	balancer "github.com/brocaar/l3dsr-hash-balancer"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// mss is the maximum payload size of the segments sent by a Host.
+const mss = 1400
+
+// ErrTimeout is returned when a connection did not reach the expected state
+// in time.
+var ErrTimeout = errors.New("timeout")
+
+// Host is a minimal TCP/IPv4 stack, used as client or backend of a
+// simulation. It retransmits the unacknowledged segments (go-back-N) after
+// the retransmission timeout, out of order segments are dropped.
+// Hosts with a MAC address send Ethernet frames to their gateway, hosts
+// without one send IPv4 packets.
+type Host struct {
+	sync.Mutex
+	IP      net.IP
+	MAC     net.HardwareAddr
+	Gateway net.HardwareAddr
+	RTO     time.Duration
+
+	handle    balancer.PacketHandle
+	conns     map[connKey]*Conn
+	listeners map[layers.TCPPort]chan *Conn
+	nextPort  layers.TCPPort
+	nextISS   uint32
+	done      chan struct{}
+	closing   sync.WaitGroup
+}
+
+type connKey struct {
+	ip        string
+	port      layers.TCPPort
+	localPort layers.TCPPort
+}
+
+// NewHost creates a new Host sending and receiving packets using the given
+// handle, the host takes ownership of the handle.
+func NewHost(ip net.IP, mac, gateway net.HardwareAddr, handle balancer.PacketHandle, rto time.Duration) *Host {
+	h := &Host{
+		IP:        ip.To4(),
+		MAC:       mac,
+		Gateway:   gateway,
+		RTO:       rto,
+		handle:    handle,
+		conns:     make(map[connKey]*Conn),
+		listeners: make(map[layers.TCPPort]chan *Conn),
+		nextPort:  40000,
+		nextISS:   1000,
+		done:      make(chan struct{}),
+	}
+	h.closing.Add(2)
+	go h.receive()
+	go h.retransmit()
+	return h
+}
+
+// Close closes the handle of the host and stops its goroutines.
+func (h *Host) Close() {
+	close(h.done)
+	h.handle.Close()
+	h.closing.Wait()
+}
+
+// Listen starts accepting the connections on the given port.
+func (h *Host) Listen(port layers.TCPPort) {
+	h.Lock()
+	defer h.Unlock()
+	h.listeners[port] = make(chan *Conn, 16)
+}
+
+// Accept returns the next connection accepted on the given port.
+func (h *Host) Accept(port layers.TCPPort, timeout time.Duration) (*Conn, error) {
+	h.Lock()
+	accept, ok := h.listeners[port]
+	h.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("not listening on port %d", port)
+	}
+	select {
+	case c := <-accept:
+		return c, nil
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+// Dial opens a connection to the given IP and port and waits until the
+// handshake has completed.
+func (h *Host) Dial(ip net.IP, port layers.TCPPort, timeout time.Duration) (*Conn, error) {
+	h.Lock()
+	c := h.newConn(ip, port, h.nextPort)
+	h.nextPort++
+	h.Unlock()
+
+	c.Lock()
+	c.send(segment{seq: c.sndNxt, syn: true})
+	c.Unlock()
+
+	if err := c.wait(timeout, func() bool { return c.established }); err != nil {
+		return nil, fmt.Errorf("could not connect to %s:%d: %s", ip, port, err)
+	}
+	return c, nil
+}
+
+// newConn creates a new connection, the host must be locked.
+func (h *Host) newConn(ip net.IP, port, localPort layers.TCPPort) *Conn {
+	c := &Conn{
+		host:       h,
+		RemoteIP:   ip.To4(),
+		RemotePort: port,
+		LocalPort:  localPort,
+		sndUna:     h.nextISS,
+		sndNxt:     h.nextISS,
+		changed:    make(chan struct{}),
+	}
+	h.nextISS += 100000
+	h.conns[connKey{ip.String(), port, localPort}] = c
+	return c
+}
+
+func (h *Host) receive() {
+	defer h.closing.Done()
+	for p := range h.handle.Packets() {
+		ip, _ := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		tcp, _ := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if ip == nil || tcp == nil || !ip.DstIP.Equal(h.IP) || !validChecksum(ip, tcp) {
+			continue
+		}
+
+		h.Lock()
+		c, ok := h.conns[connKey{ip.SrcIP.String(), tcp.SrcPort, tcp.DstPort}]
+		if !ok && tcp.SYN && !tcp.ACK {
+			if accept, listening := h.listeners[tcp.DstPort]; listening {
+				c = h.newConn(ip.SrcIP, tcp.SrcPort, tcp.DstPort)
+				c.accept = accept
+				ok = true
+			}
+		}
+		h.Unlock()
+
+		if ok {
+			c.handle(tcp)
+		}
+	}
+}
+
+func (h *Host) retransmit() {
+	defer h.closing.Done()
+	ticker := time.NewTicker(h.RTO / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+		}
+
+		h.Lock()
+		conns := make([]*Conn, 0, len(h.conns))
+		for _, c := range h.conns {
+			conns = append(conns, c)
+		}
+		h.Unlock()
+
+		for _, c := range conns {
+			c.retransmit(time.Now())
+		}
+	}
+}
+
+// write sends the given TCP segment to the given IP.
+func (h *Host) write(dst net.IP, tcp *layers.TCP) error {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Flags:    layers.IPv4DontFragment,
+		SrcIP:    h.IP,
+		DstIP:    dst,
+		Protocol: layers.IPProtocolTCP,
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	var l []gopacket.SerializableLayer
+	if h.MAC != nil {
+		l = append(l, &layers.Ethernet{SrcMAC: h.MAC, DstMAC: h.Gateway, EthernetType: layers.EthernetTypeIPv4})
+	}
+	l = append(l, ip, tcp, gopacket.Payload(tcp.Payload))
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, l...); err != nil {
+		return fmt.Errorf("could not serialize packet: %s", err)
+	}
+	return h.handle.WritePacketData(buf.Bytes())
+}
+
+// validChecksum returns true when the checksums of the given IPv4 header and
+// TCP segment are valid, corrupted packets are dropped.
+func validChecksum(ip *layers.IPv4, tcp *layers.TCP) bool {
+	if checksum(ip.Contents) != 0xffff {
+		return false
+	}
+	b := make([]byte, 12, 12+len(tcp.Contents)+len(tcp.Payload))
+	copy(b[0:4], ip.SrcIP.To4())
+	copy(b[4:8], ip.DstIP.To4())
+	b[9] = byte(layers.IPProtocolTCP)
+	binary.BigEndian.PutUint16(b[10:], uint16(len(tcp.Contents)+len(tcp.Payload)))
+	b = append(append(b, tcp.Contents...), tcp.Payload...)
+	return checksum(b) == 0xffff
+}
+
+// checksum returns the folded one's complement sum of the given data.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
+
+// segment is a segment sent by a connection, kept until it is acknowledged.
+type segment struct {
+	seq     uint32
+	syn     bool
+	fin     bool
+	payload []byte
+	sent    time.Time
+}
+
+// len returns the sequence space used by the segment.
+func (s segment) len() uint32 {
+	n := uint32(len(s.payload))
+	if s.syn {
+		n++
+	}
+	if s.fin {
+		n++
+	}
+	return n
+}
+
+// Conn is a TCP connection of a Host.
+type Conn struct {
+	sync.Mutex
+	RemoteIP   net.IP
+	RemotePort layers.TCPPort
+	LocalPort  layers.TCPPort
+
+	host   *Host
+	accept chan *Conn
+
+	sndUna, sndNxt uint32
+	rcvNxt         uint32
+	unacked        []segment
+	received       []byte
+
+	synReceived bool
+	established bool
+	finSent     bool
+	finReceived bool
+
+	// changed is closed (and replaced) when the state of the connection
+	// changes
+	changed chan struct{}
+
+	retransmits int
+}
+
+// Write sends the given data.
+func (c *Conn) Write(b []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.finSent {
+		return io.ErrClosedPipe
+	}
+	for len(b) > 0 {
+		n := len(b)
+		if n > mss {
+			n = mss
+		}
+		c.send(segment{seq: c.sndNxt, payload: append([]byte(nil), b[:n]...)})
+		b = b[n:]
+	}
+	return nil
+}
+
+// ReadUntil waits until the received data contains the given delimiter, or
+// the peer closed the connection, and returns (and consumes) the received
+// data up to and including the delimiter. An empty delimiter reads until
+// the connection is closed by the peer.
+func (c *Conn) ReadUntil(delim []byte, timeout time.Duration) ([]byte, error) {
+	var n int
+	err := c.wait(timeout, func() bool {
+		if len(delim) > 0 {
+			if i := bytes.Index(c.received, delim); i >= 0 {
+				n = i + len(delim)
+				return true
+			}
+		}
+		n = len(c.received)
+		return c.finReceived
+	})
+
+	c.Lock()
+	defer c.Unlock()
+	b := append([]byte(nil), c.received[:n]...)
+	c.received = c.received[n:]
+	if err == nil && n == 0 && c.finReceived {
+		err = io.EOF
+	}
+	return b, err
+}
+
+// Close sends a FIN and waits until the connection is closed by both
+// peers and all sent data is acknowledged.
+func (c *Conn) Close(timeout time.Duration) error {
+	c.Lock()
+	if !c.finSent {
+		c.finSent = true
+		c.send(segment{seq: c.sndNxt, fin: true})
+	}
+	c.Unlock()
+
+	return c.wait(timeout, func() bool { return c.finReceived && c.sndUna == c.sndNxt })
+}
+
+// Retransmits returns the number of segments retransmitted.
+func (c *Conn) Retransmits() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.retransmits
+}
+
+// wait waits until cond (called with the connection locked) returns true.
+func (c *Conn) wait(timeout time.Duration, cond func() bool) error {
+	deadline := time.After(timeout)
+	for {
+		c.Lock()
+		ok, changed := cond(), c.changed
+		c.Unlock()
+		if ok {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return ErrTimeout
+		}
+	}
+}
+
+// notify wakes up the waiters, the connection must be locked.
+func (c *Conn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// send sends a new segment, the connection must be locked.
+func (c *Conn) send(s segment) {
+	s.sent = time.Now()
+	c.sndNxt += s.len()
+	c.unacked = append(c.unacked, s)
+	c.transmit(s)
+}
+
+// transmit (re)transmits the given segment, the connection must be locked.
+func (c *Conn) transmit(s segment) {
+	tcp := &layers.TCP{
+		SrcPort: c.LocalPort,
+		DstPort: c.RemotePort,
+		Seq:     s.seq,
+		SYN:     s.syn,
+		FIN:     s.fin,
+		PSH:     len(s.payload) > 0,
+		Window:  65535,
+	}
+	tcp.Payload = s.payload
+	if c.established || c.accept != nil {
+		tcp.ACK = true
+		tcp.Ack = c.rcvNxt
+	}
+	c.host.write(c.RemoteIP, tcp)
+}
+
+// ack sends an ACK, the connection must be locked.
+func (c *Conn) ack() {
+	c.host.write(c.RemoteIP, &layers.TCP{
+		SrcPort: c.LocalPort,
+		DstPort: c.RemotePort,
+		Seq:     c.sndNxt,
+		Ack:     c.rcvNxt,
+		ACK:     true,
+		Window:  65535,
+	})
+}
+
+// retransmit retransmits all unacknowledged segments when the oldest one
+// is not acknowledged within the retransmission timeout.
+func (c *Conn) retransmit(now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.unacked) == 0 || now.Sub(c.unacked[0].sent) < c.host.RTO {
+		return
+	}
+	for i := range c.unacked {
+		c.unacked[i].sent = now
+		c.retransmits++
+		c.transmit(c.unacked[i])
+	}
+}
+
+// handle handles a received segment.
+func (c *Conn) handle(tcp *layers.TCP) {
+	c.Lock()
+	defer c.Unlock()
+	defer c.notify()
+
+	if tcp.RST {
+		c.finReceived = true
+		c.unacked = nil
+		c.sndUna = c.sndNxt
+		return
+	}
+
+	if tcp.SYN {
+		if c.accept == nil && !c.established && !(tcp.ACK && tcp.Ack == c.sndUna+1) {
+			// the SYN ACK does not acknowledge our SYN
+			return
+		}
+		if !c.synReceived {
+			c.synReceived = true
+			c.rcvNxt = tcp.Seq + 1
+			if c.accept != nil {
+				// passive open, answer with a SYN ACK
+				c.send(segment{seq: c.sndNxt, syn: true})
+				return
+			}
+		} else {
+			// a retransmitted SYN (ACK), our SYN ACK (ACK) was lost, a
+			// lost SYN ACK is retransmitted by the timer
+			if c.established {
+				c.ack()
+			}
+			return
+		}
+	}
+
+	if tcp.ACK && seqGT(tcp.Ack, c.sndUna) && !seqGT(tcp.Ack, c.sndNxt) {
+		c.sndUna = tcp.Ack
+		for len(c.unacked) > 0 && !seqGT(c.unacked[0].seq+c.unacked[0].len(), c.sndUna) {
+			c.unacked = c.unacked[1:]
+		}
+		if !c.established {
+			c.established = true
+			if c.accept != nil {
+				c.accept <- c
+			}
+		}
+	}
+
+	if tcp.SYN {
+		// the SYN ACK of an active open
+		if c.established {
+			c.ack()
+		}
+		return
+	}
+
+	if len(tcp.Payload) == 0 && !tcp.FIN {
+		return
+	}
+	if tcp.Seq == c.rcvNxt && c.established {
+		c.received = append(c.received, tcp.Payload...)
+		c.rcvNxt += uint32(len(tcp.Payload))
+		if tcp.FIN {
+			c.rcvNxt++
+			c.finReceived = true
+		}
+	}
+	// acknowledge in order segments, send a duplicate ACK for the others
+	c.ack()
+}
+
+// seqGT returns true when sequence number a is after b.
+func seqGT(a, b uint32) bool {
+	return int32(a-b) > 0
+}
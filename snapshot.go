@@ -0,0 +1,238 @@
+package balancer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A snapshot file contains the encoded records (see record.go) of a state
+// table, after a header:
+//
+//	magic "L3SS" (4 bytes) | version (1) | table (1) | record length (2) | record count (4) | saved at (8, unix ns)
+//
+// Each record of a state table snapshot is followed by the time a packet of
+// the connection was last seen (8, unix ns), so that idle connections keep
+// expiring after a restore. The flows imported by the migration API are
+// encoded without it (the record length is the one of the state records).
+const (
+	snapshotMagic     = "L3SS"
+	snapshotVersion   = 1
+	snapshotHeaderLen = 20
+	snapshotSeenLen   = 8
+)
+
+// snapshot table identifiers
+const (
+	snapshotTablePacketBridge uint8 = iota + 1
+	snapshotTableBalancer
+)
+
+// snapshot is a decoded snapshot.
+type snapshot struct {
+	savedAt time.Time
+	records [][]byte
+}
+
+// expired returns true when a state with the given TCPState, of a
+// connection last seen at the given time, must not be restored. Closed
+// states are always expired. When the snapshot was saved longer than maxAge
+// ago, all states are expired (the clients have given up on the
+// connections), handshakes that have been idle for longer than maxAge
+// neither will be completed. A maxAge of 0 disables the expiry by age. Idle
+// established connections are expired by the state table after the restore.
+func (s *snapshot) expired(state TCPState, lastSeen time.Time, maxAge time.Duration) bool {
+	if state == TCP_STATE_CLOSED {
+		return true
+	}
+	if maxAge == 0 {
+		return false
+	}
+	if time.Since(s.savedAt) > maxAge {
+		return true
+	}
+	return state != TCP_STATE_ESTABLISHED && time.Since(lastSeen) > maxAge
+}
+
+// appendSeen appends the given last seen time (in nanoseconds) of a
+// connection to the snapshot record b.
+func appendSeen(b []byte, lastSeen int64) []byte {
+	return binary.BigEndian.AppendUint64(b, uint64(lastSeen))
+}
+
+// parseSeen returns the last seen time (in nanoseconds) of the connection of
+// the given snapshot record.
+func parseSeen(r []byte) int64 {
+	return int64(binary.BigEndian.Uint64(r[len(r)-snapshotSeenLen:]))
+}
+
+// writeSnapshot writes the given records to the given file. The file is
+// replaced atomically, so that a crash never leaves a partial snapshot.
+func writeSnapshot(path string, table uint8, recordLen int, records [][]byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	if err := encodeSnapshot(f, table, recordLen, records); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// encodeSnapshot writes the snapshot header and the given records to w.
+func encodeSnapshot(w io.Writer, table uint8, recordLen int, records [][]byte) error {
+	bw := bufio.NewWriter(w)
+	header := make([]byte, 0, snapshotHeaderLen)
+	header = append(header, snapshotMagic...)
+	header = append(header, snapshotVersion, table)
+	header = binary.BigEndian.AppendUint16(header, uint16(recordLen))
+	header = binary.BigEndian.AppendUint32(header, uint32(len(records)))
+	header = binary.BigEndian.AppendUint64(header, uint64(time.Now().UnixNano()))
+	bw.Write(header)
+	for _, r := range records {
+		bw.Write(r)
+	}
+	return bw.Flush()
+}
+
+// readSnapshot reads the given snapshot file.
+func readSnapshot(path string, table uint8, recordLen int) (*snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodeSnapshot(f, table, recordLen)
+}
+
+// decodeSnapshot reads the snapshot header and the records of the given
+// length from r.
+func decodeSnapshot(r io.Reader, table uint8, recordLen int) (*snapshot, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, snapshotHeaderLen)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("could not read snapshot header: %s", err)
+	}
+	if string(header[0:4]) != snapshotMagic {
+		return nil, errors.New("not a snapshot file")
+	}
+	if header[4] != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version: %d", header[4])
+	}
+	if header[5] != table {
+		return nil, fmt.Errorf("snapshot is for an other state table (%d)", header[5])
+	}
+	if n := int(binary.BigEndian.Uint16(header[6:8])); n != recordLen {
+		return nil, fmt.Errorf("unexpected snapshot record length: %d", n)
+	}
+
+	snap := &snapshot{savedAt: time.Unix(0, int64(binary.BigEndian.Uint64(header[12:20])))}
+	count := binary.BigEndian.Uint32(header[8:12])
+	for i := uint32(0); i < count; i++ {
+		b := make([]byte, recordLen)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, fmt.Errorf("could not read snapshot record: %s", err)
+		}
+		snap.records = append(snap.records, b)
+	}
+	return snap, nil
+}
+
+// SaveSnapshot writes the states of the table to the given file.
+func (s *PacketBridgeStateTable) SaveSnapshot(path string) error {
+	var records [][]byte
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.RLock()
+		for _, st := range shard.byIP {
+			records = append(records, appendSeen(appendPacketBridgeRecord(nil, *st), s.lastSeen[st.RandPort].Load()))
+		}
+		shard.RUnlock()
+	}
+	return writeSnapshot(path, snapshotTablePacketBridge, packetBridgeRecordLen+snapshotSeenLen, records)
+}
+
+// LoadSnapshot adds the states of the given snapshot file to the table and
+// returns the number of states added. The backends are looked up in the given
+// pool, states for unknown backends and expired states (see maxAge of
+// snapshot.expired) are skipped.
+func (s *PacketBridgeStateTable) LoadSnapshot(path string, pool PoolBalancer, maxAge time.Duration) (int, error) {
+	snap, err := readSnapshot(path, snapshotTablePacketBridge, packetBridgeRecordLen+snapshotSeenLen)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, r := range snap.records {
+		state, err := parsePacketBridgeRecord(r, pool)
+		if err != nil {
+			log.Warningf("skipping snapshot record: %s", err)
+			continue
+		}
+		lastSeen := parseSeen(r)
+		if snap.expired(state.State, time.Unix(0, lastSeen), maxAge) {
+			continue
+		}
+		s.put(state, lastSeen)
+		n++
+	}
+	return n, nil
+}
+
+// SaveSnapshot writes the states of the table to the given file.
+func (s *StateTable) SaveSnapshot(path string) error {
+	var records [][]byte
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.RLock()
+		for _, e := range shard.states {
+			records = append(records, appendSeen(appendStateRecord(nil, *e.state), e.lastSeen.Load()))
+		}
+		shard.RUnlock()
+	}
+	return writeSnapshot(path, snapshotTableBalancer, stateRecordLen+snapshotSeenLen, records)
+}
+
+// LoadSnapshot adds the states of the given snapshot file to the table and
+// returns the number of states added. The services and servers are looked up
+// in the given ServiceTable, states for unknown services or servers and
+// expired states (see maxAge of snapshot.expired) are skipped.
+func (s *StateTable) LoadSnapshot(path string, services *ServiceTable, maxAge time.Duration) (int, error) {
+	snap, err := readSnapshot(path, snapshotTableBalancer, stateRecordLen+snapshotSeenLen)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, r := range snap.records {
+		state, err := parseStateRecord(r, services)
+		if err != nil {
+			log.Warningf("skipping snapshot record: %s", err)
+			continue
+		}
+		lastSeen := parseSeen(r)
+		if snap.expired(state.State, time.Unix(0, lastSeen), maxAge) {
+			continue
+		}
+		s.put(state, lastSeen)
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,162 @@
+package balancer
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestPacketBridgeSnapshot(t *testing.T) {
+	pool := NewConsistentHashPool()
+	pool.AddServer(&Server{IP: net.ParseIP("192.168.33.30").To4()})
+	path := filepath.Join(t.TempDir(), "packetbridge.snapshot")
+
+	table := NewPacketBridgeStateTable()
+	for port := 1000; port < 1010; port++ {
+		state, err := table.NewState(&PacketBridgeState{
+			IP:           net.ParseIP("10.0.0.1").To4(),
+			HardwareAddr: net.HardwareAddr{0x08, 0, 0, 0, 0, 1},
+			Port:         layers.TCPPort(port),
+			VIP:          net.ParseIP("192.168.33.10").To4(),
+			ServicePort:  80,
+			BackendPort:  8080,
+			Backend:      pool.Servers()[0],
+			LBIndex:      1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		state.State = TCP_STATE_ESTABLISHED
+		state.SeqOffset = uint32(port)
+	}
+
+	if err := table.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewPacketBridgeStateTable()
+	n, err := restored.LoadSnapshot(path, pool, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 {
+		t.Fatalf("Was expecting 10 states, got: %d", n)
+	}
+	for _, state := range table.States() {
+		s, ok := restored.GetByPort(state.RandPort)
+		if !ok {
+			t.Fatalf("State for random port %d was not restored.", state.RandPort)
+		}
+		if s.SeqOffset != state.SeqOffset || s.Port != state.Port || s.State != state.State || !s.Created.Equal(state.Created) {
+			t.Errorf("Was expecting %+v, got: %+v", state, s)
+		}
+	}
+
+	// the time the connections were last seen is restored
+	idle := table.States()[0]
+	now = func() time.Time { return time.Now().Add(-time.Hour) }
+	table.Put(&idle)
+	now = time.Now
+	if err := table.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	restored = NewPacketBridgeStateTable()
+	if _, err := restored.LoadSnapshot(path, pool, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := restored.Expire(time.Minute, time.Minute); n != 1 {
+		t.Errorf("Was expecting the idle state to expire, got %d expired states.", n)
+	}
+	if _, ok := restored.GetByPort(idle.RandPort); ok {
+		t.Error("The idle state should have expired.")
+	}
+
+	// states for unknown backends are skipped
+	other := NewConsistentHashPool()
+	other.AddServer(&Server{IP: net.ParseIP("192.168.33.31").To4()})
+	if n, err := NewPacketBridgeStateTable().LoadSnapshot(path, other, 0); err != nil || n != 0 {
+		t.Errorf("Was expecting 0 states, got: %d (%v)", n, err)
+	}
+
+	// a truncated snapshot is rejected
+	b, _ := os.ReadFile(path)
+	os.WriteFile(path, b[:len(b)-1], 0644)
+	if _, err := NewPacketBridgeStateTable().LoadSnapshot(path, pool, 0); err == nil {
+		t.Error("Was expecting an error for a truncated snapshot.")
+	}
+}
+
+func TestBalancerSnapshot(t *testing.T) {
+	services := newSyncTestServices(t)
+	service, _ := services.GetService(net.ParseIP("192.168.33.10"), 80)
+	path := filepath.Join(t.TempDir(), "balancer.snapshot")
+
+	table := NewStateTable()
+	established := table.NewState(net.ParseIP("10.0.0.1").To4(), 1000, service)
+	established.State = TCP_STATE_ESTABLISHED
+	established.Server = service.Pool.Servers()[1]
+	established.Created = time.Now().Add(-time.Hour)
+
+	// an old handshake that was never completed and an idle connection
+	now = func() time.Time { return time.Now().Add(-time.Hour) }
+	handshake := table.NewState(net.ParseIP("10.0.0.1").To4(), 1001, service)
+	handshake.State = TCP_STATE_SYN_RECEIVED
+	idle := table.NewState(net.ParseIP("10.0.0.1").To4(), 1003, service)
+	idle.State = TCP_STATE_ESTABLISHED
+	idle.Server = service.Pool.Servers()[1]
+	now = time.Now
+
+	// a connection migrated to an other packetbridge
+	closed := table.NewState(net.ParseIP("10.0.0.1").To4(), 1002, service)
+	closed.State = TCP_STATE_CLOSED
+
+	if err := table.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewStateTable()
+	n, err := restored.LoadSnapshot(path, services, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("Was expecting 2 states, got: %d", n)
+	}
+
+	// the idle connection expires, as it was last seen an hour ago
+	if n := restored.Expire(time.Minute, time.Minute); n != 1 {
+		t.Errorf("Was expecting the idle state to expire, got %d expired states.", n)
+	}
+	if _, ok := restored.GetState(idle.IP, idle.Port, service.IP, service.Port); ok {
+		t.Error("The idle state should have expired.")
+	}
+	s, ok := restored.GetState(established.IP, established.Port, service.IP, service.Port)
+	if !ok || s.Server != established.Server || s.Seq != established.Seq || s.State != TCP_STATE_ESTABLISHED {
+		t.Errorf("Was expecting %+v, got: %+v", established, s)
+	}
+
+	// the snapshot of the other table is rejected
+	if _, err := NewPacketBridgeStateTable().LoadSnapshot(path, service.Pool, 0); err == nil {
+		t.Error("Was expecting an error for a snapshot of the balancer table.")
+	}
+
+	// all states of an old snapshot have expired
+	b, _ := os.ReadFile(path)
+	binary.BigEndian.PutUint64(b[12:20], uint64(time.Now().Add(-time.Hour).UnixNano()))
+	os.WriteFile(path, b, 0644)
+	if n, err := NewStateTable().LoadSnapshot(path, services, time.Minute); err != nil || n != 0 {
+		t.Errorf("Was expecting 0 states, got: %d (%v)", n, err)
+	}
+
+	// snapshots with an other record length are rejected
+	binary.BigEndian.PutUint16(b[6:8], stateRecordLen+2)
+	os.WriteFile(path, b, 0644)
+	if _, err := NewStateTable().LoadSnapshot(path, services, time.Minute); err == nil {
+		t.Error("Was expecting an error for an other record length.")
+	}
+}
@@ -1,131 +1,708 @@
 package balancer
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
 )
 
-// State represents a single connection state
+// State represents a single connection state. A State is not modified once
+// it has been added to the StateTable, as it is read concurrently (e.g. by
+// States and the metrics): a change is published by adding a modified copy
+// with Put.
 type State struct {
-	State  TCPState
-	Server *Server
-	Seq    uint32
+	IP      net.IP
+	Port    layers.TCPPort
+	State   TCPState
+	Service *Service
+	Server  *Server
+	Seq     uint32
+	Created time.Time
+
+	// Offloaded is set when the packets of the connection are forwarded by
+	// the FastPath of the StateTable.
+	Offloaded bool
+}
+
+// FastPath forwards the packets of established connections without passing
+// them to BalancePackets (e.g. XDPFastPath).
+type FastPath interface {
+	// Offload starts forwarding the packets of the given connection to
+	// its server.
+	Offload(state *State) error
+	// Remove stops forwarding the packets of the given connection.
+	Remove(state *State) error
+	// Active returns true when packets of the given connection have been
+	// forwarded since the previous call.
+	Active(state *State) bool
 }
 
-// StateTable keeps track of the connection states.
+// stateTableShards is the number of partitions of the state tables. Each
+// partition has its own lock, so that the packet handling workers rarely
+// contend on the same lock.
+const stateTableShards = 64
+
+// StateTable keeps track of the connection states. A state is removed when
+// the connection is reset (see Remove) or when it has been idle for too long
+// (see Expire).
 type StateTable struct {
+	shards   [stateTableShards]stateTableShard
+	onChange func(State)
+	fastPath FastPath
+}
+
+type stateTableShard struct {
 	sync.RWMutex
-	states map[string]*State
+	states map[connKey]*stateEntry
+}
+
+// stateEntry is a state in the StateTable, with the time (in nanoseconds) a
+// packet of the connection was last seen. lastPublished is the time the
+// state was last published with Changed, it is protected by the lock of the
+// shard.
+type stateEntry struct {
+	state         *State
+	lastSeen      atomic.Int64
+	lastPublished int64
 }
 
 // NewStateTable creates and initializes a new StateTable.
 func NewStateTable() *StateTable {
-	return &StateTable{
-		states: make(map[string]*State),
+	s := &StateTable{}
+	for i := range s.shards {
+		s.shards[i].states = make(map[connKey]*stateEntry)
 	}
+	return s
 }
 
-func (s *StateTable) NewState(ip net.IP, port layers.TCPPort) *State {
-	s.Lock()
-	defer s.Unlock()
-	state := &State{
-		Seq: randomSequence(),
-	}
-	s.states[fmt.Sprintf("%s:%d", ip.String(), port)] = state
+func (s *StateTable) shard(key connKey) *stateTableShard {
+	return &s.shards[shardIndex(key)]
+}
+
+// NewState creates a new state for the connection between the given client
+// and service and adds it to the table. The IP is copied, as it usually
+// references the data of the received packet.
+func (s *StateTable) NewState(ip net.IP, port layers.TCPPort, service *Service) *State {
+	state := newState(ip, port, service)
+	s.Put(state)
 	return state
 }
 
-func (s *StateTable) GetState(ip net.IP, port layers.TCPPort) (*State, bool) {
-	s.RLock()
-	defer s.RUnlock()
+// newState returns a new state for the connection between the given client
+// and service, without adding it to the table. It can be modified until it
+// is added with Put.
+func newState(ip net.IP, port layers.TCPPort, service *Service) *State {
+	return &State{
+		IP:      append(net.IP(nil), ip...),
+		Port:    port,
+		Service: service,
+		Seq:     randomSequence(),
+		Created: now(),
+	}
+}
+
+// GetState returns the state for the connection between the given client
+// and the given VIP and port. It marks the connection as active, see Expire.
+func (s *StateTable) GetState(ip net.IP, port layers.TCPPort, vip net.IP, vipPort layers.TCPPort) (*State, bool) {
+	key := flowKey(ip, port, vip, vipPort)
+	shard := s.shard(key)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	e, ok := shard.states[key]
+	if !ok {
+		return nil, false
+	}
+	e.lastSeen.Store(now().UnixNano())
+	return e.state, true
+}
+
+// Put adds the given state to the table, replacing the existing state of
+// the connection (if any). Put does not call the OnChange function.
+func (s *StateTable) Put(state *State) {
+	s.put(state, now().UnixNano())
+}
+
+// put adds the given state to the table like Put, with the given time (in
+// nanoseconds) a packet of the connection was last seen.
+func (s *StateTable) put(state *State, lastSeen int64) {
+	key := flowKey(state.IP, state.Port, state.Service.IP, state.Service.Port)
+	e := &stateEntry{state: state, lastPublished: lastSeen}
+	e.lastSeen.Store(lastSeen)
 
-	state, ok := s.states[fmt.Sprintf("%s:%d", ip.String(), port)]
-	return state, ok
+	shard := s.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	shard.states[key] = e
 }
 
-// PacketBridgeState represents a single connection state at the packet bridge.
+// Remove removes the given state from the table, unless it has been
+// replaced in the meantime. An offloaded connection is removed from the
+// FastPath too. Remove does not call the OnChange function.
+func (s *StateTable) Remove(state *State) {
+	key := flowKey(state.IP, state.Port, state.Service.IP, state.Service.Port)
+	shard := s.shard(key)
+	shard.Lock()
+	e, ok := shard.states[key]
+	if !ok || e.state != state {
+		shard.Unlock()
+		return
+	}
+	delete(shard.states, key)
+	shard.Unlock()
+	s.removeFromFastPath(state)
+}
+
+// removeFromFastPath removes the given removed state from the FastPath, when
+// it was offloaded.
+func (s *StateTable) removeFromFastPath(state *State) {
+	if s.fastPath == nil || !state.Offloaded {
+		return
+	}
+	if err := s.fastPath.Remove(state); err != nil {
+		fastPathErrors.Inc()
+		logPacket(func() log.Fields {
+			return log.Fields{
+				"client": fmt.Sprintf("%s:%d", state.IP, state.Port),
+				"error":  err.Error(),
+			}
+		}, "could not remove connection from fast path")
+	}
+}
+
+// replace replaces the given old state of a connection with the given state.
+// It returns false when the old state has been replaced or removed in the
+// meantime.
+func (s *StateTable) replace(old, state *State) bool {
+	key := flowKey(old.IP, old.Port, old.Service.IP, old.Service.Port)
+	shard := s.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	e, ok := shard.states[key]
+	if !ok || e.state != old {
+		return false
+	}
+	e.state = state
+	return true
+}
+
+// update adds the given state of a connection received from a peer (see
+// StateSync), replacing the existing state. When the connection is
+// offloaded, it stays offloaded if it is still established with the same
+// server, else it is removed from the FastPath.
+func (s *StateTable) update(state *State) {
+	key := flowKey(state.IP, state.Port, state.Service.IP, state.Service.Port)
+	e := &stateEntry{state: state, lastPublished: now().UnixNano()}
+	e.lastSeen.Store(e.lastPublished)
+
+	var unloaded *State
+	shard := s.shard(key)
+	shard.Lock()
+	if old, ok := shard.states[key]; ok && old.state.Offloaded {
+		if state.State == TCP_STATE_ESTABLISHED && state.Server == old.state.Server {
+			state.Offloaded = true
+		} else {
+			unloaded = old.state
+		}
+	}
+	shard.states[key] = e
+	shard.Unlock()
+
+	if unloaded != nil {
+		s.removeFromFastPath(unloaded)
+	}
+}
+
+// States returns a copy of all states.
+func (s *StateTable) States() []State {
+	var out []State
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.RLock()
+		for _, e := range shard.states {
+			out = append(out, *e.state)
+		}
+		shard.RUnlock()
+	}
+	return out
+}
+
+// OnChange sets the function that is called (with a copy of the state) when
+// a state has been changed. It must be set before the table is used.
+func (s *StateTable) OnChange(f func(State)) {
+	s.onChange = f
+}
+
+// Changed must be called after the given state has been changed (e.g. a
+// state transition or the selection of a server).
+func (s *StateTable) Changed(state *State) {
+	if s.onChange != nil {
+		s.onChange(*state)
+	}
+}
+
+// SetFastPath sets the FastPath established connections are offloaded to.
+// It must be set before the table is used.
+func (s *StateTable) SetFastPath(f FastPath) {
+	s.fastPath = f
+}
+
+// offload offloads the given established connection to the FastPath (if
+// any), unless it has been offloaded already. The state is replaced by a copy
+// with Offloaded set.
+func (s *StateTable) offload(state *State) {
+	if s.fastPath == nil || state.Offloaded {
+		return
+	}
+	if err := s.fastPath.Offload(state); err != nil {
+		fastPathErrors.Inc()
+		logPacket(func() log.Fields {
+			return log.Fields{
+				"client": fmt.Sprintf("%s:%d", state.IP, state.Port),
+				"error":  err.Error(),
+			}
+		}, "could not offload connection")
+		return
+	}
+	offloaded := *state
+	offloaded.Offloaded = true
+	if !s.replace(state, &offloaded) {
+		// the state has been replaced (e.g. migrated to an other server)
+		// while it was offloaded, the next packet offloads the new state
+		s.fastPath.Remove(state)
+		return
+	}
+	fastPathOffloads.Inc()
+}
+
+// unload removes the given connection from the FastPath (e.g. when it is
+// closed). The state is replaced by a copy with Offloaded unset, which is
+// returned.
+func (s *StateTable) unload(state *State) *State {
+	if s.fastPath == nil || !state.Offloaded {
+		return state
+	}
+	if err := s.fastPath.Remove(state); err != nil {
+		fastPathErrors.Inc()
+		logPacket(func() log.Fields {
+			return log.Fields{
+				"client": fmt.Sprintf("%s:%d", state.IP, state.Port),
+				"error":  err.Error(),
+			}
+		}, "could not remove connection from fast path")
+		return state
+	}
+	unloaded := *state
+	unloaded.Offloaded = false
+	if !s.replace(state, &unloaded) {
+		return state
+	}
+	return &unloaded
+}
+
+// Expire removes the states of the connections that have been idle for
+// longer than the given timeout. Connections that are not established (a
+// handshake that was not completed or a connection that is closing) are
+// removed after the closingTimeout. The packets of offloaded connections are
+// not seen by the table, the FastPath is asked whether they are active
+// instead (when the connection seems idle for half the idleTimeout); expired
+// connections are removed from the FastPath too. The states of active
+// connections are published again (with Changed) every half idleTimeout, so
+// that the peers do not expire them. It returns the number of removed states.
+func (s *StateTable) Expire(idleTimeout, closingTimeout time.Duration) int {
+	t := now().UnixNano()
+	var removed, active []*State
+	for i := range s.shards {
+		shard := &s.shards[i]
+
+		// ask the FastPath without holding the lock, it might be slow
+		var offloaded []*stateEntry
+		shard.RLock()
+		for _, e := range shard.states {
+			if e.state.Offloaded && t-e.lastSeen.Load() > int64(idleTimeout/2) {
+				offloaded = append(offloaded, e)
+			}
+		}
+		shard.RUnlock()
+		for _, e := range offloaded {
+			if s.fastPath != nil && s.fastPath.Active(e.state) {
+				e.lastSeen.Store(t)
+			}
+		}
+
+		shard.Lock()
+		for key, e := range shard.states {
+			timeout := idleTimeout
+			if e.state.State != TCP_STATE_ESTABLISHED {
+				timeout = closingTimeout
+			}
+			lastSeen := e.lastSeen.Load()
+			switch {
+			case t-lastSeen > int64(timeout):
+				delete(shard.states, key)
+				removed = append(removed, e.state)
+			case lastSeen > e.lastPublished && t-e.lastPublished > int64(idleTimeout/2):
+				e.lastPublished = t
+				active = append(active, e.state)
+			}
+		}
+		shard.Unlock()
+	}
+
+	for _, state := range removed {
+		s.removeFromFastPath(state)
+	}
+	for _, state := range active {
+		s.Changed(state)
+	}
+	expiredStates.Add(float64(len(removed)))
+	return len(removed)
+}
+
+// RunExpiry calls Expire at the given interval, until the program exits.
+func (s *StateTable) RunExpiry(interval, idleTimeout, closingTimeout time.Duration) {
+	for range time.Tick(interval) {
+		if n := s.Expire(idleTimeout, closingTimeout); n > 0 {
+			log.WithField("count", n).Debug("expired connection states")
+		}
+	}
+}
+
+// CountByState returns the number of connections per TCPState.
+func (s *StateTable) CountByState() map[TCPState]int {
+	out := make(map[TCPState]int)
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.RLock()
+		for _, e := range shard.states {
+			out[e.state.State]++
+		}
+		shard.RUnlock()
+	}
+	return out
+}
+
+// PacketBridgeState represents a single connection state at the packet
+// bridge. Like a State, it is not modified once it has been added to the
+// table, see PacketBridgeStateTable.Put.
 type PacketBridgeState struct {
 	State        TCPState
 	IP           net.IP
 	HardwareAddr net.HardwareAddr
 	RandPort     layers.TCPPort
 	Port         layers.TCPPort
+	VIP          net.IP
+	ServicePort  layers.TCPPort
+	BackendPort  layers.TCPPort
+	Backend      *Server
 	LBIndex      uint8
 	SeqOffset    uint32
 	PayloadBuf   []byte
+	Created      time.Time
+
+	// Passthrough is set when the balancer forwarded the SYN of the client
+	// (l4hash mode), the handshake is then done between the client and the
+	// backend and the sequence numbers are not translated
+	Passthrough bool
+
+	// Encapsulated is set when the balancer encapsulates the packets of the
+	// client, the MSS announced by the backend is then clamped (see
+	// encapMSS)
+	Encapsulated bool
 }
 
-// PacketBridgeStateTable represents a table of tcp connection states.
+// PacketBridgeStateTable represents a table of tcp connection states. The
+// states are indexed by the connection (partitioned like the StateTable)
+// and by random port. The random port index is lock-free, as it is used for
+// every packet received from the backends. Like in the StateTable, a state is
+// removed when it has been idle for too long (see Expire).
 type PacketBridgeStateTable struct {
+	shards   [stateTableShards]packetBridgeStateTableShard
+	byPort   [65536]atomic.Pointer[PacketBridgeState]
+	onChange func(PacketBridgeState)
+
+	// the time (in nanoseconds) a packet of the connection using the
+	// random port was last seen and its state was last published
+	lastSeen      [65536]atomic.Int64
+	lastPublished [65536]atomic.Int64
+}
+
+type packetBridgeStateTableShard struct {
 	sync.RWMutex
-	byPort map[layers.TCPPort]*PacketBridgeState
-	byIP   map[string]*PacketBridgeState
+	byIP map[connKey]*PacketBridgeState
 }
 
 // NewPacketBridgeStateTable creates and initializes a new PacketBridgeStateTable.
 func NewPacketBridgeStateTable() *PacketBridgeStateTable {
-	return &PacketBridgeStateTable{
-		byPort: make(map[layers.TCPPort]*PacketBridgeState),
-		byIP:   make(map[string]*PacketBridgeState),
+	s := &PacketBridgeStateTable{}
+	for i := range s.shards {
+		s.shards[i].byIP = make(map[connKey]*PacketBridgeState)
 	}
+	return s
+}
+
+func (s *PacketBridgeStateTable) shard(key connKey) *packetBridgeStateTableShard {
+	return &s.shards[shardIndex(key)]
 }
 
-func (s *PacketBridgeStateTable) NewState(ip net.IP, mac net.HardwareAddr, port layers.TCPPort, lbIndex uint8, seqOffset uint32, payload []byte) *PacketBridgeState {
-	var randPort layers.TCPPort
-	s.Lock()
-	defer s.Unlock()
+// errNoFreePort is returned by PacketBridgeStateTable.NewState when all
+// random ports are in use.
+var errNoFreePort = errors.New("no free random port")
 
-	// generate random port that is not yet in the table
-	// todo max number of tries or a better way to find unique port!
-	for {
-		randPort = randomPort()
-		if _, ok := s.byPort[randPort]; !ok {
+// NewState adds the given state to the table. It sets a random port that is
+// not yet in use, which is used for the connection with the backend. It
+// returns errNoFreePort when all ports are in use.
+func (s *PacketBridgeStateTable) NewState(state *PacketBridgeState) (*PacketBridgeState, error) {
+	state.Created = now()
+
+	// claim the first port that is not yet in the table, starting at a
+	// random port (port 0 is never used)
+	start := int(randomPort())
+	for i := 0; ; i++ {
+		if i == 65535 {
+			return nil, errNoFreePort
+		}
+		state.RandPort = layers.TCPPort(1 + (start-1+i)%65535)
+		if s.byPort[state.RandPort].CompareAndSwap(nil, state) {
 			break
 		}
 	}
 
-	state := &PacketBridgeState{
-		IP:           ip,
-		Port:         port,
-		HardwareAddr: mac,
-		RandPort:     randPort,
-		LBIndex:      lbIndex,
-		SeqOffset:    seqOffset,
-		PayloadBuf:   payload,
+	s.seen(state.RandPort, now().UnixNano())
+
+	key := flowKey(state.IP, state.Port, state.VIP, state.ServicePort)
+	shard := s.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	shard.byIP[key] = state
+	return state, nil
+}
+
+// seen marks the connection using the given random port as active and as
+// published at the given time (in nanoseconds), see Expire.
+func (s *PacketBridgeStateTable) seen(port layers.TCPPort, t int64) {
+	s.lastSeen[port].Store(t)
+	s.lastPublished[port].Store(t)
+}
+
+// Put adds the given state to the table, replacing the existing state of
+// the connection or random port (if any). Put does not call the OnChange
+// function.
+func (s *PacketBridgeStateTable) Put(state *PacketBridgeState) {
+	s.put(state, now().UnixNano())
+}
+
+// put adds the given state to the table like Put, with the given time (in
+// nanoseconds) a packet of the connection was last seen.
+func (s *PacketBridgeStateTable) put(state *PacketBridgeState, lastSeen int64) {
+	key := flowKey(state.IP, state.Port, state.VIP, state.ServicePort)
+	shard := s.shard(key)
+	shard.Lock()
+	if old, ok := shard.byIP[key]; ok && old.RandPort != state.RandPort {
+		s.byPort[old.RandPort].CompareAndSwap(old, nil)
+	}
+	shard.byIP[key] = state
+	old := s.byPort[state.RandPort].Swap(state)
+	s.seen(state.RandPort, lastSeen)
+	shard.Unlock()
+
+	// the random port was in use by an other connection
+	if old != nil && old != state {
+		if oldKey := flowKey(old.IP, old.Port, old.VIP, old.ServicePort); oldKey != key {
+			oldShard := s.shard(oldKey)
+			oldShard.Lock()
+			if oldShard.byIP[oldKey] == old {
+				delete(oldShard.byIP, oldKey)
+			}
+			oldShard.Unlock()
+		}
 	}
+}
 
-	s.byPort[randPort] = state
-	s.byIP[fmt.Sprintf("%s:%d", ip.String(), port)] = state
-	return state
+// Remove removes the given state from the table, unless it has been
+// replaced in the meantime. Remove does not call the OnChange function.
+func (s *PacketBridgeStateTable) Remove(state *PacketBridgeState) {
+	key := flowKey(state.IP, state.Port, state.VIP, state.ServicePort)
+	shard := s.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	if shard.byIP[key] == state {
+		delete(shard.byIP, key)
+	}
+	s.byPort[state.RandPort].CompareAndSwap(state, nil)
+}
+
+// Expire removes the states of the connections that have been idle for
+// longer than the given timeout, which frees their random ports. Connections
+// that are not established (a handshake that was not completed, a closing or
+// a migrated connection) are removed after the closingTimeout. The states of
+// active connections are published again (with Changed) every half
+// idleTimeout, so that the peers do not expire them. It returns the number
+// of removed states.
+func (s *PacketBridgeStateTable) Expire(idleTimeout, closingTimeout time.Duration) int {
+	t := now().UnixNano()
+	var removed, active []*PacketBridgeState
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.RLock()
+		for _, state := range shard.byIP {
+			timeout := idleTimeout
+			if state.State != TCP_STATE_ESTABLISHED {
+				timeout = closingTimeout
+			}
+			lastSeen := s.lastSeen[state.RandPort].Load()
+			lastPublished := s.lastPublished[state.RandPort].Load()
+			switch {
+			case t-lastSeen > int64(timeout):
+				removed = append(removed, state)
+			case lastSeen > lastPublished && t-lastPublished > int64(idleTimeout/2):
+				s.lastPublished[state.RandPort].Store(t)
+				active = append(active, state)
+			}
+		}
+		shard.RUnlock()
+	}
+
+	// a state that has been replaced in the meantime is kept
+	for _, state := range removed {
+		s.Remove(state)
+	}
+	for _, state := range active {
+		s.Changed(state)
+	}
+	expiredStates.Add(float64(len(removed)))
+	return len(removed)
 }
 
+// RunExpiry calls Expire at the given interval, until the program exits.
+func (s *PacketBridgeStateTable) RunExpiry(interval, idleTimeout, closingTimeout time.Duration) {
+	for range time.Tick(interval) {
+		if n := s.Expire(idleTimeout, closingTimeout); n > 0 {
+			log.WithField("count", n).Debug("expired connection states")
+		}
+	}
+}
+
+// States returns a copy of all states.
+func (s *PacketBridgeStateTable) States() []PacketBridgeState {
+	var out []PacketBridgeState
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.RLock()
+		for _, state := range shard.byIP {
+			out = append(out, *state)
+		}
+		shard.RUnlock()
+	}
+	return out
+}
+
+// OnChange sets the function that is called (with a copy of the state) when
+// a state has been changed. It must be set before the table is used.
+func (s *PacketBridgeStateTable) OnChange(f func(PacketBridgeState)) {
+	s.onChange = f
+}
+
+// Changed must be called after the given state has been changed.
+func (s *PacketBridgeStateTable) Changed(state *PacketBridgeState) {
+	if s.onChange != nil {
+		s.onChange(*state)
+	}
+}
+
+// GetByPort returns the state of the connection using the given random port.
+// It marks the connection as active, see Expire.
 func (s *PacketBridgeStateTable) GetByPort(port layers.TCPPort) (*PacketBridgeState, bool) {
-	s.RLock()
-	defer s.RUnlock()
+	state := s.byPort[port].Load()
+	if state == nil {
+		return nil, false
+	}
+	s.lastSeen[port].Store(now().UnixNano())
+	return state, true
+}
+
+// GetByIP returns the state of the connection between the given client and
+// VIP. It marks the connection as active, see Expire.
+func (s *PacketBridgeStateTable) GetByIP(ip net.IP, port layers.TCPPort, vip net.IP, vipPort layers.TCPPort) (*PacketBridgeState, bool) {
+	key := flowKey(ip, port, vip, vipPort)
+	shard := s.shard(key)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	state, ok := shard.byIP[key]
+	if !ok {
+		return nil, false
+	}
+	s.lastSeen[state.RandPort].Store(now().UnixNano())
+	return state, true
+}
 
-	state, ok := s.byPort[port]
-	return state, ok
+// CountByState returns the number of connections per TCPState.
+func (s *PacketBridgeStateTable) CountByState() map[TCPState]int {
+	out := make(map[TCPState]int)
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.RLock()
+		for _, state := range shard.byIP {
+			out[state.State]++
+		}
+		shard.RUnlock()
+	}
+	return out
 }
 
-func (s *PacketBridgeStateTable) GetByIP(ip net.IP, port layers.TCPPort) (*PacketBridgeState, bool) {
-	s.RLock()
-	defer s.RUnlock()
+// connKey identifies a connection in the state tables: the source IP and
+// port and the destination IP and port (IPs in their 16 byte form).
+type connKey [2*net.IPv6len + 4]byte
+
+func flowKey(srcIP net.IP, srcPort layers.TCPPort, dstIP net.IP, dstPort layers.TCPPort) connKey {
+	var key connKey
+	copy(key[0:16], srcIP.To16())
+	binary.BigEndian.PutUint16(key[16:18], uint16(srcPort))
+	copy(key[18:34], dstIP.To16())
+	binary.BigEndian.PutUint16(key[34:36], uint16(dstPort))
+	return key
+}
 
-	state, ok := s.byIP[fmt.Sprintf("%s:%d", ip.String(), port)]
-	return state, ok
+// shardIndex returns the state table partition of the given flow key
+// (FNV-1a).
+func shardIndex(key connKey) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % stateTableShards)
 }
 
+// seededRand is used instead of the global source of math/rand when set, so
+// that a replay (see Replay) picks the same sequence numbers and ports on
+// every run. It is not safe for concurrent use, it is only set by Replay,
+// which handles the packets in a single goroutine.
+var seededRand *rand.Rand
+
+// randomSequence returns a random initial sequence number. Unless seededRand
+// is set, it uses the global source, which is safe for concurrent use by the
+// workers.
 func randomSequence() uint32 {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	return uint32(r.Int31())
+	if seededRand != nil {
+		return uint32(seededRand.Int31())
+	}
+	return uint32(rand.Int31())
 }
 
+// randomPort returns a random port (never 0), see randomSequence.
 func randomPort() layers.TCPPort {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	return layers.TCPPort(r.Int31n(65536))
+	if seededRand != nil {
+		return layers.TCPPort(1 + seededRand.Int31n(65535))
+	}
+	return layers.TCPPort(1 + rand.Int31n(65535))
 }
@@ -0,0 +1,290 @@
+package balancer
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestStateTableFlowKey(t *testing.T) {
+	st := NewStateTable()
+	s1 := &Service{IP: net.ParseIP("10.0.0.1").To4(), Port: 80}
+	s2 := &Service{IP: net.ParseIP("10.0.0.2").To4(), Port: 80}
+	client := net.ParseIP("192.168.1.1").To4()
+
+	state1 := st.NewState(client, 1234, s1)
+	state2 := st.NewState(client, 1234, s2)
+
+	if state, ok := st.GetState(client, 1234, s1.IP, s1.Port); !ok || state != state1 {
+		t.Error("Was expecting the state of the first service.")
+	}
+	if state, ok := st.GetState(client, 1234, s2.IP, s2.Port); !ok || state != state2 {
+		t.Error("Was expecting the state of the second service.")
+	}
+}
+
+func TestStateTableExpire(t *testing.T) {
+	t0 := time.Now()
+	clock := t0
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	st := NewStateTable()
+	var changed []State
+	st.OnChange(func(state State) { changed = append(changed, state) })
+	service := &Service{IP: net.ParseIP("10.0.0.1").To4(), Port: 80}
+	client := net.ParseIP("192.168.1.1").To4()
+
+	established := newState(client, 1000, service)
+	established.State = TCP_STATE_ESTABLISHED
+	st.Put(established)
+	active := newState(client, 1001, service)
+	active.State = TCP_STATE_ESTABLISHED
+	st.Put(active)
+	handshake := newState(client, 1002, service)
+	handshake.State = TCP_STATE_SYN_RECEIVED
+	st.Put(handshake)
+	fastPath := &testFastPath{flows: 1, active: true}
+	st.SetFastPath(fastPath)
+	offloaded := newState(client, 1003, service)
+	offloaded.State = TCP_STATE_ESTABLISHED
+	offloaded.Offloaded = true
+	st.Put(offloaded)
+
+	clock = t0.Add(2 * time.Minute)
+	st.GetState(client, 1001, service.IP, service.Port)
+	if n := st.Expire(10*time.Minute, time.Minute); n != 1 {
+		t.Errorf("Was expecting the handshake to expire, got %d expired states.", n)
+	}
+	if _, ok := st.GetState(client, 1002, service.IP, service.Port); ok {
+		t.Error("The state of the handshake should have been removed.")
+	}
+
+	clock = t0.Add(6 * time.Minute)
+	st.GetState(client, 1001, service.IP, service.Port)
+	if n := st.Expire(10*time.Minute, time.Minute); n != 0 {
+		t.Errorf("Was expecting no expired states, got: %d", n)
+	}
+	if len(changed) != 2 {
+		t.Errorf("Was expecting the active connections (also the offloaded one) to be published, got: %+v", changed)
+	}
+
+	clock = t0.Add(11 * time.Minute)
+	if n := st.Expire(10*time.Minute, time.Minute); n != 1 {
+		t.Errorf("Was expecting the idle connection to expire, got %d expired states.", n)
+	}
+	for port, keep := range map[layers.TCPPort]bool{1000: false, 1001: true, 1003: true} {
+		if _, ok := st.GetState(client, port, service.IP, service.Port); ok != keep {
+			t.Errorf("Was expecting the state of port %d to be kept: %t", port, keep)
+		}
+	}
+
+	// an offloaded connection without packets is removed from the fast
+	// path too
+	fastPath.active = false
+	clock = t0.Add(22 * time.Minute)
+	st.Expire(10*time.Minute, time.Minute)
+	if _, ok := st.GetState(client, 1003, service.IP, service.Port); ok || fastPath.flows != 0 {
+		t.Errorf("Was expecting the idle offloaded connection to be removed, got %d flows.", fastPath.flows)
+	}
+}
+
+// TestStateTableConcurrentReads reads the states (as the metrics, state sync
+// and snapshots do) while the connections change state, run with -race.
+func TestStateTableConcurrentReads(t *testing.T) {
+	routerMAC, _ := net.ParseMAC("22:22:22:22:22:22")
+	vip := net.ParseIP("192.168.33.100").To4()
+	pool := NewConsistentHashPool()
+	pool.AddServer(&Server{IP: net.ParseIP("192.168.33.20").To4(), HardwareAddr: net.HardwareAddr{0x08, 0, 0, 0, 0, 1}})
+	services := NewServiceTable()
+	if err := services.AddService(&Service{IP: vip, Port: 80, Protocol: layers.IPProtocolTCP, LBIndex: 1, Pool: pool, KeyExtractor: FlowKey}); err != nil {
+		t.Fatal(err)
+	}
+	stateTable := NewStateTable()
+	stateTable.SetFastPath(&testFastPath{})
+
+	clientPacket := func(port layers.TCPPort, tcp *layers.TCP) gopacket.Packet {
+		eth := &layers.Ethernet{SrcMAC: routerMAC, DstMAC: routerMAC, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, TTL: 63, SrcIP: net.ParseIP("10.0.0.1").To4(), DstIP: vip, Protocol: layers.IPProtocolTCP}
+		tcp.SrcPort = port
+		tcp.DstPort = 80
+		tcp.Window = 1024
+		b, err := NewEthPacket(eth, ip, tcp).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gopacket.NewPacket(b, layers.LayerTypeEthernet, gopacket.Default)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		out := NewEthPacketQueue("test", 16, OVERFLOW_DROP_OLDEST)
+		for port := layers.TCPPort(1000); port < 1200; port++ {
+			for _, tcp := range []*layers.TCP{
+				{Seq: 100, SYN: true},
+				{Seq: 101, ACK: true},
+				{Seq: 101, ACK: true, PSH: true, BaseLayer: layers.BaseLayer{Payload: []byte("GET /")}},
+				{Seq: 106, ACK: true},
+			} {
+				BalancePacket(clientPacket(port, tcp), out, stateTable, services)
+			}
+		}
+	}()
+
+	collector := NewStateTableCollector(stateTable, nil)
+	for {
+		select {
+		case <-done:
+			if n := stateTable.CountByState()[TCP_STATE_ESTABLISHED]; n != 200 {
+				t.Errorf("Was expecting 200 established connections, got: %d", n)
+			}
+			return
+		default:
+		}
+		ch := make(chan prometheus.Metric, 16)
+		collector.Collect(ch)
+		for _, state := range stateTable.States() {
+			_ = state.State == TCP_STATE_ESTABLISHED && state.Server != nil && state.Offloaded
+		}
+	}
+}
+
+func TestPacketBridgeStateTableNoFreePort(t *testing.T) {
+	st := NewPacketBridgeStateTable()
+	backend := &Server{IP: net.ParseIP("192.168.33.30").To4()}
+	vip := net.ParseIP("192.168.33.10").To4()
+
+	for i := 0; i < 65535; i++ {
+		client := net.IPv4(10, 0, byte(i>>8), byte(i)).To4()
+		state, err := st.NewState(&PacketBridgeState{IP: client, Port: 1000, VIP: vip, ServicePort: 80, Backend: backend})
+		if err != nil {
+			t.Fatalf("Connection %d: %s", i, err)
+		}
+		if state.RandPort == 0 {
+			t.Fatal("Random port 0 should not be used.")
+		}
+	}
+	if _, err := st.NewState(&PacketBridgeState{IP: net.ParseIP("10.1.0.1").To4(), Port: 1000, VIP: vip, ServicePort: 80, Backend: backend}); err != errNoFreePort {
+		t.Errorf("Was expecting errNoFreePort, got: %v", err)
+	}
+}
+
+func TestPacketBridgeStateTableExpire(t *testing.T) {
+	t0 := time.Now()
+	clock := t0
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	st := NewPacketBridgeStateTable()
+	var changed []PacketBridgeState
+	st.OnChange(func(state PacketBridgeState) { changed = append(changed, state) })
+	backend := &Server{IP: net.ParseIP("192.168.33.30").To4()}
+	vip := net.ParseIP("192.168.33.10").To4()
+	client := net.ParseIP("10.0.0.1").To4()
+
+	states := make(map[layers.TCPPort]*PacketBridgeState)
+	for port, state := range map[layers.TCPPort]TCPState{
+		1000: TCP_STATE_ESTABLISHED, // idle
+		1001: TCP_STATE_ESTABLISHED, // active
+		1002: TCP_STATE_SYN_SENT,
+		1003: TCP_STATE_CLOSED, // migrated
+	} {
+		s, err := st.NewState(&PacketBridgeState{State: state, IP: client, Port: port, VIP: vip, ServicePort: 80, Backend: backend})
+		if err != nil {
+			t.Fatal(err)
+		}
+		states[port] = s
+	}
+
+	clock = t0.Add(2 * time.Minute)
+	st.GetByPort(states[1001].RandPort)
+	if n := st.Expire(10*time.Minute, time.Minute); n != 2 {
+		t.Errorf("Was expecting the handshake and the migrated connection to expire, got %d expired states.", n)
+	}
+
+	clock = t0.Add(6 * time.Minute)
+	st.GetByIP(client, 1001, vip, 80)
+	if n := st.Expire(10*time.Minute, time.Minute); n != 0 || len(changed) != 1 || changed[0].Port != 1001 {
+		t.Errorf("Was expecting the active connection to be published, got %d expired states and: %+v", n, changed)
+	}
+
+	clock = t0.Add(11 * time.Minute)
+	if n := st.Expire(10*time.Minute, time.Minute); n != 1 {
+		t.Errorf("Was expecting the idle connection to expire, got %d expired states.", n)
+	}
+	for port, keep := range map[layers.TCPPort]bool{1000: false, 1001: true, 1002: false, 1003: false} {
+		if _, ok := st.GetByIP(client, port, vip, 80); ok != keep {
+			t.Errorf("Was expecting the state of port %d to be kept: %t", port, keep)
+		}
+		if _, ok := st.GetByPort(states[port].RandPort); ok != keep {
+			t.Errorf("Was expecting the random port of port %d to be kept: %t", port, keep)
+		}
+	}
+
+	// a removed state frees its random port
+	st.Remove(states[1001])
+	if _, ok := st.GetByPort(states[1001].RandPort); ok || len(st.States()) != 0 {
+		t.Error("Was expecting the state to be removed.")
+	}
+}
+
+func TestPacketBridgeStateTableConcurrent(t *testing.T) {
+	st := NewPacketBridgeStateTable()
+	backend := &Server{IP: net.ParseIP("192.168.33.30").To4()}
+	vip := net.ParseIP("192.168.33.10").To4()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for port := 0; port < 500; port++ {
+				client := net.IPv4(10, 0, 0, byte(w)).To4()
+				state, err := st.NewState(&PacketBridgeState{IP: client, Port: layers.TCPPort(port), VIP: vip, ServicePort: 80, Backend: backend})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if s, ok := st.GetByIP(client, layers.TCPPort(port), vip, 80); !ok || s != state {
+					t.Errorf("Was expecting the new state for %s:%d.", client, port)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	states := st.States()
+	if len(states) != 2000 {
+		t.Fatalf("Was expecting 2000 states, got: %d", len(states))
+	}
+	for _, state := range states {
+		if s, ok := st.GetByPort(state.RandPort); !ok || s.Port != state.Port || !s.IP.Equal(state.IP) {
+			t.Errorf("Random port %d should be unique.", state.RandPort)
+		}
+	}
+
+	// replacing the state of a connection releases its random port
+	state, _ := st.GetByIP(net.IPv4(10, 0, 0, 0).To4(), 1, vip, 80)
+	moved := *state
+	moved.RandPort = state.RandPort + 1
+	if other, ok := st.GetByPort(moved.RandPort); ok {
+		st.Put(&moved)
+		if _, ok := st.GetByIP(other.IP, other.Port, other.VIP, other.ServicePort); ok {
+			t.Error("The state that used the random port should have been removed.")
+		}
+	} else {
+		st.Put(&moved)
+	}
+	if _, ok := st.GetByPort(state.RandPort); ok {
+		t.Error("The previous random port should have been released.")
+	}
+	if s, ok := st.GetByPort(moved.RandPort); !ok || s != &moved {
+		t.Error("Was expecting the moved state for the new random port.")
+	}
+}
@@ -0,0 +1,494 @@
+package balancer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The state sync protocol replicates a state table between peers over UDP.
+// Each message starts with a header:
+//
+//	magic (2 bytes) | version (1) | type (1) | node ID (4) | sequence (4) |
+//	chunk (4) | chunks (4) | record count (2)
+//
+// followed by the records (see record.go). The magic identifies the table
+// (balancer or packetbridge). Updates are sent with an incrementing sequence
+// number per node, a receiver that detects a gap (or that does not know the
+// node yet) requests a full resync of the table. A resync is sent in chunks
+// (the index of the chunk and the number of chunks of the resync, 0 for the
+// other messages), paced by syncResyncInterval so that the socket buffer of
+// the receiver does not overflow. A receiver that misses chunks requests the
+// resync again.
+const (
+	syncMagicBalancer     = 0x4c33 // "L3"
+	syncMagicPacketBridge = 0x5042 // "PB"
+	syncVersion           = 1
+	syncHeaderLen         = 22
+	syncMaxPayload        = 1400 - syncHeaderLen
+
+	// syncResyncInterval is the interval between the chunks of a resync
+	syncResyncInterval = time.Millisecond
+	// syncResyncTimeout is the time after which a resync that is missing
+	// chunks is requested again
+	syncResyncTimeout = time.Second
+)
+
+// state sync message types
+const (
+	syncMsgUpdate uint8 = iota + 1
+	syncMsgResyncRequest
+	syncMsgResync
+)
+
+type syncHeader struct {
+	Type   uint8
+	NodeID uint32
+	Seq    uint32
+	Chunk  uint32
+	Chunks uint32
+}
+
+// syncTable is a state table that is replicated by StateSync.
+type syncTable interface {
+	// magic returns the magic identifying the table in the messages
+	magic() uint16
+	// recordLen returns the length of an encoded record
+	recordLen() int
+	// records returns the encoded records of all states
+	records() [][]byte
+	// apply adds the state of the given encoded record to the table
+	apply(b []byte) error
+}
+
+type balancerSyncTable struct {
+	stateTable *StateTable
+	services   *ServiceTable
+}
+
+func (t balancerSyncTable) magic() uint16  { return syncMagicBalancer }
+func (t balancerSyncTable) recordLen() int { return stateRecordLen }
+
+func (t balancerSyncTable) records() [][]byte {
+	var out [][]byte
+	for _, st := range t.stateTable.States() {
+		out = append(out, appendStateRecord(nil, st))
+	}
+	return out
+}
+
+func (t balancerSyncTable) apply(b []byte) error {
+	state, err := parseStateRecord(b, t.services)
+	if err != nil {
+		return err
+	}
+	// the connection has been reset at the peer
+	if state.State == TCP_STATE_CLOSED {
+		if old, ok := t.stateTable.GetState(state.IP, state.Port, state.Service.IP, state.Service.Port); ok {
+			t.stateTable.Remove(old)
+		}
+		return nil
+	}
+	t.stateTable.update(state)
+	return nil
+}
+
+type packetBridgeSyncTable struct {
+	stateTable *PacketBridgeStateTable
+	pool       PoolBalancer
+}
+
+func (t packetBridgeSyncTable) magic() uint16  { return syncMagicPacketBridge }
+func (t packetBridgeSyncTable) recordLen() int { return packetBridgeRecordLen }
+
+func (t packetBridgeSyncTable) records() [][]byte {
+	var out [][]byte
+	for _, st := range t.stateTable.States() {
+		out = append(out, appendPacketBridgeRecord(nil, st))
+	}
+	return out
+}
+
+func (t packetBridgeSyncTable) apply(b []byte) error {
+	state, err := parsePacketBridgeRecord(b, t.pool)
+	if err != nil {
+		return err
+	}
+	t.stateTable.Put(state)
+	return nil
+}
+
+func marshalSyncMessage(magic uint16, h syncHeader, records [][]byte) []byte {
+	b := make([]byte, 0, syncHeaderLen+syncMaxPayload)
+	b = binary.BigEndian.AppendUint16(b, magic)
+	b = append(b, syncVersion, h.Type)
+	b = binary.BigEndian.AppendUint32(b, h.NodeID)
+	b = binary.BigEndian.AppendUint32(b, h.Seq)
+	b = binary.BigEndian.AppendUint32(b, h.Chunk)
+	b = binary.BigEndian.AppendUint32(b, h.Chunks)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(records)))
+	for _, r := range records {
+		b = append(b, r...)
+	}
+	return b
+}
+
+func unmarshalSyncMessage(magic uint16, recordLen int, b []byte) (syncHeader, [][]byte, error) {
+	var h syncHeader
+	if len(b) < syncHeaderLen || binary.BigEndian.Uint16(b[0:2]) != magic {
+		return h, nil, errors.New("not a state sync message for this table")
+	}
+	if b[2] != syncVersion {
+		return h, nil, fmt.Errorf("unsupported state sync version: %d", b[2])
+	}
+	h.Type = b[3]
+	h.NodeID = binary.BigEndian.Uint32(b[4:8])
+	h.Seq = binary.BigEndian.Uint32(b[8:12])
+	h.Chunk = binary.BigEndian.Uint32(b[12:16])
+	h.Chunks = binary.BigEndian.Uint32(b[16:20])
+	count := int(binary.BigEndian.Uint16(b[20:22]))
+
+	b = b[syncHeaderLen:]
+	if len(b) != count*recordLen {
+		return h, nil, fmt.Errorf("invalid state sync message length for %d records", count)
+	}
+	records := make([][]byte, count)
+	for i := range records {
+		records[i] = b[i*recordLen : (i+1)*recordLen]
+	}
+	return h, records, nil
+}
+
+// StateSync replicates the changes of a state table to the peers and
+// applies the changes received from the peers. For the balancer this makes
+// sure that a balancer taking over the VIP (e.g. after a VRRP failover)
+// keeps forwarding the existing connections, for the packetbridge that a
+// standby can take over the backend-facing IP and keep translating the
+// sequence numbers of the existing connections.
+// The peers are unicast or multicast UDP addresses. Note that the messages
+// are not authenticated, the sync traffic must be on a trusted network.
+type StateSync struct {
+	conn    *net.UDPConn
+	peers   []*net.UDPAddr
+	nodeID  uint32
+	seq     uint32
+	table   syncTable
+	updates chan []byte
+	done    chan struct{}
+	close   sync.Once
+
+	// lastSeq and resyncs are only used by the receive loop
+	lastSeq map[uint32]uint32
+	resyncs map[uint32]*resyncProgress
+}
+
+// resyncProgress tracks the chunks received of a resync from a peer.
+type resyncProgress struct {
+	addr     *net.UDPAddr
+	seq      uint32
+	received []bool
+	missing  int
+	deadline time.Time
+}
+
+// NewStateSync creates a new StateSync for the given balancer StateTable,
+// listening on the given address. The changes of the table are published
+// using its OnChange function. When one of the peers is a multicast address,
+// the multicast group is joined instead, the given address must then be the
+// port of the group (e.g. ":7946").
+func NewStateSync(bind string, peers []string, stateTable *StateTable, services *ServiceTable) (*StateSync, error) {
+	s, err := newStateSync(bind, peers, balancerSyncTable{stateTable: stateTable, services: services})
+	if err != nil {
+		return nil, err
+	}
+	stateTable.OnChange(func(st State) {
+		s.publish(appendStateRecord(nil, st))
+	})
+	return s, nil
+}
+
+// NewPacketBridgeStateSync creates a new StateSync for the given
+// PacketBridgeStateTable, see NewStateSync. The backends are looked up in the
+// given pool.
+func NewPacketBridgeStateSync(bind string, peers []string, stateTable *PacketBridgeStateTable, pool PoolBalancer) (*StateSync, error) {
+	s, err := newStateSync(bind, peers, packetBridgeSyncTable{stateTable: stateTable, pool: pool})
+	if err != nil {
+		return nil, err
+	}
+	stateTable.OnChange(func(st PacketBridgeState) {
+		s.publish(appendPacketBridgeRecord(nil, st))
+	})
+	return s, nil
+}
+
+func newStateSync(bind string, peers []string, table syncTable) (*StateSync, error) {
+	s := &StateSync{
+		nodeID:  rand.New(rand.NewSource(time.Now().UnixNano())).Uint32(),
+		table:   table,
+		updates: make(chan []byte, 4096),
+		done:    make(chan struct{}),
+		lastSeq: make(map[uint32]uint32),
+		resyncs: make(map[uint32]*resyncProgress),
+	}
+
+	var group *net.UDPAddr
+	for _, p := range peers {
+		addr, err := net.ResolveUDPAddr("udp4", p)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve sync peer %s: %s", p, err)
+		}
+		if addr.IP.IsMulticast() {
+			group = addr
+		}
+		s.peers = append(s.peers, addr)
+	}
+
+	laddr, err := net.ResolveUDPAddr("udp4", bind)
+	if err != nil {
+		return nil, err
+	}
+	if group != nil {
+		// the group is joined on all interfaces, the socket is bound to
+		// the group address and port
+		if laddr.Port != group.Port || (laddr.IP != nil && !laddr.IP.IsUnspecified()) {
+			return nil, fmt.Errorf("the sync bind address must be :%d (the port of multicast group %s), got: %s", group.Port, group, bind)
+		}
+		s.conn, err = net.ListenMulticastUDP("udp4", nil, group)
+	} else {
+		s.conn, err = net.ListenUDP("udp4", laddr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open state sync socket: %s", err)
+	}
+
+	return s, nil
+}
+
+// LocalAddr returns the local address of the sync socket.
+func (s *StateSync) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// publish queues the given record for replication. It does not block, when
+// the queue is full the update is dropped (peers will miss it until the
+// next change of the connection).
+func (s *StateSync) publish(record []byte) {
+	select {
+	case s.updates <- record:
+	default:
+		stateSyncRecords.WithLabelValues("dropped").Inc()
+	}
+}
+
+// Close closes the sync socket and stops Run.
+func (s *StateSync) Close() error {
+	var err error
+	s.close.Do(func() {
+		close(s.done)
+		err = s.conn.Close()
+	})
+	return err
+}
+
+// Run requests a full resync from the peers and then replicates the state
+// changes, until Close is called.
+func (s *StateSync) Run() {
+	go s.receive()
+
+	log.WithFields(log.Fields{
+		"node_id": s.nodeID,
+		"peers":   s.peers,
+	}).Info("requesting state resync from peers")
+	for _, peer := range s.peers {
+		s.send(peer, syncHeader{Type: syncMsgResyncRequest}, nil)
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	maxRecords := syncMaxPayload / s.table.recordLen()
+	var batch [][]byte
+	for {
+		select {
+		case r := <-s.updates:
+			batch = append(batch, r)
+			if len(batch) < maxRecords {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-s.done:
+			return
+		}
+
+		h := syncHeader{Type: syncMsgUpdate, Seq: atomic.AddUint32(&s.seq, 1)}
+		for _, peer := range s.peers {
+			s.send(peer, h, batch)
+		}
+		stateSyncRecords.WithLabelValues("sent").Add(float64(len(batch)))
+		batch = batch[:0]
+	}
+}
+
+func (s *StateSync) send(addr *net.UDPAddr, h syncHeader, records [][]byte) {
+	h.NodeID = s.nodeID
+	if _, err := s.conn.WriteToUDP(marshalSyncMessage(s.table.magic(), h, records), addr); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.WithField("peer", addr).Errorf("could not send state sync message: %s", err)
+	}
+}
+
+// sendResync sends the complete state table to the given peer, in chunks
+// paced by syncResyncInterval.
+func (s *StateSync) sendResync(addr *net.UDPAddr) {
+	h := syncHeader{Type: syncMsgResync, Seq: atomic.LoadUint32(&s.seq)}
+	maxRecords := syncMaxPayload / s.table.recordLen()
+	records := s.table.records()
+
+	// always send at least one chunk, so that the peer learns our sequence
+	// number, even when the table is empty
+	h.Chunks = uint32((len(records) + maxRecords - 1) / maxRecords)
+	if h.Chunks == 0 {
+		h.Chunks = 1
+	}
+
+	ticker := time.NewTicker(syncResyncInterval)
+	defer ticker.Stop()
+	for ; h.Chunk < h.Chunks; h.Chunk++ {
+		batch := records[int(h.Chunk)*maxRecords:]
+		if len(batch) > maxRecords {
+			batch = batch[:maxRecords]
+		}
+		s.send(addr, h, batch)
+
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *StateSync) receive() {
+	b := make([]byte, 1500)
+	for {
+		// wake up to request the resyncs that are missing chunks
+		s.checkResyncs()
+		var deadline time.Time
+		for _, r := range s.resyncs {
+			if deadline.IsZero() || r.deadline.Before(deadline) {
+				deadline = r.deadline
+			}
+		}
+		s.conn.SetReadDeadline(deadline)
+
+		n, addr, err := s.conn.ReadFromUDP(b)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		} else if err != nil {
+			log.Errorf("could not read state sync message: %s", err)
+			continue
+		}
+
+		h, records, err := unmarshalSyncMessage(s.table.magic(), s.table.recordLen(), b[:n])
+		if err != nil {
+			log.WithField("peer", addr).Warningf("could not decode state sync message: %s", err)
+			continue
+		}
+		if h.NodeID == s.nodeID {
+			// our own multicast message
+			continue
+		}
+
+		switch h.Type {
+		case syncMsgUpdate:
+			// a resync in progress includes the missed updates
+			_, resyncing := s.resyncs[h.NodeID]
+			if last, ok := s.lastSeq[h.NodeID]; !resyncing && (!ok || h.Seq != last+1) {
+				log.WithFields(log.Fields{
+					"peer":    addr,
+					"node_id": h.NodeID,
+				}).Info("missed state sync updates, requesting resync")
+				s.send(addr, syncHeader{Type: syncMsgResyncRequest}, nil)
+			}
+			s.lastSeq[h.NodeID] = h.Seq
+			s.apply(records)
+		case syncMsgResync:
+			s.receiveResync(addr, h, records)
+		case syncMsgResyncRequest:
+			log.WithFields(log.Fields{
+				"peer":    addr,
+				"node_id": h.NodeID,
+			}).Info("sending state resync")
+			go s.sendResync(addr)
+		}
+	}
+}
+
+// receiveResync applies the given chunk of a resync. Once all chunks have
+// been received, the sequence number of the resync is the last sequence
+// number of the peer (unless newer updates have been received meanwhile).
+func (s *StateSync) receiveResync(addr *net.UDPAddr, h syncHeader, records [][]byte) {
+	if h.Chunk >= h.Chunks {
+		log.WithField("peer", addr).Warningf("invalid state resync chunk %d of %d", h.Chunk, h.Chunks)
+		return
+	}
+	r, ok := s.resyncs[h.NodeID]
+	if !ok || r.seq != h.Seq || len(r.received) != int(h.Chunks) {
+		r = &resyncProgress{seq: h.Seq, received: make([]bool, h.Chunks), missing: int(h.Chunks)}
+		s.resyncs[h.NodeID] = r
+	}
+	r.addr = addr
+	r.deadline = time.Now().Add(syncResyncTimeout)
+	if !r.received[h.Chunk] {
+		r.received[h.Chunk] = true
+		r.missing--
+	}
+	s.apply(records)
+
+	if r.missing == 0 {
+		delete(s.resyncs, h.NodeID)
+		if last, ok := s.lastSeq[h.NodeID]; !ok || int32(h.Seq-last) > 0 {
+			s.lastSeq[h.NodeID] = h.Seq
+		}
+	}
+}
+
+// checkResyncs requests the resyncs again that did not receive a chunk for
+// syncResyncTimeout.
+func (s *StateSync) checkResyncs() {
+	t := time.Now()
+	for nodeID, r := range s.resyncs {
+		if t.Before(r.deadline) {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"peer":    r.addr,
+			"node_id": nodeID,
+			"missing": r.missing,
+		}).Warning("state resync is missing chunks, requesting resync")
+		stateSyncResyncsIncomplete.Inc()
+		delete(s.resyncs, nodeID)
+		s.send(r.addr, syncHeader{Type: syncMsgResyncRequest}, nil)
+	}
+}
+
+func (s *StateSync) apply(records [][]byte) {
+	for _, r := range records {
+		if err := s.table.apply(r); err != nil {
+			log.Warningf("could not apply state sync record: %s", err)
+		}
+	}
+	stateSyncRecords.WithLabelValues("received").Add(float64(len(records)))
+}
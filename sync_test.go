@@ -0,0 +1,345 @@
+package balancer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func newSyncTestServices(t *testing.T) *ServiceTable {
+	pool := NewConsistentHashPool()
+	pool.AddServer(&Server{IP: net.ParseIP("192.168.33.20").To4()})
+	pool.AddServer(&Server{IP: net.ParseIP("192.168.33.21").To4()})
+
+	services := NewServiceTable()
+	if err := services.AddService(&Service{
+		IP:       net.ParseIP("192.168.33.10").To4(),
+		Port:     80,
+		Protocol: layers.IPProtocolTCP,
+		Pool:     pool,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return services
+}
+
+func TestSyncMessage(t *testing.T) {
+	services := newSyncTestServices(t)
+	service, _ := services.GetService(net.ParseIP("192.168.33.10"), 80)
+	server := service.Pool.Servers()[1]
+
+	stateTable := NewStateTable()
+	state := stateTable.NewState(net.ParseIP("10.0.0.1"), 1234, service)
+	state.State = TCP_STATE_ESTABLISHED
+	state.Server = server
+
+	b := marshalSyncMessage(syncMagicBalancer, syncHeader{Type: syncMsgUpdate, NodeID: 1, Seq: 2}, [][]byte{appendStateRecord(nil, *state)})
+	h, records, err := unmarshalSyncMessage(syncMagicBalancer, stateRecordLen, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Type != syncMsgUpdate || h.NodeID != 1 || h.Seq != 2 || h.Chunk != 0 || h.Chunks != 0 || len(records) != 1 {
+		t.Fatalf("Unexpected header %+v with %d records", h, len(records))
+	}
+
+	decoded, err := parseStateRecord(records[0], services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.IP.Equal(state.IP) || decoded.Port != state.Port || decoded.Service != service ||
+		decoded.Server != server || decoded.State != state.State || decoded.Seq != state.Seq ||
+		!decoded.Created.Equal(state.Created) {
+		t.Errorf("Was expecting %+v, got: %+v", state, decoded)
+	}
+
+	if _, _, err := unmarshalSyncMessage(syncMagicBalancer, stateRecordLen, b[:len(b)-1]); err == nil {
+		t.Error("Was expecting an error for a truncated message.")
+	}
+	if _, _, err := unmarshalSyncMessage(syncMagicPacketBridge, packetBridgeRecordLen, b); err == nil {
+		t.Error("Was expecting an error for a message of an other table.")
+	}
+}
+
+func TestStateSync(t *testing.T) {
+	servicesA := newSyncTestServices(t)
+	servicesB := newSyncTestServices(t)
+	serviceA, _ := servicesA.GetService(net.ParseIP("192.168.33.10"), 80)
+
+	tableA := NewStateTable()
+	tableB := NewStateTable()
+
+	existing := tableA.NewState(net.ParseIP("10.0.0.1"), 1000, serviceA)
+	existing.State = TCP_STATE_ESTABLISHED
+	existing.Server = serviceA.Pool.Servers()[0]
+
+	syncA, err := NewStateSync("127.0.0.1:0", nil, tableA, servicesA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncB, err := NewStateSync("127.0.0.1:0", []string{syncA.LocalAddr().String()}, tableB, servicesB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syncA.Close()
+	defer syncB.Close()
+	syncA.peers = append(syncA.peers, syncB.LocalAddr().(*net.UDPAddr))
+
+	go syncA.Run()
+	go syncB.Run()
+
+	waitForState := func(port layers.TCPPort, f func(*State) bool) {
+		for i := 0; i < 100; i++ {
+			if state, ok := tableB.GetState(net.ParseIP("10.0.0.1"), port, serviceA.IP, serviceA.Port); ok && f(state) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("State for port %d was not replicated.", port)
+	}
+
+	// the existing state is replicated by the resync on join
+	waitForState(1000, func(s *State) bool {
+		return s.State == TCP_STATE_ESTABLISHED && s.Server.IP.Equal(existing.Server.IP) && s.Seq == existing.Seq
+	})
+
+	// changes are replicated
+	state := tableA.NewState(net.ParseIP("10.0.0.1"), 2000, serviceA)
+	state.State = TCP_STATE_SYN_RECEIVED
+	tableA.Changed(state)
+	waitForState(2000, func(s *State) bool {
+		return s.State == TCP_STATE_SYN_RECEIVED && s.Server == nil
+	})
+
+	state.State = TCP_STATE_ESTABLISHED
+	state.Server = serviceA.Pool.Servers()[1]
+	tableA.Changed(state)
+	waitForState(2000, func(s *State) bool {
+		return s.State == TCP_STATE_ESTABLISHED && s.Server != nil && s.Server.IP.Equal(state.Server.IP)
+	})
+}
+
+func TestStateSyncResyncChunks(t *testing.T) {
+	services := newSyncTestServices(t)
+	service, _ := services.GetService(net.ParseIP("192.168.33.10"), 80)
+
+	tableA := NewStateTable()
+	tableB := NewStateTable()
+	for port := layers.TCPPort(1000); port < 1500; port++ {
+		state := tableA.NewState(net.ParseIP("10.0.0.1"), port, service)
+		state.State = TCP_STATE_ESTABLISHED
+	}
+
+	syncA, err := NewStateSync("127.0.0.1:0", nil, tableA, services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncB, err := NewStateSync("127.0.0.1:0", []string{syncA.LocalAddr().String()}, tableB, services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syncA.Close()
+	defer syncB.Close()
+
+	go syncA.Run()
+	go syncB.Run()
+
+	// the resync of 500 states takes 11 chunks
+	for i := 0; i < 100 && len(tableB.States()) != 500; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(tableB.States()); n != 500 {
+		t.Errorf("Was expecting 500 replicated states, got: %d", n)
+	}
+}
+
+func TestStateSyncMissingChunks(t *testing.T) {
+	services := newSyncTestServices(t)
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peerAddr := peer.LocalAddr().(*net.UDPAddr)
+
+	s, err := NewStateSync("127.0.0.1:0", nil, NewStateTable(), services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the first of two chunks
+	s.receiveResync(peerAddr, syncHeader{Type: syncMsgResync, NodeID: 1, Seq: 5, Chunk: 0, Chunks: 2}, nil)
+	if r, ok := s.resyncs[1]; !ok || r.missing != 1 {
+		t.Fatalf("Was expecting a resync missing 1 chunk, got: %+v", r)
+	}
+	if _, ok := s.lastSeq[1]; ok {
+		t.Error("The sequence number of an incomplete resync should not have been used.")
+	}
+
+	// the second chunk is lost, the resync is requested again
+	s.resyncs[1].deadline = time.Now()
+	s.checkResyncs()
+	if len(s.resyncs) != 0 {
+		t.Error("Was expecting the incomplete resync to be removed.")
+	}
+	b := make([]byte, 1500)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := peer.ReadFromUDP(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, _, err := unmarshalSyncMessage(syncMagicBalancer, stateRecordLen, b[:n]); err != nil || h.Type != syncMsgResyncRequest {
+		t.Errorf("Was expecting a resync request, got: %+v (%v)", h, err)
+	}
+
+	// a complete resync sets the sequence number
+	s.receiveResync(peerAddr, syncHeader{Type: syncMsgResync, NodeID: 1, Seq: 6, Chunk: 1, Chunks: 2}, nil)
+	s.receiveResync(peerAddr, syncHeader{Type: syncMsgResync, NodeID: 1, Seq: 6, Chunk: 0, Chunks: 2}, nil)
+	if seq, ok := s.lastSeq[1]; !ok || seq != 6 || len(s.resyncs) != 0 {
+		t.Errorf("Was expecting the complete resync with sequence number 6, got: %d (%t)", seq, ok)
+	}
+}
+
+func TestBalancerSyncTableOffloaded(t *testing.T) {
+	services := newSyncTestServices(t)
+	service, _ := services.GetService(net.ParseIP("192.168.33.10"), 80)
+	servers := service.Pool.Servers()
+
+	fastPath := &testFastPath{}
+	stateTable := NewStateTable()
+	stateTable.SetFastPath(fastPath)
+	table := balancerSyncTable{stateTable: stateTable, services: services}
+
+	offload := func() *State {
+		state := newState(net.ParseIP("10.0.0.1"), 1000, service)
+		state.State = TCP_STATE_ESTABLISHED
+		state.Server = servers[0]
+		stateTable.Put(state)
+		stateTable.offload(state)
+		return state
+	}
+	apply := func(state State) *State {
+		if err := table.apply(appendStateRecord(nil, state)); err != nil {
+			t.Fatal(err)
+		}
+		s, _ := stateTable.GetState(state.IP, state.Port, service.IP, service.Port)
+		return s
+	}
+
+	// the same established state keeps the connection offloaded
+	state := offload()
+	if s := apply(*state); s == nil || !s.Offloaded || fastPath.flows != 1 {
+		t.Errorf("Was expecting the connection to stay offloaded, got: %+v (%d flows)", s, fastPath.flows)
+	}
+
+	// a closing connection is removed from the fast path
+	closing := *state
+	closing.State = TCP_STATE_FIN_WAIT_1
+	if s := apply(closing); s == nil || s.Offloaded || fastPath.flows != 0 {
+		t.Errorf("Was expecting the connection to be removed from the fast path, got: %+v (%d flows)", s, fastPath.flows)
+	}
+
+	// and so is a connection migrated to an other server
+	state = offload()
+	migrated := *state
+	migrated.Server = servers[1]
+	if s := apply(migrated); s == nil || s.Offloaded || fastPath.flows != 0 {
+		t.Errorf("Was expecting the migrated connection to be removed from the fast path, got: %+v (%d flows)", s, fastPath.flows)
+	}
+
+	// and a reset connection
+	state = offload()
+	closed := *state
+	closed.State = TCP_STATE_CLOSED
+	if s := apply(closed); s != nil || fastPath.flows != 0 {
+		t.Errorf("Was expecting the reset connection to be removed, got: %+v (%d flows)", s, fastPath.flows)
+	}
+}
+
+func TestPacketBridgeStateSync(t *testing.T) {
+	pool := NewConsistentHashPool()
+	pool.AddServer(&Server{IP: net.ParseIP("192.168.33.30").To4()})
+
+	tableA := NewPacketBridgeStateTable()
+	tableB := NewPacketBridgeStateTable()
+
+	syncA, err := NewPacketBridgeStateSync("127.0.0.1:0", nil, tableA, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncB, err := NewPacketBridgeStateSync("127.0.0.1:0", []string{syncA.LocalAddr().String()}, tableB, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syncA.Close()
+	defer syncB.Close()
+	syncA.peers = append(syncA.peers, syncB.LocalAddr().(*net.UDPAddr))
+
+	go syncA.Run()
+	go syncB.Run()
+
+	state, err := tableA.NewState(&PacketBridgeState{
+		IP:           net.ParseIP("10.0.0.1").To4(),
+		HardwareAddr: net.HardwareAddr{0x08, 0, 0, 0, 0, 1},
+		Port:         1234,
+		VIP:          net.ParseIP("192.168.33.10").To4(),
+		ServicePort:  80,
+		BackendPort:  8080,
+		Backend:      pool.Servers()[0],
+		LBIndex:      1,
+		State:        TCP_STATE_ESTABLISHED,
+		SeqOffset:    12345,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tableA.Changed(state)
+
+	for i := 0; i < 100; i++ {
+		if s, ok := tableB.GetByPort(state.RandPort); ok && s.State == TCP_STATE_ESTABLISHED {
+			if s.SeqOffset != 12345 || s.Backend != pool.Servers()[0] || s.BackendPort != 8080 || s.HardwareAddr.String() != state.HardwareAddr.String() {
+				t.Fatalf("Was expecting %+v, got: %+v", state, s)
+			}
+			if _, ok := tableB.GetByIP(state.IP, state.Port, state.VIP, state.ServicePort); !ok {
+				t.Fatal("The replicated state should be indexed by client IP.")
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("The state was not replicated.")
+}
+
+func TestStateSyncClose(t *testing.T) {
+	s, err := NewStateSync("127.0.0.1:0", nil, NewStateTable(), NewServiceTable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Run()
+		close(done)
+	}()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run should have returned after Close.")
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Closing twice should not fail, got: %s", err)
+	}
+}
+
+func TestStateSyncMulticastBind(t *testing.T) {
+	if _, err := NewStateSync("127.0.0.1:7946", []string{"239.1.1.1:7946"}, NewStateTable(), NewServiceTable()); err == nil {
+		t.Error("A bind address with an IP should be rejected for a multicast group.")
+	}
+	if _, err := NewStateSync(":7947", []string{"239.1.1.1:7946"}, NewStateTable(), NewServiceTable()); err == nil {
+		t.Error("A bind address with an other port should be rejected for a multicast group.")
+	}
+}
@@ -1,6 +1,7 @@
 package balancer
 
 import (
+	"encoding/binary"
 	"fmt"
 	"net"
 
@@ -25,10 +26,49 @@ const (
 	TCP_STATE_CLOSED
 )
 
+var tcpStateNames = map[TCPState]string{
+	TCP_STATE_SYN_SENT:     "SYN_SENT",
+	TCP_STATE_SYN_RECEIVED: "SYN_RECEIVED",
+	TCP_STATE_ESTABLISHED:  "ESTABLISHED",
+	TCP_STATE_FIN_WAIT_1:   "FIN_WAIT_1",
+	TCP_STATE_FIN_WAIT_2:   "FIN_WAIT_2",
+	TCP_STATE_CLOSE_WAIT:   "CLOSE_WAIT",
+	TCP_STATE_CLOSING:      "CLOSING",
+	TCP_STATE_LAST_ACK:     "LAST_ACK",
+	TCP_STATE_TIME_WAIT:    "TIME_WAIT",
+	TCP_STATE_CLOSED:       "CLOSED",
+}
+
+func (s TCPState) String() string {
+	if name, ok := tcpStateNames[s]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// clampMSS lowers the MSS option of the given SYN to mss, when it announces a
+// larger MSS. The option data is replaced instead of modified, as it
+// references the received packet.
+func clampMSS(tcp *layers.TCP, mss uint16) {
+	for i, opt := range tcp.Options {
+		if opt.OptionType == layers.TCPOptionKindMSS && len(opt.OptionData) == 2 && binary.BigEndian.Uint16(opt.OptionData) > mss {
+			tcp.Options[i].OptionData = binary.BigEndian.AppendUint16(nil, mss)
+		}
+	}
+}
+
 // TCPPacket represents a TCP packet.
 type TCPPacket struct {
 	ip  *layers.IPv4
 	tcp *layers.TCP
+
+	// decoder is set when the TCP layer was decoded by a packetDecoder, buf
+	// once the packet has been serialized (see Release)
+	decoder *packetDecoder
+	buf     gopacket.SerializeBuffer
+
+	// hdr is the IPv4 header serialized by MarshalIPBinary
+	hdr layers.IPv4
 }
 
 // NewTCPPacket creates and initializes a new TCP packet.
@@ -40,16 +80,65 @@ func NewTCPPacket(ip *layers.IPv4, tcp *layers.TCP) *TCPPacket {
 	}
 }
 
-// MarshalBinary returns the binary representation of the packet.
+// MarshalBinary returns the binary representation of the packet (the TCP
+// segment). The returned slice is valid until Release is called.
 func (p *TCPPacket) MarshalBinary() ([]byte, error) {
-	p.tcp.SetNetworkLayerForChecksum(p.ip)
-	opts := gopacket.SerializeOptions{
-		ComputeChecksums: true,
-		FixLengths:       true,
+	if p.buf == nil {
+		p.buf = serializeBufferPool.Get().(gopacket.SerializeBuffer)
+	}
+	err := serializeTCP(p.buf, p.decoder, p.ip, p.tcp)
+	if err != nil {
+		serializeErrors.WithLabelValues("tcp").Inc()
+	}
+	return p.buf.Bytes(), err
+}
+
+// MarshalIPBinary returns the binary representation of the packet including
+// a new IPv4 header, like the header the kernel adds to a segment sent on a
+// raw socket. Only the addresses of the IP layer of the packet are used. The
+// returned slice is valid until Release is called.
+func (p *TCPPacket) MarshalIPBinary() ([]byte, error) {
+	if p.buf == nil {
+		p.buf = serializeBufferPool.Get().(gopacket.SerializeBuffer)
+	}
+	p.hdr = layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Flags:    layers.IPv4DontFragment,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    p.ip.SrcIP,
+		DstIP:    p.ip.DstIP,
+	}
+	err := serializeTCP(p.buf, p.decoder, &p.hdr, p.tcp, &p.hdr)
+	if err != nil {
+		serializeErrors.WithLabelValues("ip").Inc()
+	}
+	return p.buf.Bytes(), err
+}
+
+// Release returns the buffers of the packet (including the decoded layers it
+// was created from) for reuse. The packet and the data returned by
+// MarshalBinary must not be used afterwards.
+func (p *TCPPacket) Release() {
+	if p.buf != nil {
+		serializeBufferPool.Put(p.buf)
+		p.buf = nil
+	}
+	if d := p.decoder; d != nil {
+		p.decoder = nil
+		d.release()
 	}
-	buf := gopacket.NewSerializeBuffer()
-	err := gopacket.SerializeLayers(buf, opts, p.tcp, gopacket.Payload(p.tcp.Payload))
-	return buf.Bytes(), err
+}
+
+// isControl returns true for SYN, FIN and RST packets (see
+// OVERFLOW_PRIORITIZE_CONTROL).
+func (p *TCPPacket) isControl() bool {
+	return p.tcp != nil && (p.tcp.SYN || p.tcp.FIN || p.tcp.RST)
+}
+
+// DstIP returns the destination IP.
+func (p *TCPPacket) DstIP() net.IP {
+	return p.ip.DstIP
 }
 
 // SetDstIP sets the destination IP.
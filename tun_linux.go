@@ -0,0 +1,84 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// TUN receives and sends IPv4 packets using a TUN device. The packets routed
+// to the device are received, the packets sent are handled by the kernel as
+// if they were received on the device. The device must be configured (e.g.
+// brought up and routed to) by the caller.
+type TUN struct {
+	name string
+	file *os.File
+}
+
+// NewTUN creates (or attaches to) the TUN device with the given name, when
+// empty the kernel picks the name (see Name).
+func NewTUN(name string) (*TUN, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not open /dev/net/tun: %s", err)
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("could not create TUN device: %s", err)
+	}
+	return &TUN{name: ifr.Name(), file: os.NewFile(uintptr(fd), "/dev/net/tun")}, nil
+}
+
+// Name returns the name of the device.
+func (t *TUN) Name() string {
+	return t.name
+}
+
+// Packets returns a channel with the received IPv4 packets. The channel is
+// closed when the device is closed.
+func (t *TUN) Packets() chan gopacket.Packet {
+	out := make(chan gopacket.Packet, 1000)
+	go func() {
+		defer close(out)
+		b := make([]byte, 65535)
+		for {
+			n, err := t.file.Read(b)
+			if err != nil {
+				if !errors.Is(err, os.ErrClosed) {
+					log.WithField("iface", t.name).Errorf("could not read from TUN device: %s", err)
+				}
+				return
+			}
+			if n == 0 || b[0]>>4 != 4 {
+				// e.g. IPv6 router solicitations
+				continue
+			}
+			data := append([]byte(nil), b[:n]...)
+			out <- gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		}
+	}()
+	return out
+}
+
+// WritePacketData sends the given IPv4 packet. It is safe for concurrent
+// use.
+func (t *TUN) WritePacketData(data []byte) error {
+	_, err := t.file.Write(data)
+	return err
+}
+
+// Close closes the device.
+func (t *TUN) Close() {
+	t.file.Close()
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package balancer
+
+import (
+	"errors"
+
+	"github.com/google/gopacket"
+)
+
+// TUN is only supported on Linux.
+type TUN struct{}
+
+// NewTUN returns an error, TUN devices are only supported on Linux.
+func NewTUN(name string) (*TUN, error) {
+	return nil, errors.New("TUN devices are only supported on Linux")
+}
+
+func (t *TUN) Name() string                      { return "" }
+func (t *TUN) Packets() chan gopacket.Packet     { return nil }
+func (t *TUN) WritePacketData(data []byte) error { return nil }
+func (t *TUN) Close()                            {}
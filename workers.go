@@ -0,0 +1,131 @@
+package balancer
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// workerQueueLen is the number of batches that can be queued per worker.
+const workerQueueLen = 64
+
+// RunWorkers dispatches the received packets over the given number of
+// worker goroutines, which call handle for each packet. The worker is
+// selected by a symmetric hash of the flow of the packet, so that all packets
+// of a connection are handled by the same worker, in order.
+// Packets are dispatched in batches of up to batchSize packets. A batch is
+// dispatched when it is full, or when no more packets are pending, so that
+// batching does not add latency when the load is low. RunWorkers returns
+// when packetsIn has been closed and all packets have been handled.
+func RunWorkers(packetsIn chan gopacket.Packet, workers, batchSize int, handle func(gopacket.Packet)) {
+	if workers < 1 {
+		workers = 1
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	var wg sync.WaitGroup
+	queues := make([]chan []gopacket.Packet, workers)
+	for i := range queues {
+		queues[i] = make(chan []gopacket.Packet, workerQueueLen)
+		wg.Add(1)
+		go func(queue chan []gopacket.Packet) {
+			defer wg.Done()
+			for batch := range queue {
+				for _, p := range batch {
+					handle(p)
+				}
+			}
+		}(queues[i])
+	}
+
+	batches := make([][]gopacket.Packet, workers)
+	dispatch := func(i int) {
+		if len(batches[i]) == 0 {
+			return
+		}
+		queues[i] <- batches[i]
+		batches[i] = make([]gopacket.Packet, 0, batchSize)
+	}
+
+	for p := range packetsIn {
+		i := int(flowHash(p) % uint64(workers))
+		batches[i] = append(batches[i], p)
+		if len(batches[i]) >= batchSize {
+			dispatch(i)
+		}
+		if len(packetsIn) == 0 {
+			for i := range batches {
+				dispatch(i)
+			}
+		}
+	}
+
+	for i := range queues {
+		dispatch(i)
+		close(queues[i])
+	}
+	wg.Wait()
+}
+
+// flowHash returns a symmetric hash of the flow of the given packet (A->B
+// and B->A have the same hash). It is computed from the raw Ethernet frame,
+// so that the packet does not have to be decoded. For IPIP and GRE packets
+// the inner flow is hashed, for UDP (foo-over-udp) the outer flow (the source
+// port is a hash of the inner flow).
+func flowHash(p gopacket.Packet) uint64 {
+	data := p.Data()
+	if len(data) < 14 || data[12] != 0x08 || data[13] != 0x00 {
+		return 0
+	}
+	ip := data[14:]
+
+	for i := 0; i < 2; i++ {
+		if len(ip) < 20 || ip[0]>>4 != 4 {
+			return 0
+		}
+		ihl := int(ip[0]&0x0f) * 4
+		if len(ip) < ihl {
+			return 0
+		}
+		switch layers.IPProtocol(ip[9]) {
+		case layers.IPProtocolIPv4:
+			ip = ip[ihl:]
+			continue
+		case layers.IPProtocolGRE:
+			// only GRE without optional fields
+			if len(ip) < ihl+4 || ip[ihl]&0xf0 != 0 {
+				break
+			}
+			ip = ip[ihl+4:]
+			continue
+		}
+
+		a := uint64(binary.BigEndian.Uint32(ip[12:16])) << 16
+		b := uint64(binary.BigEndian.Uint32(ip[16:20])) << 16
+		// the ports of TCP and UDP (not fragmented)
+		proto := layers.IPProtocol(ip[9])
+		if (proto == layers.IPProtocolTCP || proto == layers.IPProtocolUDP) && binary.BigEndian.Uint16(ip[6:8])&0x1fff == 0 && len(ip) >= ihl+4 {
+			a |= uint64(binary.BigEndian.Uint16(ip[ihl:]))
+			b |= uint64(binary.BigEndian.Uint16(ip[ihl+2:]))
+		}
+		if a > b {
+			a, b = b, a
+		}
+		return mix64(a*0x9e3779b97f4a7c15 ^ b)
+	}
+	return 0
+}
+
+// mix64 is the finalizer of MurmurHash3.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
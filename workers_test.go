@@ -0,0 +1,57 @@
+package balancer
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestRunWorkers(t *testing.T) {
+	clientIP := net.ParseIP("10.0.0.1").To4()
+	vip := net.ParseIP("192.168.33.10").To4()
+
+	packet := func(srcIP, dstIP net.IP, srcPort, dstPort layers.TCPPort, seq uint32) gopacket.Packet {
+		eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0x08, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0x08, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, TTL: 64, SrcIP: srcIP, DstIP: dstIP, Protocol: layers.IPProtocolTCP}
+		tcp := &layers.TCP{SrcPort: srcPort, DstPort: dstPort, Seq: seq, ACK: true, Window: 1024}
+		b, err := NewEthPacket(eth, ip, tcp).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gopacket.NewPacket(b, layers.LayerTypeEthernet, gopacket.Default)
+	}
+
+	// both directions of a connection have the same hash
+	if flowHash(packet(clientIP, vip, 1000, 80, 0)) != flowHash(packet(vip, clientIP, 80, 1000, 0)) {
+		t.Error("The flow hash should be symmetric.")
+	}
+
+	in := make(chan gopacket.Packet, 1000)
+	for seq := uint32(0); seq < 10; seq++ {
+		for port := layers.TCPPort(1000); port < 1050; port++ {
+			in <- packet(clientIP, vip, port, 80, seq)
+		}
+	}
+	close(in)
+
+	var mu sync.Mutex
+	var handled int
+	lastSeq := make(map[layers.TCPPort]uint32)
+	RunWorkers(in, 4, 8, func(p gopacket.Packet) {
+		tcp := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		mu.Lock()
+		defer mu.Unlock()
+		if last, ok := lastSeq[tcp.SrcPort]; ok && tcp.Seq != last+1 {
+			t.Errorf("Port %d: packet %d was handled after packet %d.", tcp.SrcPort, tcp.Seq, last)
+		}
+		lastSeq[tcp.SrcPort] = tcp.Seq
+		handled++
+	})
+
+	if handled != 500 {
+		t.Errorf("Was expecting 500 handled packets, got: %d", handled)
+	}
+}
@@ -0,0 +1,377 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+)
+
+// The XDP program forwards the packets of the connections in the flows map
+// (the key is the client IP, VIP, client port and VIP port as in the
+// packet). The value holds the server IP, the TOS (LBIndex), flags, the
+// source MAC (l2dsr) and the active flag, which the program sets for every
+// forwarded packet (see Active). The MAC of the server is looked up in the
+// servers map, so that it can be updated without touching the flows.
+// The program rewrites the Ethernet addresses and (unless it is an l2dsr
+// flow) the destination IP, TTL and TOS, updates the checksums and sends the
+// packet back out (XDP_TX). All other packets, including SYN, FIN and RST
+// packets, are passed to the kernel (and thus to BalancePackets).
+const (
+	xdpFlowKeyLen     = 12
+	xdpFlowValueLen   = 16
+	xdpServerValueLen = 8
+
+	// xdpFlowActive is the offset of the active flag in the flow value
+	xdpFlowActive = 12
+
+	xdpFlagRewriteIP = 1 << 0
+	xdpFlagSrcMAC    = 1 << 1
+)
+
+// Ethernet / IPv4 / TCP header offsets used by the XDP program, the IPv4
+// header must not have options.
+const (
+	xdpOffEtherType = 12
+	xdpOffIP        = 14
+	xdpOffTOS       = xdpOffIP + 1
+	xdpOffFrag      = xdpOffIP + 6
+	xdpOffTTL       = xdpOffIP + 8
+	xdpOffProto     = xdpOffIP + 9
+	xdpOffIPCsum    = xdpOffIP + 10
+	xdpOffSrcIP     = xdpOffIP + 12
+	xdpOffDstIP     = xdpOffIP + 16
+	xdpOffTCP       = xdpOffIP + 20
+	xdpOffTCPFlags  = xdpOffTCP + 13
+	xdpOffTCPCsum   = xdpOffTCP + 16
+	xdpMinLen       = xdpOffTCP + 20
+)
+
+// XDPFastPath is a FastPath using an XDP program on the interface that
+// receives the packets for the VIPs. The packets are sent back out on the
+// same interface.
+type XDPFastPath struct {
+	flows   *ebpf.Map
+	servers *ebpf.Map
+	prog    *ebpf.Program
+	link    link.Link
+}
+
+// NewXDPFastPath loads the XDP program. The flows map is an LRU map of the
+// given size, so that flows that are never closed are evicted eventually.
+// The program must be attached to the interface with Attach.
+func NewXDPFastPath(maxFlows int) (*XDPFastPath, error) {
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return nil, fmt.Errorf("could not remove memlock limit: %s", err)
+	}
+
+	x := &XDPFastPath{}
+	var err error
+	x.flows, err = ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "l3dsr_flows",
+		Type:       ebpf.LRUHash,
+		KeySize:    xdpFlowKeyLen,
+		ValueSize:  xdpFlowValueLen,
+		MaxEntries: uint32(maxFlows),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create flows map: %s", err)
+	}
+	x.servers, err = ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "l3dsr_servers",
+		Type:       ebpf.Hash,
+		KeySize:    4,
+		ValueSize:  xdpServerValueLen,
+		MaxEntries: 4096,
+	})
+	if err != nil {
+		x.Close()
+		return nil, fmt.Errorf("could not create servers map: %s", err)
+	}
+	x.prog, err = ebpf.NewProgram(&ebpf.ProgramSpec{
+		Name:         "l3dsr_xdp",
+		Type:         ebpf.XDP,
+		License:      "GPL",
+		Instructions: xdpInstructions(x.flows.FD(), x.servers.FD()),
+	})
+	if err != nil {
+		x.Close()
+		return nil, fmt.Errorf("could not load XDP program: %s", err)
+	}
+	return x, nil
+}
+
+// Attach attaches the XDP program to the given interface. In generic mode
+// the program runs after the allocation of the socket buffer, which works
+// with every driver (e.g. veth) but is slower.
+func (x *XDPFastPath) Attach(ifaceName string, generic bool) error {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return err
+	}
+	opts := link.XDPOptions{Program: x.prog, Interface: iface.Index}
+	if generic {
+		opts.Flags = link.XDPGenericMode
+	}
+	if x.link, err = link.AttachXDP(opts); err != nil {
+		return fmt.Errorf("could not attach XDP program to %s: %s", ifaceName, err)
+	}
+	return nil
+}
+
+// Close detaches the XDP program and releases the maps.
+func (x *XDPFastPath) Close() error {
+	if x.link != nil {
+		x.link.Close()
+	}
+	if x.prog != nil {
+		x.prog.Close()
+	}
+	if x.servers != nil {
+		x.servers.Close()
+	}
+	if x.flows != nil {
+		x.flows.Close()
+	}
+	return nil
+}
+
+// Offload implements FastPath. Only connections of services without
+// encapsulation can be offloaded.
+func (x *XDPFastPath) Offload(state *State) error {
+	if state.Server == nil {
+		return errors.New("no server selected")
+	}
+	if state.Service.Encap != ENCAP_NONE {
+		return fmt.Errorf("encapsulation %s is not supported", state.Service.Encap)
+	}
+	if err := x.updateServer(state.Server); err != nil {
+		return err
+	}
+
+	value := make([]byte, xdpFlowValueLen)
+	copy(value[0:4], state.Server.IP.To4())
+	switch state.Service.Mode {
+	case MODE_L2DSR:
+		if state.Service.SrcHardwareAddr != nil {
+			value[5] |= xdpFlagSrcMAC
+			copy(value[6:12], state.Service.SrcHardwareAddr)
+		}
+	default:
+		value[4] = state.Service.LBIndex
+		value[5] |= xdpFlagRewriteIP
+	}
+	return x.flows.Put(xdpFlowKey(state.IP, state.Port, state.Service.IP, state.Service.Port), value)
+}
+
+// Remove implements FastPath.
+func (x *XDPFastPath) Remove(state *State) error {
+	err := x.flows.Delete(xdpFlowKey(state.IP, state.Port, state.Service.IP, state.Service.Port))
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Active implements FastPath. It reads and clears the active flag of the
+// flow.
+func (x *XDPFastPath) Active(state *State) bool {
+	key := xdpFlowKey(state.IP, state.Port, state.Service.IP, state.Service.Port)
+	value := make([]byte, xdpFlowValueLen)
+	if err := x.flows.Lookup(key, value); err != nil || value[xdpFlowActive] == 0 {
+		return false
+	}
+	value[xdpFlowActive] = 0
+	if err := x.flows.Update(key, value, ebpf.UpdateExist); err != nil {
+		log.WithField("client", fmt.Sprintf("%s:%d", state.IP, state.Port)).Errorf("could not clear XDP active flag: %s", err)
+	}
+	return true
+}
+
+// Flows returns the number of offloaded flows.
+func (x *XDPFastPath) Flows() int {
+	var n int
+	var key, value []byte
+	iter := x.flows.Iterate()
+	for iter.Next(&key, &value) {
+		n++
+	}
+	return n
+}
+
+// RunRefresh updates the MAC addresses of the servers of the given services
+// in the XDP program at the given interval (see NeighborCache), until the
+// program exits.
+func (x *XDPFastPath) RunRefresh(services *ServiceTable, interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, s := range services.Services() {
+			for _, server := range s.Pool.Servers() {
+				if err := x.updateServer(server); err != nil {
+					log.WithField("server", server.IP).Errorf("could not update XDP server: %s", err)
+				}
+			}
+		}
+	}
+}
+
+func (x *XDPFastPath) updateServer(server *Server) error {
+	hwAddr := server.GetHardwareAddr()
+	if hwAddr == nil {
+		return fmt.Errorf("MAC address of server %s is unknown", server.IP)
+	}
+	value := make([]byte, xdpServerValueLen)
+	copy(value, hwAddr)
+	return x.servers.Put([]byte(server.IP.To4()), value)
+}
+
+func xdpFlowKey(ip net.IP, port layers.TCPPort, vip net.IP, vipPort layers.TCPPort) []byte {
+	key := make([]byte, 0, xdpFlowKeyLen)
+	key = append(key, ip.To4()...)
+	key = append(key, vip.To4()...)
+	return append(key, byte(port>>8), byte(port), byte(vipPort>>8), byte(vipPort))
+}
+
+// xdpInstructions returns the XDP program for the given maps. Note that the
+// one's complement checksums do not depend on the byte order, as long as
+// all 16 bit words are loaded and stored in the same byte order.
+func xdpInstructions(flows, servers int) asm.Instructions {
+	const (
+		xdpPass = 2
+		xdpTX   = 3
+	)
+
+	// foldChecksum folds the 32 bit sum in R1 to 16 bits and inverts it
+	foldChecksum := asm.Instructions{
+		asm.Mov.Reg(asm.R2, asm.R1),
+		asm.RSh.Imm(asm.R2, 16),
+		asm.And.Imm(asm.R1, 0xffff),
+		asm.Add.Reg(asm.R1, asm.R2),
+		asm.Mov.Reg(asm.R2, asm.R1),
+		asm.RSh.Imm(asm.R2, 16),
+		asm.And.Imm(asm.R1, 0xffff),
+		asm.Add.Reg(asm.R1, asm.R2),
+		asm.Xor.Imm(asm.R1, 0xffff),
+	}
+
+	insns := asm.Instructions{
+		// R7 = data, R3 = data_end
+		asm.LoadMem(asm.R7, asm.R1, 0, asm.Word),
+		asm.LoadMem(asm.R3, asm.R1, 4, asm.Word),
+		asm.Mov.Reg(asm.R4, asm.R7),
+		asm.Add.Imm(asm.R4, xdpMinLen),
+		asm.JGT.Reg(asm.R4, asm.R3, "pass"),
+
+		// IPv4 without options, not fragmented, TCP
+		asm.LoadMem(asm.R4, asm.R7, xdpOffEtherType, asm.Byte),
+		asm.JNE.Imm(asm.R4, 0x08, "pass"),
+		asm.LoadMem(asm.R4, asm.R7, xdpOffEtherType+1, asm.Byte),
+		asm.JNE.Imm(asm.R4, 0x00, "pass"),
+		asm.LoadMem(asm.R4, asm.R7, xdpOffIP, asm.Byte),
+		asm.JNE.Imm(asm.R4, 0x45, "pass"),
+		asm.LoadMem(asm.R4, asm.R7, xdpOffFrag, asm.Byte),
+		asm.JSet.Imm(asm.R4, 0x3f, "pass"),
+		asm.LoadMem(asm.R4, asm.R7, xdpOffFrag+1, asm.Byte),
+		asm.JNE.Imm(asm.R4, 0, "pass"),
+		asm.LoadMem(asm.R4, asm.R7, xdpOffProto, asm.Byte),
+		asm.JNE.Imm(asm.R4, int32(layers.IPProtocolTCP), "pass"),
+
+		// SYN, FIN and RST are handled by BalancePackets
+		asm.LoadMem(asm.R4, asm.R7, xdpOffTCPFlags, asm.Byte),
+		asm.JSet.Imm(asm.R4, 0x07, "pass"),
+
+		// look up the flow, the key is the src IP, dst IP, src port and
+		// dst port (contiguous in the packet)
+		asm.LoadMem(asm.R4, asm.R7, xdpOffSrcIP, asm.Word),
+		asm.StoreMem(asm.RFP, -16, asm.R4, asm.Word),
+		asm.LoadMem(asm.R4, asm.R7, xdpOffDstIP, asm.Word),
+		asm.StoreMem(asm.RFP, -12, asm.R4, asm.Word),
+		asm.LoadMem(asm.R4, asm.R7, xdpOffTCP, asm.Word),
+		asm.StoreMem(asm.RFP, -8, asm.R4, asm.Word),
+		asm.LoadMapPtr(asm.R1, flows),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -16),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "pass"),
+		asm.Mov.Reg(asm.R8, asm.R0),
+		asm.StoreImm(asm.R8, xdpFlowActive, 1, asm.Byte),
+
+		// look up the MAC of the server
+		asm.LoadMem(asm.R4, asm.R8, 0, asm.Word),
+		asm.StoreMem(asm.RFP, -20, asm.R4, asm.Word),
+		asm.LoadMapPtr(asm.R1, servers),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -20),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "pass"),
+
+		// Ethernet addresses
+		asm.LoadMem(asm.R4, asm.R0, 0, asm.Word),
+		asm.StoreMem(asm.R7, 0, asm.R4, asm.Word),
+		asm.LoadMem(asm.R4, asm.R0, 4, asm.Half),
+		asm.StoreMem(asm.R7, 4, asm.R4, asm.Half),
+		asm.LoadMem(asm.R9, asm.R8, 5, asm.Byte),
+		asm.JSet.Imm(asm.R9, xdpFlagSrcMAC, "src_mac"),
+		asm.Ja.Label("rewrite_ip"),
+		asm.LoadMem(asm.R4, asm.R8, 6, asm.Word).WithSymbol("src_mac"),
+		asm.StoreMem(asm.R7, 6, asm.R4, asm.Word),
+		asm.LoadMem(asm.R4, asm.R8, 10, asm.Half),
+		asm.StoreMem(asm.R7, 10, asm.R4, asm.Half),
+
+		asm.Mov.Reg(asm.R4, asm.R9).WithSymbol("rewrite_ip"),
+		asm.And.Imm(asm.R4, xdpFlagRewriteIP),
+		asm.JEq.Imm(asm.R4, 0, "tx"),
+
+		// update the TCP checksum for the new destination IP (RFC 1624):
+		// HC' = ~(~HC + ~m + m')
+		asm.LoadMem(asm.R1, asm.R7, xdpOffTCPCsum, asm.Half),
+		asm.Xor.Imm(asm.R1, 0xffff),
+		asm.LoadMem(asm.R2, asm.R7, xdpOffDstIP, asm.Half),
+		asm.Xor.Imm(asm.R2, 0xffff),
+		asm.Add.Reg(asm.R1, asm.R2),
+		asm.LoadMem(asm.R2, asm.R7, xdpOffDstIP+2, asm.Half),
+		asm.Xor.Imm(asm.R2, 0xffff),
+		asm.Add.Reg(asm.R1, asm.R2),
+		asm.LoadMem(asm.R2, asm.R8, 0, asm.Half),
+		asm.Add.Reg(asm.R1, asm.R2),
+		asm.LoadMem(asm.R2, asm.R8, 2, asm.Half),
+		asm.Add.Reg(asm.R1, asm.R2),
+	}
+	insns = append(insns, foldChecksum...)
+	insns = append(insns,
+		asm.StoreMem(asm.R7, xdpOffTCPCsum, asm.R1, asm.Half),
+
+		// destination IP, TTL and TOS
+		asm.LoadMem(asm.R4, asm.R8, 0, asm.Word),
+		asm.StoreMem(asm.R7, xdpOffDstIP, asm.R4, asm.Word),
+		asm.StoreImm(asm.R7, xdpOffTTL, 64, asm.Byte),
+		asm.LoadMem(asm.R4, asm.R8, 4, asm.Byte),
+		asm.StoreMem(asm.R7, xdpOffTOS, asm.R4, asm.Byte),
+
+		// IP header checksum
+		asm.StoreImm(asm.R7, xdpOffIPCsum, 0, asm.Half),
+		asm.Mov.Imm(asm.R1, 0),
+	)
+	for off := int16(xdpOffIP); off < xdpOffTCP; off += 2 {
+		insns = append(insns,
+			asm.LoadMem(asm.R2, asm.R7, off, asm.Half),
+			asm.Add.Reg(asm.R1, asm.R2),
+		)
+	}
+	insns = append(insns, foldChecksum...)
+	insns = append(insns,
+		asm.StoreMem(asm.R7, xdpOffIPCsum, asm.R1, asm.Half),
+
+		asm.Mov.Imm(asm.R0, xdpTX).WithSymbol("tx"),
+		asm.Return(),
+		asm.Mov.Imm(asm.R0, xdpPass).WithSymbol("pass"),
+		asm.Return(),
+	)
+	return insns
+}
@@ -0,0 +1,109 @@
+package balancer
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestXDPFastPath(t *testing.T) {
+	x, err := NewXDPFastPath(16)
+	if err != nil {
+		t.Skipf("Could not load XDP program: %s", err)
+	}
+	defer x.Close()
+
+	client := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	balancerMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	server := &Server{IP: net.ParseIP("192.168.33.20"), HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 3}}
+	splice := &Service{IP: net.ParseIP("192.168.33.10"), Port: 80, LBIndex: 5}
+	l2dsr := &Service{IP: net.ParseIP("192.168.33.10"), Port: 443, Mode: MODE_L2DSR, SrcHardwareAddr: balancerMAC}
+
+	packet := func(service *Service, dstMAC, srcMAC net.HardwareAddr, dstIP net.IP, ttl, tos uint8, tcp layers.TCP) []byte {
+		eth := &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: ttl, TOS: tos, Id: 1234, Flags: layers.IPv4DontFragment, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("10.0.0.1").To4(), DstIP: dstIP.To4()}
+		tcp.SrcPort = 40000
+		tcp.DstPort = service.Port
+		tcp.Seq = 1000
+		tcp.Ack = 2000
+		tcp.Window = 64240
+		tcp.SetNetworkLayerForChecksum(ip)
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}, eth, ip, &tcp, gopacket.Payload("GET / HTTP/1.0\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	data := layers.TCP{ACK: true, PSH: true}
+
+	for _, s := range []*Service{splice, l2dsr} {
+		if err := x.Offload(&State{IP: net.ParseIP("10.0.0.1"), Port: 40000, Service: s, Server: server}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := x.Flows(); n != 2 {
+		t.Errorf("Was expecting 2 flows, got: %d", n)
+	}
+
+	tests := []struct {
+		name     string
+		in       []byte
+		action   uint32
+		expected []byte
+	}{
+		{
+			name:     "splice",
+			in:       packet(splice, balancerMAC, client, splice.IP, 60, 0, data),
+			action:   3,
+			expected: packet(splice, server.HardwareAddr, client, server.IP, 64, 5, data),
+		},
+		{
+			name:     "l2dsr",
+			in:       packet(l2dsr, balancerMAC, client, l2dsr.IP, 60, 0, data),
+			action:   3,
+			expected: packet(l2dsr, server.HardwareAddr, balancerMAC, l2dsr.IP, 60, 0, data),
+		},
+		{
+			name:   "fin",
+			in:     packet(splice, balancerMAC, client, splice.IP, 60, 0, layers.TCP{ACK: true, FIN: true}),
+			action: 2,
+		},
+		{
+			name:   "unknown flow",
+			in:     packet(&Service{Port: 8080}, balancerMAC, client, splice.IP, 60, 0, data),
+			action: 2,
+		},
+	}
+
+	for _, test := range tests {
+		action, out, err := x.prog.Test(test.in)
+		if err != nil {
+			t.Skipf("Could not run XDP program: %s", err)
+		}
+		if action != test.action {
+			t.Errorf("%s: was expecting action %d, got: %d", test.name, test.action, action)
+		}
+		if test.expected != nil && !bytes.Equal(out, test.expected) {
+			t.Errorf("%s: was expecting packet\n%x\ngot:\n%x", test.name, test.expected, out)
+		}
+	}
+
+	// the forwarded packets mark the flows as active, until checked
+	spliceState := &State{IP: net.ParseIP("10.0.0.1"), Port: 40000, Service: splice}
+	if !x.Active(spliceState) {
+		t.Error("Was expecting the flow to be active.")
+	}
+	if x.Active(spliceState) {
+		t.Error("Was expecting the active flag to be cleared.")
+	}
+
+	if err := x.Remove(&State{IP: net.ParseIP("10.0.0.1"), Port: 40000, Service: splice}); err != nil {
+		t.Fatal(err)
+	}
+	if action, _, _ := x.prog.Test(tests[0].in); action != 2 {
+		t.Errorf("Was expecting the removed flow to be passed, got action: %d", action)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package balancer
+
+import (
+	"errors"
+	"time"
+)
+
+// XDPFastPath is only supported on Linux.
+type XDPFastPath struct{}
+
+// NewXDPFastPath returns an error, XDP is only supported on Linux.
+func NewXDPFastPath(maxFlows int) (*XDPFastPath, error) {
+	return nil, errors.New("XDP is only supported on Linux")
+}
+
+func (x *XDPFastPath) Attach(ifaceName string, generic bool) error               { return nil }
+func (x *XDPFastPath) Close() error                                              { return nil }
+func (x *XDPFastPath) Offload(state *State) error                                { return nil }
+func (x *XDPFastPath) Remove(state *State) error                                 { return nil }
+func (x *XDPFastPath) Active(state *State) bool                                  { return false }
+func (x *XDPFastPath) Flows() int                                                { return 0 }
+func (x *XDPFastPath) RunRefresh(services *ServiceTable, interval time.Duration) {}